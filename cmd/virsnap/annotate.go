@@ -0,0 +1,156 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"regexp"
+
+	"github.com/joroec/virsnap/pkg/virt"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// setDescription is a global variable holding the new description of the
+	// snapshot
+	setDescription string
+
+	// appendDescription is a global variable holding the text that should be
+	// appended to the description of the snapshot
+	appendDescription string
+
+	// annotateCmd is a global variable defining the corresponding cobra command
+	annotateCmd = &cobra.Command{
+		Use: "annotate (--set <description> | --append <text>) <vm_regex> " +
+			"<snapshot_name>",
+		Short: "Change the description of an existing snapshot",
+		Long: "Change the description of the snapshot with the given name of any " +
+			"found virtual machine with a name matching the given regular " +
+			"expression. --set replaces the description, --append appends a new " +
+			"line to the existing description. The snapshot is not recreated, " +
+			"only its metadata is redefined, so all other properties of the " +
+			"snapshot are preserved. For example, 'virsnap annotate --append " +
+			"\"before upgrade\" \"^testing$\" virsnap_angry_hypatia' adds a note " +
+			"to the snapshot of the VM \"testing\".",
+		Args:    cobra.ExactArgs(2),
+		PreRunE: validateFlags(exactlyOneFlag("set", "append")),
+		Run:     annotateRun,
+	}
+)
+
+// init is a special golang function that is called exactly once regardless
+// how often the package is imported.
+func init() {
+	// initialize flags and arguments needed for this command
+	annotateCmd.Flags().StringVar(&setDescription, "set", "", "Replace the "+
+		"description of the snapshot.")
+
+	annotateCmd.Flags().StringVar(&appendDescription, "append", "", "Append a "+
+		"new line to the description of the snapshot.")
+
+	// add command to root command so that cobra works as expected
+	RootCmd.AddCommand(annotateCmd)
+}
+
+// annotateRun takes as parameter the regular expression of the names of the
+// VMs and the name of the snapshot to annotate
+func annotateRun(cmd *cobra.Command, args []string) {
+	// exactly one of --set and --append was given, see PreRunE
+	add := flagGiven(cmd, "append")
+
+	lck := acquireLock()
+	defer lck.Release()
+
+	vms, err := virt.ListMatchingVMs(logger, args[:1], socketURL)
+	if err != nil {
+		logger.Fatalf("unable to retrieve virtual machines: %s", err)
+	}
+
+	defer virt.FreeVMs(logger, vms)
+
+	if len(vms) == 0 {
+		logger.Fatal(errNoVMsMatchingRegex)
+	}
+
+	// a boolean indicating whether at least one error occured. Useful for
+	// the exit code of the program after iterating over the virtual machines.
+	failed := false
+
+	snapshotRegex := "^" + regexp.QuoteMeta(args[1]) + "$"
+	for _, vm := range vms {
+		snapshots, err := vm.ListMatchingSnapshots([]string{snapshotRegex})
+		if err != nil {
+			logger.Errorf("skipping VM '%s': unable to retrieve snapshots: %s",
+				vm.Descriptor.Name,
+				err,
+			)
+			failed = true
+			continue
+		}
+
+		defer virt.FreeSnapshots(logger, snapshots)
+
+		if len(snapshots) == 0 {
+			logger.Errorf("skipping VM '%s': snapshot '%s' does not exist",
+				vm.Descriptor.Name,
+				args[1],
+			)
+			failed = true
+			continue
+		}
+
+		snapshot := &snapshots[0]
+		oldDescription := snapshot.Descriptor.Description
+
+		newDescription := setDescription
+		if add {
+			newDescription = appendLine(oldDescription, appendDescription)
+
+			// the text of a structured description is appended to its summary,
+			// so that the description remains parsable
+			structured := virt.ParseDescription(oldDescription)
+			if structured.Structured {
+				structured.Summary = appendLine(structured.Summary,
+					appendDescription)
+				newDescription, err = structured.Encode()
+				if err != nil {
+					logger.Error(err)
+					failed = true
+					continue
+				}
+			}
+		}
+
+		err = vm.UpdateSnapshotDescription(snapshot, newDescription)
+		if err != nil {
+			logger.Error(err)
+			failed = true
+			continue
+		}
+
+		logger.Infof("changed description of snapshot '%s' of VM '%s' from %q "+
+			"to %q",
+			snapshot.Descriptor.Name,
+			vm.Descriptor.Name,
+			oldDescription,
+			newDescription,
+		)
+	}
+
+	// TODO (obitech): improve error handling
+	// See: https://blog.golang.org/errors-are-values
+	if failed {
+		logger.Fatal("annotate process failed due to errors")
+	}
+}
+
+// appendLine appends the given line to the given text, separated by a newline
+// if the text is not empty.
+func appendLine(text string, line string) string {
+	if text == "" {
+		return line
+	}
+	return text + "\n" + line
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import "os"
+
+// exitTooManyFailures is the exit code of create, clean and export if the run
+// was aborted by --max-consecutive-failures, as opposed to the exit code 1 of
+// a run that failed for individual VMs.
+const exitTooManyFailures = 3
+
+// failureBreaker aborts a run over many VMs after a number of VMs failed in a
+// row, which rather indicates a systemic problem (e.g. an unavailable storage
+// backend) than problems of the individual VMs.
+type failureBreaker struct {
+	// max is the number of consecutive failed VMs after which the run is
+	// aborted. Zero disables the breaker.
+	max int
+
+	// consecutive is the number of VMs that failed in a row
+	consecutive int
+
+	// failures is the number of failures of the run seen by the last call of
+	// tripped
+	failures int
+}
+
+// tripped is called before processing the next VM with the number of failures
+// of the run so far. The previous VM failed if the number increased since the
+// last call. tripped determines whether the run needs to be aborted.
+func (b *failureBreaker) tripped(failures int) bool {
+	if failures > b.failures {
+		b.consecutive++
+	} else {
+		b.consecutive = 0
+	}
+	b.failures = failures
+
+	return b.max > 0 && b.consecutive >= b.max
+}
+
+// abort terminates the run of the given command with exitTooManyFailures,
+// skipping the given number of remaining VMs.
+func (b *failureBreaker) abort(command string, remaining int) {
+	logger.Errorf("aborting %s: the last %d VMs failed in a row, which "+
+		"indicates a systemic problem; skipping %d remaining VMs", command,
+		b.consecutive, remaining)
+	_ = logger.Sync()
+	os.Exit(exitTooManyFailures)
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailureBreaker(t *testing.T) {
+	breaker := failureBreaker{max: 2}
+
+	// first VM
+	require.False(t, breaker.tripped(0))
+	// the first VM failed twice, e.g. the snapshot and restoring its state
+	require.False(t, breaker.tripped(2))
+	// the second VM succeeded, which resets the counter
+	require.False(t, breaker.tripped(2))
+	require.False(t, breaker.tripped(3))
+	require.True(t, breaker.tripped(4))
+	require.Equal(t, 2, breaker.consecutive)
+
+	// disabled
+	breaker = failureBreaker{}
+	for failures := 0; failures < 10; failures++ {
+		require.False(t, breaker.tripped(failures))
+	}
+}
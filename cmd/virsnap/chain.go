@@ -0,0 +1,89 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/joroec/virsnap/pkg/virt"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// chainCmd is a global variable defining the corresponding cobra command
+	chainCmd = &cobra.Command{
+		Use:   "chain <regex1> [<regex2>] [<regex3>] ...",
+		Short: "Show the backing chains of the disks of one or more VMs",
+		Long: "Show the backing chain of each disk of any found virtual machine " +
+			"with a name matching at least one of the given regular expressions. " +
+			"For each image of the chain, starting with the active image, the " +
+			"path, the format, the virtual size and the allocated size are " +
+			"printed, each backing file indented below the image it backs. The " +
+			"chains are inspected read-only with 'qemu-img info --backing-chain', " +
+			"which needs to be installed.",
+		Args: cobra.MinimumNArgs(1),
+		Run:  chainRun,
+	}
+)
+
+// init is a special golang function that is called exactly once regardless
+// how often the package is imported.
+func init() {
+	// add command to root command so that cobra works as expected
+	RootCmd.AddCommand(chainCmd)
+}
+
+// chainRun takes as parameter the regular expressions of the names of the VMs
+// whose backing chains should be shown
+func chainRun(cmd *cobra.Command, args []string) {
+	vms, err := virt.ListMatchingVMs(logger, args, socketURL)
+	if err != nil {
+		logger.Fatalf("unable to retrieve virtual machines: %s", err)
+	}
+
+	defer virt.FreeVMs(logger, vms)
+
+	if len(vms) == 0 {
+		logger.Fatal(errNoVMsMatchingRegex)
+	}
+
+	// a boolean indicating whether at least one chain could not be inspected.
+	// Useful for the exit code of the program after iterating over the VMs.
+	failed := false
+
+	for _, vm := range vms {
+		fmt.Println(vm.Descriptor.Name)
+
+		chains := vm.BackingChains()
+		if len(chains) == 0 {
+			fmt.Println("  (no disks)")
+		}
+
+		for _, chain := range chains {
+			if chain.Error != nil {
+				fmt.Printf("  %s: %s\n", chain.Target, chain.Error)
+				failed = true
+				continue
+			}
+
+			fmt.Printf("  %s:\n", chain.Target)
+			for depth, image := range chain.Images {
+				fmt.Printf("%s%s (%s, virtual size %s, allocated %s)\n",
+					strings.Repeat("  ", depth+2),
+					image.Filename,
+					image.Format,
+					formatBytes(image.VirtualSize),
+					formatBytes(image.ActualSize),
+				)
+			}
+		}
+	}
+
+	if failed {
+		logger.Fatal("unable to inspect all backing chains")
+	}
+}
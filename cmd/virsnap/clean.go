@@ -6,17 +6,21 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"os"
-	"strings"
+	"time"
 
 	"github.com/joroec/virsnap/pkg/virt"
+	"github.com/libvirt/libvirt-go"
 	"github.com/spf13/cobra"
+	"go.uber.org/zap"
 )
 
 const (
 	errNoVMsMatchingRegex = "no virtual machines found matching provided regex"
+
+	// deleteRetries is the number of times the removal of a snapshot is
+	// retried if the VM is busy.
+	deleteRetries = 3
 )
 
 var (
@@ -28,9 +32,54 @@ var (
 	// without additional confirmation.
 	assumeYes bool
 
+	// countAll is a global variable determining whether snapshots that were not
+	// created by virsnap should be counted and removed as well.
+	countAll bool
+
+	// allowDeleteAll is a global variable determining whether clean may remove
+	// every snapshot of a VM without an additional confirmation.
+	allowDeleteAll bool
+
+	// cleanAfter and cleanBefore are global variables holding the names of the
+	// reference snapshots. Only snapshots created after cleanAfter and before
+	// cleanBefore are removed. Empty if not restricted.
+	cleanAfter  string
+	cleanBefore string
+
+	// keepDailyLatest is a global variable holding the number of calendar days
+	// for which the newest snapshot of the day is kept. Zero if the policy is
+	// not applied.
+	keepDailyLatest int
+
+	// olderThan is a global variable holding the minimum age of the snapshots
+	// that are removed. Zero if the age is not checked.
+	olderThan time.Duration
+
+	// timeZone is a global variable holding the name of the time zone the
+	// calendar days of keepDailyLatest are determined in. Empty for the time
+	// zone of the host.
+	timeZone string
+
+	// batchSize is a global variable holding the number of snapshots removed
+	// in a row before pausing. Zero if the removals are not batched.
+	batchSize int
+
+	// batchPause is a global variable holding the time to pause between two
+	// batches of removals
+	batchPause = 5 * time.Second
+
+	// dryRun is a global variable determining whether clean only reports the
+	// snapshots it would remove instead of removing them.
+	dryRun bool
+
+	// vmState is a global variable holding the state a VM needs to be in for
+	// its snapshots to be cleaned. Empty if VMs in any state are cleaned.
+	vmState string
+
 	// cleanCmd is a global variable defining the corresponding cobra command
 	cleanCmd = &cobra.Command{
-		Use:   "clean [-y] -k <keep> <regex1> [<regex2>] [<regex3>] ...",
+		Use: "clean [-y] [--dry-run] [-k <keep>] [--after <name>] [--before <name>] <regex1> " +
+			"[<regex2>] [<regex3>] ...",
 		Short: "Remove expired snapshots from the system",
 		Long: "Remove expired snapshots from the system. The parameter k " +
 			"specifies how many successive snapshots of a VM should be kept before " +
@@ -41,9 +90,51 @@ var (
 			"snapshots should get cleaned. For example, 'virsnap clean -k 10 \".*\"' " +
 			"cleans the snapshots of all found virtual machines, whereas " +
 			"'virsnap clean -k 10 \"testing\"' cleans the snapshots only for those " +
-			"virtial machines whose name includes \"testing\". ",
+			"virtial machines whose name includes \"testing\". By default, only " +
+			"snapshots created by virsnap (i.e. whose name starts with the " +
+			"prefix 'virsnap_') are counted and removed. Snapshots created by " +
+			"other means are never touched unless --count-all is specified. If " +
+			"clean would remove every snapshot of a VM, an additional " +
+			"confirmation is required. Since -y skips confirmations, the VM is " +
+			"skipped in this case unless --allow-delete-all is specified. With " +
+			"--vm-state, only VMs currently in the given state are cleaned, e.g. " +
+			"'--vm-state shutoff' avoids any IO on running VMs. With --after " +
+			"and --before, only snapshots positioned after or before the given " +
+			"reference snapshot are removed, e.g. '--after <name> -k 0' removes " +
+			"every snapshot taken after a known bad one. The reference snapshot " +
+			"itself is kept. -k is optional then and still protects the newest " +
+			"snapshots. --keep-daily-latest n keeps the newest snapshot of each " +
+			"of the last n calendar days that have snapshots and removes the " +
+			"others. Combined with -k, a snapshot is kept if either policy keeps " +
+			"it. --older-than removes only snapshots older than the given " +
+			"duration, e.g. '720h' for 30 days. Combined with -k, a snapshot is " +
+			"only removed if it is both beyond the k newest snapshots and older " +
+			"than the duration, without -k any snapshot older than the duration " +
+			"is removed. '--older-than 0' disables the age check. If more VMs " +
+			"than --confirm-threshold match, the number of VMs " +
+			"needs to be typed to confirm the clean, even with -y, unless --force " +
+			"is given. With --batch-size n, clean pauses for --batch-pause after " +
+			"every n removals, so that other operations waiting for the libvirt " +
+			"locks of the VMs can proceed on a busy host, at the cost of a " +
+			"slower clean. With --dry-run, the snapshots that would be removed " +
+			"are only logged, without asking for any confirmation.",
 		Args: cobra.MinimumNArgs(1),
-		Run:  cleanRun,
+		PreRunE: validateFlags(
+			requiredFlagUnless("keep", "after", "before", "keep-daily-latest",
+				"older-than"),
+			nonNegativeFlag("keep", &keepVersions),
+			positiveFlag("keep-daily-latest", &keepDailyLatest),
+			nonNegativeFlag("batch-size", &batchSize),
+			nonNegativeFlag("max-consecutive-failures", &maxConsecutiveFailures),
+			flagValue("batch-pause", func() bool { return batchPause >= 0 },
+				"must not be negative"),
+			flagValue("older-than", func() bool { return olderThan >= 0 },
+				"must not be negative"),
+			flagValue("wait-for-job", func() bool {
+				return waitForJob >= 0
+			}, "must not be negative"),
+		),
+		Run: cleanRun,
 	}
 )
 
@@ -52,13 +143,73 @@ var (
 func init() {
 	// initialize flags and arguments needed for this command
 	cleanCmd.Flags().IntVarP(&keepVersions, "keep", "k", 10, "Number of "+
-		"version to keep before begin cleaning. (required)")
-	cleanCmd.MarkFlagRequired("keep")
+		"version to keep before begin cleaning. (required unless --after or "+
+		"--before is given)")
+
+	cleanCmd.Flags().DurationVar(&olderThan, "older-than", 0, "Only remove "+
+		"snapshots older than this duration, e.g. '720h'. 0 disables the age "+
+		"check.")
+
+	cleanCmd.Flags().IntVar(&keepDailyLatest, "keep-daily-latest", 0, "Keep "+
+		"the newest snapshot of each of the last n calendar days that have "+
+		"snapshots, remove the others.")
+
+	cleanCmd.Flags().StringVar(&timeZone, "tz", "", "Time zone the calendar "+
+		"days of --keep-daily-latest are determined in, e.g. 'Europe/Berlin'. "+
+		"Defaults to the time zone of the host.")
+
+	cleanCmd.Flags().StringVar(&cleanAfter, "after", "", "Only remove "+
+		"snapshots created after the snapshot with the given name.")
+
+	cleanCmd.Flags().StringVar(&cleanBefore, "before", "", "Only remove "+
+		"snapshots created before the snapshot with the given name.")
 
 	cleanCmd.Flags().BoolVarP(&assumeYes, "assume-yes", "y", false, "Do not ask "+
 		"for additional confirmation when about to remove a snapshot. Useful for "+
 		"automated execution.")
 
+	cleanCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only log the "+
+		"snapshots that would be removed without removing them. Implies that no "+
+		"confirmation is asked for.")
+
+	cleanCmd.Flags().BoolVar(&countAll, "count-all", false, "Count and remove "+
+		"all snapshots of a VM, including snapshots that were not created by "+
+		"virsnap.")
+
+	cleanCmd.Flags().BoolVar(&allowDeleteAll, "allow-delete-all", false,
+		"Remove the expired snapshots even if no snapshot of the VM would remain.")
+
+	cleanCmd.Flags().StringVar(&vmState, "vm-state", "", "Only clean the "+
+		"snapshots of VMs currently in the given state (running, paused, "+
+		"pmsuspended, shutoff, ...). Other VMs are skipped.")
+
+	cleanCmd.Flags().IntVar(&confirmThreshold, "confirm-threshold",
+		confirmThreshold, "Number of matching VMs above which the number of "+
+			"VMs needs to be typed to confirm the clean, even with -y. 0 disables "+
+			"the typed confirmation.")
+
+	cleanCmd.Flags().BoolVar(&forceFleet, "force", false, "Skip the typed "+
+		"confirmation required if more VMs than --confirm-threshold match.")
+
+	cleanCmd.Flags().DurationVar(&waitForJob, "wait-for-job", 0, "How long to "+
+		"wait for an active libvirt job of a VM (e.g. a migration or a block "+
+		"job) to finish. VMs with an active job are skipped if zero.")
+
+	cleanCmd.Flags().BoolVar(&failFast, "fail-fast", false, "Stop at the first "+
+		"VM that fails and skip the remaining VMs instead of continuing with "+
+		"them. The exit code indicates the failure in any case.")
+
+	cleanCmd.Flags().IntVar(&maxConsecutiveFailures, "max-consecutive-failures",
+		0, "Abort the run with exit code 3 after this many VMs failed in a "+
+			"row, which indicates a systemic problem. 0 means no limit.")
+
+	cleanCmd.Flags().IntVar(&batchSize, "batch-size", 0, "Number of snapshots "+
+		"removed in a row before pausing for --batch-pause. 0 removes all "+
+		"expired snapshots without pausing.")
+
+	cleanCmd.Flags().DurationVar(&batchPause, "batch-pause", batchPause,
+		"Pause between two batches of removals with --batch-size.")
+
 	// add command to root command so that cobra works as expected
 	RootCmd.AddCommand(cleanCmd)
 }
@@ -66,10 +217,39 @@ func init() {
 // cleanRun takes as parameter the name of the VMs to clean
 func cleanRun(cmd *cobra.Command, args []string) {
 	// check the validity of the console line parameters
-	if keepVersions < 0 {
-		logger.Fatal("parameter k must not be negative")
+	anchored := cleanAfter != "" || cleanBefore != ""
+	daily := flagGiven(cmd, "keep-daily-latest")
+	if !flagGiven(cmd, "keep") {
+		// the other policies select the snapshots to remove
+		keepVersions = 0
 	}
 
+	loc := time.Local
+	if timeZone != "" {
+		var err error
+		loc, err = time.LoadLocation(timeZone)
+		if err != nil {
+			logger.Fatalf("invalid time zone '%s': %s", timeZone, err)
+		}
+	}
+
+	filterState := flagGiven(cmd, "vm-state")
+	var requiredState libvirt.DomainState
+	if filterState {
+		state, err := virt.ParseState(vmState)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		requiredState = state
+	}
+
+	// the same cutoff applies to all VMs, regardless of how long the clean of
+	// the previous VMs took
+	cutoff := time.Now().Add(-olderThan)
+
+	lck := acquireLock()
+	defer lck.Release()
+
 	vms, err := virt.ListMatchingVMs(logger, args, socketURL)
 	if err != nil {
 		logger.Fatalf("unable to retrieve virtual machines: %s", err)
@@ -82,42 +262,188 @@ func cleanRun(cmd *cobra.Command, args []string) {
 	}
 	logger.Debugf("found %d matching VMs", len(vms))
 
-	if assumeYes {
+	// a fat-fingered regex like ".*" must not wipe the snapshots of the whole
+	// fleet. A dry run removes nothing, so it needs no confirmation.
+	if !dryRun && !confirmFleet("clean", len(vms)) {
+		logger.Fatal("clean of many VMs was not confirmed")
+	}
+
+	if dryRun {
+		logger.Info("dry run, no snapshots are removed")
+	} else if assumeYes {
 		logger.Debugf("removing snapshots without any further confirmation")
 	}
 
-	// a boolean indicating whether at least one error occured. Useful for
-	// the exit code of the program after iterating over the virtual machines.
-	failed := false
+	// the number of errors that occured. Useful for the exit code of the
+	// program after iterating over the virtual machines.
+	failures := 0
+	breaker := failureBreaker{max: maxConsecutiveFailures}
+
+	// the batches span all VMs, since the removals compete for the locks of
+	// the same libvirt daemon
+	batch := removalBatch{
+		size:  batchSize,
+		pause: batchPause,
+		sleep: time.Sleep,
+	}
+
+	// the number of snapshots and VMs a dry run would clean
+	wouldRemove, wouldClean := 0, 0
 
 vmfor:
-	for _, vm := range vms {
+	for i, vm := range vms {
+		// with --fail-fast, the remaining VMs are skipped after the first error
+		if failFast && failures > 0 {
+			logger.Warnf("skipping %d remaining VMs due to --fail-fast",
+				len(vms)-i)
+			break
+		}
+
+		// with --max-consecutive-failures, the run is aborted after too many
+		// VMs failed in a row
+		if breaker.tripped(failures) {
+			breaker.abort("clean", len(vms)-i)
+		}
+
+		vmLog := vmLogger(&vm)
+
+		// skip VMs not in the requested state before touching their snapshots
+		if filterState {
+			state, _, err := vm.Instance.GetState()
+			if err != nil {
+				vmLog.Errorf("skipping VM '%s': unable to retrieve state: %s",
+					vm.Descriptor.Name,
+					err,
+				)
+				failures++
+				continue
+			}
+
+			if state != requiredState {
+				vmLog.Infof("skipping VM '%s': state is '%s', not '%s'",
+					vm.Descriptor.Name,
+					virt.GetStateString(state),
+					virt.GetStateString(requiredState),
+				)
+				continue
+			}
+		}
+
+		ready, err := jobFinished(vmLog, &vm)
+		if err != nil {
+			vmLog.Errorf("skipping VM '%s': %s", vm.Descriptor.Name, err)
+			failures++
+			continue
+		}
+		if !ready {
+			continue
+		}
 
 		// iterate over the domains and clean the snapshots for each of it
-		regex := fmt.Sprintf("^%s.*$", snapshotPrefix)
-		snapshots, err := vm.ListMatchingSnapshots([]string{regex})
+		snapshots, err := vm.ListMatchingSnapshots([]string{".*"})
 		if err != nil {
-			logger.Errorf("skpping VM '%s': error, unable to get snapshot: %s",
+			vmLog.Errorf("skpping VM '%s': error, unable to get snapshot: %s",
 				vm.Descriptor.Name,
 				err,
 			)
-			failed = true
+			failures++
 			continue
 		}
 
 		// scoped block for efficiently freeing the snapshots
 		{
-			defer virt.FreeSnapshots(logger, snapshots)
+			defer virt.FreeSnapshots(vmLog, snapshots)
+
+			// only snapshots created by virsnap are counted and removed, unless
+			// specified otherwise
+			candidates := snapshots
+			if !countAll {
+				candidates = virt.FilterSnapshotsByPrefix(snapshots, snapshotPrefix)
+				vmLog.Debugf("ignoring %d snapshots of VM '%s' not created by virsnap",
+					len(snapshots)-len(candidates),
+					vm.Descriptor.Name,
+				)
+			}
+
+			expired := virt.ExpiredSnapshots(candidates, keepVersions)
+
+			// a snapshot kept by either policy is not removed
+			if daily {
+				expired = virt.IntersectSnapshots(expired,
+					virt.ExpiredDailySnapshots(candidates, keepDailyLatest, loc))
+			}
 
-			if len(snapshots) <= keepVersions {
-				continue vmfor // continue with next VM
+			// a snapshot needs to be old enough in addition
+			if olderThan > 0 {
+				expired = virt.IntersectSnapshots(expired,
+					virt.SnapshotsOlderThan(candidates, cutoff))
+			}
+
+			// the position relative to the reference snapshots is determined
+			// among all snapshots, since the reference need not be a candidate
+			if anchored {
+				window, err := virt.SnapshotsBetween(snapshots, cleanAfter,
+					cleanBefore)
+				if err != nil {
+					vmLog.Errorf("skipping VM '%s': %s", vm.Descriptor.Name, err)
+					failures++
+					continue vmfor
+				}
+				expired = virt.IntersectSnapshots(expired, window)
+			}
+
+			// removing every snapshot of a VM is almost never intended, e.g. if
+			// -k 0 was given by accident
+			if len(expired) > 0 && len(expired) == len(snapshots) && !allowDeleteAll {
+				switch {
+				case dryRun:
+					// a dry run must not prompt, e.g. when run by cron
+					vmLog.Warnf("clean would remove all %d snapshots of VM '%s', "+
+						"which needs to be confirmed or --allow-delete-all",
+						len(snapshots),
+						vm.Descriptor.Name,
+					)
+				case assumeYes:
+					vmLog.Errorf("skipping VM '%s': clean would remove all %d "+
+						"snapshots of the VM, specify --allow-delete-all to proceed",
+						vm.Descriptor.Name,
+						len(snapshots),
+					)
+					failures++
+					continue vmfor
+				default:
+					question := fmt.Sprintf("Clean would remove ALL %d snapshots "+
+						"of VM '%s'. Continue?", len(snapshots), vm.Descriptor.Name)
+					if !confirm(question, 10) {
+						vmLog.Infof("skipping VM '%s': removal of all snapshots "+
+							"was not confirmed", vm.Descriptor.Name)
+						continue vmfor
+					}
+				}
+			}
+
+			if dryRun {
+				for i := range expired {
+					vmLog.Infof("would remove snapshot '%s' of VM '%s'",
+						expired[i].Descriptor.Name,
+						vm.Descriptor.Name,
+					)
+				}
+				if len(expired) > 0 {
+					wouldRemove += len(expired)
+					wouldClean++
+				}
+				continue vmfor
 			}
 
 			// iterate over the snapshot exceeding the k snapshots that should
-			// remain
-			for i := 0; i < len(snapshots)-keepVersions; i++ {
-				logger.Infof("removing snapshot '%s' of VM '%s'.",
-					snapshots[i].Descriptor.Name,
+			// remain. A snapshot that cannot be removed does not prevent the
+			// removal of the others.
+			removed := 0
+			removalFailures := 0
+			for i := range expired {
+				vmLog.Infof("removing snapshot '%s' of VM '%s'.",
+					expired[i].Descriptor.Name,
 					vm.Descriptor.Name,
 				)
 
@@ -128,61 +454,78 @@ vmfor:
 					accepted = confirm("Remove snapshot?", 10)
 				}
 
-				if accepted {
-					logger.Infof("removing snapshot '%s' of VM '%s'.",
-						snapshots[i].Descriptor.Name,
+				if !accepted {
+					vmLog.Infof("skipping removal of snapshot '%s' of VM '%s'",
+						expired[i].Descriptor.Name,
 						vm.Descriptor.Name,
 					)
+					continue
+				}
 
-					err = snapshots[i].Instance.Delete(0)
-					if err != nil {
-						logger.Errorf("skipping VM '%s': error, unable to remove snapshot '%s' of VM '%s': %s",
-							vm.Descriptor.Name,
-							snapshots[i].Descriptor.Name,
-							err,
-						)
-						failed = true
-						continue vmfor // continue with next VM
-					}
-				} else {
-					logger.Infof("skipping removal of snapshot '%s' of VM '%s'",
-						snapshots[i].Descriptor.Name,
-						vm.Descriptor.Name,
-					)
+				vmLog.Infof("removing snapshot '%s' of VM '%s'.",
+					expired[i].Descriptor.Name,
+					vm.Descriptor.Name,
+				)
+
+				batch.next(vmLog)
+				err = vm.DeleteSnapshot(&expired[i], deleteRetries)
+				if err != nil {
+					vmLog.Error(err)
+					removalFailures++
+					continue
 				}
+				removed++
+			}
+
+			if len(expired) > 0 {
+				vmLog.Infof("removed %d of %d expired snapshots of VM '%s'",
+					removed,
+					len(expired),
+					vm.Descriptor.Name,
+				)
+			}
+
+			if removalFailures > 0 {
+				failures++
 			}
 		}
 
 	}
+
+	if dryRun {
+		logger.Infof("dry run: %d snapshots of %d VMs would be removed",
+			wouldRemove, wouldClean)
+	}
+
 	// TODO (obitech): improve error handling
 	// See: https://blog.golang.org/errors-are-values
-	if failed {
+	if failures > 0 {
 		logger.Fatal("clean process failed due to errors")
 	}
 }
 
-// confirm displays a prompt `s` to the user and returns a bool indicating
-// yes / no. If the lowercased, trimmed input begins with anything other than
-// 'y', it returns false. It accepts an int `tries` representing the number of
-// attempts before returning false
-func confirm(s string, tries int) bool {
-	r := bufio.NewReader(os.Stdin)
+// removalBatch pauses between batches of snapshot removals, so that other
+// operations waiting for libvirt locks are not starved by a long clean.
+type removalBatch struct {
+	// size is the number of removals per batch. Zero disables the batching.
+	size int
 
-	for ; tries > 0; tries-- {
-		fmt.Printf("%s [y/n]: ", s)
+	// pause is the time to pause between two batches.
+	pause time.Duration
 
-		res, err := r.ReadString('\n')
-		if err != nil {
-			logger.Fatal(err)
-		}
+	// sleep pauses for the given duration. Replaced by tests.
+	sleep func(d time.Duration)
 
-		// Empty input (i.e. "\n")
-		if len(res) < 2 {
-			continue
-		}
+	// removals is the number of removals started so far.
+	removals int
+}
 
-		return strings.ToLower(strings.TrimSpace(res))[0] == 'y'
+// next needs to be called before each removal and pauses if the removal
+// starts a new batch.
+func (b *removalBatch) next(vmLog *zap.SugaredLogger) {
+	if b.size > 0 && b.removals > 0 && b.removals%b.size == 0 {
+		vmLog.Debugf("removed %d snapshots, pausing for %s", b.removals, b.pause)
+		b.sleep(b.pause)
 	}
-
-	return false
+	b.removals++
 }
@@ -0,0 +1,37 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRemovalBatch(t *testing.T) {
+	var pauses []time.Duration
+	batch := removalBatch{
+		size:  2,
+		pause: time.Second,
+		sleep: func(d time.Duration) { pauses = append(pauses, d) },
+	}
+
+	// the pauses fall between the batches, not before the first removal
+	for i := 0; i < 5; i++ {
+		batch.next(zap.NewNop().Sugar())
+	}
+	require.Equal(t, []time.Duration{time.Second, time.Second}, pauses)
+
+	// without a batch size, clean never pauses
+	pauses = nil
+	batch = removalBatch{sleep: batch.sleep}
+	for i := 0; i < 5; i++ {
+		batch.next(zap.NewNop().Sugar())
+	}
+	require.Empty(t, pauses)
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// configFile is a global variable holding the path of the configuration file
+// given with --config. Empty for the default path.
+var configFile string
+
+// flagAliases maps the flags to their aliases setting the same variable. A
+// flag is not set from the configuration file if its alias was given on the
+// command line.
+var flagAliases = map[string]string{
+	"socket-url": "connect",
+	"connect":    "socket-url",
+}
+
+// defaultConfigFile returns the path of the configuration file read if
+// --config is not given, i.e. config.yaml in the virsnap directory below
+// $XDG_CONFIG_HOME or ~/.config. Empty if neither is known.
+func defaultConfigFile() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "virsnap", "config.yaml")
+}
+
+// configAnnotation is the key of the flag annotation marking a flag whose
+// default was replaced by the configuration file. It holds the built-in
+// default of the flag.
+const configAnnotation = "virsnap_config_default"
+
+// loadConfig reads the defaults of the flags from the configuration file,
+// which maps the long flag names to their values, e.g.
+//
+//	keep: 5
+//	socket-url: "qemu+ssh://host/system"
+//
+// The file is read with viper, so besides YAML, any format known to viper can
+// be used by its extension, e.g. config.json or config.toml. A missing file is
+// not an error unless it was given with --config.
+func loadConfig() (map[string]string, error) {
+	path := configFile
+	if path == "" {
+		path = defaultConfigFile()
+		if path == "" {
+			return nil, nil
+		}
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) && configFile == "" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open configuration file: %s", err)
+	}
+	defer file.Close()
+
+	format := strings.TrimPrefix(filepath.Ext(path), ".")
+	if format == "" {
+		format = "yaml"
+	}
+
+	values, err := parseConfig(file, format)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse configuration file '%s': %s",
+			path, err)
+	}
+	return values, nil
+}
+
+// parseConfig parses the configuration of the given format (e.g. "yaml") and
+// returns the values by key, formatted like on the command line. Lists are
+// joined by commas, as expected by the slice flags. Keys without a value are
+// skipped.
+func parseConfig(r io.Reader, format string) (map[string]string, error) {
+	supported := false
+	for _, ext := range viper.SupportedExts {
+		supported = supported || ext == format
+	}
+	if !supported {
+		return nil, fmt.Errorf("unsupported format '%s', use one of %s", format,
+			strings.Join(viper.SupportedExts, ", "))
+	}
+
+	v := viper.New()
+	v.SetConfigType(format)
+	err := v.ReadConfig(r)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	for _, key := range v.AllKeys() {
+		switch v.Get(key).(type) {
+		case nil:
+			continue
+		case []interface{}:
+			values[key] = strings.Join(v.GetStringSlice(key), ",")
+		default:
+			values[key] = v.GetString(key)
+		}
+	}
+	return values, nil
+}
+
+// applyConfig replaces the defaults of the flags of the given command that
+// were not given on the command line by the values of the configuration file,
+// so that the command line takes precedence over the file, which takes
+// precedence over the built-in defaults. The flags are not marked as changed,
+// so the values of the file are no flags given on the command line for the
+// flag rules (see flagConfigured). Keys that are no flags of the command are
+// ignored, since the file is shared by all commands, e.g. "keep" only applies
+// to clean.
+func applyConfig(cmd *cobra.Command, values map[string]string) error {
+	for name, value := range values {
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil || flag.Changed {
+			continue
+		}
+		if alias := cmd.Flags().Lookup(flagAliases[name]); alias != nil &&
+			alias.Changed {
+			continue
+		}
+
+		err := flag.Value.Set(value)
+		if err != nil {
+			return fmt.Errorf("invalid value '%s' of '%s' in configuration "+
+				"file: %s", value, name, err)
+		}
+
+		if flag.Annotations == nil {
+			flag.Annotations = make(map[string][]string)
+		}
+		flag.Annotations[configAnnotation] = []string{flag.DefValue}
+		flag.DefValue = flag.Value.String()
+	}
+	return nil
+}
+
+// flagConfigured determines whether the default of the flag with the given
+// name was replaced by the configuration file. A boolean flag configured as
+// false counts as not configured.
+func flagConfigured(cmd *cobra.Command, name string) bool {
+	flag := cmd.Flags().Lookup(name)
+	if flag == nil || flag.Changed {
+		return false
+	}
+	if _, ok := flag.Annotations[configAnnotation]; !ok {
+		return false
+	}
+	return flag.Value.Type() != "bool" || flag.Value.String() == "true"
+}
+
+// resetConfigured restores the built-in default of the flag with the given
+// name if it was replaced by the configuration file.
+func resetConfigured(cmd *cobra.Command, name string) {
+	flag := cmd.Flags().Lookup(name)
+	if flag == nil || flag.Changed {
+		return
+	}
+	defaults, ok := flag.Annotations[configAnnotation]
+	if !ok {
+		return
+	}
+
+	// the built-in default was valid before
+	_ = flag.Value.Set(defaults[0])
+	flag.DefValue = defaults[0]
+	delete(flag.Annotations, configAnnotation)
+}
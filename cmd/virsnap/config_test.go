@@ -0,0 +1,93 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfig(t *testing.T) {
+	values, err := parseConfig(strings.NewReader(`---
+# defaults of virsnap
+keep: 5 # a week
+socket-url: "qemu+ssh://host/system"
+log-level: 'debug'
+assume-yes: yes
+description: "yes: it is"
+ssh-option:
+  - StrictHostKeyChecking=yes
+  - ConnectTimeout=5
+
+timeout:
+`), "yaml")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"keep":        "5",
+		"socket-url":  "qemu+ssh://host/system",
+		"log-level":   "debug",
+		"assume-yes":  "true",
+		"description": "yes: it is",
+		"ssh-option":  "StrictHostKeyChecking=yes,ConnectTimeout=5",
+	}, values)
+
+	values, err = parseConfig(strings.NewReader(`{"keep": 3}`), "json")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"keep": "3"}, values)
+
+	_, err = parseConfig(strings.NewReader("keep: 5\n- 3\n"), "yaml")
+	require.Error(t, err)
+
+	_, err = parseConfig(strings.NewReader("keep: 5\n"), "conf")
+	require.Error(t, err)
+}
+
+func TestApplyConfig(t *testing.T) {
+	var keep, timeout int
+	var socket, logLevel string
+
+	root := &cobra.Command{Use: "root"}
+	root.PersistentFlags().StringVar(&socket, "socket-url", "", "")
+	root.PersistentFlags().StringVar(&socket, "connect", "", "")
+	root.PersistentFlags().StringVar(&logLevel, "log-level", "info", "")
+
+	cmd := &cobra.Command{Use: "test"}
+	cmd.Flags().IntVarP(&keep, "keep", "k", 10, "")
+	cmd.Flags().IntVarP(&timeout, "timeout", "t", 3, "")
+	root.AddCommand(cmd)
+	require.NoError(t, cmd.ParseFlags([]string{"-t", "7", "--connect",
+		"qemu:///session"}))
+
+	// the command line wins over the file, unknown keys are ignored
+	err := applyConfig(cmd, map[string]string{
+		"keep":       "5",
+		"timeout":    "1",
+		"socket-url": "qemu+ssh://host/system",
+		"log-level":  "debug",
+		"tz":         "UTC",
+	})
+	require.NoError(t, err)
+	require.Equal(t, 5, keep)
+	require.Equal(t, 7, timeout)
+	require.Equal(t, "qemu:///session", socket)
+	require.Equal(t, "debug", logLevel)
+
+	// the values of the file are defaults, not flags given on the command line
+	require.False(t, flagSet(cmd, "keep"))
+	require.True(t, flagConfigured(cmd, "keep"))
+	require.True(t, flagGiven(cmd, "keep"))
+	require.Equal(t, "5", cmd.Flags().Lookup("keep").DefValue)
+
+	resetConfigured(cmd, "keep")
+	require.Equal(t, 10, keep)
+	require.False(t, flagConfigured(cmd, "keep"))
+
+	err = applyConfig(cmd, map[string]string{"keep": "many"})
+	require.Error(t, err)
+}
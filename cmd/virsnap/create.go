@@ -6,16 +6,38 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joroec/virsnap/pkg/fs"
+	"github.com/joroec/virsnap/pkg/hook"
+	"github.com/joroec/virsnap/pkg/instrument/trace"
 	"github.com/joroec/virsnap/pkg/virt"
 	"github.com/libvirt/libvirt-go"
 	"github.com/spf13/cobra"
+	"go.uber.org/zap"
 )
 
 const (
 	// snapshotPrefix is a prefix for all snapshots created by virsnap.
 	snapshotPrefix = "virsnap_"
+
+	// snapshotDescription is the default description of the snapshots
+	// created by virsnap.
+	snapshotDescription = "snapshot created by virnsnap"
 )
 
+// validName matches the snapshot names and prefixes that are accepted by
+// --name and --prefix, i.e. only characters libvirt accepts in snapshot names
+// and that need no escaping in paths and shells.
+var validName = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
 var (
 	// shutdown is a global variable determing whether virsnap should try to
 	// shutdown the virtual machine before taking the snapshot
@@ -25,11 +47,109 @@ var (
 	// shutdown of virtual machine before taking the snapshot
 	force bool
 
+	// pause is a global variable determining whether virsnap should pause a
+	// running virtual machine while taking the snapshot and resume it
+	// afterwards
+	pause bool
+
 	// timeout is a global variable determing the timeout in minutes to wait for a
 	// graceful shutdown before forcing the shutdown if enabled or returning with
 	// an error code
 	timeout int
 
+	// snapshotTimeout is a global variable determining how long libvirt may
+	// take to create the snapshot itself before the snapshot job is aborted
+	snapshotTimeout time.Duration
+
+	// nameScheme is a global variable determining how the names of new
+	// snapshots are generated
+	nameScheme = "random"
+
+	// diskOnly is a global variable determining whether external snapshots of
+	// the disks only are created instead of internal snapshots
+	diskOnly bool
+
+	// externalDir is a global variable holding the directory the overlay files
+	// of disk-only snapshots are created in. Empty for the directories of the
+	// current images.
+	externalDir string
+
+	// reuseExisting is a global variable determining whether disk-only
+	// snapshots may use existing overlay files
+	reuseExisting bool
+
+	// quiesce is a global variable determining whether the guest agent
+	// freezes the filesystems of the guest during disk-only snapshots
+	quiesce bool
+
+	// waitForAgent is a global variable holding how long to wait for the guest
+	// agent to answer before creating a quiesced snapshot
+	waitForAgent time.Duration
+
+	// skipSpaceCheck is a global variable determining whether the check for
+	// enough free space before creating a snapshot should be skipped
+	skipSpaceCheck bool
+
+	// reason is a global variable holding the reason for the snapshot stored
+	// in the structured description
+	reason string
+
+	// trigger is a global variable holding what caused the snapshot, stored in
+	// the structured description
+	trigger = string(virt.TriggerManual)
+
+	// structuredDescription is a global variable determining whether the
+	// description of the snapshot is stored as JSON object
+	structuredDescription bool
+
+	// plan is a global variable determining whether the state transitions of
+	// the VMs should only be printed instead of creating snapshots
+	plan bool
+
+	// failFast is a global variable determining whether the remaining VMs are
+	// skipped after the first VM failed. Shared by create, clean and export.
+	failFast bool
+
+	// maxConsecutiveFailures is a global variable holding the number of VMs
+	// failing in a row after which the run is aborted. Zero means no limit.
+	// Shared by create, clean and export.
+	maxConsecutiveFailures int
+
+	// limit is a global variable holding the maximum number of VMs processed
+	// by a single run. Zero means no limit. Shared by create and export.
+	limit int
+
+	// order is a global variable determining which VMs are processed first,
+	// i.e. which VMs are picked if the number of VMs is limited. Shared by
+	// create and export.
+	order = string(virt.OrderByName)
+
+	// waitForJob is a global variable holding how long to wait for an active
+	// libvirt job of a VM to finish. VMs with an active job are skipped if
+	// zero. Shared by create, clean and export.
+	waitForJob time.Duration
+
+	// namePrefix is a global variable holding the prefix of the names of new
+	// snapshots
+	namePrefix = snapshotPrefix
+
+	// snapshotName is a global variable holding the exact name of new
+	// snapshots. Empty if the names are generated according to nameScheme.
+	snapshotName string
+
+	// createDescription is a global variable holding the description of new
+	// snapshots, which is the summary of a structured description
+	createDescription = snapshotDescription
+
+	// parallel is a global variable holding the number of VMs that are
+	// snapshotted at the same time, each using its own libvirt connection
+	parallel = 1
+
+	// preSnapshotHook and postSnapshotHook are global variables holding the
+	// shell commands run before and after the creation of each snapshot
+	preSnapshotHook  string
+	postSnapshotHook string
+
 	// createCmd is a global variable defining the corresponding cobra command
 	createCmd = &cobra.Command{
 		Use:   "create <regex1> [<regex2>] [<regex3>] ...",
@@ -40,7 +160,10 @@ var (
 			"machines, whereas 'virsnap create \"testing\"' creates a new snapshot " +
 			"only for those virtial machines whose name includes \"testing\". The " +
 			"snapshot will be assigned a random name. In any case, the name starts " +
-			"with the prefix 'virsnap_'. virsnap expects the virtual machines " +
+			"with the prefix 'virsnap_' or the one given with --prefix, unless " +
+			"the exact name is given with --name. Note that " +
+			"clean only counts snapshots with the prefix 'virsnap_' unless " +
+			"--count-all is given. virsnap expects the virtual machines " +
 			"configured according to the personal snapshot preferences. If you want " +
 			"to use QCOW2 internal snapshots, for example, edit the VM's XML " +
 			"descriptor ('virsh edit <vm_name>') of the VM so that the default " +
@@ -55,7 +178,38 @@ var (
   <address type='drive' controller='0' bus='0' target='0' unit='0'/>
 </disk>`,
 		Args: cobra.MinimumNArgs(1),
-		Run:  createRun,
+		PreRunE: validateFlags(
+			dependentFlag("force", "shutdown"),
+			exclusiveFlags("pause", "shutdown"),
+			positiveFlag("timeout", &timeout),
+			flagValue("prefix", func() bool {
+				return validName.MatchString(namePrefix)
+			}, "must only contain letters, digits, '_' and '-'"),
+			flagValue("name", func() bool {
+				return validName.MatchString(snapshotName)
+			}, "must only contain letters, digits, '_' and '-'"),
+			exclusiveFlags("name", "prefix"),
+			exclusiveFlags("name", "name-scheme"),
+			dependentFlag("external-dir", "disk-only"),
+			dependentFlag("reuse-existing", "disk-only"),
+			dependentFlag("quiesce", "disk-only"),
+			dependentFlag("wait-for-agent", "quiesce"),
+			exclusiveFlags("quiesce", "shutdown"),
+			exclusiveFlags("quiesce", "pause"),
+			flagValue("wait-for-agent", func() bool {
+				return waitForAgent >= 0
+			}, "must not be negative"),
+			flagValue("snapshot-timeout", func() bool {
+				return snapshotTimeout >= 0
+			}, "must not be negative"),
+			nonNegativeFlag("limit", &limit),
+			positiveFlag("parallel", &parallel),
+			nonNegativeFlag("max-consecutive-failures", &maxConsecutiveFailures),
+			flagValue("wait-for-job", func() bool {
+				return waitForJob >= 0
+			}, "must not be negative"),
+		),
+		Run: createRun,
 	}
 )
 
@@ -70,12 +224,120 @@ func init() {
 		"shutdown of the virtual machine. This flag can be combined with -s "+
 		"exclusively.")
 
+	createCmd.Flags().BoolVar(&pause, "pause", false, "Pause a running VM "+
+		"(freeze its CPUs) while taking the snapshot and resume it afterwards. "+
+		"VMs that are not running are snapshotted as they are. Cannot be "+
+		"combined with -s.")
+
 	createCmd.Flags().IntVarP(&timeout, "timeout", "t", 3, "Timeout in minutes "+
 		"to wait for a virtual machine to shutdown gracefully before returning an "+
 		"error code or forcing the shutdown (flag -f). This flag is only "+
 		"combinable with -s and -f . If the timeout expires and force is "+
 		"specified, plug the power cord to bring the machine down.")
 
+	createCmd.Flags().DurationVar(&snapshotTimeout, "snapshot-timeout", 0,
+		"Maximum time the creation of the snapshot itself may take, e.g. '5m'. "+
+			"If it expires, the snapshot job is aborted and the VM is restored to "+
+			"its previous state. Zero waits forever.")
+
+	createCmd.Flags().StringVar(&nameScheme, "name-scheme", nameScheme,
+		"Naming scheme of new snapshots (random, timestamp, sequence). 'random' "+
+			"appends a random name to the prefix, 'timestamp' appends the creation "+
+			"time in RFC3339 format, 'sequence' appends the name of the VM and the "+
+			"next sequence number of its snapshots, e.g. 'testvm-0042'.")
+
+	createCmd.Flags().StringVar(&namePrefix, "prefix", namePrefix, "Prefix "+
+		"of the names of new snapshots. Only letters, digits, '_' and '-' are "+
+		"allowed.")
+
+	createCmd.Flags().StringVar(&snapshotName, "name", "", "Exact name of "+
+		"the new snapshots, e.g. 'nightly-2019-07-11', instead of a generated "+
+		"one. Since snapshot names are unique per VM only, every matching VM "+
+		"gets a snapshot of this name. A VM that already has a snapshot of "+
+		"this name fails.")
+
+	createCmd.Flags().StringVar(&createDescription, "description",
+		createDescription, "Description of new snapshots. With a structured "+
+			"description, this is the summary.")
+
+	createCmd.Flags().BoolVar(&diskOnly, "disk-only", false, "Create an "+
+		"external snapshot of the disks only: the current images are frozen as "+
+		"the snapshot and the VM continues on new qcow2 overlay files, so that "+
+		"the frozen images can be backed up while the VM is running. The "+
+		"memory is not saved.")
+
+	createCmd.Flags().StringVar(&externalDir, "external-dir", "", "Existing "+
+		"directory the overlay files of --disk-only snapshots are created in. "+
+		"Defaults to the directories of the current images.")
+
+	createCmd.Flags().BoolVar(&reuseExisting, "reuse-existing", false, "Use "+
+		"overlay files of --disk-only snapshots that already exist instead of "+
+		"failing. The files must be qcow2 images backed by the current images.")
+
+	createCmd.Flags().BoolVar(&quiesce, "quiesce", false, "Let the QEMU "+
+		"guest agent freeze the filesystems of a running VM while the "+
+		"--disk-only snapshot is created, so that they are consistent. Fails "+
+		"if the guest agent does not answer. Cannot be combined with -s or "+
+		"--pause.")
+
+	createCmd.Flags().DurationVar(&waitForAgent, "wait-for-agent", 0,
+		"How long to wait for the guest agent to answer before a --quiesce "+
+			"snapshot, e.g. '2m' for a VM that was just booted. Zero does not "+
+			"wait.")
+
+	createCmd.Flags().BoolVar(&skipSpaceCheck, "skip-space-check", false,
+		"Do not check whether the filesystems holding the disks of a VM (or "+
+			"the --external-dir of --disk-only snapshots) have enough free "+
+			"space for a new snapshot.")
+
+	createCmd.Flags().BoolVar(&structuredDescription, "structured-description",
+		false, "Store the description of the snapshot as JSON object holding "+
+			"the reason, the trigger and the operator of the snapshot, so that it "+
+			"can be parsed by automated tools. Implied by --reason and --trigger.")
+
+	createCmd.Flags().StringVar(&reason, "reason", "", "Reason for creating "+
+		"the snapshot, e.g. 'before upgrade'. Stored in the structured "+
+		"description.")
+
+	createCmd.Flags().StringVar(&trigger, "trigger", trigger, "What caused the "+
+		"snapshot (manual, scheduled). Stored in the structured description.")
+
+	createCmd.Flags().BoolVar(&plan, "plan", false, "Only print the current "+
+		"state of each matching VM and the state transitions that creating the "+
+		"snapshot would cause, then exit without changing anything.")
+
+	createCmd.Flags().BoolVar(&failFast, "fail-fast", false, "Stop at the first "+
+		"VM that fails and skip the remaining VMs instead of continuing with "+
+		"them. The exit code indicates the failure in any case.")
+
+	createCmd.Flags().DurationVar(&waitForJob, "wait-for-job", 0, "How long to "+
+		"wait for an active libvirt job of a VM (e.g. a migration or a block "+
+		"job) to finish. VMs with an active job are skipped if zero.")
+
+	createCmd.Flags().IntVar(&maxConsecutiveFailures, "max-consecutive-failures",
+		0, "Abort the run with exit code 3 after this many VMs failed in a "+
+			"row, which indicates a systemic problem. 0 means no limit.")
+
+	createCmd.Flags().IntVar(&parallel, "parallel", parallel, "Number of VMs "+
+		"that are snapshotted at the same time, each using its own libvirt "+
+		"connection.")
+
+	createCmd.Flags().IntVar(&limit, "limit", 0, "Process at most this many "+
+		"of the matching VMs, picked according to --order. 0 means no limit.")
+
+	createCmd.Flags().StringVar(&order, "order", order, "Order in which the "+
+		"VMs are processed (name, oldest-backup, oldest-snapshot).")
+
+	createCmd.Flags().StringVar(&preSnapshotHook, "pre-snapshot-hook", "",
+		"Shell command run before the snapshot of each VM is created, e.g. to "+
+			"flush the buffers of an application. Gets the VM name as $1 and "+
+			"VIRSNAP_VM. If the command fails, the VM is not snapshotted.")
+
+	createCmd.Flags().StringVar(&postSnapshotHook, "post-snapshot-hook", "",
+		"Shell command run after the snapshot of each VM was created. Gets the "+
+			"VM name as $1 and VIRSNAP_VM and the snapshot name as $2 and "+
+			"VIRSNAP_SNAPSHOT. A failure is only logged as warning.")
+
 	// add command to root command so that cobra works as expected
 	RootCmd.AddCommand(createCmd)
 }
@@ -83,15 +345,45 @@ func init() {
 // createRun takes as parameter the regular expressions of the names of the VMs
 // to create a snapshot for
 func createRun(cmd *cobra.Command, args []string) {
-	// check the validity of the console line parameters
-	if force && !shutdown {
-		logger.Fatal("flag -f can only be specified if -s was specified!")
+	// the relations of the flags were checked by PreRunE, only their values
+	// are parsed here
+	newGenerator, err := nameGenerator(nameScheme)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	vmOrder := parseOrder()
+
+	// a missing directory is reported before any VM is shut down or paused
+	if externalDir != "" {
+		err = fs.EnsureDirectory(externalDir)
+		if err != nil {
+			logger.Fatal(err)
+		}
 	}
 
-	if timeout <= 0 {
-		logger.Fatal("nvalid timeout specified. Must be greater than zero!")
+	var structured *virt.Description
+	if structuredDescription || flagGiven(cmd, "reason") ||
+		flagGiven(cmd, "trigger") {
+		parsedTrigger, err := virt.ParseTrigger(trigger)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		structured = &virt.Description{
+			Reason:   reason,
+			Trigger:  parsedTrigger,
+			Operator: operator(),
+		}
 	}
 
+	if plan {
+		planRun(args, shutdown, force, pause)
+		return
+	}
+
+	lck := acquireLock()
+	defer lck.Release()
+
 	vms, err := virt.ListMatchingVMs(logger, args, socketURL)
 	if err != nil {
 		logger.Fatal("could not retrieve virtual machines.")
@@ -103,84 +395,451 @@ func createRun(cmd *cobra.Command, args []string) {
 		logger.Fatal(errNoVMsMatchingRegex)
 	}
 
-	// a boolean indicating whether at least one error occured. Useful for
-	// the exit code of the program after iterating over the virtual machines.
-	failed := false
+	vms = limitVMs(vms, vmOrder)
+
+	// the number of errors that occured. Useful for the exit code of the
+	// program after iterating over the virtual machines.
+	failures := 0
+	breaker := failureBreaker{max: maxConsecutiveFailures}
+
+	// the errors of the failed VMs by name, so that the final message names
+	// them even if their log messages are interleaved with the other workers
+	vmErrors := make(map[string]error)
+
+	// with --parallel, each worker borrows its own connection from the pool
+	var pool *virt.ConnectionPool
+	if parallel > 1 {
+		pool, err = virt.NewConnectionPool(logger, socketURL, parallel)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		defer pool.Close()
+	}
+
+	// the VMs are dispatched to at most parallel workers, which count the
+	// failures and update the breaker once their VM is done. Without
+	// --parallel, the next VM is dispatched after the previous one is done.
+	var mutex sync.Mutex
+	var workers sync.WaitGroup
+	slots := make(chan struct{}, parallel)
+	tripped := false
+	remaining := 0
+
+	for i := range vms {
+		// wait for a free worker
+		slots <- struct{}{}
+
+		mutex.Lock()
+		failed := failures > 0
+		abort := tripped
+		mutex.Unlock()
+
+		// with --fail-fast, the remaining VMs are skipped after the first error
+		if failFast && failed {
+			logger.Warnf("skipping %d remaining VMs due to --fail-fast",
+				len(vms)-i)
+			<-slots
+			break
+		}
+
+		// with --max-consecutive-failures, the run is aborted after too many
+		// VMs failed in a row. The running workers are waited for, so that
+		// their VMs are restored.
+		if abort {
+			remaining = len(vms) - i
+			<-slots
+			break
+		}
+
+		workers.Add(1)
+		go func(vm *virt.VM) {
+			defer workers.Done()
+			defer func() { <-slots }()
+
+			vmFailures := snapshotPooledVM(pool, vm, newGenerator, structured)
+
+			mutex.Lock()
+			failures += vmFailures
+			if vmFailures > 0 {
+				vmErrors[vm.Descriptor.Name] = fmt.Errorf("number of errors: %d",
+					vmFailures)
+			}
+			if !tripped && breaker.tripped(failures) {
+				tripped = true
+			}
+			mutex.Unlock()
+		}(&vms[i])
+	}
+
+	workers.Wait()
+
+	if remaining > 0 {
+		breaker.abort("create", remaining)
+	}
+
+	// TODO (obitech): improve error handling
+	// See: https://blog.golang.org/errors-are-values
+	if failures > 0 {
+		names := make([]string, 0, len(vmErrors))
+		for name := range vmErrors {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			logger.Errorf("VM '%s' failed: %s", name, vmErrors[name])
+		}
+		logger.Fatalf("create process failed due to errors for the VMs '%s'",
+			strings.Join(names, "', '"))
+	}
+
+}
+
+// snapshotPooledVM runs snapshotVM for the given VM on a connection borrowed
+// from the given pool, so that it can run concurrently with the other VMs.
+// Without pool, the connection the VM was listed with is used.
+func snapshotPooledVM(pool *virt.ConnectionPool, vm *virt.VM,
+	newGenerator generatorFactory, structured *virt.Description) int {
+	if pool == nil {
+		return snapshotVM(vm, newGenerator, structured)
+	}
+
+	conn, err := pool.Get()
+	if err != nil {
+		logger.Errorf("skipping VM '%s': %s", vm.Descriptor.Name, err)
+		return 1
+	}
+
+	worker, err := vm.Reconnect(conn)
+	if err != nil {
+		pool.Put(conn)
+		logger.Errorf("skipping VM '%s': %s", vm.Descriptor.Name, err)
+		return 1
+	}
+
+	failures := snapshotVM(&worker, newGenerator, structured)
+
+	err = worker.Free()
+	if err != nil {
+		logger.Warnf("unable to free VM '%s': %s", vm.Descriptor.Name, err)
+	}
+	pool.Put(conn)
+
+	return failures
+}
+
+// snapshotVM creates a snapshot of the given VM, shutting down or pausing the
+// VM before if requested, and returns the number of errors that occured.
+func snapshotVM(vm *virt.VM, newGenerator generatorFactory,
+	structured *virt.Description) int {
+	vmLog := vmLogger(vm)
+	timer := trace.New(vmLog, "VM '"+vm.Descriptor.Name+"'")
+
+	ready, err := jobFinished(vmLog, vm)
+	if err != nil {
+		vmLog.Errorf("skipping VM '%s': %s", vm.Descriptor.Name, err)
+		return 1
+	}
+	if !ready {
+		return 0
+	}
+
+	generate, err := newGenerator(vm)
+	if err != nil {
+		vmLog.Error(err)
+		return 1
+	}
+
+	opts := virt.SnapshotOptions{
+		SkipSpaceCheck: skipSpaceCheck,
+		Structured:     structured,
+		Timeout:        snapshotTimeout,
+		DiskOnly:       diskOnly,
+		ExternalDir:    externalDir,
+		ReuseExisting:  reuseExisting,
+		Quiesce:        quiesce,
+		WaitForAgent:   waitForAgent,
+	}
+
+	// the free space is checked before the VM is shut down or paused, so
+	// that it is not interrupted for a snapshot that cannot be created
+	if !skipSpaceCheck {
+		state := libvirt.DOMAIN_SHUTOFF
+		if !shutdown {
+			state, _, err = vm.Instance.GetState()
+			if err != nil {
+				vmLog.Errorf("unable to retrieve state of VM '%s': %s",
+					vm.Descriptor.Name, err)
+				return 1
+			}
+		}
+
+		err = vm.CheckSnapshotSpace(state, opts)
+		if err != nil {
+			vmLog.Errorf("skipping VM '%s': %s", vm.Descriptor.Name, err)
+			return 1
+		}
+		opts.SkipSpaceCheck = true
+	}
+
+	// the pre-snapshot hook runs before the VM changes its state, e.g. an
+	// application needs to be running to flush its buffers
+	preHook := hook.Hook{Name: "pre-snapshot", Command: preSnapshotHook}
+	err = preHook.Run(vmLog, []string{vm.Descriptor.Name},
+		[]string{"VIRSNAP_VM=" + vm.Descriptor.Name})
+	if err != nil {
+		vmLog.Errorf("skipping VM '%s': %s", vm.Descriptor.Name, err)
+		return 1
+	}
 
-	for _, vm := range vms {
-		// iterate over the domains and crete a new snapshot for each of it
-		formerState := libvirt.DOMAIN_NOSTATE
-		if shutdown {
-			formerState, err = vm.Transition(libvirt.DOMAIN_SHUTOFF, force, timeout)
+	// transitioned determines whether the previous state of the VM needs
+	// to be restored after the snapshot
+	formerState := libvirt.DOMAIN_NOSTATE
+	transitioned := false
+	if shutdown {
+		span := timer.Start("shutdown")
+		formerState, err = vm.Transition(libvirt.DOMAIN_SHUTOFF, force, timeout)
+		span.End()
+		if err != nil {
+			vmLog.Error(err)
+			return 1
+		}
+		transitioned = true
+	} else if pause {
+		state, _, err := vm.Instance.GetState()
+		if err != nil {
+			vmLog.Errorf("unable to retrieve state of VM '%s': %s",
+				vm.Descriptor.Name, err)
+			return 1
+		}
+
+		// only a running VM is paused, booting a VM that is shut off just
+		// to pause it would be pointless
+		if state == libvirt.DOMAIN_RUNNING {
+			span := timer.Start("pause")
+			formerState, err = vm.Transition(libvirt.DOMAIN_PAUSED, force,
+				timeout)
+			span.End()
 			if err != nil {
-				logger.Error(err)
-				failed = true
-				continue // continue with next VM
+				vmLog.Error(err)
+				return 1
 			}
+			transitioned = true
+		} else {
+			vmLog.Debugf("not pausing VM '%s' in state '%s'",
+				vm.Descriptor.Name, virt.GetStateString(state))
 		}
+	}
 
-		logger.Debugf("Beginning creation of snapshot for VM '%s'.",
+	vmLog.Debugf("Beginning creation of snapshot for VM '%s'.",
+		vm.Descriptor.Name,
+	)
+
+	// the state of the VM is restored even if the snapshot fails, so the
+	// errors are counted from here on
+	failures := 0
+
+	span := timer.Start("snapshot")
+	var snapshot virt.Snapshot
+	if snapshotName != "" {
+		snapshot, err = vm.CreateNamedSnapshot(snapshotName, createDescription,
+			opts)
+	} else {
+		snapshot, err = vm.CreateSnapshot(namePrefix, createDescription, generate,
+			opts)
+	}
+	span.End()
+	if err == nil {
+		vmLog.Infof("Created snapshot '%s' for VM '%s'",
+			snapshot.Descriptor.Name, vm.Descriptor.Name)
+
+		postHook := hook.Hook{Name: "post-snapshot", Command: postSnapshotHook}
+		err = postHook.Run(vmLog, []string{vm.Descriptor.Name,
+			snapshot.Descriptor.Name}, []string{
+			"VIRSNAP_VM=" + vm.Descriptor.Name,
+			"VIRSNAP_SNAPSHOT=" + snapshot.Descriptor.Name,
+		})
+		if err != nil {
+			vmLog.Warn(err)
+		}
+	} else if err == virt.ErrSnapshotInProgress {
+		vmLog.Errorf("unable to create snapshot for VM '%s': another "+
+			"operation is using this VM, try again later",
 			vm.Descriptor.Name,
 		)
+		failures++
+	} else if err == virt.ErrSnapshotExists {
+		vmLog.Errorf("unable to create snapshot for VM '%s': snapshot '%s' "+
+			"already exists", vm.Descriptor.Name, snapshotName)
+		failures++
+	} else if err == virt.ErrSnapshotTimeout {
+		vmLog.Errorf("unable to create snapshot for VM '%s' within %s, the "+
+			"snapshot job was aborted", vm.Descriptor.Name, snapshotTimeout)
+		failures++
+	} else {
+		vmLog.Errorf("unable to create snapshot for VM: '%s': %s",
+			vm.Descriptor.Name,
+			err,
+		)
+		failures++
+		// no return here, since we want to startup the VM is any case!
+	}
 
-		snapshot, err := vm.CreateSnapshot("virsnap_",
-			"snapshot created by virnsnap")
-		if err == nil {
-			logger.Infof("Created snapshot '%s' for VM '%s'",
-				snapshot.Descriptor.Name, vm.Descriptor.Name)
-		} else {
-			logger.Errorf("unable to create snapshot for VM: '%s': %s",
+	defer snapshot.Free()
+
+	if transitioned {
+		vmLog.Debugf("Restoring previous state of vm '%s'",
+			vm.Descriptor.Name,
+		)
+		span := timer.Start("restore")
+		_, err = vm.Transition(formerState, force, timeout)
+		span.End()
+		if err != nil {
+			vmLog.Errorf("unable to restore state '%s' of VM '%s': %s",
+				virt.GetStateString(formerState),
 				vm.Descriptor.Name,
 				err,
 			)
-			failed = true
-			// no continue here, since we want to startup the VM is any case!
-		}
-
-		// scoped block for efficiently freeing the snapshots
-		{
-			defer snapshot.Free()
+			failures++
 
-			if shutdown {
-				logger.Debugf("Restoring previous state of vm '%s'",
+			newState, err := vm.GetCurrentStateString()
+			if err != nil {
+				vmLog.Errorf("unable to retrieve current state of VM ;;'%s': %s ",
 					vm.Descriptor.Name,
+					err,
 				)
-				_, err = vm.Transition(formerState, force, timeout)
-				if err != nil {
-					logger.Errorf("unable to restore state '%s' of VM '%s': %s",
-						virt.GetStateString(formerState),
-						vm.Descriptor.Name,
-						err,
-					)
-					failed = true
-
-					newState, err := vm.GetCurrentStateString()
-					if err != nil {
-						logger.Errorf("unable to retrieve current state of VM ;;'%s': %s ",
-							vm.Descriptor.Name,
-							err,
-						)
-						continue // continue with next VM
-					}
-
-					logger.Warnf("state of VM '%s' is now '%s'", vm.Descriptor.Name,
-						newState)
-					continue // continue with next VM
-				}
+				return failures
 			}
 
-			logger.Debugf("Finished creation of snapshot '%s' for VM '%s'.",
-				snapshot.Descriptor.Name,
-				vm.Descriptor.Name,
-			)
+			vmLog.Warnf("state of VM '%s' is now '%s'", vm.Descriptor.Name,
+				newState)
+			return failures
 		}
 
+		// a paused VM is resumed instantly, so it must be running again
+		if pause {
+			state, _, err := vm.Instance.GetState()
+			if err == nil && state != formerState {
+				vmLog.Errorf("VM '%s' is in state '%s' instead of '%s' after "+
+					"resuming it", vm.Descriptor.Name,
+					virt.GetStateString(state),
+					virt.GetStateString(formerState),
+				)
+				failures++
+			}
+		}
 	}
 
-	// TODO (obitech): improve error handling
-	// See: https://blog.golang.org/errors-are-values
-	if failed {
-		logger.Fatal("create process failed due to errors")
+	vmLog.Debugf("Finished creation of snapshot '%s' for VM '%s'.",
+		snapshot.Descriptor.Name,
+		vm.Descriptor.Name,
+	)
+	timer.Summary()
+
+	return failures
+}
+
+// operator returns the name of the user running virsnap. If virsnap was run
+// with sudo, the name of the invoking user is returned instead of root.
+func operator() string {
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		return name
+	}
+
+	current, err := user.Current()
+	if err != nil {
+		logger.Warnf("unable to determine the current user: %s", err)
+		return ""
+	}
+	return current.Username
+}
+
+// generatorFactory returns the snapshot name generator for the given VM.
+type generatorFactory func(vm *virt.VM) (virt.NameGenerator, error)
+
+// nameGenerator returns a factory of snapshot name generators for the given
+// naming scheme.
+func nameGenerator(scheme string) (generatorFactory, error) {
+	switch scheme {
+	case "random":
+		return func(vm *virt.VM) (virt.NameGenerator, error) {
+			return virt.RandomNames(), nil
+		}, nil
+	case "timestamp":
+		return func(vm *virt.VM) (virt.NameGenerator, error) {
+			return virt.TimestampNames(), nil
+		}, nil
+	case "sequence":
+		// the sequence is continued per VM, so the existing snapshots of each VM
+		// are needed
+		return func(vm *virt.VM) (virt.NameGenerator, error) {
+			snapshots, err := vm.ListMatchingSnapshots([]string{".*"})
+			if err != nil {
+				err = fmt.Errorf("unable to retrieve snapshots of VM '%s' for the "+
+					"sequence number: %s", vm.Descriptor.Name, err)
+				return nil, err
+			}
+			defer virt.FreeSnapshots(logger, snapshots)
+
+			return virt.SequenceNames(namePrefix, vm.Descriptor.Name,
+				snapshots), nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid name scheme '%s': must be one of "+
+			"'random', 'timestamp' or 'sequence'", scheme)
+	}
+}
+
+// parseOrder parses the --order flag.
+func parseOrder() virt.VMOrder {
+	vmOrder, err := virt.ParseVMOrder(order)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	return vmOrder
+}
+
+// jobFinished determines whether the given VM has no active libvirt job, so
+// that it can be snapshotted or shut down without interfering with the job.
+// With --wait-for-job, it waits for an active job to finish and returns an
+// error if the job is still running afterwards. Otherwise, a warning is logged
+// and false is returned if the VM has an active job.
+func jobFinished(vmLog *zap.SugaredLogger, vm *virt.VM) (bool, error) {
+	active, err := vm.HasActiveJob()
+	if err != nil {
+		return false, err
+	}
+	if !active {
+		return true, nil
+	}
+
+	if waitForJob == 0 {
+		vmLog.Warnf("skipping VM '%s': it has an active libvirt job, e.g. a "+
+			"migration or a block job; use --wait-for-job to wait for it",
+			vm.Descriptor.Name)
+		return false, nil
+	}
+
+	vmLog.Infof("waiting up to %s for the active job of VM '%s' to finish",
+		waitForJob, vm.Descriptor.Name)
+	err = vm.WaitForJob(waitForJob)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// limitVMs sorts the given VMs according to the given order and returns at
+// most limit of them. The returned VMs share the memory of the given slice, so
+// that freeing the given slice frees the VMs that were not picked as well.
+func limitVMs(vms []virt.VM, vmOrder virt.VMOrder) []virt.VM {
+	virt.OrderVMs(logger, vms, vmOrder)
+
+	if limit == 0 || len(vms) <= limit {
+		return vms
 	}
 
+	logger.Infof("processing %d of %d matching VMs due to --limit", limit,
+		len(vms))
+	return vms[:limit]
 }
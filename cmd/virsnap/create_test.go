@@ -0,0 +1,22 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidName(t *testing.T) {
+	for _, prefix := range []string{snapshotPrefix, "pre-upgrade_", "A1"} {
+		require.True(t, validName.MatchString(prefix), prefix)
+	}
+
+	for _, prefix := range []string{"", "pre upgrade", "a/b", "snap.", "ä_"} {
+		require.False(t, validName.MatchString(prefix), prefix)
+	}
+}
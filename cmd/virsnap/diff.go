@@ -0,0 +1,99 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"fmt"
+
+	"github.com/joroec/virsnap/pkg/virt"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// ignoreFields is a global variable holding the descriptor fields that
+	// should not be compared
+	ignoreFields []string
+
+	// diffDescriptorCmd is a global variable defining the corresponding cobra
+	// command
+	diffDescriptorCmd = &cobra.Command{
+		Use: "diff-descriptor [--ignore <field1>,<field2>,...] <vm_regex> " +
+			"<descriptor.xml>",
+		Short: "Compare the descriptor of a VM with an exported descriptor",
+		Long: "Compare the current descriptor of any found virtual machine with " +
+			"a name matching the given regular expression against the given " +
+			"descriptor, e.g. the descriptor.xml of an export. This allows to " +
+			"validate an import or to detect configuration drift. Fields that " +
+			"change whenever a VM is started (e.g. the ID of the VM or device " +
+			"aliases) are ignored. Further fields can be ignored with --ignore, " +
+			"either by name (e.g. 'Alias') or by path (e.g. " +
+			"'Devices.Disks.Source'). Note that export rewrites the disk paths " +
+			"unless --path-mode original was used. The command fails if any " +
+			"difference was found.",
+		Args: cobra.ExactArgs(2),
+		Run:  diffDescriptorRun,
+
+		// the second argument is the path of the descriptor
+		Annotations: map[string]string{regexArgsAnnotation: "1"},
+	}
+)
+
+// init is a special golang function that is called exactly once regardless
+// how often the package is imported.
+func init() {
+	// initialize flags and arguments needed for this command
+	diffDescriptorCmd.Flags().StringSliceVar(&ignoreFields, "ignore", nil,
+		"Fields of the descriptor that should not be compared, either by name "+
+			"or by path without indices.")
+
+	// add command to root command so that cobra works as expected
+	RootCmd.AddCommand(diffDescriptorCmd)
+}
+
+// diffDescriptorRun takes as parameter the regular expression of the names of
+// the VMs and the path of the descriptor to compare them with
+func diffDescriptorRun(cmd *cobra.Command, args []string) {
+	exported, err := virt.ReadDescriptor(args[1])
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	vms, err := virt.ListMatchingVMs(logger, args[:1], socketURL)
+	if err != nil {
+		logger.Fatalf("unable to retrieve virtual machines: %s", err)
+	}
+
+	defer virt.FreeVMs(logger, vms)
+
+	if len(vms) == 0 {
+		logger.Fatal(errNoVMsMatchingRegex)
+	}
+
+	// a boolean indicating whether at least one difference was found. Useful
+	// for the exit code of the program after iterating over the VMs.
+	differ := false
+
+	for _, vm := range vms {
+		differences := virt.DiffDescriptors(exported, vm.Descriptor,
+			ignoreFields)
+		if len(differences) == 0 {
+			logger.Infof("descriptor of VM '%s' matches '%s'", vm.Descriptor.Name,
+				args[1])
+			continue
+		}
+
+		differ = true
+		fmt.Printf("%s (%d differences, exported != current)\n",
+			vm.Descriptor.Name, len(differences))
+		for _, difference := range differences {
+			fmt.Printf("  %s\n", difference)
+		}
+	}
+
+	if differ {
+		logger.Fatal("descriptors differ")
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/joroec/virsnap/pkg/virt"
+	"github.com/libvirt/libvirt-go"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// dumpSnapshot is a global variable holding the name of the snapshot whose
+	// XML descriptor should be printed instead of the one of the VM
+	dumpSnapshot string
+
+	// dumpFlags is a global variable holding the libvirt XML flags
+	dumpFlags []string
+
+	// dumpXMLCmd is a global variable defining the corresponding cobra command
+	dumpXMLCmd = &cobra.Command{
+		Use: "dumpxml [--snapshot <name>] [--flags <flag1>,<flag2>,...] " +
+			"<regex1> [<regex2>] [<regex3>] ...",
+		Short: "Print the XML descriptor of one or more VMs or snapshots",
+		Long: "Print the XML descriptor of any found virtual machine with a name " +
+			"matching at least one of the given regular expressions, as reported " +
+			"by libvirt. With --snapshot, the XML descriptor of the snapshot with " +
+			"exactly the given name is printed instead. The libvirt XML flags " +
+			"'secure', 'inactive', 'update-cpu' and 'migratable' can be passed " +
+			"with --flags; libvirt only supports 'secure' for snapshots. If more " +
+			"than one VM matches, each descriptor is preceded by an XML comment " +
+			"naming the VM.",
+		Args: cobra.MinimumNArgs(1),
+		Run:  dumpXMLRun,
+	}
+)
+
+// init is a special golang function that is called exactly once regardless
+// how often the package is imported.
+func init() {
+	// initialize flags and arguments needed for this command
+	dumpXMLCmd.Flags().StringVarP(&dumpSnapshot, "snapshot", "s", "",
+		"Print the XML descriptor of the snapshot with this name.")
+	dumpXMLCmd.Flags().StringSliceVar(&dumpFlags, "flags", nil,
+		"libvirt XML flags (secure, inactive, update-cpu, migratable).")
+
+	// add command to root command so that cobra works as expected
+	RootCmd.AddCommand(dumpXMLCmd)
+}
+
+// dumpXMLRun takes as parameter the regular expressions of the names of the
+// VMs whose XML descriptors should be printed
+func dumpXMLRun(cmd *cobra.Command, args []string) {
+	// libvirt uses distinct flags for the XML of snapshots
+	var flags libvirt.DomainXMLFlags
+	var snapshotFlags libvirt.DomainSnapshotXMLFlags
+	var err error
+	if dumpSnapshot != "" {
+		snapshotFlags, err = virt.ParseSnapshotXMLFlags(dumpFlags)
+	} else {
+		flags, err = virt.ParseXMLFlags(dumpFlags)
+	}
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	vms, err := virt.ListMatchingVMs(logger, args, socketURL)
+	if err != nil {
+		logger.Fatalf("unable to retrieve virtual machines: %s", err)
+	}
+
+	defer virt.FreeVMs(logger, vms)
+
+	if len(vms) == 0 {
+		logger.Fatal(errNoVMsMatchingRegex)
+	}
+
+	// a boolean indicating whether at least one descriptor could not be
+	// retrieved. Useful for the exit code of the program after iterating over
+	// the VMs.
+	failed := false
+
+	for _, vm := range vms {
+		var xml string
+		if dumpSnapshot != "" {
+			xml, err = vm.SnapshotXML(dumpSnapshot, snapshotFlags)
+		} else {
+			xml, err = vm.XML(flags)
+		}
+		if err != nil {
+			logger.Error(err)
+			failed = true
+			continue
+		}
+
+		if len(vms) > 1 {
+			// "--" must not occur within an XML comment
+			fmt.Printf("<!-- VM '%s' -->\n",
+				strings.Replace(vm.Descriptor.Name, "--", "- -", -1))
+		}
+		fmt.Print(xml)
+		if !strings.HasSuffix(xml, "\n") {
+			fmt.Println()
+		}
+	}
+
+	if failed {
+		logger.Fatal("unable to retrieve all XML descriptors")
+	}
+}
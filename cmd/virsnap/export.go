@@ -6,13 +6,19 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"os"
-	"path/filepath"
+	"text/template"
+	"time"
 
+	"github.com/joroec/virsnap/pkg/fs"
+	"github.com/joroec/virsnap/pkg/instrument/trace"
 	"github.com/joroec/virsnap/pkg/virt"
 
 	"github.com/libvirt/libvirt-go"
 	"github.com/spf13/cobra"
+	"go.uber.org/zap"
 )
 
 const (
@@ -21,16 +27,79 @@ const (
 )
 
 var (
-	// outputDir is the target directory of the backup
-	outputDir string
+	// outputDir is the target directory of the backup. It may contain template
+	// actions that are expanded by expandOutputDir.
+	outputDir = "./virsnap-export/{{.Date}}"
 
 	// snapshotAfterShutdown determines whether virsnap should make a new
 	// snapshot after the machine was shut down.
 	snapshotAfterShutdown = true
 
+	// strictExport determines whether exporting a VM without any disk device
+	// should be treated as an error.
+	strictExport bool
+
+	// pathMode determines how the disk source paths are rewritten in the
+	// exported descriptor.
+	pathMode = string(virt.PathModeRelative)
+
+	// checksum determines whether rsync should compare the disks by checksum.
+	checksum bool
+
+	// noRsync determines whether the disks are copied without rsync.
+	noRsync bool
+
+	// destination is the URL of the target of the export. If empty, the
+	// output directory is used.
+	destination string
+
+	// sshIdentity is the private key used to authenticate at the host of an
+	// SSH destination. Empty for the default keys of ssh.
+	sshIdentity string
+
+	// sshOptions are the options passed to ssh when connecting to the host of
+	// an SSH destination.
+	sshOptions []string
+
+	// estimate determines whether only the size and duration of the export
+	// should be estimated instead of exporting the VMs.
+	estimate bool
+
+	// throughput is the assumed throughput in MiB/s of the export used for
+	// estimating its duration.
+	throughput = 100
+
+	// cleanOnFailure determines whether partially exported files should be
+	// removed if the export of a VM fails.
+	cleanOnFailure bool
+
+	// skipUnchanged determines whether VMs whose disks did not change since
+	// the previous export to the output directory should be skipped.
+	skipUnchanged bool
+
+	// onlyNewDisks determines whether only the disks that changed since the
+	// previous export to the output directory should be copied
+	onlyNewDisks bool
+
+	// pool is the name of the libvirt storage pool the volume disks of the VMs
+	// are resolved in. If empty, only file disks are exported.
+	pool string
+
+	// flatten determines whether the disks are exported as standalone images
+	// with the backing chain collapsed instead of copying the image files.
+	flatten bool
+
+	// trim determines whether the guest is asked to discard the unused blocks
+	// of its filesystems before the VM is shut down
+	trim bool
+
+	// trimTimeout is how long the guest agent may take to trim the
+	// filesystems of the guest
+	trimTimeout = 5 * time.Minute
+
 	// exportCmd is a global variable defining the corresponding cobra command
 	exportCmd = &cobra.Command{
-		Use:   "export --output-dir <export_directory> <regex1> [<regex2>] [<regex3>] ...",
+		Use:   "export [--output-dir <export_directory>] <regex1> [<regex2>] [<regex3>] ...",
 		Short: "Export a VM by copying the hard drive images to an output directory",
 		Long: "Export a VM by copying the hard drive images and an copy of the " +
 			"VMs XML descriptor file to an output directory. Exports any found " +
@@ -39,9 +108,39 @@ var (
 			"shutoff. Hence, virsnap shuts down the VM if its running, exports the " +
 			"disk files and restores the VM's previous state afterwards. Apart from " +
 			"this, there is an option to create a snapshot of the VM after " +
-			"shutdowning and before exporting to the given directory.",
+			"shutdowning and before exporting to the given directory. The output " +
+			"directory may contain the placeholders {{.Date}} (e.g. 2019-07-29) " +
+			"and {{.Time}} (e.g. 21-11-54), which are replaced by the start time " +
+			"of the export, e.g. --output-dir './backups/{{.Date}}'. Each VM is " +
+			"exported into a sub directory named after the VM. Instead of a local " +
+			"directory, --destination accepts an URL of the target, e.g. " +
+			"'s3://bucket/backups/{{.Date}}' to upload the export to an " +
+			"S3-compatible object storage using the AWS CLI, or " +
+			"'ssh://backup@nas/backups/{{.Date}}' to copy the export to a remote " +
+			"host using rsync over ssh. With " +
+			"--skip-unchanged, a VM is neither shut down nor exported if the " +
+			"manifest of a previous export to the same directory shows that none " +
+			"of its disks changed since. With --only-new-disks, only the disks that " +
+			"changed since are copied again. --estimate prints the size of the export " +
+			"and a rough estimate of its duration without shutting down or " +
+			"exporting any VM. With --flatten, each disk is exported as a single " +
+			"standalone image of its current state using qemu-img convert, " +
+			"discarding backing files and snapshots. Disks backed by a volume of a " +
+			"libvirt storage pool are exported if the pool is given with --pool. " +
+			"With --trim, the guest agent of a running VM discards the unused " +
+			"blocks of the guest filesystems before the VM is shut down.",
 		Args: cobra.MinimumNArgs(1),
-		Run:  exportRun,
+		PreRunE: validateFlags(
+			exclusiveFlags("destination", "output-dir"),
+			positiveFlag("timeout", &timeout),
+			positiveFlag("throughput", &throughput),
+			nonNegativeFlag("limit", &limit),
+			nonNegativeFlag("max-consecutive-failures", &maxConsecutiveFailures),
+			flagValue("wait-for-job", func() bool {
+				return waitForJob >= 0
+			}, "must not be negative"),
+		),
+		Run: exportRun,
 	}
 )
 
@@ -49,18 +148,119 @@ var (
 // how often the package is imported.
 func init() {
 	// initialize flags and arguments needed for this command
-	exportCmd.Flags().StringVarP(&outputDir, "output-dir", "o", "default?",
-		"desc")
-	exportCmd.MarkFlagRequired("output-dir")
+	exportCmd.Flags().StringVarP(&outputDir, "output-dir", "o", outputDir,
+		"Target directory of the export. Supports the placeholders {{.Date}} and "+
+			"{{.Time}}.")
 
 	exportCmd.Flags().BoolVarP(&snapshotAfterShutdown, "snapshot", "s", true,
 		"Create a new snapshot after the machine has been shut down.")
 
+	exportCmd.Flags().BoolVar(&strictExport, "strict", false, "Treat the "+
+		"export of a VM without any disk device as an error instead of skipping "+
+		"it with a warning.")
+
+	exportCmd.Flags().StringVar(&pathMode, "path-mode", pathMode, "How to "+
+		"rewrite the disk paths in the exported descriptor (relative, absolute, "+
+		"original). 'relative' references the disks as './<filename>' and keeps "+
+		"the export portable, 'absolute' references the exported disk images "+
+		"so that an import can use them in place, 'original' keeps the original "+
+		"disk locations so that an import expects the disks to be copied back.")
+
+	exportCmd.Flags().BoolVar(&checksum, "checksum", false, "Let rsync "+
+		"compare the disks by their checksums instead of their size and "+
+		"modification time. This guarantees a bit-exact copy, but requires "+
+		"reading the whole source and target disk image, which is considerably "+
+		"slower for large disks.")
+
+	exportCmd.Flags().BoolVar(&noRsync, "no-rsync", false, "Copy the disks "+
+		"to a local output directory without rsync. Without this flag, the "+
+		"built-in copy is only used if rsync is not installed.")
+
+	exportCmd.Flags().StringVar(&destination, "destination", "", "URL of the "+
+		"target of the export (file:///<dir>, s3://<bucket>/<prefix> or "+
+		"ssh://[<user>@]<host>[:<port>]/<dir>). Use "+
+		"the query parameter 'endpoint' for S3-compatible object storages, e.g. "+
+		"s3://bucket?endpoint=http://minio:9000. Supports the same placeholders "+
+		"as --output-dir and cannot be combined with it.")
+
+	exportCmd.Flags().StringVar(&sshIdentity, "ssh-identity", "", "Private "+
+		"key used by ssh to authenticate at the host of an ssh:// destination.")
+
+	exportCmd.Flags().StringSliceVar(&sshOptions, "ssh-option", nil, "Option "+
+		"passed to ssh when connecting to the host of an ssh:// destination, "+
+		"e.g. 'StrictHostKeyChecking=yes'. May be given multiple times.")
+
+	exportCmd.Flags().BoolVar(&skipUnchanged, "skip-unchanged", false, "Skip "+
+		"VMs whose disk images did not change in size and modification time "+
+		"since the previous export to the output directory. Avoids shutting "+
+		"down the VM for an export that would not change anything.")
+
+	exportCmd.Flags().BoolVar(&onlyNewDisks, "only-new-disks", false, "Only "+
+		"copy the disk images that changed in size or modification time since "+
+		"the previous export to the output directory. The other disks are "+
+		"carried over and marked as such in the manifest. Has no effect with "+
+		"--flatten.")
+
+	exportCmd.Flags().StringVar(&pool, "pool", "", "Name of the libvirt "+
+		"storage pool whose volumes back the disks of the VMs. The paths of "+
+		"volume disks are resolved with the storage volume API of this pool. "+
+		"Without this flag, only disks backed by a file are exported.")
+
+	exportCmd.Flags().BoolVar(&flatten, "flatten", false, "Export each disk "+
+		"as a standalone image of its current state using 'qemu-img convert' "+
+		"instead of copying the image file. Collapses the backing chain and "+
+		"drops the internal snapshots of the disk. Requires qemu-img. Since the "+
+		"flattened image differs in size from the source, --skip-unchanged "+
+		"never skips such an export.")
+
+	exportCmd.Flags().BoolVar(&trim, "trim", false, "Ask the guest agent of "+
+		"running VMs to discard the unused blocks of the guest filesystems "+
+		"(guest-fstrim) before the VM is shut down, so that they are not "+
+		"exported. VMs without a reachable guest agent are exported untrimmed.")
+
+	exportCmd.Flags().DurationVar(&trimTimeout, "trim-timeout", trimTimeout,
+		"How long the guest agent may take to trim the filesystems with --trim.")
+
+	exportCmd.Flags().BoolVar(&cleanOnFailure, "clean-on-failure", false,
+		"Remove the partially exported files of a VM if its export fails. "+
+			"Empty export directories are always removed. A previous export of "+
+			"the VM in the same directory is never removed.")
+
+	exportCmd.Flags().BoolVar(&plan, "plan", false, "Only print the current "+
+		"state of each matching VM and the state transitions that the export "+
+		"would cause, then exit without changing anything.")
+
+	exportCmd.Flags().BoolVar(&estimate, "estimate", false, "Only print the "+
+		"allocated size of the disks of the matching VMs and an estimate of the "+
+		"export duration, then exit. Requires qemu-img.")
+
+	exportCmd.Flags().IntVar(&throughput, "throughput", throughput, "Assumed "+
+		"throughput of the export in MiB/s used by --estimate.")
+
 	exportCmd.Flags().IntVarP(&timeout, "timeout", "t", 3, "Timeout in minutes "+
 		"to wait for a virtual machine to shutdown gracefully before forcing the "+
 		"shutdown (flag -f). If the timeout expires and force is specified, plug "+
 		"the power cord to bring the machine down.")
 
+	exportCmd.Flags().BoolVar(&failFast, "fail-fast", false, "Stop at the first "+
+		"VM that fails and skip the remaining VMs instead of continuing with "+
+		"them. The exit code indicates the failure in any case.")
+
+	exportCmd.Flags().DurationVar(&waitForJob, "wait-for-job", 0, "How long to "+
+		"wait for an active libvirt job of a VM (e.g. a migration or a block "+
+		"job) to finish. VMs with an active job are skipped if zero.")
+
+	exportCmd.Flags().IntVar(&maxConsecutiveFailures, "max-consecutive-failures",
+		0, "Abort the run with exit code 3 after this many VMs failed in a "+
+			"row, which indicates a systemic problem. 0 means no limit.")
+
+	exportCmd.Flags().IntVar(&limit, "limit", 0, "Export at most this many "+
+		"of the matching VMs, picked according to --order. 0 means no limit.")
+
+	exportCmd.Flags().StringVar(&order, "order", order, "Order in which the "+
+		"VMs are exported (name, oldest-backup, oldest-snapshot). Use "+
+		"oldest-backup with --limit for rolling backups.")
+
 	// add command to root command so that cobra works as expected
 	RootCmd.AddCommand(exportCmd)
 }
@@ -69,16 +269,73 @@ func init() {
 // to export to the given output directory
 func exportRun(cmd *cobra.Command, args []string) {
 	// check the validity of the console line parameters
-	absOutputDir, err := filepath.Abs(outputDir)
+	mode, err := virt.ParsePathMode(pathMode)
 	if err != nil {
-		logger.Fatalf("could not parse outputDir filepath '%s': %v", outputDir, err)
+		logger.Fatal(err)
+	}
+
+	vmOrder := parseOrder()
+
+	if estimate {
+		estimateRun(args)
+		return
+	}
+
+	if plan {
+		planRun(args, true, true, false)
+		return
 	}
 
-	err = os.MkdirAll(absOutputDir, filemode)
+	target := outputDir
+	if flagGiven(cmd, "destination") {
+		target = destination
+	}
+
+	expandedTarget, err := expandOutputDir(target, time.Now())
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	dest, err := fs.ParseDestination(expandedTarget, filemode, logger,
+		fs.SyncOptions{
+			Checksum:    checksum,
+			NoRsync:     noRsync,
+			SSHIdentity: sshIdentity,
+			SSHOptions:  sshOptions,
+		})
 	if err != nil {
-		logger.Fatalf("could not create the output directory: %s", err)
+		logger.Fatal(err)
 	}
 
+	// previous exports can only be inspected in a local directory
+	local, isLocal := dest.(*fs.FilesystemDestination)
+	if isLocal {
+		if checksum && noRsync {
+			logger.Warn("--checksum has no effect with --no-rsync")
+		}
+
+		err = os.MkdirAll(local.Directory, filemode)
+		if err != nil {
+			logger.Fatalf("could not create the output directory: %s", err)
+		}
+	} else {
+		if _, isSSH := dest.(*fs.SSHDestination); checksum && !isSSH {
+			logger.Warn("--checksum only applies to local and ssh:// " +
+				"destinations")
+		}
+		if skipUnchanged {
+			logger.Warn("--skip-unchanged only applies to local output " +
+				"directories")
+		}
+		if onlyNewDisks {
+			logger.Warn("--only-new-disks only applies to local output " +
+				"directories")
+		}
+	}
+
+	lck := acquireLock()
+	defer lck.Release()
+
 	vms, err := virt.ListMatchingVMs(logger, args, socketURL)
 	if err != nil {
 		logger.Fatalf("could not retrieve virtual machines: %s", err)
@@ -89,79 +346,282 @@ func exportRun(cmd *cobra.Command, args []string) {
 		logger.Fatal(errNoVMsMatchingRegex)
 	}
 
-	// a boolean indicating whether at least one error occured. Useful for
-	// the exit code of the program after iterating over the virtual machines.
-	var failed bool
+	vms = limitVMs(vms, vmOrder)
+
+	var storagePool *libvirt.StoragePool
+	if pool != "" {
+		storagePool, err = virt.LookupStoragePool(logger, socketURL, pool)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		defer storagePool.Free()
+	}
+
+	// the number of errors that occured. Useful for the exit code of the
+	// program after iterating over the virtual machines.
+	failures := 0
+	breaker := failureBreaker{max: maxConsecutiveFailures}
 
 	// iterate over the VMs, shut them down and export them
-	for _, vm := range vms {
+	for i, vm := range vms {
+		// with --fail-fast, the remaining VMs are skipped after the first error
+		if failFast && failures > 0 {
+			logger.Warnf("skipping %d remaining VMs due to --fail-fast",
+				len(vms)-i)
+			break
+		}
+
+		// with --max-consecutive-failures, the run is aborted after too many
+		// VMs failed in a row
+		if breaker.tripped(failures) {
+			breaker.abort("export", len(vms)-i)
+		}
 
-		logger.Debugf("starting to shutdown VM '%s'", vm.Descriptor.Name)
+		vmLog := vmLogger(&vm)
+
+		timer := trace.New(vmLog, "VM '"+vm.Descriptor.Name+"'")
+
+		// cheaply check the previous export before causing any downtime
+		if skipUnchanged && isLocal {
+			upToDate, err := vm.ExportUpToDate(local.Directory)
+			if err != nil {
+				vmLog.Warnf("unable to compare VM '%s' with previous export, "+
+					"exporting anyway: %s", vm.Descriptor.Name, err)
+			} else if upToDate {
+				vmLog.Infof("skipping VM '%s': disks did not change since the "+
+					"previous export", vm.Descriptor.Name)
+				continue
+			}
+		}
+
+		// do not interfere with a migration or block job by shutting down
+		ready, err := jobFinished(vmLog, &vm)
+		if err != nil {
+			vmLog.Errorf("skipping VM '%s': %s", vm.Descriptor.Name, err)
+			failures++
+			continue
+		}
+		if !ready {
+			continue
+		}
+
+		if vm.RestartsOnPoweroff() {
+			vmLog.Warnf("VM '%s' is configured to restart on poweroff and may "+
+				"restart during the export, which is aborted in this case",
+				vm.Descriptor.Name)
+		}
+
+		if trim {
+			span := timer.Start("trim")
+			trimFilesystems(vmLog, &vm)
+			span.End()
+		}
+
+		vmLog.Debugf("starting to shutdown VM '%s'", vm.Descriptor.Name)
+		span := timer.Start("shutdown")
 		formerState, err := vm.Transition(libvirt.DOMAIN_SHUTOFF, true, timeout)
+		span.End()
 		if err != nil {
-			logger.Error(err)
-			failed = true
+			vmLog.Error(err)
+			failures++
 			continue
 		}
-		logger.Debugf("finshed shutdown process of VM '%s'", vm.Descriptor.Name)
+		vmLog.Debugf("finshed shutdown process of VM '%s'", vm.Descriptor.Name)
 
-		// scoped block for efficiently restoring the previous state of the VM
+		// scoped block for restoring the previous state of the VM
 		{
-			// restore previous state of VM
-			defer func() {
-				logger.Debugf("restoring previous state of vm '%s'", vm.Descriptor.Name)
+			// restore previous state of VM. This is not deferred, since the
+			// deferred functions of exportRun would only run after all VMs were
+			// exported and not at all if the run is aborted with os.Exit, e.g.
+			// by --max-consecutive-failures, leaving the VMs shut off.
+			restore := func() {
+				vmLog.Debugf("restoring previous state of vm '%s'", vm.Descriptor.Name)
 
+				span := timer.Start("restore")
 				_, err = vm.Transition(formerState, true, timeout)
+				span.End()
 				if err != nil {
-					logger.Errorf("unable to restore state '%s' of VM '%s': %s",
+					vmLog.Errorf("unable to restore state '%s' of VM '%s': %s",
 						virt.GetStateString(formerState), vm.Descriptor.Name, err)
-					failed = true
+					failures++
 
 					newState, err := vm.GetCurrentStateString()
 					if err != nil {
-						logger.Errorf("unable to retrieve current state of VM '%s': %s ",
+						vmLog.Errorf("unable to retrieve current state of VM '%s': %s ",
 							vm.Descriptor.Name, err)
 					}
 
-					logger.Warnf("state of VM '%s' is now '%s'", vm.Descriptor.Name,
+					vmLog.Warnf("state of VM '%s' is now '%s'", vm.Descriptor.Name,
 						newState)
 				}
-			}()
+
+				timer.Summary()
+			}
 
 			// should we create a snapshot after the VM has been shutdown?
 			if snapshotAfterShutdown {
-				logger.Debugf("Beginning creation of snapshot for VM '%s'.",
+				vmLog.Debugf("Beginning creation of snapshot for VM '%s'.",
 					vm.Descriptor.Name)
 
-				snap, err := vm.CreateSnapshot("virsnap_", "snapshot created by virnsnap")
+				span := timer.Start("snapshot")
+				snap, err := vm.CreateSnapshot("virsnap_", "snapshot created by virnsnap",
+					virt.RandomNames(), virt.SnapshotOptions{})
+				span.End()
 				if err == nil {
-					logger.Infof("Created snapshot '%s' for VM '%s'", snap.Descriptor.Name,
+					vmLog.Infof("Created snapshot '%s' for VM '%s'", snap.Descriptor.Name,
 						vm.Descriptor.Name)
 				} else {
-					logger.Errorf("unable to create a snapshot for the VM '%s': %s ",
+					if err == virt.ErrSnapshotInProgress {
+						err = fmt.Errorf("another operation is using this VM, try " +
+							"again later")
+					}
+					vmLog.Errorf("unable to create a snapshot for the VM '%s': %s ",
 						vm.Descriptor.Name, err)
-					logger.Errorf("exporting VM '%s' without new snapshot", vm.Descriptor.Name)
-					failed = true
+					vmLog.Errorf("exporting VM '%s' without new snapshot", vm.Descriptor.Name)
+					failures++
 				}
 				snap.Free()
 			}
 
-			// do the actual export job, whenever we exit the scope of the
-			// scoped block, we restore the previous state of the VM
-			logger.Debugf("starting export process of VM '%s'", vm.Descriptor.Name)
-			err = vm.Export(absOutputDir, filemode, logger)
+			// do the actual export job, the previous state of the VM is
+			// restored at the end of the scoped block
+			vmLog.Debugf("starting export process of VM '%s'", vm.Descriptor.Name)
+			previous := isLocal && vm.HasExport(local.Directory)
+			manifest, err := vm.Export(dest, vmLog, virt.ExportOptions{
+				Strict:           strictExport,
+				PathMode:         mode,
+				Flatten:          flatten,
+				Pool:             storagePool,
+				Timer:            timer,
+				OnlyChangedDisks: onlyNewDisks && isLocal,
+			})
 			if err != nil {
-				logger.Errorf("could not export the VM '%s': %v", vm.Descriptor.Name, err)
-				failed = true
+				vmLog.Errorf("could not export the VM '%s': %v", vm.Descriptor.Name, err)
+				failures++
+
+				// never remove a previous export that was overwritten partially
+				if isLocal && !previous {
+					err = vm.RemoveFailedExport(local.Directory, cleanOnFailure)
+					if err != nil {
+						vmLog.Warnf("unable to clean up failed export of VM '%s': %s",
+							vm.Descriptor.Name, err)
+					}
+				}
+			} else if len(manifest.Disks) > 0 {
+				vmLog.Infof("Exported VM '%s' with %d disks", vm.Descriptor.Name,
+					len(manifest.Disks))
 			}
-			logger.Infof("Exported VM '%s'", vm.Descriptor.Name)
 
+			restore()
 		}
 	}
 
 	// TODO (obitech): improve error handling
 	// See: https://blog.golang.org/errors-are-values
-	if failed {
+	if failures > 0 {
 		logger.Fatal("export process failed due to errors")
 	}
 }
+
+// trimFilesystems asks the guest agent of the given VM to trim the filesystems
+// of the guest. A VM that cannot be trimmed is exported anyway, so failures
+// are only logged.
+func trimFilesystems(vmLog *zap.SugaredLogger, vm *virt.VM) {
+	results, err := vm.TrimFilesystems(trimTimeout)
+	if err == virt.ErrAgentUnavailable {
+		vmLog.Debugf("not trimming VM '%s': VM is not running or has no guest "+
+			"agent", vm.Descriptor.Name)
+		return
+	}
+	if err != nil {
+		vmLog.Warnf("exporting VM '%s' untrimmed: %s", vm.Descriptor.Name, err)
+		return
+	}
+
+	for _, result := range results {
+		if result.Error != "" {
+			vmLog.Warnf("unable to trim filesystem '%s' of VM '%s': %s",
+				result.Path, vm.Descriptor.Name, result.Error)
+			continue
+		}
+		vmLog.Debugf("trimmed %s of filesystem '%s' of VM '%s'",
+			formatBytes(result.Trimmed), result.Path, vm.Descriptor.Name)
+	}
+	vmLog.Infof("Trimmed the filesystems of VM '%s'", vm.Descriptor.Name)
+}
+
+// estimateRun prints the size of the export of the VMs matching the given
+// regular expressions and the estimated duration based on the throughput. The
+// VMs are only inspected, neither shut down nor exported.
+func estimateRun(args []string) {
+	vms, err := virt.ListMatchingVMs(logger, args, socketURL)
+	if err != nil {
+		logger.Fatalf("could not retrieve virtual machines: %s", err)
+	}
+	defer virt.FreeVMs(logger, vms)
+
+	if len(vms) == 0 {
+		logger.Fatal(errNoVMsMatchingRegex)
+	}
+
+	var total uint64
+	for _, vm := range vms {
+		size, err := vm.ExportSize()
+		if err != nil {
+			logger.Fatalf("could not estimate export size of VM '%s': %s",
+				vm.Descriptor.Name, err)
+		}
+		total += size
+		fmt.Printf("%s: %s\n", vm.Descriptor.Name, formatBytes(size))
+	}
+
+	seconds := total / (uint64(throughput) << 20)
+	fmt.Printf("total: %s, estimated duration at %d MiB/s: %s\n",
+		formatBytes(total), throughput, time.Duration(seconds)*time.Second)
+}
+
+// formatBytes returns the given number of bytes in a human-readable format
+// using binary units, e.g. "1.5 GiB".
+func formatBytes(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := uint64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// outputDirData is the data available in the output directory template.
+type outputDirData struct {
+	Date string
+	Time string
+}
+
+// expandOutputDir expands the placeholders of the given output directory
+// template using the given time.
+func expandOutputDir(dir string, now time.Time) (string, error) {
+	tmpl, err := template.New("output-dir").Option("missingkey=error").Parse(dir)
+	if err != nil {
+		return "", fmt.Errorf("could not parse output directory '%s': %v", dir, err)
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, outputDirData{
+		Date: now.Format("2006-01-02"),
+		Time: now.Format("15-04-05"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not expand output directory '%s': %v", dir, err)
+	}
+
+	if buf.Len() == 0 {
+		return "", fmt.Errorf("output directory '%s' expands to an empty path", dir)
+	}
+
+	return buf.String(), nil
+}
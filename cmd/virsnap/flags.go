@@ -0,0 +1,192 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// flagRule checks the flags of the given command and returns an error
+// describing the violation of the rule, if any.
+type flagRule func(cmd *cobra.Command) error
+
+// validateFlags returns a PreRunE function checking the flags of a command
+// against the given rules before any libvirt work happens. The violations of
+// all rules are reported at once.
+func validateFlags(rules ...flagRule) func(cmd *cobra.Command,
+	args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		violations := make([]string, 0)
+		for _, rule := range rules {
+			err := rule(cmd)
+			if err != nil {
+				violations = append(violations, err.Error())
+			}
+		}
+
+		if len(violations) == 0 {
+			return nil
+		}
+		return fmt.Errorf("invalid flags: %s", strings.Join(violations, "; "))
+	}
+}
+
+// flagSet determines whether the flag with the given name was given on the
+// command line. A boolean flag explicitly set to false counts as not given.
+func flagSet(cmd *cobra.Command, name string) bool {
+	flag := cmd.Flags().Lookup(name)
+	if flag == nil || !flag.Changed {
+		return false
+	}
+	return flag.Value.Type() != "bool" || flag.Value.String() == "true"
+}
+
+// setFlags returns the names of the given flags that were given on the
+// command line, formatted like "--name".
+func setFlags(cmd *cobra.Command, names []string) []string {
+	set := make([]string, 0, len(names))
+	for _, name := range names {
+		if flagSet(cmd, name) {
+			set = append(set, "--"+name)
+		}
+	}
+	return set
+}
+
+// flagGiven determines whether the flag with the given name was given on the
+// command line or in the configuration file (see flagConfigured).
+func flagGiven(cmd *cobra.Command, name string) bool {
+	return flagSet(cmd, name) || flagConfigured(cmd, name)
+}
+
+// givenFlags returns the names of the given flags that were given on the
+// command line, formatted like "--name". The configuration file only provides
+// defaults, so if any of the flags was given on the command line, the values
+// of the others from the file are discarded. Otherwise, the flags given in the
+// configuration file are returned.
+func givenFlags(cmd *cobra.Command, names []string) []string {
+	set := setFlags(cmd, names)
+	if len(set) > 0 {
+		for _, name := range names {
+			resetConfigured(cmd, name)
+		}
+		return set
+	}
+
+	configured := make([]string, 0, len(names))
+	for _, name := range names {
+		if flagConfigured(cmd, name) {
+			configured = append(configured, "--"+name)
+		}
+	}
+	return configured
+}
+
+// formatFlags formats the given flag names like "--a, --b or --c".
+func formatFlags(names []string) string {
+	formatted := make([]string, 0, len(names))
+	for _, name := range names {
+		formatted = append(formatted, "--"+name)
+	}
+	if len(formatted) == 1 {
+		return formatted[0]
+	}
+	return strings.Join(formatted[:len(formatted)-1], ", ") + " or " +
+		formatted[len(formatted)-1]
+}
+
+// exclusiveFlags returns a rule that at most one of the given flags is given.
+// A flag given on the command line overrides the others from the
+// configuration file (see givenFlags).
+func exclusiveFlags(names ...string) flagRule {
+	return func(cmd *cobra.Command) error {
+		set := givenFlags(cmd, names)
+		if len(set) > 1 {
+			return fmt.Errorf("%s cannot be combined", strings.Join(set, " and "))
+		}
+		return nil
+	}
+}
+
+// exactlyOneFlag returns a rule that exactly one of the given flags is given.
+// A flag given on the command line overrides the others from the
+// configuration file (see givenFlags).
+func exactlyOneFlag(names ...string) flagRule {
+	return func(cmd *cobra.Command) error {
+		if len(givenFlags(cmd, names)) != 1 {
+			return fmt.Errorf("exactly one of %s must be specified",
+				formatFlags(names))
+		}
+		return nil
+	}
+}
+
+// dependentFlag returns a rule that the flag with the given name is only given
+// together with the flag it depends on. The flag may be given in the
+// configuration file without its dependency, e.g. as default for the runs
+// giving the dependency.
+func dependentFlag(name string, dependency string) flagRule {
+	return func(cmd *cobra.Command) error {
+		if flagSet(cmd, name) && !flagGiven(cmd, dependency) {
+			return fmt.Errorf("--%s can only be specified if --%s is specified",
+				name, dependency)
+		}
+		return nil
+	}
+}
+
+// requiredFlagUnless returns a rule that the flag with the given name is given
+// unless one of the alternatives is given.
+func requiredFlagUnless(name string, alternatives ...string) flagRule {
+	return func(cmd *cobra.Command) error {
+		if flagGiven(cmd, name) {
+			return nil
+		}
+		for _, alternative := range alternatives {
+			if flagGiven(cmd, alternative) {
+				return nil
+			}
+		}
+		return fmt.Errorf("--%s is required unless %s is specified", name,
+			formatFlags(alternatives))
+	}
+}
+
+// flagValue returns a rule that the value of the flag with the given name
+// satisfies valid, which is evaluated when the flags are validated. Only
+// values given on the command line or in the configuration file are checked,
+// the built-in defaults are valid by definition, e.g. a default of zero may
+// disable a policy whose value needs to be positive. The requirement describes
+// a valid value, e.g. "must be greater than zero".
+func flagValue(name string, valid func() bool, requirement string) flagRule {
+	return func(cmd *cobra.Command) error {
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil || valid() {
+			return nil
+		}
+		if _, configured := flag.Annotations[configAnnotation]; !flag.Changed &&
+			!configured {
+			return nil
+		}
+		return fmt.Errorf("invalid value '%s' of --%s: %s", flag.Value.String(),
+			name, requirement)
+	}
+}
+
+// positiveFlag returns a rule that the given int flag is greater than zero.
+func positiveFlag(name string, value *int) flagRule {
+	return flagValue(name, func() bool { return *value > 0 },
+		"must be greater than zero")
+}
+
+// nonNegativeFlag returns a rule that the given int flag is not negative.
+func nonNegativeFlag(name string, value *int) flagRule {
+	return flagValue(name, func() bool { return *value >= 0 },
+		"must not be negative")
+}
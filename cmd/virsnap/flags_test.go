@@ -0,0 +1,104 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+// validateTestFlags parses the given command line with the flags of a test
+// command and validates them against the given rules.
+func validateTestFlags(t *testing.T, args []string, rules ...flagRule) error {
+	return validateConfiguredTestFlags(t, args, nil, rules...)
+}
+
+// validateConfiguredTestFlags is like validateTestFlags, but applies the given
+// values of the configuration file before validating the flags.
+func validateConfiguredTestFlags(t *testing.T, args []string,
+	config map[string]string, rules ...flagRule) error {
+	var shutdown, force, pause bool
+	var keep, days int
+	var after string
+
+	cmd := &cobra.Command{Use: "test"}
+	cmd.Flags().BoolVar(&shutdown, "shutdown", false, "")
+	cmd.Flags().BoolVar(&force, "force", false, "")
+	cmd.Flags().BoolVar(&pause, "pause", false, "")
+	cmd.Flags().IntVar(&keep, "keep", 10, "")
+	cmd.Flags().IntVar(&days, "days", 0, "")
+	cmd.Flags().StringVar(&after, "after", "", "")
+	require.NoError(t, cmd.ParseFlags(args))
+	require.NoError(t, applyConfig(cmd, config))
+
+	// the value rules need to refer to the variables of this command
+	rules = append(rules, nonNegativeFlag("keep", &keep),
+		positiveFlag("days", &days))
+	return validateFlags(rules...)(cmd, nil)
+}
+
+func TestValidateFlags(t *testing.T) {
+	require.NoError(t, validateTestFlags(t, nil,
+		dependentFlag("force", "shutdown"),
+		exclusiveFlags("pause", "shutdown")))
+
+	err := validateTestFlags(t, []string{"--force"},
+		dependentFlag("force", "shutdown"))
+	require.EqualError(t, err, "invalid flags: --force can only be specified "+
+		"if --shutdown is specified")
+
+	// an explicitly disabled boolean flag does not count
+	require.NoError(t, validateTestFlags(t,
+		[]string{"--pause", "--shutdown=false"},
+		exclusiveFlags("pause", "shutdown")))
+
+	// all violations are reported at once
+	err = validateTestFlags(t, []string{"--pause", "--shutdown", "--keep=-1",
+		"--days", "0"}, exclusiveFlags("pause", "shutdown"),
+		exactlyOneFlag("after", "keep", "days"))
+	require.EqualError(t, err, "invalid flags: --pause and --shutdown cannot "+
+		"be combined; exactly one of --after, --keep or --days must be "+
+		"specified; invalid value '-1' of --keep: must not be negative; "+
+		"invalid value '0' of --days: must be greater than zero")
+
+	err = validateTestFlags(t, nil, requiredFlagUnless("keep", "after",
+		"days"))
+	require.EqualError(t, err, "invalid flags: --keep is required unless "+
+		"--after or --days is specified")
+	require.NoError(t, validateTestFlags(t, []string{"--after", "snap"},
+		requiredFlagUnless("keep", "after", "days")))
+}
+
+func TestValidateConfiguredFlags(t *testing.T) {
+	// a flag of the command line overrides a conflicting one of the file
+	require.NoError(t, validateConfiguredTestFlags(t, []string{"--after",
+		"snap"}, map[string]string{"keep": "5"},
+		exactlyOneFlag("after", "keep")))
+	require.NoError(t, validateConfiguredTestFlags(t, []string{"--shutdown"},
+		map[string]string{"pause": "true"},
+		exclusiveFlags("pause", "shutdown")))
+
+	// conflicting flags of the file are reported
+	err := validateConfiguredTestFlags(t, nil, map[string]string{
+		"pause": "true", "shutdown": "true"},
+		exclusiveFlags("pause", "shutdown"))
+	require.EqualError(t, err, "invalid flags: --pause and --shutdown cannot "+
+		"be combined")
+
+	// a value of the file satisfies a required flag and is validated
+	require.NoError(t, validateConfiguredTestFlags(t, nil,
+		map[string]string{"keep": "5"}, requiredFlagUnless("keep", "after")))
+	err = validateConfiguredTestFlags(t, nil, map[string]string{"keep": "-1"})
+	require.EqualError(t, err, "invalid flags: invalid value '-1' of --keep: "+
+		"must not be negative")
+
+	// a dependent flag of the file is a default for the runs giving its
+	// dependency
+	require.NoError(t, validateConfiguredTestFlags(t, nil,
+		map[string]string{"force": "true"}, dependentFlag("force", "shutdown")))
+}
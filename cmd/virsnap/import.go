@@ -0,0 +1,104 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"github.com/joroec/virsnap/pkg/virt"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// importDiskDir is the directory the relative disk paths of the exported
+	// descriptor are resolved against. Empty for the export directory.
+	importDiskDir string
+
+	// verifyImport determines whether the exported files are checked against
+	// their checksums before the VM is defined.
+	verifyImport bool
+
+	// replaceVM determines whether an existing VM with the same name is
+	// replaced by the imported one.
+	replaceVM bool
+
+	// strictImport determines whether incompatibilities of the imported VM
+	// with the host should be treated as an error.
+	strictImport bool
+
+	// importCmd is a global variable defining the corresponding cobra command
+	importCmd = &cobra.Command{
+		Use:   "import <export_dir>",
+		Short: "Define a VM from an export directory",
+		Long: "Define the virtual machine exported to the given directory, i.e. " +
+			"the directory named after the VM below the output directory of " +
+			"'virsnap export'. The relative paths of the disk images and the " +
+			"UEFI variable store in the exported descriptor are resolved " +
+			"against the export directory or --disk-dir, and every referenced " +
+			"file needs to exist. The architecture, machine type, NUMA nodes " +
+			"and CPU model of the VM are checked against the host. The disk " +
+			"images are used in place, they are not copied. For example, " +
+			"'virsnap import ./virsnap-export/2019-10-01/testing' defines the " +
+			"VM \"testing\".",
+		Args:        cobra.ExactArgs(1),
+		Annotations: map[string]string{regexArgsAnnotation: "0"},
+		PreRunE:     validateFlags(exclusiveFlags("verify", "disk-dir")),
+		Run:         importRun,
+	}
+)
+
+// init is a special golang function that is called exactly once regardless
+// how often the package is imported.
+func init() {
+	// initialize flags and arguments needed for this command
+	importCmd.Flags().StringVar(&importDiskDir, "disk-dir", "", "Directory "+
+		"the relative disk paths of the exported descriptor are resolved "+
+		"against, e.g. after moving the disk images. Defaults to the export "+
+		"directory.")
+
+	importCmd.Flags().BoolVar(&verifyImport, "verify", false, "Check the "+
+		"exported files against the checksums recorded by the export before "+
+		"defining the VM. Cannot be combined with --disk-dir.")
+
+	importCmd.Flags().BoolVar(&replaceVM, "replace", false, "Replace an "+
+		"existing VM with the same name. The existing VM needs to be shut off. "+
+		"Its disk images are kept. If it has another UUID than the imported "+
+		"VM, its snapshot metadata is removed.")
+
+	importCmd.Flags().BoolVar(&strictImport, "strict", false, "Refuse to "+
+		"define a VM that is not compatible with the host, e.g. because of "+
+		"an unsupported machine type or CPU model, instead of only warning.")
+
+	// add command to root command so that cobra works as expected
+	RootCmd.AddCommand(importCmd)
+}
+
+// importRun takes as parameter the export directory of the VM to define
+func importRun(cmd *cobra.Command, args []string) {
+	lck := acquireLock()
+	defer lck.Release()
+
+	conn, err := virt.Connect(logger, socketURL)
+	if err != nil {
+		logger.Fatalf("unable to connect to libvirt: %s", err)
+	}
+	defer conn.Close()
+
+	opts := virt.ImportOptions{
+		DiskDir: importDiskDir,
+		Verify:  verifyImport,
+		Replace: replaceVM,
+		Strict:  strictImport,
+	}
+	name, err := virt.ImportVM(logger, conn, args[0], opts)
+	if err == virt.ErrVMExists {
+		logger.Fatalf("VM '%s' already exists, specify --replace to replace it",
+			name)
+	}
+	if err != nil {
+		logger.Fatalf("unable to import VM: %s", err)
+	}
+
+	logger.Infof("imported VM '%s' from '%s'", name, args[0])
+}
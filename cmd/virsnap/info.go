@@ -0,0 +1,177 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/bclicn/color"
+	"github.com/joroec/virsnap/pkg/virt"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// infoCmd is a global variable defining the corresponding cobra command
+	infoCmd = &cobra.Command{
+		Use:     "info <vm_regex> <snapshot_name>",
+		Aliases: []string{"snapshot-info"},
+		Short:   "Show the metadata of a snapshot",
+		Long: "Show the metadata of the snapshot with the given name of any " +
+			"found virtual machine with a name matching the given regular " +
+			"expression: the parent snapshot, the creation time, the state of " +
+			"the VM, whether the memory is included, the description and, per " +
+			"disk, whether the disk is included in the snapshot internally or " +
+			"externally. For example, 'virsnap info \"^testing$\" " +
+			"virsnap_angry_hypatia' shows the metadata of the snapshot of the VM " +
+			"\"testing\".",
+		Args:        cobra.ExactArgs(2),
+		Annotations: map[string]string{regexArgsAnnotation: "1"},
+		Run:         infoRun,
+	}
+)
+
+// init is a special golang function that is called exactly once regardless
+// how often the package is imported.
+func init() {
+	// add command to root command so that cobra works as expected
+	RootCmd.AddCommand(infoCmd)
+}
+
+// infoRun takes as parameter the regular expression of the names of the VMs
+// and the name of the snapshot to show
+func infoRun(cmd *cobra.Command, args []string) {
+	vms, err := virt.ListMatchingVMs(logger, args[:1], socketURL)
+	if err != nil {
+		logger.Fatalf("unable to retrieve virtual machines: %s", err)
+	}
+
+	defer virt.FreeVMs(logger, vms)
+
+	if len(vms) == 0 {
+		logger.Fatal(errNoVMsMatchingRegex)
+	}
+
+	// a boolean indicating whether at least one error occured. Useful for
+	// the exit code of the program after iterating over the virtual machines.
+	failed := false
+
+	snapshotRegex := "^" + regexp.QuoteMeta(args[1]) + "$"
+	printed := 0
+	for _, vm := range vms {
+		vmLog := vmLogger(&vm)
+
+		snapshots, err := vm.ListMatchingSnapshots([]string{snapshotRegex})
+		if err != nil {
+			vmLog.Errorf("skipping VM '%s': unable to retrieve snapshots: %s",
+				vm.Descriptor.Name,
+				err,
+			)
+			failed = true
+			continue
+		}
+
+		if len(snapshots) == 0 {
+			vmLog.Errorf("skipping VM '%s': snapshot '%s' does not exist",
+				vm.Descriptor.Name,
+				args[1],
+			)
+			failed = true
+			continue
+		}
+
+		// snapshot names are unique per VM
+		snapshot := snapshots[0]
+		if snapshot.Unparseable {
+			vmLog.Errorf("skipping VM '%s': unable to parse XML descriptor of "+
+				"snapshot '%s'", vm.Descriptor.Name, args[1])
+			virt.FreeSnapshots(vmLog, snapshots)
+			failed = true
+			continue
+		}
+
+		if printed > 0 {
+			fmt.Println()
+		}
+		renderSnapshotInfo(os.Stdout, vm.Descriptor.Name, snapshot.Descriptor,
+			timeFormat, time.Now())
+		printed++
+
+		virt.FreeSnapshots(vmLog, snapshots)
+	}
+
+	if failed {
+		logger.Fatal("info process failed due to errors")
+	}
+}
+
+// renderSnapshotInfo writes the metadata of the snapshot of the VM with the
+// given name to w. The creation time is formatted with the given format
+// relative to now.
+func renderSnapshotInfo(w io.Writer, vmName string,
+	snapshot libvirtxml.DomainSnapshot, format virt.TimeFormat, now time.Time) {
+	fmt.Fprintf(w, "%s (VM %s)\n", color.BGreen(snapshot.Name), vmName)
+
+	parent := "none, this is a root snapshot"
+	if snapshot.Parent != nil && snapshot.Parent.Name != "" {
+		parent = snapshot.Parent.Name
+	}
+
+	created := "unknown"
+	seconds, err := strconv.ParseInt(snapshot.CreationTime, 10, 64)
+	if err == nil {
+		created = format.Format(time.Unix(seconds, 0), now)
+	}
+
+	memory := "unknown"
+	if snapshot.Memory != nil && snapshot.Memory.Snapshot != "" {
+		memory = snapshot.Memory.Snapshot
+		if snapshot.Memory.File != "" {
+			memory += " (" + snapshot.Memory.File + ")"
+		}
+	}
+
+	description := virt.ParseDescription(snapshot.Description).String()
+	if description == "" {
+		description = "none"
+	}
+
+	fmt.Fprintf(w, "Parent:      %s\n", parent)
+	fmt.Fprintf(w, "Created:     %s\n", created)
+	fmt.Fprintf(w, "State:       %s\n", snapshot.State)
+	fmt.Fprintf(w, "Memory:      %s\n", memory)
+	fmt.Fprintf(w, "Description: %s\n", description)
+
+	if snapshot.Disks == nil || len(snapshot.Disks.Disks) == 0 {
+		fmt.Fprintln(w, "Disks:       none")
+		return
+	}
+
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"Disk", "Snapshot", "File"})
+	table.SetRowLine(false)
+	for _, disk := range snapshot.Disks.Disks {
+		// libvirt decides on the type of snapshot of disks without an
+		// explicit one
+		mode := disk.Snapshot
+		if mode == "" {
+			mode = "default"
+		}
+
+		file := ""
+		if disk.Source != nil && disk.Source.File != nil {
+			file = disk.Source.File.File
+		}
+		table.Append([]string{disk.Name, mode, file})
+	}
+	table.Render()
+}
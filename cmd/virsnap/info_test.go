@@ -0,0 +1,54 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/joroec/virsnap/pkg/virt"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+func TestRenderSnapshotInfo(t *testing.T) {
+	snapshot := libvirtxml.DomainSnapshot{
+		Name:         "virsnap_angry_hypatia",
+		Description:  "snapshot created by virnsnap",
+		State:        "shutoff",
+		CreationTime: ago(3 * 24 * time.Hour),
+		Parent:       &libvirtxml.DomainSnapshotParent{Name: "virsnap_base"},
+		Memory:       &libvirtxml.DomainSnapshotMemory{Snapshot: "internal"},
+		Disks: &libvirtxml.DomainSnapshotDisks{
+			Disks: []libvirtxml.DomainSnapshotDisk{
+				{Name: "vda", Snapshot: "internal"},
+				{
+					Name:     "vdb",
+					Snapshot: "external",
+					Source: &libvirtxml.DomainDiskSource{
+						File: &libvirtxml.DomainDiskSourceFile{
+							File: "/var/lib/libvirt/images/testvm-vdb.snap",
+						},
+					},
+				},
+				{Name: "sda", Snapshot: "no"},
+			},
+		},
+	}
+
+	// a root snapshot without any optional metadata
+	root := libvirtxml.DomainSnapshot{
+		Name:  "virsnap_base",
+		State: "running",
+	}
+
+	var buf bytes.Buffer
+	renderSnapshotInfo(&buf, "testvm", snapshot, virt.TimeFormatRelative,
+		testNow)
+	buf.WriteString("\n")
+	renderSnapshotInfo(&buf, "testvm", root, virt.TimeFormatRelative, testNow)
+	requireGolden(t, "info", buf.Bytes())
+}
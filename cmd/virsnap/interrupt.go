@@ -0,0 +1,43 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// errInterrupted is the message the reporting commands exit with after they
+// were interrupted and flushed their partial output.
+const errInterrupted = "interrupted, the output is truncated"
+
+// notifyInterrupt returns a context that is cancelled as soon as virsnap
+// receives SIGINT or SIGTERM, so that the reporting commands can stop after
+// the current VM and flush the results gathered so far. A second signal
+// terminates virsnap immediately. The returned function releases the signal
+// handler and needs to be called once the context is not needed anymore.
+func notifyInterrupt() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-signals:
+			logger.Warn("interrupted, stopping after the current VM")
+			cancel()
+		case <-ctx.Done():
+		}
+
+		// restore the default behavior for a second signal
+		signal.Stop(signals)
+	}()
+
+	return ctx, cancel
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNotifyInterrupt(t *testing.T) {
+	original := logger
+	logger = zap.NewNop().Sugar()
+	defer func() { logger = original }()
+
+	ctx, stop := notifyInterrupt()
+	defer stop()
+	require.NoError(t, ctx.Err())
+
+	require.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGINT))
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context was not cancelled on interrupt")
+	}
+}
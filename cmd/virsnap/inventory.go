@@ -0,0 +1,135 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/joroec/virsnap/pkg/virt"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// inventoryFormat is a global variable holding the format of the inventory
+	// document (json, yaml)
+	inventoryFormat = "json"
+
+	// inventoryFull is a global variable determining whether the XML
+	// descriptors of the VMs and snapshots are included in the inventory
+	inventoryFull bool
+
+	// inventoryCmd is a global variable defining the corresponding cobra command
+	inventoryCmd = &cobra.Command{
+		Use:   "inventory [--format json|yaml] [--full] [<regex1>] [<regex2>] ...",
+		Short: "Dump the VMs and their snapshots as JSON or YAML document",
+		Long: "Dump any found virtual machine with a name matching at least one " +
+			"of the given regular expressions, its current state, its disks and " +
+			"all of its snapshots as a single JSON or YAML document to stdout. If " +
+			"no regex is given, any accessible virtual machine is included. In " +
+			"contrast to list, the document is meant to be processed by other " +
+			"tools, e.g. for auditing or for backing up the metadata. With " +
+			"--full, the XML descriptors of the VMs and the snapshots are " +
+			"included as well. VMs that could not be inventoried completely are " +
+			"included with an error and cause a non-zero exit code. If virsnap " +
+			"is interrupted, the VMs inventoried so far are written with " +
+			"\"truncated\": true.",
+		Run: inventoryRun,
+	}
+)
+
+// init is a special golang function that is called exactly once regardless
+// how often the package is imported.
+func init() {
+	// initialize flags and arguments needed for this command
+	inventoryCmd.Flags().StringVar(&inventoryFormat, "format", inventoryFormat,
+		"Format of the document (json, yaml).")
+
+	inventoryCmd.Flags().BoolVar(&inventoryFull, "full", false, "Include the "+
+		"XML descriptors of the VMs and the snapshots.")
+
+	// add command to root command so that cobra works as expected
+	RootCmd.AddCommand(inventoryCmd)
+}
+
+// inventoryRun takes as parameter the regular expressions of the names of the
+// VMs to include in the inventory
+func inventoryRun(cmd *cobra.Command, args []string) {
+	// check the validity of the console line parameters
+	if inventoryFormat != "json" && inventoryFormat != "yaml" {
+		logger.Fatalf("invalid format '%s', expected json or yaml",
+			inventoryFormat)
+	}
+
+	if len(args) == 0 {
+		args = []string{".*"}
+	}
+
+	vms, err := virt.ListMatchingVMs(logger, args, socketURL)
+	if err != nil {
+		logger.Fatalf("unable to retrieve virtual machines: %s", err)
+	}
+
+	defer virt.FreeVMs(logger, vms)
+
+	if len(vms) == 0 {
+		logger.Fatal(errNoVMsMatchingRegex)
+	}
+
+	// a boolean indicating whether at least one VM could not be inventoried.
+	// Useful for the exit code of the program after iterating over the VMs.
+	failed := false
+
+	// on interrupt, the VMs inventoried so far are still written
+	ctx, stop := notifyInterrupt()
+	defer stop()
+
+	inventory := virt.Inventory{
+		URI:  socketURL,
+		Time: time.Now(),
+		VMs:  make([]virt.VMInventory, 0, len(vms)),
+	}
+	for i := range vms {
+		if ctx.Err() != nil {
+			inventory.Truncated = true
+			break
+		}
+
+		vmLog := vmLogger(&vms[i])
+
+		entry, err := vms[i].Inventory(inventoryFull)
+		if err != nil {
+			vmLog.Errorf("unable to inventory VM '%s': %s",
+				vms[i].Descriptor.Name, err)
+			entry.Error = err.Error()
+			failed = true
+		}
+		inventory.VMs = append(inventory.VMs, entry)
+	}
+
+	if inventoryFormat == "yaml" {
+		err = writeYAML(os.Stdout, inventory)
+	} else {
+		var document []byte
+		document, err = json.MarshalIndent(inventory, "", "  ")
+		if err != nil {
+			logger.Fatalf("unable to encode inventory: %s", err)
+		}
+		_, err = os.Stdout.Write(append(document, '\n'))
+	}
+	if err != nil {
+		logger.Fatalf("unable to write inventory: %s", err)
+	}
+
+	if inventory.Truncated {
+		logger.Fatal(errInterrupted)
+	}
+
+	if failed {
+		logger.Fatal("unable to inventory all VMs")
+	}
+}
@@ -6,46 +6,174 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"strconv"
+	"sort"
 	"time"
 
 	"github.com/bclicn/color"
 	"github.com/joroec/virsnap/pkg/virt"
-	"github.com/olekukonko/tablewriter"
 	"github.com/spf13/cobra"
 )
 
-// listCmd is a global variable defining the corresponding cobra command
-var listCmd = &cobra.Command{
-	Use:   "list [<regex1>] [<regex2>] [<regex3>] ...",
-	Short: "List snapshots of one or more virtual machines",
-	Long: "List the virtual machine with the snapshots that can be detected " +
-		"via using libvirt. This is meant to be a simple method of getting an " +
-		"overview of the current virtual machines and the corresponding " +
-		"snapshots. It is possible to specify a regular expression that filters " +
-		"the shwon virtual machines by name. For example, 'virsnap list \".*\"' " +
-		"prints all accessible virtual machines with the corresponding snapshots " +
-		", whereas 'virsnap list \"testing\"' prints only virtual machines with " +
-		"the corresponding snapshots whose name includes \"testing\". If no " +
-		"regex is given, any acccessible virtual machine is printed.",
-	Run: listRun,
-}
+var (
+	// listUnmanaged is a global variable determining whether internal qcow2
+	// snapshots libvirt has no metadata for should be listed as well
+	listUnmanaged bool
+
+	// listDescriptions is a global variable determining whether the
+	// descriptions of the snapshots should be listed as well
+	listDescriptions bool
+
+	// showLastBackup is a global variable determining whether the time of the
+	// last successful export of each VM should be listed as well
+	showLastBackup bool
+
+	// probeAgent is a global variable determining whether the guest agents of
+	// the running VMs should be pinged
+	probeAgent bool
+
+	// agentTimeout is a global variable holding how long to wait for the
+	// answer of a guest agent
+	agentTimeout = 2 * time.Second
+
+	// groupBy is a global variable holding the specification how the listed
+	// VMs should be grouped. Empty if the VMs should not be grouped.
+	groupBy string
+
+	// reportFormat is a global variable holding the output format of list
+	// (table, csv)
+	reportFormat = "table"
+
+	// listOutput is a global variable holding the output format of list for
+	// other tools (table, json, yaml)
+	listOutput = "table"
+
+	// listCmd is a global variable defining the corresponding cobra command
+	listCmd = &cobra.Command{
+		Use:   "list [<regex1>] [<regex2>] [<regex3>] ...",
+		Short: "List snapshots of one or more virtual machines",
+		Long: "List the virtual machine with the snapshots that can be detected " +
+			"via using libvirt. This is meant to be a simple method of getting an " +
+			"overview of the current virtual machines and the corresponding " +
+			"snapshots. It is possible to specify a regular expression that filters " +
+			"the shwon virtual machines by name. For example, 'virsnap list \".*\"' " +
+			"prints all accessible virtual machines with the corresponding snapshots " +
+			", whereas 'virsnap list \"testing\"' prints only virtual machines with " +
+			"the corresponding snapshots whose name includes \"testing\". If no " +
+			"regex is given, any acccessible virtual machine is printed. With " +
+			"--unmanaged, the qcow2 disks are additionally inspected with qemu-img " +
+			"to also show internal snapshots libvirt has no metadata for, e.g. " +
+			"snapshots taken with the raw qemu tools. With --group-by, the VMs are " +
+			"grouped by the first n characters of their name ('prefix:<n>'), by " +
+			"their name up to a delimiter ('prefix:-') or by an element of their " +
+			"<metadata> ('tag:<key>'), with subtotals per group. With " +
+			"--descriptions, the description of each snapshot is shown, including " +
+			"the reason, trigger and operator of structured descriptions. With " +
+			"--show-last-backup, the time of the last successful export of each " +
+			"VM is shown, as recorded by export in the <metadata> of the VM. With " +
+			"--agent, the QEMU guest agent of each running VM is pinged to show " +
+			"which VMs can take application-consistent snapshots. With " +
+			"'--report-format csv', a single CSV document with one row per VM " +
+			"(snapshot count, oldest and newest snapshot) is printed instead of " +
+			"the tables. With '--output json' or '--output yaml', the VMs and " +
+			"their snapshots are printed as a single document for other tools, " +
+			"e.g. Ansible.",
+		PreRunE: validateFlags(
+			flagValue("report-format", func() bool {
+				return reportFormat == "table" || reportFormat == "csv"
+			}, "must be table or csv"),
+			csvWithoutGroups,
+			flagValue("output", func() bool {
+				return listOutput == "table" || listOutput == "json" ||
+					listOutput == "yaml"
+			}, "must be table, json or yaml"),
+			documentWithoutTables,
+		),
+		Run: listRun,
+	}
+)
 
 // init is a special golang function that is called exactly once regardless
 // how often the package is imported.
 func init() {
+	// initialize flags and arguments needed for this command
+	listCmd.Flags().BoolVar(&listUnmanaged, "unmanaged", false, "Also list "+
+		"internal snapshots of qcow2 disks libvirt has no metadata for. "+
+		"Requires qemu-img.")
+
+	listCmd.Flags().BoolVar(&listDescriptions, "descriptions", false, "Also "+
+		"list the descriptions of the snapshots.")
+
+	listCmd.Flags().BoolVar(&showLastBackup, "show-last-backup", false, "Also "+
+		"list the time of the last successful export of each VM.")
+
+	listCmd.Flags().BoolVar(&probeAgent, "agent", false, "Ping the QEMU "+
+		"guest agent of each running VM and list whether it is reachable, "+
+		"i.e. whether the VM supports quiesced snapshots.")
+
+	listCmd.Flags().DurationVar(&agentTimeout, "agent-timeout", agentTimeout,
+		"How long to wait for the answer of a guest agent with --agent. "+
+			"Rounded down to full seconds, at least one second.")
+
+	listCmd.Flags().StringVar(&groupBy, "group-by", "", "Group the VMs by "+
+		"name prefix or metadata tag (prefix:<n>, prefix:<delimiter>, "+
+		"tag:<key>) and print subtotals per group.")
+
+	listCmd.Flags().StringVar(&reportFormat, "report-format", reportFormat,
+		"Output format (table, csv). csv prints one row per VM and cannot be "+
+			"combined with --group-by.")
+
+	listCmd.Flags().StringVarP(&listOutput, "output", "o", listOutput,
+		"Output format (table, json, yaml). json and yaml print a single "+
+			"document and cannot be combined with --group-by or --report-format.")
+
 	// add command to root command so that cobra works as expected
 	RootCmd.AddCommand(listCmd)
 }
 
+// csvWithoutGroups is a rule that the VMs are not grouped in CSV output, which
+// has no room for the subtotals of the groups.
+func csvWithoutGroups(cmd *cobra.Command) error {
+	if reportFormat == "csv" && flagSet(cmd, "group-by") {
+		return fmt.Errorf("--report-format csv cannot be combined with --group-by")
+	}
+	return nil
+}
+
+// documentWithoutTables is a rule that a JSON or YAML document is neither
+// grouped nor combined with another report format.
+func documentWithoutTables(cmd *cobra.Command) error {
+	if listOutput == "table" {
+		return nil
+	}
+	if flagSet(cmd, "group-by") {
+		return fmt.Errorf("--output %s cannot be combined with --group-by",
+			listOutput)
+	}
+	if flagSet(cmd, "report-format") {
+		return fmt.Errorf("--output %s cannot be combined with --report-format",
+			listOutput)
+	}
+	return nil
+}
+
 // listRun is the function called after the command line parser detected
 // that we want to end up here.
 func listRun(cmd *cobra.Command, args []string) {
 	var err error
 	var vms []virt.VM
 
+	// check the validity of the console line parameters
+	var key virt.GroupKey
+	if groupBy != "" {
+		key, err = virt.ParseGroupBy(groupBy)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+
 	if len(args) > 0 {
 		logger.Debug("Using regular expression specified as command line argument: %#v", args)
 		vms, err = virt.ListMatchingVMs(logger, args, socketURL)
@@ -71,64 +199,197 @@ func listRun(cmd *cobra.Command, args []string) {
 		logger.Fatal(errNoVMsMatchingRegex)
 	}
 
-	// iterate over the VMs and output the gathered information
-	for index, vm := range vms {
-		vmstate, err := vm.GetCurrentStateString()
-		if err != nil {
-			logger.Errorf("unable to retrieve current state of VM %s: %s",
-				vm.Descriptor.Name,
-				err,
-			)
-		}
+	// a common reference time for relative timestamps of all snapshots
+	now := time.Now()
 
-		snapshots, err := vm.ListMatchingSnapshots([]string{".*"})
-		if err != nil {
-			logger.Errorf("skipping domain '%s': unable to retrieve snapshots for said domain: %s",
-				vm.Descriptor.Name,
-				err,
-			)
-			continue
-		}
+	// on interrupt, the VMs printed so far are kept and a note is printed
+	ctx, stop := notifyInterrupt()
+	defer stop()
 
-		defer virt.FreeSnapshots(logger, snapshots)
+	if reportFormat == "csv" {
+		printCSV(ctx, vms, now)
+		return
+	}
 
-		// print the VM header to stdout
-		fmt.Printf("%s (current state: %s, %d snapshots total)\n",
-			color.BGreen(vm.Descriptor.Name), vmstate,
-			len(snapshots))
+	if listOutput != "table" {
+		printDocument(ctx, vms, now)
+		return
+	}
 
-		// print no snapshot table if there are no snapshots for this VM
-		if len(snapshots) == 0 {
-			continue
-		}
+	if groupBy == "" {
+		// iterate over the VMs and output the gathered information
+		for index := range vms {
+			if ctx.Err() != nil {
+				printTruncated(index, len(vms))
+				logger.Fatal(errInterrupted)
+			}
 
-		table := tablewriter.NewWriter(os.Stdout)
-		table.SetHeader([]string{"Snapshot", "Time", "State"})
-		table.SetRowLine(false)
+			printVM(&vms[index], now)
 
-		for _, snapshot := range snapshots {
+			// do not print a new line if we are the last VM
+			if index != len(vms)-1 {
+				fmt.Println("")
+			}
+		}
+		return
+	}
+
+	groups := virt.GroupVMs(vms, key)
+	printed := 0
+	for index, group := range groups {
+		fmt.Printf("%s (%d VMs)\n", color.BBlue("group '"+group.Name+"'"),
+			len(group.VMs))
 
-			// convert timestamp to human-readable format
-			timeInt, err := strconv.ParseInt(snapshot.Descriptor.CreationTime, 10, 64)
-			if err != nil {
-				logger.Errorf("skipping VM '%s': unable to convert snapshot creation time of VM: %s",
-					vm.Descriptor.Name,
-					err,
-				)
-				continue
+		total := 0
+		for i := range group.VMs {
+			if ctx.Err() != nil {
+				fmt.Println("")
+				printTruncated(printed, len(vms))
+				logger.Fatal(errInterrupted)
 			}
-			time := time.Unix(timeInt, 0)
 
-			// append the table row for this snapshot
-			table.Append([]string{snapshot.Descriptor.Name,
-				time.Format("Mon Jan 2 15:04:05 MST 2006"), snapshot.Descriptor.State})
+			fmt.Println("")
+			total += printVM(&group.VMs[i], now)
+			printed++
 		}
 
-		table.Render()
+		fmt.Printf("\nsubtotal of group '%s': %d VMs, %d snapshots\n", group.Name,
+			len(group.VMs), total)
 
-		// do not print a new line if we are the last VM
-		if index != len(vms)-1 {
+		// do not print a new line if we are the last group
+		if index != len(groups)-1 {
 			fmt.Println("")
 		}
 	}
 }
+
+// printTruncated prints a note that the listing was interrupted after the
+// given number of VMs.
+func printTruncated(printed int, total int) {
+	fmt.Printf("(truncated: interrupted after %d of %d VMs)\n", printed, total)
+}
+
+// printCSV prints the VMs as a single CSV document. On interrupt, the rows of
+// the VMs gathered so far are printed.
+func printCSV(ctx context.Context, vms []virt.VM, now time.Time) {
+	views, interrupted := listVMViews(ctx, vms)
+
+	errs, err := RenderVMCSV(os.Stdout, views, listRenderOptions(now))
+	for _, err := range errs {
+		logger.Error(err)
+	}
+	if err != nil {
+		logger.Fatalf("unable to write CSV: %s", err)
+	}
+
+	if interrupted {
+		logger.Fatal(errInterrupted)
+	}
+}
+
+// printDocument prints the VMs as a single JSON or YAML document. On
+// interrupt, the VMs gathered so far are printed.
+func printDocument(ctx context.Context, vms []virt.VM, now time.Time) {
+	views, interrupted := listVMViews(ctx, vms)
+
+	err := RenderVMDocument(os.Stdout, views, listRenderOptions(now),
+		listOutput == "yaml")
+	if err != nil {
+		logger.Fatalf("unable to write %s: %s", listOutput, err)
+	}
+
+	if interrupted {
+		logger.Fatal(errInterrupted)
+	}
+}
+
+// listVMViews gathers the views of the given VMs, skipping the VMs whose
+// snapshots could not be retrieved. The boolean is true if the context was
+// cancelled before all VMs were gathered.
+func listVMViews(ctx context.Context, vms []virt.VM) ([]VMView, bool) {
+	views := make([]VMView, 0, len(vms))
+	for index := range vms {
+		if ctx.Err() != nil {
+			return views, true
+		}
+
+		view, ok := listVMView(&vms[index])
+		if ok {
+			views = append(views, view)
+		}
+	}
+	return views, false
+}
+
+// listRenderOptions returns the options of rendering the VMs according to the
+// flags of list.
+func listRenderOptions(now time.Time) RenderOptions {
+	return RenderOptions{
+		TimeFormat:   timeFormat,
+		Now:          now,
+		Descriptions: listDescriptions,
+		LastBackup:   showLastBackup,
+		Agent:        probeAgent,
+	}
+}
+
+// listVMView gathers the state and the snapshots of the VM. The boolean is
+// false if the snapshots of the VM could not be retrieved.
+func listVMView(vm *virt.VM) (VMView, bool) {
+	vmstate, err := vm.GetCurrentStateString()
+	if err != nil {
+		logger.Errorf("unable to retrieve current state of VM %s: %s",
+			vm.Descriptor.Name,
+			err,
+		)
+	}
+
+	snapshots, err := vm.ListMatchingSnapshots([]string{".*"})
+	if err != nil {
+		logger.Errorf("skipping domain '%s': unable to retrieve snapshots for said domain: %s",
+			vm.Descriptor.Name,
+			err,
+		)
+		return VMView{}, false
+	}
+
+	defer virt.FreeSnapshots(logger, snapshots)
+
+	if listUnmanaged {
+		unmanaged, err := vm.ListUnmanagedSnapshots(snapshots)
+		if err != nil {
+			logger.Errorf("unable to retrieve unmanaged snapshots of VM '%s': %s",
+				vm.Descriptor.Name,
+				err,
+			)
+		}
+		snapshots = append(snapshots, unmanaged...)
+
+		sorter := virt.SnapshotSorter{
+			Snapshots: &snapshots,
+		}
+		sort.Sort(&sorter)
+	}
+
+	view := newVMView(vm, vmstate, snapshots)
+	if probeAgent {
+		view.Agent = vm.PingAgent(agentTimeout)
+	}
+	return view, true
+}
+
+// printVM prints the VM with a table of its snapshots and returns the number of
+// printed snapshots.
+func printVM(vm *virt.VM, now time.Time) int {
+	view, ok := listVMView(vm)
+	if !ok {
+		return 0
+	}
+
+	errs := RenderVMTable(os.Stdout, []VMView{view}, listRenderOptions(now))
+	for _, err := range errs {
+		logger.Error(err)
+	}
+
+	return len(view.Snapshots)
+}
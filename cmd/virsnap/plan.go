@@ -0,0 +1,90 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"fmt"
+
+	"github.com/joroec/virsnap/pkg/virt"
+	"github.com/libvirt/libvirt-go"
+)
+
+// planRun prints the state transitions create or export would apply to the
+// VMs matching the given regular expressions without executing them. If
+// shutdown is true, the VMs are shut down and restored afterwards, force
+// determines whether the VMs are destroyed if they do not shut down
+// gracefully within the timeout. If pause is true, running VMs are paused and
+// resumed afterwards.
+func planRun(args []string, shutdown bool, force bool, pause bool) {
+	vms, err := virt.ListMatchingVMs(logger, args, socketURL)
+	if err != nil {
+		logger.Fatalf("unable to retrieve virtual machines: %s", err)
+	}
+	defer virt.FreeVMs(logger, vms)
+
+	if len(vms) == 0 {
+		logger.Fatal(errNoVMsMatchingRegex)
+	}
+
+	for _, vm := range vms {
+		state, _, err := vm.Instance.GetState()
+		if err != nil {
+			logger.Errorf("unable to retrieve state of VM '%s': %s",
+				vm.Descriptor.Name, err)
+			continue
+		}
+
+		if pause && state == libvirt.DOMAIN_RUNNING {
+			fmt.Printf("%s: %s\n", vm.Descriptor.Name,
+				virt.FormatTransitions([]libvirt.DomainState{state,
+					libvirt.DOMAIN_PAUSED, state}))
+			continue
+		}
+
+		if !shutdown {
+			fmt.Printf("%s: %s (no transition)\n", vm.Descriptor.Name,
+				virt.FormatTransitions([]libvirt.DomainState{state}))
+			continue
+		}
+
+		path, previous, err := virt.PlanTransition(state, libvirt.DOMAIN_SHUTOFF)
+		if err != nil {
+			fmt.Printf("%s: %s\n", vm.Descriptor.Name, err)
+			continue
+		}
+
+		// a graceful shutdown depends on the guest reacting to the request
+		graceful := false
+		for i := 1; i < len(path); i++ {
+			if path[i-1] == libvirt.DOMAIN_RUNNING &&
+				path[i] == libvirt.DOMAIN_SHUTOFF {
+				graceful = true
+			}
+		}
+
+		notes := ""
+		restore, _, err := virt.PlanTransition(libvirt.DOMAIN_SHUTOFF, previous)
+		if err == nil {
+			path = append(path, restore[1:]...)
+		} else {
+			notes += fmt.Sprintf(", state '%s' cannot be restored",
+				virt.FormatTransitions([]libvirt.DomainState{previous}))
+		}
+
+		if graceful {
+			if force {
+				notes += fmt.Sprintf(", destroyed if not shut down gracefully "+
+					"within %d minutes", timeout)
+			} else {
+				notes += fmt.Sprintf(", fails if not shut down gracefully within "+
+					"%d minutes", timeout)
+			}
+		}
+
+		fmt.Printf("%s: %s%s\n", vm.Descriptor.Name,
+			virt.FormatTransitions(path), notes)
+	}
+}
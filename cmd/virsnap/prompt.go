@@ -0,0 +1,97 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	// confirmThreshold is a global variable holding the number of VMs above
+	// which a destructive command requires a typed confirmation. Zero disables
+	// the typed confirmation.
+	confirmThreshold = 20
+
+	// forceFleet is a global variable determining whether the typed
+	// confirmation of destructive commands affecting many VMs is skipped
+	forceFleet bool
+)
+
+// confirm displays a prompt `s` to the user and returns a bool indicating
+// yes / no. If the lowercased, trimmed input begins with anything other than
+// 'y', it returns false. It accepts an int `tries` representing the number of
+// attempts before returning false
+func confirm(s string, tries int) bool {
+	r := bufio.NewReader(os.Stdin)
+
+	for ; tries > 0; tries-- {
+		fmt.Printf("%s [y/n]: ", s)
+
+		res, err := r.ReadString('\n')
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		// Empty input (i.e. "\n")
+		if len(res) < 2 {
+			continue
+		}
+
+		return strings.ToLower(strings.TrimSpace(res))[0] == 'y'
+	}
+
+	return false
+}
+
+// confirmFleet asks the user to confirm the given destructive action on the
+// given number of VMs by typing the number of VMs, if it exceeds the
+// confirmation threshold. Unlike confirm, this cannot be skipped with -y, but
+// only with --force. It returns whether the action may proceed.
+func confirmFleet(action string, count int) bool {
+	if confirmThreshold <= 0 || count <= confirmThreshold {
+		return true
+	}
+
+	if forceFleet {
+		logger.Warnf("%s affects %d VMs, proceeding due to --force", action,
+			count)
+		return true
+	}
+
+	prompt := fmt.Sprintf("%s would affect %d VMs, which is more than %d. "+
+		"Type the number of affected VMs to continue", action, count,
+		confirmThreshold)
+	return confirmPhrase(os.Stdin, os.Stdout, prompt, strconv.Itoa(count), 3)
+}
+
+// confirmPhrase displays the prompt on w and reads lines from r until a line
+// matches the given phrase. It returns false if no line matched within the
+// given number of tries or if no more input is available, e.g. because the
+// input is not a terminal.
+func confirmPhrase(r io.Reader, w io.Writer, prompt string, phrase string,
+	tries int) bool {
+	reader := bufio.NewReader(r)
+
+	for ; tries > 0; tries-- {
+		fmt.Fprintf(w, "%s: ", prompt)
+
+		res, err := reader.ReadString('\n')
+		if strings.TrimSpace(res) == phrase {
+			return true
+		}
+		if err != nil {
+			fmt.Fprintln(w, "")
+			return false
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestConfirmPhrase(t *testing.T) {
+	var out bytes.Buffer
+	require.True(t, confirmPhrase(strings.NewReader("42\n"), &out, "Type 42",
+		"42", 3))
+	require.Equal(t, "Type 42: ", out.String())
+
+	// a simple yes is not enough
+	require.False(t, confirmPhrase(strings.NewReader("y\nyes\n"), &out,
+		"Type 42", "42", 3))
+
+	// the phrase may follow wrong answers within the tries
+	require.True(t, confirmPhrase(strings.NewReader("y\n 42 \n"), &out,
+		"Type 42", "42", 3))
+	require.False(t, confirmPhrase(strings.NewReader("1\n2\n3\n42\n"), &out,
+		"Type 42", "42", 3))
+
+	// no input at all, e.g. in a cron job
+	require.False(t, confirmPhrase(strings.NewReader(""), &out, "Type 42",
+		"42", 3))
+	require.True(t, confirmPhrase(strings.NewReader("42"), &out, "Type 42",
+		"42", 3))
+}
+
+func TestConfirmFleet(t *testing.T) {
+	defer func(threshold int, force bool, l *zap.SugaredLogger) {
+		confirmThreshold = threshold
+		forceFleet = force
+		logger = l
+	}(confirmThreshold, forceFleet, logger)
+	logger = zap.NewNop().Sugar()
+
+	confirmThreshold = 20
+	forceFleet = false
+	require.True(t, confirmFleet("clean", 20))
+
+	confirmThreshold = 0
+	require.True(t, confirmFleet("clean", 1000))
+
+	confirmThreshold = 20
+	forceFleet = true
+	require.True(t, confirmFleet("clean", 1000))
+}
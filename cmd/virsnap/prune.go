@@ -0,0 +1,100 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"github.com/joroec/virsnap/pkg/virt"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// metadataDir is a global variable determining the directory in which
+	// libvirt stores the snapshot metadata.
+	metadataDir = virt.DefaultSnapshotMetadataDir
+
+	// pruneMetadataCmd is a global variable defining the corresponding cobra
+	// command
+	pruneMetadataCmd = &cobra.Command{
+		Use:   "prune-metadata [-y] [--metadata-dir <dir>]",
+		Short: "Remove snapshot metadata of VMs that are not defined anymore",
+		Long: "Find snapshot metadata that is not associated with any VM " +
+			"currently defined in libvirt, e.g. because the VM was undefined " +
+			"without removing its snapshots. Since libvirt offers no way to access " +
+			"the snapshots of undefined VMs, the metadata directory of libvirt " +
+			"(default: " + virt.DefaultSnapshotMetadataDir + ") is inspected " +
+			"directly, so this command only works on the host running libvirt " +
+			"and refuses any connection other than qemu:///system. VMs that " +
+			"are defined, running or transient are never considered orphaned. " +
+			"Without -y, the orphaned metadata is only reported. With -y, the " +
+			"metadata files are removed. Disk images are never touched.",
+		Args: cobra.NoArgs,
+		Run:  pruneMetadataRun,
+	}
+)
+
+// init is a special golang function that is called exactly once regardless
+// how often the package is imported.
+func init() {
+	// initialize flags and arguments needed for this command
+	pruneMetadataCmd.Flags().BoolVarP(&assumeYes, "assume-yes", "y", false,
+		"Remove the orphaned snapshot metadata instead of only reporting it.")
+
+	pruneMetadataCmd.Flags().StringVar(&metadataDir, "metadata-dir",
+		metadataDir, "Directory in which libvirt stores the snapshot metadata.")
+
+	// add command to root command so that cobra works as expected
+	RootCmd.AddCommand(pruneMetadataCmd)
+}
+
+// pruneMetadataRun reports and removes orphaned snapshot metadata.
+func pruneMetadataRun(cmd *cobra.Command, args []string) {
+	lck := acquireLock()
+	defer lck.Release()
+
+	orphans, err := virt.ListOrphanedSnapshotMetadata(logger, socketURL,
+		metadataDir)
+	if err != nil {
+		logger.Fatalf("unable to find orphaned snapshot metadata: %s", err)
+	}
+
+	if len(orphans) == 0 {
+		logger.Info("no orphaned snapshot metadata found")
+		return
+	}
+
+	// a boolean indicating whether at least one error occured. Useful for
+	// the exit code of the program after iterating over the metadata.
+	failed := false
+
+	for _, orphan := range orphans {
+		logger.Infof("found %d snapshot metadata files of undefined VM '%s' in '%s'",
+			len(orphan.Files),
+			orphan.Domain,
+			orphan.Dir,
+		)
+
+		if !assumeYes {
+			continue
+		}
+
+		err = orphan.Remove()
+		if err != nil {
+			logger.Error(err)
+			failed = true
+			continue
+		}
+		logger.Infof("removed snapshot metadata of undefined VM '%s'",
+			orphan.Domain)
+	}
+
+	if !assumeYes {
+		logger.Info("run again with -y to remove the orphaned snapshot metadata")
+	}
+
+	if failed {
+		logger.Fatal("prune-metadata process failed due to errors")
+	}
+}
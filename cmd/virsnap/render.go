@@ -0,0 +1,350 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/bclicn/color"
+	"github.com/joroec/virsnap/pkg/virt"
+	"github.com/olekukonko/tablewriter"
+	"gopkg.in/yaml.v3"
+)
+
+// snapshotUnparseable is the state shown for snapshots whose metadata cannot
+// be parsed.
+const snapshotUnparseable = "unparseable"
+
+// VMView is the data of a VM shown by list. It is independent of libvirt, so
+// that the output can be rendered without a connection.
+type VMView struct {
+	// Name is the name of the VM.
+	Name string
+
+	// State is the human-readable current state of the VM.
+	State string
+
+	// Snapshots are the snapshots of the VM in the order they are shown.
+	Snapshots []SnapshotView
+
+	// LastExport is the time of the last successful export of the VM. Zero if
+	// the VM was never exported.
+	LastExport time.Time
+
+	// Agent is the status of the guest agent of the VM. Empty if the agent was
+	// not probed.
+	Agent virt.AgentStatus
+}
+
+// SnapshotView is the data of a snapshot shown by list.
+type SnapshotView struct {
+	// Name is the name of the snapshot.
+	Name string
+
+	// CreationTime is the creation time of the snapshot in seconds since the
+	// epoch, as stored by libvirt.
+	CreationTime string
+
+	// State is the state of the VM at the time of the snapshot, "unmanaged"
+	// for snapshots libvirt has no metadata for or "unparseable" for snapshots
+	// whose metadata cannot be parsed.
+	State string
+
+	// Description is the description of the snapshot.
+	Description string
+}
+
+// RenderOptions bundles the settings of RenderVMTable.
+type RenderOptions struct {
+	// TimeFormat is the format of the creation times.
+	TimeFormat virt.TimeFormat
+
+	// Now is the reference time of relative creation times.
+	Now time.Time
+
+	// Descriptions determines whether the descriptions of the snapshots are
+	// shown in an additional column.
+	Descriptions bool
+
+	// LastBackup determines whether the time of the last successful export of
+	// each VM is shown in its header line.
+	LastBackup bool
+
+	// Agent determines whether the status of the guest agent of each VM is
+	// shown in its header line.
+	Agent bool
+}
+
+// newVMView returns the view of the given VM in the given state with the given
+// snapshots.
+func newVMView(vm *virt.VM, state string, snapshots []virt.Snapshot) VMView {
+	view := VMView{
+		Name:      vm.Descriptor.Name,
+		State:     state,
+		Snapshots: make([]SnapshotView, 0, len(snapshots)),
+	}
+
+	if lastExport, ok := vm.LastExport(); ok {
+		view.LastExport = lastExport
+	}
+
+	for _, snapshot := range snapshots {
+		// unmanaged snapshots have no libvirt metadata about the VM state
+		state := snapshot.Descriptor.State
+		switch {
+		case snapshot.Unmanaged:
+			state = "unmanaged"
+		case snapshot.Unparseable:
+			state = snapshotUnparseable
+		}
+
+		view.Snapshots = append(view.Snapshots, SnapshotView{
+			Name:         snapshot.Descriptor.Name,
+			CreationTime: snapshot.Descriptor.CreationTime,
+			State:        state,
+			Description:  snapshot.Descriptor.Description,
+		})
+	}
+	return view
+}
+
+// RenderVMTable writes a header line and a table of the snapshots of each of
+// the given VMs to w, separated by an empty line. VMs without snapshots are
+// rendered without table. Snapshots with an unparsable creation time are
+// omitted from the table; an error for each of them is returned.
+func RenderVMTable(w io.Writer, vms []VMView, opts RenderOptions) []error {
+	var errs []error
+
+	for index, vm := range vms {
+		if index > 0 {
+			fmt.Fprintln(w, "")
+		}
+
+		details := fmt.Sprintf("current state: %s, %d snapshots total", vm.State,
+			len(vm.Snapshots))
+		if opts.LastBackup {
+			lastBackup := "never"
+			if !vm.LastExport.IsZero() {
+				lastBackup = opts.TimeFormat.Format(vm.LastExport, opts.Now)
+			}
+			details += ", last backup: " + lastBackup
+		}
+		if opts.Agent {
+			details += ", guest agent: " + string(vm.Agent)
+		}
+		fmt.Fprintf(w, "%s (%s)\n", color.BGreen(vm.Name), details)
+
+		// print no snapshot table if there are no snapshots for this VM
+		if len(vm.Snapshots) == 0 {
+			continue
+		}
+
+		table := tablewriter.NewWriter(w)
+		header := []string{"Snapshot", "Time", "State"}
+		if opts.Descriptions {
+			header = append(header, "Description")
+		}
+		table.SetHeader(header)
+		table.SetRowLine(false)
+
+		for _, snapshot := range vm.Snapshots {
+			// the creation time of an unparseable snapshot is unknown, but the
+			// snapshot is shown anyway so that it does not go unnoticed
+			if snapshot.State == snapshotUnparseable {
+				row := []string{snapshot.Name, "unknown", snapshot.State}
+				if opts.Descriptions {
+					row = append(row, "")
+				}
+				table.Append(row)
+				continue
+			}
+
+			// convert timestamp to human-readable format
+			seconds, err := strconv.ParseInt(snapshot.CreationTime, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("skipping snapshot '%s' of VM '%s': "+
+					"unable to parse creation time: %s", snapshot.Name, vm.Name, err))
+				continue
+			}
+			created := time.Unix(seconds, 0)
+
+			// append the table row for this snapshot
+			row := []string{snapshot.Name, opts.TimeFormat.Format(created, opts.Now),
+				snapshot.State}
+			if opts.Descriptions {
+				row = append(row, virt.ParseDescription(snapshot.Description).String())
+			}
+			table.Append(row)
+		}
+
+		table.Render()
+	}
+
+	return errs
+}
+
+// RenderVMCSV writes a header row and one row per VM to w in CSV format, e.g.
+// for importing into a spreadsheet. Each row contains the name and state of
+// the VM, the number of its snapshots and the creation times of the oldest and
+// the newest snapshot, which are empty for VMs without snapshots. The columns
+// last_backup and agent are added like the details of RenderVMTable. Snapshots
+// with an unparsable creation time are counted, but their time is ignored; an
+// error for each of them is returned.
+func RenderVMCSV(w io.Writer, vms []VMView, opts RenderOptions) ([]error,
+	error) {
+	var errs []error
+
+	writer := csv.NewWriter(w)
+	header := []string{"vm", "state", "snapshots", "oldest", "newest"}
+	if opts.LastBackup {
+		header = append(header, "last_backup")
+	}
+	if opts.Agent {
+		header = append(header, "agent")
+	}
+	err := writer.Write(header)
+	if err != nil {
+		return errs, err
+	}
+
+	for _, vm := range vms {
+		var oldest, newest time.Time
+		for _, snapshot := range vm.Snapshots {
+			if snapshot.State == snapshotUnparseable {
+				continue
+			}
+
+			seconds, err := strconv.ParseInt(snapshot.CreationTime, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("ignoring creation time of snapshot "+
+					"'%s' of VM '%s': %s", snapshot.Name, vm.Name, err))
+				continue
+			}
+
+			created := time.Unix(seconds, 0)
+			if oldest.IsZero() || created.Before(oldest) {
+				oldest = created
+			}
+			if created.After(newest) {
+				newest = created
+			}
+		}
+
+		row := []string{vm.Name, vm.State, strconv.Itoa(len(vm.Snapshots)),
+			formatOptionalTime(oldest, opts), formatOptionalTime(newest, opts)}
+		if opts.LastBackup {
+			row = append(row, formatOptionalTime(vm.LastExport, opts))
+		}
+		if opts.Agent {
+			row = append(row, string(vm.Agent))
+		}
+		err = writer.Write(row)
+		if err != nil {
+			return errs, err
+		}
+	}
+
+	writer.Flush()
+	return errs, writer.Error()
+}
+
+// formatOptionalTime formats the given time according to the options or
+// returns an empty string for the zero time.
+func formatOptionalTime(t time.Time, opts RenderOptions) string {
+	if t.IsZero() {
+		return ""
+	}
+	return opts.TimeFormat.Format(t, opts.Now)
+}
+
+// vmDocument is a VM in the JSON and YAML output of list.
+type vmDocument struct {
+	Name       string             `json:"name" yaml:"name"`
+	State      string             `json:"state" yaml:"state"`
+	LastBackup *time.Time         `json:"last_backup,omitempty" yaml:"last_backup,omitempty"`
+	Agent      virt.AgentStatus   `json:"agent,omitempty" yaml:"agent,omitempty"`
+	Snapshots  []snapshotDocument `json:"snapshots" yaml:"snapshots"`
+}
+
+// snapshotDocument is a snapshot in the JSON and YAML output of list.
+type snapshotDocument struct {
+	Name string `json:"name" yaml:"name"`
+
+	// CreationTime is the creation time of the snapshot as seconds since the
+	// unix epoch, as stored by libvirt. Empty if unknown.
+	CreationTime string `json:"creation_time" yaml:"creation_time"`
+
+	State       string `json:"state" yaml:"state"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+}
+
+// RenderVMDocument writes the given VMs to w as a single JSON or, if asYAML
+// is set, YAML document. The creation times are kept as stored by libvirt, so
+// that the document can be processed by other tools independently of the time
+// format. The last backup and the status of the guest agent are included like
+// the details of RenderVMTable, the descriptions with opts.Descriptions.
+func RenderVMDocument(w io.Writer, vms []VMView, opts RenderOptions,
+	asYAML bool) error {
+	documents := make([]vmDocument, 0, len(vms))
+	for _, vm := range vms {
+		document := vmDocument{
+			Name:      vm.Name,
+			State:     vm.State,
+			Snapshots: make([]snapshotDocument, 0, len(vm.Snapshots)),
+		}
+		if opts.LastBackup && !vm.LastExport.IsZero() {
+			lastExport := vm.LastExport.UTC()
+			document.LastBackup = &lastExport
+		}
+		if opts.Agent {
+			document.Agent = vm.Agent
+		}
+
+		for _, snapshot := range vm.Snapshots {
+			entry := snapshotDocument{
+				Name:         snapshot.Name,
+				CreationTime: snapshot.CreationTime,
+				State:        snapshot.State,
+			}
+			if opts.Descriptions {
+				entry.Description = snapshot.Description
+			}
+			document.Snapshots = append(document.Snapshots, entry)
+		}
+		documents = append(documents, document)
+	}
+
+	if asYAML {
+		return writeYAML(w, documents)
+	}
+
+	output, err := json.MarshalIndent(documents, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode VMs: %s", err)
+	}
+	output = append(output, '\n')
+
+	_, err = w.Write(output)
+	return err
+}
+
+// writeYAML writes the given value to w as a YAML document indented by two
+// spaces like the JSON documents.
+func writeYAML(w io.Writer, value interface{}) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+
+	err := encoder.Encode(value)
+	if err != nil {
+		return fmt.Errorf("unable to encode YAML: %s", err)
+	}
+	return encoder.Close()
+}
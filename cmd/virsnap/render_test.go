@@ -0,0 +1,265 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/joroec/virsnap/pkg/virt"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+// update determines whether the golden files are rewritten with the current
+// output instead of being compared with it.
+var update = flag.Bool("update", false, "update the golden files")
+
+// ansiEscape matches the color escape sequences, which are not stored in the
+// golden files.
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// testNow is the reference time of the relative creation times.
+var testNow = time.Unix(1563086270, 0)
+
+// ago returns the creation time of a snapshot created d before testNow.
+func ago(d time.Duration) string {
+	return strconv.FormatInt(testNow.Add(-d).Unix(), 10)
+}
+
+// requireGolden compares the given output without colors with the golden file
+// of the given name.
+func requireGolden(t *testing.T, name string, output []byte) {
+	output = ansiEscape.ReplaceAll(output, nil)
+	golden := filepath.Join("testdata", name+".golden")
+
+	if *update {
+		require.NoError(t, ioutil.WriteFile(golden, output, 0644))
+	}
+
+	expected, err := ioutil.ReadFile(golden)
+	require.NoError(t, err)
+	require.Equal(t, string(expected), string(output))
+}
+
+func TestRenderVMTable(t *testing.T) {
+	day := 24 * time.Hour
+	structured, err := virt.Description{
+		Summary: "backup",
+		Trigger: virt.TriggerScheduled,
+	}.Encode()
+	require.NoError(t, err)
+
+	testvm := VMView{
+		Name:  "testvm",
+		State: "DOMAIN_RUNNING",
+		Snapshots: []SnapshotView{
+			{
+				Name:         "virsnap_angry_hypatia",
+				CreationTime: ago(3 * day),
+				State:        "shutoff",
+				Description:  "snapshot created by virnsnap",
+			},
+			{
+				Name:         "virsnap_hardcore_galileo",
+				CreationTime: ago(43 * time.Hour),
+				State:        "shutoff",
+				Description:  structured,
+			},
+			{
+				Name:         "before-upgrade",
+				CreationTime: ago(2 * time.Hour),
+				State:        "running",
+			},
+			{
+				Name:         "manual",
+				CreationTime: ago(30 * time.Second),
+				State:        "unmanaged",
+			},
+		},
+	}
+
+	emptyvm := VMView{
+		Name:  "emptyvm",
+		State: "DOMAIN_SHUTOFF",
+	}
+
+	opts := RenderOptions{
+		TimeFormat: virt.TimeFormatRelative,
+		Now:        testNow,
+	}
+
+	t.Run("TestNoSnapshots", func(t *testing.T) {
+		var buf bytes.Buffer
+		errs := RenderVMTable(&buf, []VMView{emptyvm}, opts)
+		require.Empty(t, errs)
+		requireGolden(t, "list_empty", buf.Bytes())
+	})
+
+	t.Run("TestManySnapshots", func(t *testing.T) {
+		var buf bytes.Buffer
+		errs := RenderVMTable(&buf, []VMView{testvm, emptyvm}, opts)
+		require.Empty(t, errs)
+		requireGolden(t, "list_many", buf.Bytes())
+	})
+
+	t.Run("TestInvalidTime", func(t *testing.T) {
+		invalid := testvm
+		invalid.Snapshots = []SnapshotView{
+			testvm.Snapshots[0],
+			{
+				Name:         "broken",
+				CreationTime: "yesterday",
+				State:        "shutoff",
+			},
+		}
+
+		var buf bytes.Buffer
+		errs := RenderVMTable(&buf, []VMView{invalid}, opts)
+		require.Len(t, errs, 1)
+		require.Contains(t, errs[0].Error(), "'broken'")
+		requireGolden(t, "list_invalid_time", buf.Bytes())
+	})
+
+	t.Run("TestUnparseable", func(t *testing.T) {
+		unparseable := testvm
+		unparseable.Snapshots = []SnapshotView{
+			{
+				Name:  "virsnap_broken_metadata",
+				State: snapshotUnparseable,
+			},
+			testvm.Snapshots[0],
+		}
+
+		var buf bytes.Buffer
+		errs := RenderVMTable(&buf, []VMView{unparseable}, opts)
+		require.Empty(t, errs)
+		requireGolden(t, "list_unparseable", buf.Bytes())
+	})
+
+	t.Run("TestDescriptions", func(t *testing.T) {
+		described := testvm
+		described.Snapshots = testvm.Snapshots[:2]
+
+		withDescriptions := opts
+		withDescriptions.Descriptions = true
+
+		var buf bytes.Buffer
+		errs := RenderVMTable(&buf, []VMView{described}, withDescriptions)
+		require.Empty(t, errs)
+		requireGolden(t, "list_descriptions", buf.Bytes())
+	})
+
+	t.Run("TestLastBackup", func(t *testing.T) {
+		backedup := emptyvm
+		backedup.Name = "backedup"
+		backedup.LastExport = testNow.Add(-2 * day)
+
+		withLastBackup := opts
+		withLastBackup.LastBackup = true
+
+		var buf bytes.Buffer
+		errs := RenderVMTable(&buf, []VMView{emptyvm, backedup}, withLastBackup)
+		require.Empty(t, errs)
+		requireGolden(t, "list_last_backup", buf.Bytes())
+	})
+
+	t.Run("TestAgent", func(t *testing.T) {
+		running := emptyvm
+		running.Name = "runningvm"
+		running.State = "DOMAIN_RUNNING"
+		running.Agent = virt.AgentReachable
+
+		stopped := emptyvm
+		stopped.Agent = virt.AgentNotApplicable
+
+		withAgent := opts
+		withAgent.Agent = true
+
+		var buf bytes.Buffer
+		errs := RenderVMTable(&buf, []VMView{running, stopped}, withAgent)
+		require.Empty(t, errs)
+		requireGolden(t, "list_agent", buf.Bytes())
+	})
+
+	t.Run("TestCSV", func(t *testing.T) {
+		backedup := testvm
+		backedup.Snapshots = append([]SnapshotView{{
+			Name:  "virsnap_broken_metadata",
+			State: snapshotUnparseable,
+		}}, testvm.Snapshots...)
+		backedup.LastExport = testNow.Add(-2 * day)
+		backedup.Agent = virt.AgentReachable
+
+		stopped := emptyvm
+		stopped.Agent = virt.AgentNotApplicable
+
+		withDetails := opts
+		withDetails.LastBackup = true
+		withDetails.Agent = true
+
+		var buf bytes.Buffer
+		errs, err := RenderVMCSV(&buf, []VMView{backedup, stopped}, withDetails)
+		require.NoError(t, err)
+		require.Empty(t, errs)
+		requireGolden(t, "list_csv", buf.Bytes())
+	})
+
+	t.Run("TestDocument", func(t *testing.T) {
+		backedup := testvm
+		backedup.Snapshots = []SnapshotView{testvm.Snapshots[0],
+			testvm.Snapshots[3]}
+		backedup.LastExport = testNow.Add(-2 * day)
+		backedup.Agent = virt.AgentReachable
+
+		withDetails := opts
+		withDetails.Descriptions = true
+		withDetails.LastBackup = true
+		withDetails.Agent = true
+
+		var buf bytes.Buffer
+		vms := []VMView{backedup, emptyvm}
+		require.NoError(t, RenderVMDocument(&buf, vms, withDetails, false))
+		requireGolden(t, "list_json", buf.Bytes())
+
+		buf.Reset()
+		require.NoError(t, RenderVMDocument(&buf, vms, withDetails, true))
+		requireGolden(t, "list_yaml", buf.Bytes())
+	})
+
+	t.Run("TestDocumentRoundTrip", func(t *testing.T) {
+		quoted := testvm
+		quoted.Name = "yes"
+		quoted.Snapshots = []SnapshotView{testvm.Snapshots[0]}
+		quoted.Snapshots[0].Name = "- virsnap: 1"
+		quoted.Snapshots[0].Description = "first line\nsecond line\n"
+
+		withDescriptions := opts
+		withDescriptions.Descriptions = true
+
+		var buf bytes.Buffer
+		vms := []VMView{quoted}
+		require.NoError(t, RenderVMDocument(&buf, vms, withDescriptions, true))
+
+		var documents []vmDocument
+		require.NoError(t, yaml.Unmarshal(buf.Bytes(), &documents))
+		require.Len(t, documents, 1)
+		require.Equal(t, "yes", documents[0].Name)
+		require.Len(t, documents[0].Snapshots, 1)
+		require.Equal(t, quoted.Snapshots[0].Name,
+			documents[0].Snapshots[0].Name)
+		require.Equal(t, quoted.Snapshots[0].CreationTime,
+			documents[0].Snapshots[0].CreationTime)
+		require.Equal(t, quoted.Snapshots[0].Description,
+			documents[0].Snapshots[0].Description)
+	})
+}
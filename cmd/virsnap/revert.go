@@ -0,0 +1,167 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/joroec/virsnap/pkg/virt"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// revertLatest is a global variable determining whether the VMs should be
+	// reverted to their most recent snapshot instead of a named one
+	revertLatest bool
+
+	// revertCmd is a global variable defining the corresponding cobra command
+	revertCmd = &cobra.Command{
+		Use:   "revert <vm_regex> (<snapshot_name> | --latest)",
+		Short: "Revert one or more virtual machines to a snapshot",
+		Long: "Revert any found virtual machine with a name matching the given " +
+			"regular expression to the snapshot with the given name, or with " +
+			"--latest to its most recently created snapshot. The current state " +
+			"of the disks and, if running, the memory of the VM is lost, so each " +
+			"revert needs to be confirmed unless -y is given. The VM is left in " +
+			"the state recorded in the snapshot. For example, 'virsnap revert " +
+			"--latest \"^testing$\"' undoes all changes to the VM \"testing\" " +
+			"since its last snapshot.",
+		Args:        revertArgs,
+		Annotations: map[string]string{regexArgsAnnotation: "1"},
+		Run:         revertRun,
+	}
+)
+
+// init is a special golang function that is called exactly once regardless
+// how often the package is imported.
+func init() {
+	// initialize flags and arguments needed for this command
+	revertCmd.Flags().BoolVar(&revertLatest, "latest", false, "Revert to the "+
+		"most recently created snapshot of each VM. Cannot be combined with a "+
+		"snapshot name.")
+
+	revertCmd.Flags().BoolVarP(&assumeYes, "assume-yes", "y", false, "Do not "+
+		"ask for confirmation before reverting a VM. Useful for automated "+
+		"execution.")
+
+	revertCmd.Flags().IntVar(&confirmThreshold, "confirm-threshold",
+		confirmThreshold, "Number of matching VMs above which the number of "+
+			"VMs needs to be typed to confirm the revert, even with -y. 0 "+
+			"disables the typed confirmation.")
+
+	revertCmd.Flags().BoolVar(&forceFleet, "force", false, "Skip the typed "+
+		"confirmation required if more VMs than --confirm-threshold match.")
+
+	// add command to root command so that cobra works as expected
+	RootCmd.AddCommand(revertCmd)
+}
+
+// revertArgs checks that either a snapshot name or --latest is given.
+func revertArgs(cmd *cobra.Command, args []string) error {
+	err := cobra.RangeArgs(1, 2)(cmd, args)
+	if err != nil {
+		return err
+	}
+
+	if revertLatest && len(args) == 2 {
+		return fmt.Errorf("--latest cannot be combined with the snapshot name "+
+			"'%s'", args[1])
+	}
+	if !revertLatest && len(args) == 1 {
+		return fmt.Errorf("either a snapshot name or --latest must be specified")
+	}
+	return nil
+}
+
+// revertRun takes as parameter the regular expression of the names of the
+// VMs and the name of the snapshot to revert to, unless --latest is given
+func revertRun(cmd *cobra.Command, args []string) {
+	lck := acquireLock()
+	defer lck.Release()
+
+	vms, err := virt.ListMatchingVMs(logger, args[:1], socketURL)
+	if err != nil {
+		logger.Fatalf("unable to retrieve virtual machines: %s", err)
+	}
+
+	defer virt.FreeVMs(logger, vms)
+
+	if len(vms) == 0 {
+		logger.Fatal(errNoVMsMatchingRegex)
+	}
+
+	if !confirmFleet("revert", len(vms)) {
+		logger.Fatal("revert of many VMs was not confirmed")
+	}
+
+	// a boolean indicating whether at least one error occured. Useful for
+	// the exit code of the program after iterating over the virtual machines.
+	failed := false
+
+	for _, vm := range vms {
+		vmLog := vmLogger(&vm)
+
+		snapshot, err := revertTarget(&vm, args)
+		if err != nil {
+			vmLog.Errorf("skipping VM '%s': %s", vm.Descriptor.Name, err)
+			failed = true
+			continue
+		}
+
+		if !assumeYes {
+			question := fmt.Sprintf("Revert VM '%s' to snapshot '%s'? The "+
+				"current state of the VM is lost.", vm.Descriptor.Name,
+				snapshot.Descriptor.Name)
+			if !confirm(question, 10) {
+				vmLog.Infof("skipping VM '%s': revert was not confirmed",
+					vm.Descriptor.Name)
+				virt.FreeSnapshots(vmLog, []virt.Snapshot{snapshot})
+				continue
+			}
+		}
+
+		err = vm.RevertToSnapshot(&snapshot)
+		virt.FreeSnapshots(vmLog, []virt.Snapshot{snapshot})
+		if err != nil {
+			vmLog.Error(err)
+			failed = true
+			continue
+		}
+
+		vmLog.Infof("reverted VM '%s' to snapshot '%s'", vm.Descriptor.Name,
+			snapshot.Descriptor.Name)
+	}
+
+	if failed {
+		logger.Fatal("revert process failed due to errors")
+	}
+}
+
+// revertTarget returns the snapshot the given VM should be reverted to, i.e.
+// the latest snapshot with --latest or the snapshot named by the second
+// argument. The caller is responsible for calling Free on the snapshot.
+func revertTarget(vm *virt.VM, args []string) (virt.Snapshot, error) {
+	if revertLatest {
+		return vm.LatestSnapshot()
+	}
+
+	snapshotRegex := "^" + regexp.QuoteMeta(args[1]) + "$"
+	snapshots, err := vm.ListMatchingSnapshots([]string{snapshotRegex})
+	if err != nil {
+		return virt.Snapshot{}, fmt.Errorf("unable to retrieve snapshots: %s",
+			err)
+	}
+
+	if len(snapshots) == 0 {
+		return virt.Snapshot{}, fmt.Errorf("snapshot '%s' does not exist",
+			args[1])
+	}
+
+	// snapshot names are unique per VM
+	virt.FreeSnapshots(vm.Logger, snapshots[1:])
+	return snapshots[0], nil
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevertArgs(t *testing.T) {
+	defer func(latest bool) {
+		revertLatest = latest
+	}(revertLatest)
+
+	revertLatest = false
+	require.NoError(t, revertArgs(revertCmd, []string{"^testvm$",
+		"virsnap_angry_hypatia"}))
+	require.Error(t, revertArgs(revertCmd, []string{"^testvm$"}))
+
+	revertLatest = true
+	require.NoError(t, revertArgs(revertCmd, []string{"^testvm$"}))
+	err := revertArgs(revertCmd, []string{"^testvm$", "virsnap_angry_hypatia"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "--latest")
+
+	require.Error(t, revertArgs(revertCmd, nil))
+}
@@ -8,10 +8,17 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/joroec/virsnap/pkg/instrument/log"
+	"github.com/joroec/virsnap/pkg/instrument/trace"
+	"github.com/joroec/virsnap/pkg/lock"
+	"github.com/joroec/virsnap/pkg/virt"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 var (
@@ -22,15 +29,122 @@ var (
 			"deletion of VM snapshots.",
 		Long: "virsnap is a small tool that eases the automated creation and " +
 			"deletion of VM snapshots.",
-		PersistentPreRun: initLogger,
+		PersistentPreRun:  initialize,
+		PersistentPostRun: flushTraces,
 	}
 
 	logger      *zap.SugaredLogger
 	logLevel    = "info"
 	logEncoding = "console"
-	socketURL   = "qemu:///system"
+	socketURL   = defaultSocketURL()
+
+	keepAliveInterval = virt.KeepAlive.Interval
+	keepAliveCount    = virt.KeepAlive.Count
+
+	lockFile = defaultLockFile()
+	noWait   bool
+
+	timeFormatFlag = string(virt.TimeFormatDefault)
+	timeFormat     virt.TimeFormat
+
+	traceEndpoint string
 )
 
+// defaultSocketURL returns the libvirt socket URL used if no URL is specified
+// on the command line. Like virsh, the environment variable
+// LIBVIRT_DEFAULT_URI is honored. VIRSNAP_URI takes precedence over it, so
+// that virsnap can be pointed to another host than virsh.
+func defaultSocketURL() string {
+	for _, name := range []string{"VIRSNAP_URI", "LIBVIRT_DEFAULT_URI"} {
+		if uri := os.Getenv(name); uri != "" {
+			return uri
+		}
+	}
+	return "qemu:///system"
+}
+
+// defaultLockFile returns the lock file used if no lock file is specified on
+// the command line. Only root may write to /var/run, so other users, e.g.
+// managing their VMs with qemu:///session, get a lock file in their runtime
+// directory or, if it is not set, in the temporary directory.
+func defaultLockFile() string {
+	if os.Geteuid() == 0 {
+		return "/var/run/virsnap.lock"
+	}
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "virsnap.lock")
+}
+
+// initialize is run as PersistentPreRun of any command and applies the global
+// flags.
+func initialize(cmd *cobra.Command, args []string) {
+	// the configuration file may set the log level, so it is applied first
+	values, err := loadConfig()
+	if err == nil {
+		err = applyConfig(cmd, values)
+	}
+	if err != nil {
+		fmt.Printf("unable to load configuration: %s\n", err)
+		os.Exit(1)
+	}
+
+	initLogger(cmd, args)
+	initTracing()
+
+	format, err := virt.ParseTimeFormat(timeFormatFlag)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	timeFormat = format
+
+	virt.KeepAlive = virt.KeepAliveConfig{
+		Interval: keepAliveInterval,
+		Count:    keepAliveCount,
+	}
+
+	warnGlobbedArgs(cmd, args)
+}
+
+// regexArgsAnnotation is the key of a command annotation holding the number of
+// leading arguments of the command that are regular expressions. The following
+// arguments are not checked by warnGlobbedArgs. Without the annotation, all
+// arguments are regular expressions.
+const regexArgsAnnotation = "virsnap_regex_args"
+
+// warnGlobbedArgs warns about regular expression arguments that look like the
+// result of the shell expanding an unquoted pattern, e.g. "virsnap create *"
+// is run with the names of the files in the working directory as arguments.
+func warnGlobbedArgs(cmd *cobra.Command, args []string) {
+	if n, err := strconv.Atoi(cmd.Annotations[regexArgsAnnotation]); err == nil &&
+		n < len(args) {
+		args = args[:n]
+	}
+
+	for _, arg := range args {
+		if !looksGlobbed(arg) {
+			continue
+		}
+		logger.Warnf("argument '%s' is a path, not a regular expression. If the "+
+			"shell expanded an unquoted pattern, quote it, e.g. '.*' instead of "+
+			".*", arg)
+	}
+}
+
+// looksGlobbed determines whether the given argument looks like a path
+// produced by the shell instead of a regular expression: it names an existing
+// file or directory, or contains a path separator, which is unusual in VM and
+// snapshot names.
+func looksGlobbed(arg string) bool {
+	if strings.Contains(arg, "/") {
+		return true
+	}
+	_, err := os.Lstat(arg)
+	return err == nil
+}
+
 // initLogger initializes a logger according to provided flags or their default
 // values. This needs to be run as PersistenPreRun since those values
 // need to be set when application is started, not when the package is imported
@@ -50,6 +164,67 @@ func initLogger(cmd *cobra.Command, args []string) {
 	logger.Debugf("Logger initialized")
 }
 
+// initTracing exports the timing spans to the OTLP endpoint given with
+// --trace-endpoint, if any. The spans are sent when the command finishes or
+// right before the program terminates due to a fatal error.
+func initTracing() {
+	if traceEndpoint == "" {
+		return
+	}
+
+	exporter, err := trace.NewExporter(traceEndpoint)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	trace.DefaultExporter = exporter
+
+	hook := zap.Hooks(func(entry zapcore.Entry) error {
+		if entry.Level == zapcore.FatalLevel {
+			flushTraces(nil, nil)
+		}
+		return nil
+	})
+	logger = logger.Desugar().WithOptions(hook).Sugar()
+}
+
+// flushTraces is run as PersistentPostRun of any command and sends the spans
+// that were not exported yet. A collector that cannot be reached does not fail
+// the command.
+func flushTraces(cmd *cobra.Command, args []string) {
+	err := trace.DefaultExporter.Flush()
+	if err != nil {
+		logger.Warnf("unable to export trace spans: %s", err)
+	}
+}
+
+// vmLogger returns a child of the global logger that annotates every message
+// with the name of the given VM (field "vm"), so that the messages about
+// different VMs can be told apart, e.g. by filtering JSON logs. The returned
+// logger also replaces the logger of the VM, so that the messages logged by
+// package virt on behalf of the VM are annotated as well.
+func vmLogger(vm *virt.VM) *zap.SugaredLogger {
+	l := logger.With("vm", vm.Descriptor.Name)
+	vm.Logger = l
+	return l
+}
+
+// acquireLock acquires the lock preventing concurrent invocations of commands
+// that modify virtual machines or snapshots. The program terminates if the lock
+// cannot be acquired. The caller is responsible for calling Release on the
+// returned lock, usually with a "defer" statement.
+func acquireLock() *lock.Lock {
+	logger.Debugf("acquiring lock file '%s'", lockFile)
+	l, err := lock.Acquire(lockFile, !noWait)
+	if err == lock.ErrLocked {
+		logger.Fatalf("another virsnap process is running: lock file '%s' is "+
+			"held by another process", lockFile)
+	}
+	if err != nil {
+		logger.Fatal(err)
+	}
+	return l
+}
+
 // Execute runs the RootCmd.
 func Execute() {
 	if err := RootCmd.Execute(); err != nil {
@@ -64,5 +239,14 @@ func init() {
 	f := RootCmd.PersistentFlags()
 	f.StringVarP(&logLevel, "log-level", "l", logLevel, "sets the log level (debug, info, warn, error)")
 	f.StringVarP(&logEncoding, "log-encoding", "e", logEncoding, "sets the log encoding (console, json)")
-	f.StringVarP(&socketURL, "socket-url", "u", socketURL, "sets the libvirt socket URL to connect to")
+	f.StringVarP(&socketURL, "socket-url", "u", socketURL, "sets the libvirt socket URL to connect to, defaults to $VIRSNAP_URI or $LIBVIRT_DEFAULT_URI if set")
+	f.StringVarP(&socketURL, "connect", "c", socketURL, "alias for --socket-url, matching virsh")
+	f.IntVar(&keepAliveInterval, "keepalive-interval", keepAliveInterval, "sets the interval in seconds between keepalive messages sent to libvirt, 0 disables keepalive messages")
+	f.UintVar(&keepAliveCount, "keepalive-count", keepAliveCount, "sets the number of unanswered keepalive messages after which the connection is considered broken")
+	f.StringVar(&lockFile, "lock-file", lockFile, "sets the lock file preventing concurrent invocations of virsnap from modifying the same VMs, defaults to $XDG_RUNTIME_DIR/virsnap.lock for users other than root")
+	f.BoolVar(&noWait, "no-wait", noWait, "fail immediately instead of waiting if another virsnap process holds the lock file")
+	f.BoolVar(&virt.VerboseErrors, "verbose-libvirt", virt.VerboseErrors, "logs the code, domain and message of libvirt errors at debug level (use with --log-level debug)")
+	f.StringVar(&configFile, "config", configFile, "sets the configuration file holding defaults of the flags, defaults to ~/.config/virsnap/config.yaml")
+	f.StringVar(&traceEndpoint, "trace-endpoint", traceEndpoint, "sends the timing spans of connect, list, VM transitions, snapshots and disk syncs to the given OTLP/HTTP endpoint (e.g. http://localhost:4318) in addition to logging them at debug level")
+	f.StringVar(&timeFormatFlag, "time-format", timeFormatFlag, "sets the format of displayed timestamps (rfc3339, unix, relative or a Go time layout)")
 }
@@ -0,0 +1,213 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/bclicn/color"
+	"github.com/joroec/virsnap/pkg/virt"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// sizesTop is a global variable holding the number of the largest
+	// snapshots of all VMs to show. Zero shows all snapshots per VM.
+	sizesTop int
+
+	// sizesCmd is a global variable defining the corresponding cobra command
+	sizesCmd = &cobra.Command{
+		Use:   "sizes [<regex1>] [<regex2>] [<regex3>] ...",
+		Short: "List the estimated sizes of the snapshots of one or more VMs",
+		Long: "List the snapshots of any found virtual machine with a name " +
+			"matching at least one of the given regular expressions together with " +
+			"their estimated size and a total per VM, largest first, to find the " +
+			"snapshots worth cleaning up. If no regex is given, any accessible " +
+			"virtual machine is listed. The size of a snapshot is the VM state " +
+			"(memory and device state) saved with it in the qcow2 images of the " +
+			"VM, as reported by 'qemu-img info', which needs to be installed. The " +
+			"disk clusters only kept by a snapshot are not included, since qcow2 " +
+			"does not account them per snapshot, so snapshots of shut off VMs " +
+			"have a size of zero. The size of snapshots not stored in a qcow2 " +
+			"image (e.g. external snapshots) is shown as unknown. With --top, " +
+			"only the given number of largest snapshots of all VMs are listed in " +
+			"a single table.",
+		PreRunE: validateFlags(
+			nonNegativeFlag("top", &sizesTop),
+		),
+		Run: sizesRun,
+	}
+)
+
+// init is a special golang function that is called exactly once regardless
+// how often the package is imported.
+func init() {
+	// initialize flags and arguments needed for this command
+	sizesCmd.Flags().IntVar(&sizesTop, "top", 0, "Only list this many of the "+
+		"largest snapshots of all VMs. 0 lists all snapshots per VM.")
+
+	// add command to root command so that cobra works as expected
+	RootCmd.AddCommand(sizesCmd)
+}
+
+// vmSizes holds the estimated sizes of the snapshots of a VM.
+type vmSizes struct {
+	// Name is the name of the VM.
+	Name string
+
+	// Sizes are the sizes of the snapshots of the VM.
+	Sizes []virt.SnapshotSize
+}
+
+// total returns the sum of the known sizes and the number of unknown sizes.
+func (v vmSizes) total() (uint64, int) {
+	var total uint64
+	unknown := 0
+	for _, size := range v.Sizes {
+		if !size.Known {
+			unknown++
+			continue
+		}
+		total += size.Bytes
+	}
+	return total, unknown
+}
+
+// sizesRun is the function called after the command line parser detected
+// that we want to end up here.
+func sizesRun(cmd *cobra.Command, args []string) {
+	regexes := args
+	if len(regexes) == 0 {
+		regexes = []string{".*"}
+	}
+
+	vms, err := virt.ListMatchingVMs(logger, regexes, socketURL)
+	if err != nil {
+		logger.Fatalf("unable to retrieve virtual machines from libvirt: %s", err)
+	}
+
+	defer virt.FreeVMs(logger, vms)
+
+	if len(vms) == 0 {
+		logger.Fatal(errNoVMsMatchingRegex)
+	}
+
+	// a boolean indicating whether at least one error occured. Useful for
+	// the exit code of the program after iterating over the virtual machines.
+	failed := false
+
+	all := make([]vmSizes, 0, len(vms))
+	for _, vm := range vms {
+		vmLog := vmLogger(&vm)
+
+		snapshots, err := vm.ListMatchingSnapshots([]string{".*"})
+		if err != nil {
+			vmLog.Errorf("skipping VM '%s': unable to retrieve snapshots: %s",
+				vm.Descriptor.Name, err)
+			failed = true
+			continue
+		}
+
+		sizes := vm.SnapshotSizes(snapshots)
+		virt.FreeSnapshots(vmLog, snapshots)
+
+		all = append(all, vmSizes{
+			Name:  vm.Descriptor.Name,
+			Sizes: sizes,
+		})
+	}
+
+	if sizesTop > 0 {
+		renderTopSnapshotSizes(os.Stdout, all, sizesTop)
+	} else {
+		renderSnapshotSizes(os.Stdout, all)
+	}
+
+	if failed {
+		logger.Fatal("sizes process failed due to errors")
+	}
+}
+
+// formatSize returns the given size in a human-readable format or "unknown".
+func formatSize(size virt.SnapshotSize) string {
+	if !size.Known {
+		return "unknown"
+	}
+	return formatBytes(size.Bytes)
+}
+
+// renderSnapshotSizes writes a header line with the total size and a table of
+// the snapshots of each of the given VMs to w, largest first. The VMs are
+// sorted by their total size as well.
+func renderSnapshotSizes(w io.Writer, vms []vmSizes) {
+	sort.SliceStable(vms, func(i int, j int) bool {
+		totalI, _ := vms[i].total()
+		totalJ, _ := vms[j].total()
+		return totalI > totalJ
+	})
+
+	for index, vm := range vms {
+		if index > 0 {
+			fmt.Fprintln(w, "")
+		}
+
+		total, unknown := vm.total()
+		details := fmt.Sprintf("%d snapshots, total %s", len(vm.Sizes),
+			formatBytes(total))
+		if unknown > 0 {
+			details += fmt.Sprintf(", %d unknown", unknown)
+		}
+		fmt.Fprintf(w, "%s (%s)\n", color.BGreen(vm.Name), details)
+
+		if len(vm.Sizes) == 0 {
+			continue
+		}
+
+		virt.SortSnapshotSizes(vm.Sizes)
+
+		table := tablewriter.NewWriter(w)
+		table.SetHeader([]string{"Snapshot", "Size"})
+		table.SetRowLine(false)
+		for _, size := range vm.Sizes {
+			table.Append([]string{size.Snapshot, formatSize(size)})
+		}
+		table.Render()
+	}
+}
+
+// renderTopSnapshotSizes writes a single table of the given number of largest
+// snapshots of all given VMs to w. Snapshots of unknown size are not listed,
+// but counted below the table.
+func renderTopSnapshotSizes(w io.Writer, vms []vmSizes, top int) {
+	sizes := make([]virt.SnapshotSize, 0)
+	for _, vm := range vms {
+		sizes = append(sizes, vm.Sizes...)
+	}
+	virt.SortSnapshotSizes(sizes)
+
+	unknown := 0
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"VM", "Snapshot", "Size"})
+	table.SetRowLine(false)
+	for index, size := range sizes {
+		if !size.Known {
+			unknown++
+			continue
+		}
+		if index < top {
+			table.Append([]string{size.VM, size.Snapshot, formatSize(size)})
+		}
+	}
+	table.Render()
+
+	if unknown > 0 {
+		fmt.Fprintf(w, "snapshots of unknown size not listed: %d\n", unknown)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/joroec/virsnap/pkg/virt"
+)
+
+// testSizes returns the sizes of the snapshots of some VMs, not sorted.
+func testSizes() []vmSizes {
+	return []vmSizes{
+		{Name: "emptyvm"},
+		{
+			Name: "smallvm",
+			Sizes: []virt.SnapshotSize{
+				{
+					VM:       "smallvm",
+					Snapshot: "virsnap_gracious_turing",
+					Bytes:    512 << 20,
+					Known:    true,
+				},
+			},
+		},
+		{
+			Name: "bigvm",
+			Sizes: []virt.SnapshotSize{
+				{VM: "bigvm", Snapshot: "external"},
+				{VM: "bigvm", Snapshot: "virsnap_hardcore_galileo", Known: true},
+				{
+					VM:       "bigvm",
+					Snapshot: "virsnap_angry_hypatia",
+					Bytes:    1 << 30,
+					Known:    true,
+				},
+			},
+		},
+	}
+}
+
+func TestRenderSnapshotSizes(t *testing.T) {
+	var buf bytes.Buffer
+	renderSnapshotSizes(&buf, testSizes())
+	requireGolden(t, "sizes", buf.Bytes())
+}
+
+func TestRenderTopSnapshotSizes(t *testing.T) {
+	var buf bytes.Buffer
+	renderTopSnapshotSizes(&buf, testSizes(), 2)
+	requireGolden(t, "sizes_top", buf.Bytes())
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package main implements the handlers for the different command line arguments.
+package main
+
+import (
+	"github.com/joroec/virsnap/pkg/virt"
+	"github.com/libvirt/libvirt-go"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// startCmd is a global variable defining the corresponding cobra command
+	startCmd = &cobra.Command{
+		Use:   "start <regex1> [<regex2>] [<regex3>] ...",
+		Short: "Start one or more virtual machines",
+		Long: "Start any found virtual machine with a name matching at least " +
+			"one of the given regular expressions. Paused or pmsuspended virtual " +
+			"machines are resumed. For example, 'virsnap start \"testing\"' starts " +
+			"all virtual machines whose name includes \"testing\".",
+		Args:    cobra.MinimumNArgs(1),
+		PreRunE: validateFlags(positiveFlag("timeout", &timeout)),
+		Run:     stateRun(libvirt.DOMAIN_RUNNING),
+	}
+
+	// stopCmd is a global variable defining the corresponding cobra command
+	stopCmd = &cobra.Command{
+		Use:   "stop [-f] [-t <timeout>] <regex1> [<regex2>] [<regex3>] ...",
+		Short: "Shutdown one or more virtual machines",
+		Long: "Shutdown any found virtual machine with a name matching at least " +
+			"one of the given regular expressions. virsnap repeatedly asks the " +
+			"virtual machine to shutdown gracefully until the timeout expires. If " +
+			"-f is specified, the virtual machine is forced off afterwards. For " +
+			"example, 'virsnap stop -f \"testing\"' shuts down all virtual " +
+			"machines whose name includes \"testing\".",
+		Args:    cobra.MinimumNArgs(1),
+		PreRunE: validateFlags(positiveFlag("timeout", &timeout)),
+		Run:     stateRun(libvirt.DOMAIN_SHUTOFF),
+	}
+
+	// suspendCmd is a global variable defining the corresponding cobra command
+	suspendCmd = &cobra.Command{
+		Use:   "suspend <regex1> [<regex2>] [<regex3>] ...",
+		Short: "Suspend one or more virtual machines",
+		Long: "Suspend (pause) any found virtual machine with a name matching at " +
+			"least one of the given regular expressions. Shutoff virtual machines " +
+			"are booted before being suspended. For example, 'virsnap suspend " +
+			"\"testing\"' suspends all virtual machines whose name includes " +
+			"\"testing\".",
+		Args:    cobra.MinimumNArgs(1),
+		PreRunE: validateFlags(positiveFlag("timeout", &timeout)),
+		Run:     stateRun(libvirt.DOMAIN_PAUSED),
+	}
+)
+
+// init is a special golang function that is called exactly once regardless
+// how often the package is imported.
+func init() {
+	// initialize flags and arguments needed for the commands
+	for _, cmd := range []*cobra.Command{startCmd, stopCmd, suspendCmd} {
+		cmd.Flags().BoolVarP(&force, "force", "f", false, "Force the shutdown "+
+			"of the virtual machine if it does not shutdown gracefully within the "+
+			"timeout.")
+
+		cmd.Flags().IntVarP(&timeout, "timeout", "t", 3, "Timeout in minutes "+
+			"to wait for a virtual machine to shutdown gracefully before returning "+
+			"an error code or forcing the shutdown (flag -f).")
+
+		// add command to root command so that cobra works as expected
+		RootCmd.AddCommand(cmd)
+	}
+}
+
+// stateRun returns a function that transitions the VMs matching the regular
+// expressions given as parameters to the target state.
+func stateRun(to libvirt.DomainState) func(*cobra.Command, []string) {
+	return func(cmd *cobra.Command, args []string) {
+		lck := acquireLock()
+		defer lck.Release()
+
+		vms, err := virt.ListMatchingVMs(logger, args, socketURL)
+		if err != nil {
+			logger.Fatalf("unable to retrieve virtual machines: %s", err)
+		}
+
+		defer virt.FreeVMs(logger, vms)
+
+		if len(vms) == 0 {
+			logger.Fatal(errNoVMsMatchingRegex)
+		}
+
+		// a boolean indicating whether at least one error occured. Useful for
+		// the exit code of the program after iterating over the virtual machines.
+		failed := false
+
+		for _, vm := range vms {
+			formerState, err := vm.Transition(to, force, timeout)
+			if err != nil {
+				logger.Error(err)
+				failed = true
+				continue // continue with next VM
+			}
+
+			newState, err := vm.GetCurrentStateString()
+			if err != nil {
+				logger.Errorf("unable to retrieve current state of VM '%s': %s",
+					vm.Descriptor.Name,
+					err,
+				)
+				failed = true
+				continue // continue with next VM
+			}
+
+			logger.Infof("VM '%s' transitioned from '%s' to '%s'",
+				vm.Descriptor.Name,
+				virt.GetStateString(formerState),
+				newState,
+			)
+		}
+
+		// TODO (obitech): improve error handling
+		// See: https://blog.golang.org/errors-are-values
+		if failed {
+			logger.Fatalf("%s process failed due to errors", cmd.Name())
+		}
+	}
+}
@@ -7,7 +7,9 @@ package main
 
 import (
 	"fmt"
+	"runtime"
 
+	"github.com/joroec/virsnap/pkg/virt"
 	"github.com/spf13/cobra"
 )
 
@@ -19,8 +21,11 @@ const (
 var versionCmd = &cobra.Command{
 	Use:   "version",
 	Short: "Print the version of the software",
-	Long:  `Print the version of the software.`,
-	Run:   versionRun,
+	Long: "Print the version of the software along with the versions of the " +
+		"Go runtime, the libvirt library and, if a read-only connection to the " +
+		"libvirt socket can be made, the libvirt daemon and the hypervisor. " +
+		"Useful for bug reports.",
+	Run: versionRun,
 }
 
 // init is a special golang function that is called exactly once regardless
@@ -30,8 +35,25 @@ func init() {
 }
 
 // versionRun is the function called after the command line parser detected
-// that we want to end up here. This functions does noting except printing
-// the current version number.
+// that we want to end up here. Versions that cannot be determined, e.g.
+// because libvirt is not reachable, are printed as "unavailable".
 func versionRun(cmd *cobra.Command, args []string) {
 	fmt.Printf("virsnap, version %s\n", version)
+	fmt.Printf("go runtime version: %s\n", runtime.Version())
+
+	library, err := virt.LibraryVersion()
+	if err != nil {
+		logger.Debug(err)
+		library = "unavailable"
+	}
+	fmt.Printf("libvirt library version: %s\n", library)
+
+	daemon, hypervisor, err := virt.DaemonVersions(socketURL)
+	if err != nil {
+		logger.Debug(err)
+		daemon = "unavailable"
+		hypervisor = "unavailable"
+	}
+	fmt.Printf("libvirt daemon version: %s\n", daemon)
+	fmt.Printf("hypervisor (qemu) version: %s\n", hypervisor)
 }
@@ -35,7 +35,7 @@ require (
 	github.com/spf13/afero v1.2.2 // indirect
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/jwalterweatherman v1.1.0 // indirect
-	github.com/spf13/viper v1.4.0 // indirect
+	github.com/spf13/viper v1.4.0
 	github.com/stretchr/objx v0.2.0 // indirect
 	github.com/stretchr/testify v1.3.0
 	github.com/ugorji/go v1.1.7 // indirect
@@ -49,4 +49,5 @@ require (
 	golang.org/x/sys v0.0.0-20190712062909-fae7ac547cb7
 	golang.org/x/tools v0.0.0-20190725161231-2e34cfcb95cb // indirect
 	google.golang.org/grpc v1.22.1 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20190709130402-674ba3eaed22
 )
@@ -0,0 +1,131 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package fs implements helper functions for handling filesystem related
+// tasks.
+package fs
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ChecksumsFilename is the name of the file listing the checksums of the files
+// in a directory (see WriteChecksums).
+const ChecksumsFilename = "checksums.txt"
+
+// Checksum returns the hex-encoded SHA-256 of the content of the file with the
+// given path.
+func Checksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("could not open '%s': %v", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", fmt.Errorf("could not read '%s': %v", path, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// WriteChecksums writes the given checksums by filename to the checksum file
+// in the given directory. The file has the format of sha256sum, so that it can
+// also be checked with "sha256sum -c checksums.txt" inside the directory.
+func WriteChecksums(dir string, checksums map[string]string) error {
+	names := make([]string, 0, len(checksums))
+	for name := range checksums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var doc strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&doc, "%s  %s\n", checksums[name], name)
+	}
+
+	err := ioutil.WriteFile(filepath.Join(dir, ChecksumsFilename),
+		[]byte(doc.String()), 0600)
+	if err != nil {
+		return fmt.Errorf("could not write the checksums: %v", err)
+	}
+	return nil
+}
+
+// ReadChecksums reads the checksums by filename from the checksum file in the
+// given directory.
+func ReadChecksums(dir string) (map[string]string, error) {
+	file, err := os.Open(filepath.Join(dir, ChecksumsFilename))
+	if err != nil {
+		return nil, fmt.Errorf("could not read the checksums: %v", err)
+	}
+	defer file.Close()
+
+	checksums := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		// sha256sum marks files hashed in binary mode with "*"
+		parts := strings.SplitN(scanner.Text(), " ", 2)
+		if len(parts) != 2 || len(parts[0]) != hex.EncodedLen(sha256.Size) {
+			return nil, fmt.Errorf("could not parse line %d of the checksums",
+				line)
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(parts[1], " "), "*")
+		checksums[name] = strings.ToLower(parts[0])
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the checksums: %v", err)
+	}
+	return checksums, nil
+}
+
+// VerifyChecksums checks the files listed in the checksum file in the given
+// directory against their checksums. All files are checked and an error
+// naming every missing or corrupted file is returned.
+func VerifyChecksums(dir string) error {
+	checksums, err := ReadChecksums(dir)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(checksums))
+	for name := range checksums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	failed := make([]string, 0)
+	for _, name := range names {
+		checksum, err := Checksum(filepath.Join(dir, name))
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%v)", name, err))
+			continue
+		}
+		if checksum != checksums[name] {
+			failed = append(failed, name+" (checksum mismatch)")
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("could not verify %d of %d files in '%s': %s",
+			len(failed), len(names), dir, strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package fs implements helper functions for handling filesystem related
+// tasks.
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virsnap-checksum")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "testvm.qcow2")
+	require.NoError(t, ioutil.WriteFile(file, []byte("disk"), 0600))
+
+	checksum, err := Checksum(file)
+	require.NoError(t, err)
+	require.Equal(t,
+		"1044dec7206e8d7c9fbb4ae8f766668406d2567fc7fc1a160a9d4700fcf8f8e9",
+		checksum)
+
+	_, err = Checksum(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virsnap-checksum")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// no checksum file
+	require.Error(t, VerifyChecksums(dir))
+
+	disk := filepath.Join(dir, "testvm.qcow2")
+	require.NoError(t, ioutil.WriteFile(disk, []byte("disk"), 0600))
+	nvram := filepath.Join(dir, "testvm_VARS.fd")
+	require.NoError(t, ioutil.WriteFile(nvram, []byte("nvram"), 0600))
+
+	checksums := make(map[string]string)
+	for _, file := range []string{disk, nvram} {
+		checksum, err := Checksum(file)
+		require.NoError(t, err)
+		checksums[filepath.Base(file)] = checksum
+	}
+	require.NoError(t, WriteChecksums(dir, checksums))
+
+	read, err := ReadChecksums(dir)
+	require.NoError(t, err)
+	require.Equal(t, checksums, read)
+	require.NoError(t, VerifyChecksums(dir))
+
+	// silent corruption of the disk
+	require.NoError(t, ioutil.WriteFile(disk, []byte("dusk"), 0600))
+	err = VerifyChecksums(dir)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "testvm.qcow2 (checksum mismatch)")
+	require.NotContains(t, err.Error(), "testvm_VARS.fd")
+
+	require.NoError(t, os.Remove(nvram))
+	err = VerifyChecksums(dir)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "could not verify 2 of 2 files")
+}
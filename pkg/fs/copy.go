@@ -0,0 +1,123 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package fs implements helper functions for handling filesystem related
+// tasks.
+package fs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Copy copies the file or directory tree with the given source path to the
+// given destination without any external tool. Like rsync, the source is
+// copied into the destination if the destination is an existing directory.
+// Permissions and modification times are preserved. Files are written to a
+// temporary file first and renamed afterwards, so that an interrupted copy
+// never leaves a truncated file behind under the final name.
+func Copy(source string, destination string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("could not stat source '%s': %v", source, err)
+	}
+
+	target := destination
+	if dest, err := os.Stat(destination); err == nil && dest.IsDir() {
+		target = filepath.Join(destination, filepath.Base(source))
+	}
+
+	if !info.IsDir() {
+		return copyFile(source, target, info)
+	}
+
+	return filepath.Walk(source, func(path string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		targetPath := filepath.Join(target, rel)
+
+		switch {
+		case info.IsDir():
+			err = os.MkdirAll(targetPath, info.Mode().Perm())
+			if err != nil {
+				return fmt.Errorf("could not create directory '%s': %v",
+					targetPath, err)
+			}
+			return os.Chmod(targetPath, info.Mode().Perm())
+		case info.Mode().IsRegular():
+			return copyFile(path, targetPath, info)
+		default:
+			// like rsync without --devices and --specials, sockets, devices
+			// and other special files are skipped. Symbolic links are not
+			// followed by Walk and skipped as well.
+			return nil
+		}
+	})
+}
+
+// copyFile copies the regular file with the given path and file info to the
+// given target path.
+func copyFile(source string, target string, info os.FileInfo) (err error) {
+	in, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("could not open source '%s': %v", source, err)
+	}
+	defer in.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(target),
+		"."+filepath.Base(target)+".")
+	if err != nil {
+		return fmt.Errorf("could not create temporary file for '%s': %v",
+			target, err)
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	_, err = io.Copy(tmp, in)
+	if err != nil {
+		return fmt.Errorf("could not copy '%s' to '%s': %v", source, target, err)
+	}
+
+	err = tmp.Sync()
+	if err != nil {
+		return fmt.Errorf("could not flush '%s': %v", target, err)
+	}
+
+	err = tmp.Chmod(info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("could not set permissions of '%s': %v", target, err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("could not close '%s': %v", target, err)
+	}
+
+	err = os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime())
+	if err != nil {
+		return fmt.Errorf("could not set modification time of '%s': %v",
+			target, err)
+	}
+
+	err = os.Rename(tmp.Name(), target)
+	if err != nil {
+		return fmt.Errorf("could not rename temporary file to '%s': %v", target,
+			err)
+	}
+	return nil
+}
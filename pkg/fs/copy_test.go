@@ -0,0 +1,87 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package fs implements helper functions for handling filesystem related
+// tasks.
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virsnap-copy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "testvm.qcow2")
+	require.NoError(t, ioutil.WriteFile(source, []byte("disk"), 0640))
+	modTime := time.Date(2019, 7, 11, 8, 37, 50, 0, time.UTC)
+	require.NoError(t, os.Chtimes(source, modTime, modTime))
+
+	// copy to an explicit target path
+	target := filepath.Join(dir, "copy.qcow2")
+	require.NoError(t, Copy(source, target))
+
+	content, err := ioutil.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, "disk", string(content))
+
+	info, err := os.Stat(target)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	require.True(t, info.ModTime().Equal(modTime))
+
+	// copy into an existing directory
+	exportDir := filepath.Join(dir, "export")
+	require.NoError(t, os.Mkdir(exportDir, 0700))
+	require.NoError(t, Copy(source, exportDir))
+
+	content, err = ioutil.ReadFile(filepath.Join(exportDir, "testvm.qcow2"))
+	require.NoError(t, err)
+	require.Equal(t, "disk", string(content))
+
+	// no temporary files are left behind
+	entries, err := ioutil.ReadDir(exportDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestCopyDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virsnap-copy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "testvm")
+	require.NoError(t, os.MkdirAll(filepath.Join(source, "disks"), 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "descriptor.xml"),
+		[]byte("<domain/>"), 0600))
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(source, "disks", "testvm.qcow2"), []byte("disk"), 0600))
+
+	target := filepath.Join(dir, "backup")
+	require.NoError(t, Copy(source, target))
+
+	content, err := ioutil.ReadFile(filepath.Join(target, "disks",
+		"testvm.qcow2"))
+	require.NoError(t, err)
+	require.Equal(t, "disk", string(content))
+
+	info, err := os.Stat(filepath.Join(target, "disks"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0750), info.Mode().Perm())
+
+	_, err = os.Stat(filepath.Join(target, "descriptor.xml"))
+	require.NoError(t, err)
+}
+
+func TestCopyMissingSource(t *testing.T) {
+	require.Error(t, Copy("/nonexistent/testvm.qcow2", os.TempDir()))
+}
@@ -0,0 +1,346 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package fs implements helper functions for handling filesystem related
+// tasks.
+package fs
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/joroec/virsnap/pkg/instrument/log"
+)
+
+// Destination is the target of an export. Files are addressed by a key
+// relative to the root of the destination, e.g. "testvm/testvm.qcow2".
+type Destination interface {
+	// Put stores the local file with the given path under the given key. An
+	// existing file with the same key is overwritten.
+	Put(localPath string, remoteKey string) error
+
+	// Location returns a human-readable location of the file with the given
+	// key, e.g. an absolute path or an URL.
+	Location(remoteKey string) string
+}
+
+// ParseDestination returns the destination denoted by the given URL. Supported
+// schemes are "file" (e.g. "file:///var/backups"), "s3" (e.g.
+// "s3://bucket/prefix") and "ssh" (e.g. "ssh://user@host:22/var/backups"). An
+// URL without a scheme is treated as path of a local directory. The endpoint
+// of S3-compatible object storages can be specified by the query parameter
+// "endpoint", e.g. "s3://bucket?endpoint=http://minio:9000".
+func ParseDestination(rawURL string, perm os.FileMode, logger log.Logger,
+	opts SyncOptions) (Destination, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse destination '%s': %v", rawURL, err)
+	}
+
+	switch u.Scheme {
+	case "", "file":
+		dir := u.Path
+		if u.Scheme == "" {
+			dir = rawURL
+		}
+		if dir == "" {
+			return nil, fmt.Errorf("destination '%s' has no path", rawURL)
+		}
+
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse destination path '%s': %v",
+				dir, err)
+		}
+
+		return &FilesystemDestination{
+			Directory: absDir,
+			Perm:      perm,
+			Logger:    logger,
+			Options:   opts,
+		}, nil
+
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("destination '%s' has no bucket", rawURL)
+		}
+
+		return &S3Destination{
+			Bucket:   u.Host,
+			Prefix:   strings.Trim(u.Path, "/"),
+			Endpoint: u.Query().Get("endpoint"),
+			Logger:   logger,
+		}, nil
+
+	case "ssh":
+		if u.Hostname() == "" {
+			return nil, fmt.Errorf("destination '%s' has no host", rawURL)
+		}
+		if u.Path == "" || u.Path == "/" {
+			return nil, fmt.Errorf("destination '%s' has no path", rawURL)
+		}
+
+		dest := &SSHDestination{
+			Host:      u.Hostname(),
+			Port:      u.Port(),
+			Directory: path.Clean(u.Path),
+			Perm:      perm,
+			Logger:    logger,
+			Options:   opts,
+		}
+		if u.User != nil {
+			dest.User = u.User.Username()
+		}
+		return dest, nil
+
+	default:
+		return nil, fmt.Errorf("invalid destination '%s': scheme must be one of "+
+			"'file', 's3' or 'ssh'", rawURL)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// FilesystemDestination stores the files in a directory of the local
+// filesystem using rsync (see Sync).
+type FilesystemDestination struct {
+	// Directory is the absolute path of the root directory of the destination.
+	Directory string
+
+	// Perm are the access rights of created directories.
+	Perm os.FileMode
+
+	Logger  log.Logger
+	Options SyncOptions
+}
+
+// Put syncs the local file to the path of the key below the directory of the
+// destination, creating missing parent directories.
+func (d *FilesystemDestination) Put(localPath string, remoteKey string) error {
+	target := d.Location(remoteKey)
+
+	err := os.MkdirAll(path.Dir(target), d.Perm)
+	if err != nil {
+		return err
+	}
+
+	return Sync(localPath, target, d.Logger, d.Options)
+}
+
+// Location returns the absolute path of the file with the given key.
+func (d *FilesystemDestination) Location(remoteKey string) string {
+	return path.Join(d.Directory, remoteKey)
+}
+
+// -----------------------------------------------------------------------------
+
+// S3Destination stores the files in a bucket of an S3-compatible object
+// storage. It is a minimal wrapper around a call to
+// "aws s3 cp <source> s3://<bucket>/<prefix>/<key>", so credentials and region
+// are configured the usual way for the AWS CLI (e.g. environment variables or
+// ~/.aws/config). The AWS CLI uses multipart uploads for large disk images.
+type S3Destination struct {
+	// Bucket is the name of the bucket.
+	Bucket string
+
+	// Prefix is prepended to all keys. May be empty.
+	Prefix string
+
+	// Endpoint is the URL of an S3-compatible object storage. If empty, AWS S3
+	// is used.
+	Endpoint string
+
+	Logger log.Logger
+}
+
+// Put uploads the local file to the object with the given key.
+func (d *S3Destination) Put(localPath string, remoteKey string) error {
+	// find the AWS CLI in path
+	awsPath, err := exec.LookPath("aws")
+	if err != nil {
+		err = fmt.Errorf("could not find aws: %v", err)
+		return err
+	}
+	d.Logger.Debugf("found aws at '%s'", awsPath)
+
+	args := []string{"s3", "cp", "--only-show-errors"}
+	if d.Endpoint != "" {
+		args = append(args, "--endpoint-url", d.Endpoint)
+	}
+	args = append(args, localPath, d.Location(remoteKey))
+
+	// call the AWS CLI and show its output
+	d.Logger.Debugf("executing command 'aws %s'", strings.Join(args, " "))
+	cmd := exec.Command(awsPath, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// Location returns the S3 URL of the object with the given key.
+func (d *S3Destination) Location(remoteKey string) string {
+	return "s3://" + path.Join(d.Bucket, d.Prefix, remoteKey)
+}
+
+// -----------------------------------------------------------------------------
+
+// SSHDestination stores the files in a directory of a remote host using
+// rsync's native SSH transport, i.e. "rsync -avP -e ssh <source>
+// [<user>@]<host>:<path>". Missing parent directories are created with
+// "ssh <host> mkdir -p" before. Authentication is up to ssh, e.g. a key of
+// the ssh agent or the key given by SSHIdentity of the options.
+type SSHDestination struct {
+	// User is the user to log in as. Empty for the default user of ssh.
+	User string
+
+	// Host is the name or address of the remote host.
+	Host string
+
+	// Port is the SSH port of the remote host. Empty for the default port.
+	Port string
+
+	// Directory is the absolute path of the root directory of the destination
+	// on the remote host.
+	Directory string
+
+	// Perm are the access rights of created directories.
+	Perm os.FileMode
+
+	Logger  log.Logger
+	Options SyncOptions
+}
+
+// Put syncs the local file to the path of the key below the directory of the
+// destination on the remote host, creating missing parent directories.
+func (d *SSHDestination) Put(localPath string, remoteKey string) error {
+	if d.Options.NoRsync {
+		return fmt.Errorf("copying to '%s' requires rsync",
+			d.Location(remoteKey))
+	}
+
+	rsyncPath, err := exec.LookPath("rsync")
+	if err != nil {
+		err = fmt.Errorf("could not find rsync: %v", err)
+		return err
+	}
+	d.Logger.Debugf("found rsync at '%s'", rsyncPath)
+
+	target := path.Join(d.Directory, remoteKey)
+	err = d.mkdir(path.Dir(target))
+	if err != nil {
+		return err
+	}
+
+	// --protect-args prevents the remote shell from splitting the target path
+	args := []string{"-avP", "--protect-args"}
+	if d.Options.Checksum {
+		args = append(args, "-c")
+	}
+	args = append(args, "-e", d.remoteShell(), localPath, d.remoteSpec(target))
+
+	// call rsync and show rsync's output
+	d.Logger.Debugf("executing command 'rsync %s'", strings.Join(args, " "))
+	cmd := exec.Command(rsyncPath, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// Location returns the SSH URL of the file with the given key.
+func (d *SSHDestination) Location(remoteKey string) string {
+	host := d.Host
+	if d.Port != "" {
+		host += ":" + d.Port
+	}
+	if d.User != "" {
+		host = d.User + "@" + host
+	}
+	return "ssh://" + host + path.Join(d.Directory, remoteKey)
+}
+
+// mkdir creates the given directory and its parents on the remote host.
+func (d *SSHDestination) mkdir(dir string) error {
+	sshPath, err := exec.LookPath("ssh")
+	if err != nil {
+		err = fmt.Errorf("could not find ssh: %v", err)
+		return err
+	}
+
+	args := append(d.sshArgs(), d.login(), fmt.Sprintf("mkdir -p -m %o %s",
+		d.Perm.Perm(), shellQuote(dir)))
+
+	d.Logger.Debugf("executing command 'ssh %s'", strings.Join(args, " "))
+	cmd := exec.Command(sshPath, args...)
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if err != nil {
+		err = fmt.Errorf("could not create directory '%s' on '%s': %v", dir,
+			d.Host, err)
+	}
+	return err
+}
+
+// sshArgs returns the arguments of ssh derived from the port and the options
+// of the destination.
+func (d *SSHDestination) sshArgs() []string {
+	args := make([]string, 0)
+	if d.Port != "" {
+		args = append(args, "-p", d.Port)
+	}
+	if d.Options.SSHIdentity != "" {
+		args = append(args, "-i", d.Options.SSHIdentity)
+	}
+	for _, option := range d.Options.SSHOptions {
+		args = append(args, "-o", option)
+	}
+	return args
+}
+
+// remoteShell returns the remote shell command passed to rsync with -e. rsync
+// splits the command into arguments itself, honoring quotes.
+func (d *SSHDestination) remoteShell() string {
+	shell := []string{"ssh"}
+	for _, arg := range d.sshArgs() {
+		shell = append(shell, shellQuote(arg))
+	}
+	return strings.Join(shell, " ")
+}
+
+// login returns the login of the remote host in the form "[<user>@]<host>".
+func (d *SSHDestination) login() string {
+	if d.User != "" {
+		return d.User + "@" + d.Host
+	}
+	return d.Host
+}
+
+// remoteSpec returns the rsync target of the given path on the remote host.
+func (d *SSHDestination) remoteSpec(target string) string {
+	return d.login() + ":" + target
+}
+
+// shellQuote quotes the given string for a POSIX shell if it contains any
+// character besides letters, digits and "-_./=:@,+%".
+func shellQuote(s string) string {
+	safe := s != ""
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+			r >= '0' && r <= '9' || strings.ContainsRune("-_./=:@,+%", r)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
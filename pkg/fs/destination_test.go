@@ -0,0 +1,96 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package fs implements helper functions for handling filesystem related
+// tasks.
+package fs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDestination(t *testing.T) {
+	dest, err := ParseDestination("/var/backups", 0700, nil, SyncOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "/var/backups/testvm/descriptor.xml",
+		dest.Location("testvm/descriptor.xml"))
+
+	dest, err = ParseDestination("file:///var/backups", 0700, nil, SyncOptions{})
+	require.NoError(t, err)
+	require.IsType(t, &FilesystemDestination{}, dest)
+	require.Equal(t, "/var/backups/testvm/descriptor.xml",
+		dest.Location("testvm/descriptor.xml"))
+
+	dest, err = ParseDestination("s3://bucket/backups/2019-07-29?endpoint="+
+		"http://minio:9000", 0700, nil, SyncOptions{})
+	require.NoError(t, err)
+	require.Equal(t, &S3Destination{
+		Bucket:   "bucket",
+		Prefix:   "backups/2019-07-29",
+		Endpoint: "http://minio:9000",
+	}, dest)
+	require.Equal(t, "s3://bucket/backups/2019-07-29/testvm/descriptor.xml",
+		dest.Location("testvm/descriptor.xml"))
+
+	dest, err = ParseDestination("s3://bucket", 0700, nil, SyncOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "s3://bucket/testvm/descriptor.xml",
+		dest.Location("testvm/descriptor.xml"))
+
+	_, err = ParseDestination("s3:///backups", 0700, nil, SyncOptions{})
+	require.Error(t, err)
+
+	_, err = ParseDestination("ftp://host/backups", 0700, nil, SyncOptions{})
+	require.Error(t, err)
+}
+
+func TestParseSSHDestination(t *testing.T) {
+	opts := SyncOptions{
+		SSHIdentity: "/root/.ssh/backup key",
+		SSHOptions:  []string{"StrictHostKeyChecking=yes"},
+	}
+
+	dest, err := ParseDestination("ssh://backup@nas:2222/var/backups/", 0700,
+		nil, opts)
+	require.NoError(t, err)
+	require.Equal(t, &SSHDestination{
+		User:      "backup",
+		Host:      "nas",
+		Port:      "2222",
+		Directory: "/var/backups",
+		Perm:      0700,
+		Options:   opts,
+	}, dest)
+	require.Equal(t, "ssh://backup@nas:2222/var/backups/testvm/descriptor.xml",
+		dest.Location("testvm/descriptor.xml"))
+
+	ssh := dest.(*SSHDestination)
+	require.Equal(t, "backup@nas:/var/backups/testvm/testvm.qcow2",
+		ssh.remoteSpec("/var/backups/testvm/testvm.qcow2"))
+	require.Equal(t, "ssh -p 2222 -i '/root/.ssh/backup key' -o "+
+		"StrictHostKeyChecking=yes", ssh.remoteShell())
+
+	dest, err = ParseDestination("ssh://nas/var/backups", 0700, nil,
+		SyncOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "ssh://nas/var/backups/testvm/descriptor.xml",
+		dest.Location("testvm/descriptor.xml"))
+	require.Equal(t, "nas:/var/backups", dest.(*SSHDestination).remoteSpec(
+		"/var/backups"))
+
+	_, err = ParseDestination("ssh:///var/backups", 0700, nil, SyncOptions{})
+	require.Error(t, err)
+
+	_, err = ParseDestination("ssh://nas", 0700, nil, SyncOptions{})
+	require.Error(t, err)
+}
+
+func TestShellQuote(t *testing.T) {
+	require.Equal(t, "/var/backups/testvm", shellQuote("/var/backups/testvm"))
+	require.Equal(t, "'/var/my backups'", shellQuote("/var/my backups"))
+	require.Equal(t, `'it'"'"'s'`, shellQuote("it's"))
+	require.Equal(t, "''", shellQuote(""))
+}
@@ -0,0 +1,26 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package fs implements helper functions for handling filesystem related
+// tasks.
+package fs
+
+import (
+	"fmt"
+	"os"
+)
+
+// EnsureDirectory returns an error if the given path does not exist or is not
+// a directory. The directory is not created, since a missing directory, e.g.
+// of an unmounted filesystem, usually denotes a misconfiguration.
+func EnsureDirectory(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("could not access directory '%s': %v", path, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", path)
+	}
+	return nil
+}
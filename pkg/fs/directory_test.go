@@ -0,0 +1,30 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package fs implements helper functions for handling filesystem related
+// tasks.
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnsureDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virsnap-directory")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, EnsureDirectory(dir))
+
+	file := filepath.Join(dir, "testvm.qcow2")
+	require.NoError(t, ioutil.WriteFile(file, []byte("disk"), 0640))
+	require.Error(t, EnsureDirectory(file))
+
+	require.Error(t, EnsureDirectory(filepath.Join(dir, "missing")))
+}
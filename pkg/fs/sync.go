@@ -7,27 +7,63 @@
 package fs
 
 import (
-	"fmt"
 	"os"
 	"os/exec"
+	"strings"
 
 	"github.com/joroec/virsnap/pkg/instrument/log"
 )
 
+// SyncOptions bundles the optional settings of a sync.
+type SyncOptions struct {
+	// Checksum forces rsync to compare files by their checksums instead of
+	// their size and modification time (rsync's -c flag). This guarantees a
+	// bit-exact copy even if the timestamps match, but requires reading the
+	// whole source and destination file, which is considerably slower for large
+	// disk images.
+	Checksum bool
+
+	// NoRsync forces the copy without rsync (see Copy), even if rsync is
+	// installed.
+	NoRsync bool
+
+	// SSHIdentity is the private key ssh uses to authenticate at the host of
+	// an SSH destination. Empty for the default keys of ssh.
+	SSHIdentity string
+
+	// SSHOptions are passed to ssh as "-o <option>" when connecting to the
+	// host of an SSH destination, e.g. "StrictHostKeyChecking=yes".
+	SSHOptions []string
+}
+
 // Sync is a minimal and opinionated wrapper around a call to
-// "rsync -avp <source> <destination>"
-func Sync(source string, destination string, logger log.Logger) error {
+// "rsync -avP <source> <destination>". If rsync is not installed or NoRsync is
+// set, the files are copied by Copy instead.
+func Sync(source string, destination string, logger log.Logger,
+	opts SyncOptions) error {
+	if opts.NoRsync {
+		logger.Debugf("copying '%s' to '%s' without rsync", source, destination)
+		return Copy(source, destination)
+	}
+
 	// find rsync in path
 	rsyncPath, err := exec.LookPath("rsync")
 	if err != nil {
-		err = fmt.Errorf("could not find rsync: %v", err)
-		return err
+		logger.Warnf("could not find rsync, copying '%s' without it: %v", source,
+			err)
+		return Copy(source, destination)
 	}
 	logger.Debugf("found rsync at '%s'", rsyncPath)
 
+	args := []string{"-avP"}
+	if opts.Checksum {
+		args = append(args, "-c")
+	}
+	args = append(args, source, destination)
+
 	// call rsync and show rsync's output
-	logger.Debugf("executing command 'rsync -avP %s %s'", source, destination)
-	cmd := exec.Command(rsyncPath, "-avP", source, destination)
+	logger.Debugf("executing command 'rsync %s'", strings.Join(args, " "))
+	cmd := exec.Command(rsyncPath, args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
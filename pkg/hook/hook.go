@@ -0,0 +1,66 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package hook implements user-defined commands that are run around the
+// operations of virsnap, e.g. before and after the creation of a snapshot.
+package hook
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/joroec/virsnap/pkg/instrument/log"
+)
+
+// Hook is a user-defined shell command run at a certain point of an
+// operation.
+type Hook struct {
+	// Name identifies the point the hook is run at, e.g. "pre-snapshot". It is
+	// passed to the command as $0 and as VIRSNAP_HOOK.
+	Name string
+
+	// Command is the shell command, e.g. the path of a script. It is run with
+	// "sh -c". Empty if no hook is configured.
+	Command string
+}
+
+// Run runs the command of the hook. The given arguments are passed as
+// positional parameters ($1, $2, ...) and the given environment variables in
+// the form "KEY=value" are added to the environment of virsnap. The output of
+// the command is logged line by line. An error is returned if the command
+// cannot be started or exits with a non-zero exit code. Run does nothing if no
+// command is configured.
+func (h Hook) Run(logger log.Logger, args []string, env []string) error {
+	if h.Command == "" {
+		return nil
+	}
+
+	shPath, err := exec.LookPath("sh")
+	if err != nil {
+		err = fmt.Errorf("could not find sh: %v", err)
+		return err
+	}
+
+	logger.Debugf("executing %s hook '%s' with arguments '%s'", h.Name,
+		h.Command, strings.Join(args, " "))
+	cmd := exec.Command(shPath, append([]string{"-c", h.Command, h.Name},
+		args...)...)
+	cmd.Env = append(append(os.Environ(), "VIRSNAP_HOOK="+h.Name), env...)
+
+	output, err := cmd.CombinedOutput()
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		logger.Infof("%s hook: %s", h.Name, scanner.Text())
+	}
+
+	if err != nil {
+		err = fmt.Errorf("%s hook '%s' failed: %s", h.Name, h.Command, err)
+		return err
+	}
+	return nil
+}
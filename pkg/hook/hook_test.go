@@ -0,0 +1,44 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package hook implements user-defined commands that are run around the
+// operations of virsnap, e.g. before and after the creation of a snapshot.
+package hook
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRun(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core).Sugar()
+
+	hook := Hook{
+		Name:    "post-snapshot",
+		Command: `echo "$0 $1 $2 $VIRSNAP_VM $VIRSNAP_HOOK"`,
+	}
+	err := hook.Run(logger, []string{"testvm", "virsnap_a"},
+		[]string{"VIRSNAP_VM=testvm"})
+	require.NoError(t, err)
+
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 1)
+	require.Equal(t, "post-snapshot hook: post-snapshot testvm virsnap_a "+
+		"testvm post-snapshot", entries[0].Message)
+
+	// the output of a failing hook is logged as well
+	hook.Command = "echo flushing failed; exit 3"
+	err = hook.Run(logger, nil, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exit status 3")
+	require.Equal(t, "post-snapshot hook: flushing failed",
+		logs.AllUntimed()[1].Message)
+
+	// an unconfigured hook is not run
+	require.NoError(t, Hook{Name: "pre-snapshot"}.Run(logger, nil, nil))
+}
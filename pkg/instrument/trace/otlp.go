@@ -0,0 +1,195 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package trace provides lightweight timing spans for operations.
+package trace
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultExporter is the exporter the spans of all timers created by New are
+// additionally sent to. Nil if spans are only logged.
+var DefaultExporter *Exporter
+
+// tracesPath is the path of the OTLP/HTTP endpoint for traces.
+const tracesPath = "/v1/traces"
+
+// Exporter collects ended spans and sends them to an OpenTelemetry collector
+// via OTLP/HTTP with JSON encoding. Every timer becomes a trace of its own,
+// named after the timer by the attribute "virsnap.timer".
+type Exporter struct {
+	endpoint string
+	client   *http.Client
+
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+// NewExporter returns an Exporter sending the spans to the given OTLP/HTTP
+// endpoint, e.g. "http://localhost:4318". The path "/v1/traces" is appended if
+// the endpoint has no path.
+func NewExporter(endpoint string) (*Exporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trace endpoint '%s': %s", endpoint, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid trace endpoint '%s': expected an "+
+			"http or https URL", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = tracesPath
+	}
+
+	return &Exporter{
+		endpoint: u.String(),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// record adds the given span of the given timer to the spans sent by the next
+// Flush.
+func (e *Exporter) record(t *Timer, s *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.spans = append(e.spans, otlpSpan{
+		TraceID:   t.traceID,
+		SpanID:    newID(8),
+		Name:      s.Name,
+		Kind:      otlpSpanKindInternal,
+		StartTime: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTime:   strconv.FormatInt(s.start.Add(s.Duration).UnixNano(), 10),
+		Attributes: []otlpAttribute{
+			newAttribute("virsnap.timer", t.name),
+		},
+	})
+}
+
+// Flush sends the spans recorded since the previous call to the endpoint. The
+// spans are discarded even if they cannot be sent, so that a broken collector
+// does not accumulate them.
+func (e *Exporter) Flush() error {
+	if e == nil {
+		return nil
+	}
+
+	e.mu.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.mu.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	request := otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{
+					newAttribute("service.name", "virsnap"),
+				},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/joroec/virsnap"},
+				Spans: spans,
+			}},
+		}},
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("unable to marshal spans: %s", err)
+	}
+
+	resp, err := e.client.Post(e.endpoint, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to send spans to '%s': %s", e.endpoint, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unable to send spans to '%s': %s", e.endpoint,
+			resp.Status)
+	}
+	return nil
+}
+
+// newID returns a random identifier of the given number of bytes, hex encoded
+// as required by the JSON encoding of OTLP.
+func newID(size int) string {
+	id := make([]byte, size)
+	_, err := rand.Read(id)
+	if err != nil {
+		// an identifier that is not unique only confuses the collector
+		return fmt.Sprintf("%0*x", size*2, time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// otlpSpanKindInternal is the OTLP span kind of an operation that does not
+// cross a process boundary.
+const otlpSpanKindInternal = 1
+
+// otlpRequest and the following types are the subset of the JSON encoding of
+// an OTLP ExportTraceServiceRequest needed to export spans.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID    string          `json:"traceId"`
+	SpanID     string          `json:"spanId"`
+	Name       string          `json:"name"`
+	Kind       int             `json:"kind"`
+	StartTime  string          `json:"startTimeUnixNano"`
+	EndTime    string          `json:"endTimeUnixNano"`
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// newAttribute returns an OTLP attribute with the given string value.
+func newAttribute(key string, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+}
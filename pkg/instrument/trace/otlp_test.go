@@ -0,0 +1,114 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package trace provides lightweight timing spans for operations.
+package trace
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/joroec/virsnap/pkg/instrument/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewExporter(t *testing.T) {
+	exporter, err := NewExporter("http://localhost:4318")
+	require.NoError(t, err)
+	require.Equal(t, "http://localhost:4318/v1/traces", exporter.endpoint)
+
+	exporter, err = NewExporter("https://collector/otlp/v1/traces")
+	require.NoError(t, err)
+	require.Equal(t, "https://collector/otlp/v1/traces", exporter.endpoint)
+
+	for _, endpoint := range []string{"localhost:4318", "grpc://host:4317",
+		"http://", "%"} {
+		_, err = NewExporter(endpoint)
+		require.Error(t, err, endpoint)
+	}
+}
+
+func TestExporterFlush(t *testing.T) {
+	requests := make([]otlpRequest, 0)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "/v1/traces", r.URL.Path)
+			require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+			request := otlpRequest{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+			requests = append(requests, request)
+		}))
+	defer server.Close()
+
+	exporter, err := NewExporter(server.URL)
+	require.NoError(t, err)
+
+	DefaultExporter = exporter
+	defer func() { DefaultExporter = nil }()
+
+	logger := log.NewTestLogger(t).Sugar()
+	first := New(logger, "VM 'testvm'")
+	first.Start("transition").End()
+	first.Start("snapshot").End()
+	New(logger, "libvirt").Start("connect").End()
+
+	require.NoError(t, exporter.Flush())
+	require.Len(t, requests, 1)
+
+	resource := requests[0].ResourceSpans[0]
+	require.Equal(t, []otlpAttribute{newAttribute("service.name", "virsnap")},
+		resource.Resource.Attributes)
+
+	spans := resource.ScopeSpans[0].Spans
+	require.Len(t, spans, 3)
+	require.Equal(t, "transition", spans[0].Name)
+	require.Equal(t, "connect", spans[2].Name)
+	require.Equal(t, []otlpAttribute{newAttribute("virsnap.timer", "libvirt")},
+		spans[2].Attributes)
+
+	// the spans of a timer share a trace
+	require.Len(t, spans[0].TraceID, 32)
+	require.Equal(t, spans[0].TraceID, spans[1].TraceID)
+	require.NotEqual(t, spans[0].TraceID, spans[2].TraceID)
+	require.Len(t, spans[0].SpanID, 16)
+	require.NotEqual(t, spans[0].SpanID, spans[1].SpanID)
+
+	for _, span := range spans {
+		start, err := strconv.ParseInt(span.StartTime, 10, 64)
+		require.NoError(t, err)
+		end, err := strconv.ParseInt(span.EndTime, 10, 64)
+		require.NoError(t, err)
+		require.True(t, start > 0 && start <= end)
+	}
+
+	// the spans are only sent once
+	require.NoError(t, exporter.Flush())
+	require.Len(t, requests, 1)
+}
+
+func TestExporterFlushError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+	defer server.Close()
+
+	exporter, err := NewExporter(server.URL)
+	require.NoError(t, err)
+
+	timer := New(log.NewTestLogger(t).Sugar(), "libvirt")
+	timer.exporter = exporter
+	timer.traceID = newID(16)
+	timer.Start("connect").End()
+
+	require.Error(t, exporter.Flush())
+
+	// a nil exporter has nothing to send
+	var none *Exporter
+	require.NoError(t, none.Flush())
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package trace provides lightweight timing spans for operations.
+package trace
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joroec/virsnap/pkg/instrument/log"
+)
+
+// Timer collects the spans of a group of related operations, e.g. all
+// operations executed for a single VM. All methods can be called on a nil
+// Timer, in which case nothing is measured or logged.
+type Timer struct {
+	logger log.Logger
+	name   string
+
+	// exporter additionally receives the ended spans if not nil, traceID is
+	// the OTLP trace they belong to
+	exporter *Exporter
+	traceID  string
+
+	mu    sync.Mutex
+	spans []Span
+}
+
+// Span is the measurement of a single operation.
+type Span struct {
+	Name     string
+	Duration time.Duration
+
+	start time.Time
+	timer *Timer
+}
+
+// New returns a new Timer with the given name, that logs the measured spans
+// at debug level to the given logger. If DefaultExporter is set, the spans are
+// exported as well.
+func New(logger log.Logger, name string) *Timer {
+	t := &Timer{
+		logger:   logger,
+		name:     name,
+		exporter: DefaultExporter,
+	}
+	if t.exporter != nil {
+		t.traceID = newID(16)
+	}
+	return t
+}
+
+// Start starts a new span for the given operation. The caller is responsible
+// for calling End on the returned span, usually with a "defer" statement.
+func (t *Timer) Start(operation string) *Span {
+	return &Span{
+		Name:  operation,
+		start: time.Now(),
+		timer: t,
+	}
+}
+
+// End stops the span and records its duration at the corresponding timer.
+func (s *Span) End() {
+	s.Duration = time.Since(s.start)
+
+	t := s.timer
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.spans = append(t.spans, *s)
+	t.mu.Unlock()
+
+	if t.exporter != nil {
+		t.exporter.record(t, s)
+	}
+	t.logger.Debugf("%s: %s took %s", t.name, s.Name, s.Duration)
+}
+
+// Spans returns a copy of the spans that were ended so far.
+func (t *Timer) Spans() []Span {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	spans := make([]Span, len(t.spans))
+	copy(spans, t.spans)
+	return spans
+}
+
+// Summary logs the durations of all spans ended so far and their total at
+// debug level.
+func (t *Timer) Summary() {
+	if t == nil {
+		return
+	}
+
+	var total time.Duration
+	parts := make([]string, 0, len(t.spans))
+	for _, span := range t.Spans() {
+		total += span.Duration
+		parts = append(parts, span.Name+"="+span.Duration.String())
+	}
+
+	t.logger.Debugf("timing summary for %s: %s (total %s)", t.name,
+		strings.Join(parts, ", "), total)
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package trace provides lightweight timing spans for operations.
+package trace
+
+import (
+	"testing"
+	"time"
+
+	"github.com/joroec/virsnap/pkg/instrument/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpans(t *testing.T) {
+	timer := New(log.NewTestLogger(t).Sugar(), "testvm")
+
+	first := timer.Start("transition")
+	time.Sleep(time.Millisecond)
+	first.End()
+
+	second := timer.Start("snapshot")
+	second.End()
+
+	spans := timer.Spans()
+	require.Len(t, spans, 2)
+	require.Equal(t, "transition", spans[0].Name)
+	require.Equal(t, "snapshot", spans[1].Name)
+	require.True(t, spans[0].Duration >= time.Millisecond)
+
+	timer.Summary()
+}
+
+func TestNilTimer(t *testing.T) {
+	var timer *Timer
+
+	span := timer.Start("connect")
+	span.End()
+
+	require.Nil(t, timer.Spans())
+	timer.Summary()
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package lock implements an advisory file lock that prevents concurrent
+// invocations of virsnap from operating on the same virtual machines.
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrLocked is returned by Acquire if the lock is held by another process and
+// the caller does not want to wait for it.
+var ErrLocked = errors.New("lock is held by another process")
+
+// Lock is an acquired advisory lock on a file.
+type Lock struct {
+	file *os.File
+}
+
+// Acquire acquires an exclusive advisory lock on the file at the given path.
+// The file is created if it does not exist. If wait is true, Acquire blocks
+// until the lock is released by the other process. Otherwise, ErrLocked is
+// returned immediately. The caller is responsible for calling Release on the
+// returned lock. The lock is released by the operating system as well, if the
+// process exits.
+func Acquire(path string, wait bool) (*Lock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		err = fmt.Errorf("could not open lock file '%s': %v", path, err)
+		return nil, err
+	}
+
+	how := unix.LOCK_EX
+	if !wait {
+		how |= unix.LOCK_NB
+	}
+
+	err = unix.Flock(int(file.Fd()), how)
+	if err != nil {
+		file.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		err = fmt.Errorf("could not lock file '%s': %v", path, err)
+		return nil, err
+	}
+
+	return &Lock{
+		file: file,
+	}, nil
+}
+
+// Release releases the lock. The lock file itself is not removed, since
+// another process may already wait for it.
+func (l *Lock) Release() error {
+	err := unix.Flock(int(l.file.Fd()), unix.LOCK_UN)
+	if err != nil {
+		l.file.Close()
+		return fmt.Errorf("could not unlock file '%s': %v", l.file.Name(), err)
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package lock implements an advisory file lock that prevents concurrent
+// invocations of virsnap from operating on the same virtual machines.
+package lock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virsnap-lock")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "virsnap.lock")
+
+	first, err := Acquire(path, false)
+	require.NoError(t, err)
+	require.NotNil(t, first)
+
+	// a second lock on the same file must not be granted
+	second, err := Acquire(path, false)
+	require.Equal(t, ErrLocked, err)
+	require.Nil(t, second)
+
+	require.NoError(t, first.Release())
+
+	// after releasing, the lock can be acquired again
+	third, err := Acquire(path, false)
+	require.NoError(t, err)
+	require.NoError(t, third.Release())
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// AgentStatus describes whether the QEMU guest agent of a VM responds.
+type AgentStatus string
+
+const (
+	// AgentReachable denotes a guest agent that answered the ping.
+	AgentReachable AgentStatus = "reachable"
+
+	// AgentUnreachable denotes a guest agent that did not answer the ping in
+	// time or a running VM without a guest agent channel.
+	AgentUnreachable AgentStatus = "unreachable"
+
+	// AgentNotApplicable denotes a VM that is not running, so its guest agent
+	// cannot answer.
+	AgentNotApplicable AgentStatus = "n/a"
+)
+
+// guestAgentChannel is the name of the virtio channel of the QEMU guest agent.
+const guestAgentChannel = "org.qemu.guest_agent.0"
+
+// PingAgent sends "guest-ping" to the QEMU guest agent of the VM and reports
+// whether it answered within the given timeout. Only running VMs are pinged.
+// A guest agent is required for quiesced snapshots.
+func (vm *VM) PingAgent(timeout time.Duration) AgentStatus {
+	state, _, err := vm.Instance.GetState()
+	if err != nil {
+		logLibvirtError(vm.Logger, err)
+		vm.Logger.Debugf("unable to retrieve state of VM '%s': %s",
+			vm.Descriptor.Name, err)
+		return AgentUnreachable
+	}
+	if state != libvirt.DOMAIN_RUNNING {
+		return AgentNotApplicable
+	}
+
+	// without a channel, libvirt would fail right away anyway
+	if !hasAgentChannel(vm.Descriptor) {
+		vm.Logger.Debugf("VM '%s' has no guest agent channel", vm.Descriptor.Name)
+		return AgentUnreachable
+	}
+
+	// libvirt expects the timeout in seconds, zero would not wait at all
+	seconds := int(timeout / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	_, err = vm.Instance.QemuAgentCommand(`{"execute":"guest-ping"}`,
+		libvirt.DomainQemuAgentCommandTimeout(seconds), 0)
+	if err != nil {
+		logLibvirtError(vm.Logger, err)
+		vm.Logger.Debugf("guest agent of VM '%s' did not answer: %s",
+			vm.Descriptor.Name, err)
+		return AgentUnreachable
+	}
+	return AgentReachable
+}
+
+// agentPollInterval is the time to wait before pinging a guest agent again that
+// did not answer yet.
+const agentPollInterval = time.Second
+
+// WaitForAgent pings the QEMU guest agent of the running VM until it answers
+// or the given duration elapses, e.g. since the guest agent of a VM that was
+// just booted is not ready yet. An error naming the VM is returned if the
+// guest agent did not answer in time or the VM is not running.
+func (vm *VM) WaitForAgent(wait time.Duration) error {
+	switch pollAgent(vm.PingAgent, wait, agentPollInterval) {
+	case AgentReachable:
+		return nil
+	case AgentNotApplicable:
+		return fmt.Errorf("guest agent of VM '%s' cannot answer, the VM is not "+
+			"running", vm.Descriptor.Name)
+	default:
+		return fmt.Errorf("guest agent of VM '%s' did not answer within %s",
+			vm.Descriptor.Name, wait)
+	}
+}
+
+// pollAgent calls ping until it reports a guest agent that is not
+// unreachable or the given duration elapses, waiting interval between the
+// calls. The last status reported by ping is returned.
+func pollAgent(ping func(timeout time.Duration) AgentStatus, wait time.Duration,
+	interval time.Duration) AgentStatus {
+	deadline := time.Now().Add(wait)
+	for {
+		status := ping(interval)
+		if status != AgentUnreachable {
+			return status
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return status
+		}
+		if remaining < interval {
+			time.Sleep(remaining)
+		} else {
+			time.Sleep(interval)
+		}
+	}
+}
+
+// hasAgentChannel determines whether the given descriptor contains the virtio
+// channel of the QEMU guest agent.
+func hasAgentChannel(descriptor libvirtxml.Domain) bool {
+	if descriptor.Devices == nil {
+		return false
+	}
+
+	for _, channel := range descriptor.Devices.Channels {
+		if channel.Target != nil && channel.Target.VirtIO != nil &&
+			channel.Target.VirtIO.Name == guestAgentChannel {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrAgentUnavailable is returned by TrimFilesystems if the VM is not running
+// or has no guest agent channel, so that its guest agent cannot be used.
+var ErrAgentUnavailable = errors.New("guest agent is not available")
+
+// TrimResult is the result of trimming a mounted filesystem in the guest.
+type TrimResult struct {
+	// Path is the mount point of the filesystem in the guest.
+	Path string `json:"path"`
+
+	// Trimmed is the number of bytes trimmed. Not reported by every guest
+	// agent.
+	Trimmed uint64 `json:"trimmed"`
+
+	// Error describes why the filesystem could not be trimmed. Empty on
+	// success.
+	Error string `json:"error"`
+}
+
+// TrimFilesystems sends "guest-fstrim" to the QEMU guest agent of the running
+// VM, so that the guest discards the unused blocks of its filesystems and the
+// disk images do not contain them anymore. The guest agent needs to answer
+// within the given timeout. ErrAgentUnavailable is returned if the VM is not
+// running or has no guest agent channel.
+func (vm *VM) TrimFilesystems(timeout time.Duration) ([]TrimResult, error) {
+	state, _, err := vm.Instance.GetState()
+	if err != nil {
+		logLibvirtError(vm.Logger, err)
+		err = fmt.Errorf("unable to retrieve state of VM '%s': %s",
+			vm.Descriptor.Name, err)
+		return nil, err
+	}
+	if state != libvirt.DOMAIN_RUNNING || !hasAgentChannel(vm.Descriptor) {
+		return nil, ErrAgentUnavailable
+	}
+
+	// libvirt expects the timeout in seconds, zero would not wait at all
+	seconds := int(timeout / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	response, err := vm.Instance.QemuAgentCommand(
+		`{"execute":"guest-fstrim","arguments":{"minimum":0}}`,
+		libvirt.DomainQemuAgentCommandTimeout(seconds), 0)
+	if err != nil {
+		logLibvirtError(vm.Logger, err)
+		err = fmt.Errorf("unable to trim the filesystems of VM '%s': %s",
+			vm.Descriptor.Name, err)
+		return nil, err
+	}
+
+	results, err := parseTrimResponse(response)
+	if err != nil {
+		err = fmt.Errorf("unable to trim the filesystems of VM '%s': %s",
+			vm.Descriptor.Name, err)
+		return nil, err
+	}
+	return results, nil
+}
+
+// parseTrimResponse parses the response of the guest agent to "guest-fstrim".
+// Old guest agents do not report any paths.
+func parseTrimResponse(response string) ([]TrimResult, error) {
+	var parsed struct {
+		Return struct {
+			Paths []TrimResult `json:"paths"`
+		} `json:"return"`
+	}
+
+	err := json.Unmarshal([]byte(response), &parsed)
+	if err != nil {
+		err = fmt.Errorf("unable to parse response of guest agent: %s", err)
+		return nil, err
+	}
+	return parsed.Return.Paths, nil
+}
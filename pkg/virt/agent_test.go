@@ -0,0 +1,100 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"testing"
+	"time"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHasAgentChannel(t *testing.T) {
+	require.False(t, hasAgentChannel(libvirtxml.Domain{}))
+
+	descriptor := libvirtxml.Domain{}
+	err := descriptor.Unmarshal(`<domain type="kvm">
+  <name>testvm</name>
+  <devices>
+    <channel type="spicevmc">
+      <target type="virtio" name="com.redhat.spice.0"/>
+    </channel>
+  </devices>
+</domain>`)
+	require.NoError(t, err)
+	require.False(t, hasAgentChannel(descriptor))
+
+	descriptor = libvirtxml.Domain{}
+	err = descriptor.Unmarshal(`<domain type="kvm">
+  <name>testvm</name>
+  <devices>
+    <channel type="unix">
+      <source mode="bind"/>
+      <target type="virtio" name="org.qemu.guest_agent.0" state="connected"/>
+    </channel>
+  </devices>
+</domain>`)
+	require.NoError(t, err)
+	require.True(t, hasAgentChannel(descriptor))
+}
+
+func TestPollAgent(t *testing.T) {
+	// pingAfter returns a ping answering with the given status on the given
+	// call and as unreachable before
+	pingAfter := func(calls *int, answer int,
+		status AgentStatus) func(time.Duration) AgentStatus {
+		return func(timeout time.Duration) AgentStatus {
+			*calls++
+			if *calls < answer {
+				return AgentUnreachable
+			}
+			return status
+		}
+	}
+
+	calls := 0
+	require.Equal(t, AgentReachable, pollAgent(pingAfter(&calls, 3,
+		AgentReachable), time.Minute, time.Millisecond))
+	require.Equal(t, 3, calls)
+
+	// a VM that is not running is not waited for
+	calls = 0
+	require.Equal(t, AgentNotApplicable, pollAgent(pingAfter(&calls, 1,
+		AgentNotApplicable), time.Minute, time.Millisecond))
+	require.Equal(t, 1, calls)
+
+	calls = 0
+	require.Equal(t, AgentUnreachable, pollAgent(pingAfter(&calls, 1000000,
+		AgentReachable), 20*time.Millisecond, time.Millisecond))
+	require.True(t, calls > 1)
+
+	// the agent is pinged once without waiting
+	calls = 0
+	require.Equal(t, AgentUnreachable, pollAgent(pingAfter(&calls, 2,
+		AgentReachable), 0, time.Millisecond))
+	require.Equal(t, 1, calls)
+}
+
+func TestParseTrimResponse(t *testing.T) {
+	results, err := parseTrimResponse(`{"return":{"paths":[` +
+		`{"path":"/","trimmed":1073741824,"minimum":0},` +
+		`{"path":"/boot","error":"Operation not supported"}]}}`)
+	require.NoError(t, err)
+	require.Equal(t, []TrimResult{
+		{Path: "/", Trimmed: 1073741824},
+		{Path: "/boot", Error: "Operation not supported"},
+	}, results)
+
+	// old guest agents return an empty object
+	results, err = parseTrimResponse(`{"return":{}}`)
+	require.NoError(t, err)
+	require.Empty(t, results)
+
+	_, err = parseTrimResponse("not json")
+	require.Error(t, err)
+}
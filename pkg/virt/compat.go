@@ -0,0 +1,205 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/joroec/virsnap/pkg/instrument/log"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// HostIncompatibilities returns the reasons why the VM with the given
+// descriptor would not boot on the host of the given connection, e.g. after
+// it was exported on another host. The architecture, the machine type and the
+// host NUMA nodes the memory is bound to are compared with the capabilities
+// of the host, a custom CPU model is compared with the CPU of the host. An
+// empty slice is returned if no incompatibility is found.
+func HostIncompatibilities(log log.Logger, conn *libvirt.Connect,
+	descriptor libvirtxml.Domain) ([]string, error) {
+	xml, err := conn.GetCapabilities()
+	if err != nil {
+		logLibvirtError(log, err)
+		return nil, fmt.Errorf("unable to retrieve host capabilities: %s", err)
+	}
+
+	caps := libvirtxml.Caps{}
+	err = caps.Unmarshal(xml)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal host capabilities: %s", err)
+	}
+
+	problems := capsIncompatibilities(descriptor, caps)
+
+	cpu := descriptor.CPU
+	if cpu == nil {
+		return problems, nil
+	}
+
+	switch cpu.Mode {
+	case "host-passthrough":
+		// the descriptor does not tell the CPU of the exporting host
+		model := "unknown model"
+		if caps.Host.CPU != nil && caps.Host.CPU.Model != "" {
+			model = caps.Host.CPU.Model
+		}
+		log.Infof("VM '%s' passes the host CPU through, the guest will see the "+
+			"CPU of this host (%s)", descriptor.Name, model)
+	case "", "custom":
+		if cpu.Model == nil || cpu.Model.Value == "" {
+			break
+		}
+
+		cpuXML, err := cpu.Marshal()
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal CPU of VM '%s': %s",
+				descriptor.Name, err)
+		}
+		result, err := conn.CompareCPU(cpuXML, 0)
+		if err != nil {
+			logLibvirtError(log, err)
+			return nil, fmt.Errorf("unable to compare CPU of VM '%s' with the "+
+				"host CPU: %s", descriptor.Name, err)
+		}
+		if result == libvirt.CPU_COMPARE_INCOMPATIBLE {
+			problems = append(problems, fmt.Sprintf("CPU model '%s' is not "+
+				"supported by the host CPU", cpu.Model.Value))
+		}
+	}
+
+	return problems, nil
+}
+
+// capsIncompatibilities returns the reasons why the VM with the given
+// descriptor would not boot on a host with the given capabilities.
+func capsIncompatibilities(descriptor libvirtxml.Domain,
+	caps libvirtxml.Caps) []string {
+	problems := make([]string, 0)
+
+	if descriptor.OS != nil && descriptor.OS.Type != nil &&
+		descriptor.OS.Type.Arch != "" {
+		osType := descriptor.OS.Type
+		guests := make([]libvirtxml.CapsGuest, 0)
+		for _, guest := range caps.Guests {
+			if guest.Arch.Name == osType.Arch &&
+				(osType.Type == "" || guest.OSType == osType.Type) {
+				guests = append(guests, guest)
+			}
+		}
+
+		if len(guests) == 0 {
+			problems = append(problems, fmt.Sprintf("architecture '%s' is not "+
+				"supported by the host", osType.Arch))
+		} else if osType.Machine != "" &&
+			!supportsMachine(guests, descriptor.Type, osType.Machine) {
+			problems = append(problems, fmt.Sprintf("machine type '%s' is not "+
+				"supported by the host", osType.Machine))
+		}
+	}
+
+	if descriptor.NUMATune != nil {
+		cells := make(map[int]bool)
+		if caps.Host.NUMA != nil && caps.Host.NUMA.Cells != nil {
+			for _, cell := range caps.Host.NUMA.Cells.Cells {
+				cells[cell.ID] = true
+			}
+		}
+
+		nodesets := make([]string, 0)
+		if descriptor.NUMATune.Memory != nil {
+			nodesets = append(nodesets, descriptor.NUMATune.Memory.Nodeset)
+		}
+		for _, node := range descriptor.NUMATune.MemNodes {
+			nodesets = append(nodesets, node.Nodeset)
+		}
+
+		for _, nodeset := range nodesets {
+			nodes, err := parseNodeset(nodeset)
+			if err != nil {
+				problems = append(problems, err.Error())
+				continue
+			}
+			for _, node := range nodes {
+				if !cells[node] {
+					problems = append(problems, fmt.Sprintf("memory is bound to "+
+						"NUMA node %d, which the host does not have", node))
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+// supportsMachine determines whether any of the given guest capabilities
+// supports the given machine type for the given domain type (e.g. "kvm").
+func supportsMachine(guests []libvirtxml.CapsGuest, domainType string,
+	machine string) bool {
+	matches := func(machines []libvirtxml.CapsGuestMachine) bool {
+		for _, m := range machines {
+			if m.Name == machine || m.Canonical == machine {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, guest := range guests {
+		if matches(guest.Arch.Machines) {
+			return true
+		}
+		for _, domain := range guest.Arch.Domains {
+			if (domainType == "" || domain.Type == domainType) &&
+				matches(domain.Machines) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseNodeset returns the NUMA nodes of the given libvirt nodeset in
+// ascending order, e.g. [0 2 4] for "0-2,^1,4". An empty nodeset contains no
+// nodes.
+func parseNodeset(nodeset string) ([]int, error) {
+	included := make(map[int]bool)
+	for _, part := range strings.Split(nodeset, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		exclude := strings.HasPrefix(part, "^")
+		bounds := strings.SplitN(strings.TrimPrefix(part, "^"), "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		last := first
+		if err == nil && len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+		}
+		if err != nil || first < 0 || last < first {
+			return nil, fmt.Errorf("invalid NUMA nodeset '%s'", nodeset)
+		}
+
+		for node := first; node <= last; node++ {
+			included[node] = !exclude
+		}
+	}
+
+	nodes := make([]int, 0, len(included))
+	for node, ok := range included {
+		if ok {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Ints(nodes)
+	return nodes, nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/require"
+)
+
+// testCaps are the capabilities of a x86_64 host with two NUMA nodes.
+const testCaps = `<capabilities>
+  <host>
+    <cpu>
+      <arch>x86_64</arch>
+      <model>Skylake-Client-IBRS</model>
+    </cpu>
+    <topology>
+      <cells num="2">
+        <cell id="0"/>
+        <cell id="1"/>
+      </cells>
+    </topology>
+  </host>
+  <guest>
+    <os_type>hvm</os_type>
+    <arch name="x86_64">
+      <machine maxCpus="255">pc-i440fx-4.0</machine>
+      <machine canonical="pc-i440fx-4.0" maxCpus="255">pc</machine>
+      <domain type="qemu"/>
+      <domain type="kvm">
+        <machine maxCpus="288">pc-q35-4.0</machine>
+        <machine canonical="pc-q35-4.0" maxCpus="288">q35</machine>
+      </domain>
+    </arch>
+  </guest>
+</capabilities>`
+
+func TestCapsIncompatibilities(t *testing.T) {
+	caps := libvirtxml.Caps{}
+	require.NoError(t, caps.Unmarshal(testCaps))
+
+	domain := func(xml string) libvirtxml.Domain {
+		descriptor := libvirtxml.Domain{}
+		require.NoError(t, descriptor.Unmarshal(`<domain type="kvm">
+  <name>testvm</name>`+xml+`
+</domain>`))
+		return descriptor
+	}
+
+	for _, machine := range []string{"pc", "pc-i440fx-4.0", "q35", "pc-q35-4.0"} {
+		descriptor := domain(`<os><type arch="x86_64" machine="` + machine +
+			`">hvm</type></os>`)
+		require.Empty(t, capsIncompatibilities(descriptor, caps), machine)
+	}
+	require.Empty(t, capsIncompatibilities(domain(""), caps))
+
+	// q35 is only supported with KVM
+	descriptor := domain(`<os><type arch="x86_64" machine="q35">hvm</type></os>`)
+	descriptor.Type = "qemu"
+	require.Equal(t, []string{"machine type 'q35' is not supported by the host"},
+		capsIncompatibilities(descriptor, caps))
+
+	require.Equal(t, []string{
+		"machine type 'pc-q35-2.12' is not supported by the host",
+	}, capsIncompatibilities(domain(`<os><type arch="x86_64" `+
+		`machine="pc-q35-2.12">hvm</type></os>`), caps))
+
+	require.Equal(t, []string{
+		"architecture 'aarch64' is not supported by the host",
+	}, capsIncompatibilities(domain(`<os><type arch="aarch64" `+
+		`machine="virt">hvm</type></os>`), caps))
+
+	require.Empty(t, capsIncompatibilities(domain(`<numatune>
+    <memory mode="strict" nodeset="0-1"/>
+  </numatune>`), caps))
+
+	require.Equal(t, []string{
+		"memory is bound to NUMA node 2, which the host does not have",
+		"memory is bound to NUMA node 3, which the host does not have",
+	}, capsIncompatibilities(domain(`<numatune>
+    <memory mode="strict" nodeset="1-2"/>
+    <memnode cellid="0" mode="strict" nodeset="3"/>
+  </numatune>`), caps))
+}
+
+func TestParseNodeset(t *testing.T) {
+	nodes, err := parseNodeset("")
+	require.NoError(t, err)
+	require.Empty(t, nodes)
+
+	nodes, err = parseNodeset("4,0-2,^1")
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 2, 4}, nodes)
+
+	for _, nodeset := range []string{"a", "1-", "2-1", "-1", "0-1-2"} {
+		_, err := parseNodeset(nodeset)
+		require.Error(t, err, nodeset)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/joroec/virsnap/pkg/instrument/log"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+// KeepAliveConfig specifies the keepalive messages sent over a libvirt
+// connection. If the remote party does not respond to Count successive
+// keepalive messages sent every Interval seconds, the connection is considered
+// broken. An Interval less or equal to zero disables keepalive messages.
+type KeepAliveConfig struct {
+	Interval int
+	Count    uint
+}
+
+var (
+	// KeepAlive is applied to any connection opened by Connect. Long running
+	// operations over remote connections (e.g. qemu+ssh) would otherwise be
+	// interrupted due to inactivity.
+	KeepAlive = KeepAliveConfig{
+		Interval: 5,
+		Count:    6,
+	}
+
+	// eventLoop ensures that the libvirt event loop needed for keepalive
+	// messages is only started once.
+	eventLoop sync.Once
+)
+
+// Connect opens a connection to the libvirt socket with the given URL and
+// applies the keepalive configuration. The caller is responsible for calling
+// Close on the returned connection.
+func Connect(log log.Logger, socketURL string) (*libvirt.Connect, error) {
+	if KeepAlive.Interval > 0 {
+		// keepalive messages are only sent if an event loop is running. The
+		// implementation needs to be registered before opening the connection.
+		eventLoop.Do(func() {
+			err := libvirt.EventRegisterDefaultImpl()
+			if err != nil {
+				log.Warnf("unable to register libvirt event loop: %s", err)
+				return
+			}
+
+			go func() {
+				for {
+					err := libvirt.EventRunDefaultImpl()
+					if err != nil {
+						log.Warnf("unable to run libvirt event loop: %s", err)
+						return
+					}
+				}
+			}()
+		})
+	}
+
+	conn, err := libvirt.NewConnect(socketURL)
+	if err != nil {
+		logLibvirtError(log, err)
+		err = fmt.Errorf("unable to connect to QEMU socket: %s", err)
+		return nil, err
+	}
+
+	if KeepAlive.Interval > 0 {
+		err = conn.SetKeepAlive(KeepAlive.Interval, KeepAlive.Count)
+		if err != nil {
+			// not fatal, the connection may still work without keepalive messages
+			log.Warnf("unable to enable keepalive for connection to '%s': %s",
+				socketURL, err)
+		}
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/joroec/virsnap/pkg/instrument/log"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+// ErrPoolClosed is returned by ConnectionPool.Get after the pool was closed.
+var ErrPoolClosed = errors.New("connection pool is closed")
+
+// ConnectionPool hands out libvirt connections to the same socket URL up to a
+// maximum number and reuses returned connections, so that parallel operations
+// do not pay for opening a connection each (e.g. an SSH handshake for
+// qemu+ssh URLs). It is safe for concurrent use.
+//
+// A borrowed connection must only be used for one operation at a time, since
+// libvirt does not support every operation concurrently on the same handle.
+// Each connection returned by Get needs to be handed back exactly once, either
+// with Put if it is still usable or with Discard if it is broken.
+type ConnectionPool struct {
+	// log is the logger for warnings about connections that cannot be closed
+	log log.Logger
+
+	// slots limits the number of borrowed connections to its capacity
+	slots chan struct{}
+
+	// mutex protects idle and closed
+	mutex  sync.Mutex
+	idle   []*libvirt.Connect
+	closed bool
+
+	// connect opens a new connection, disconnect closes it. Replaced by tests.
+	connect    func() (*libvirt.Connect, error)
+	disconnect func(conn *libvirt.Connect) error
+}
+
+// NewConnectionPool returns a pool of at most max connections to the libvirt
+// socket with the given URL. The connections are opened lazily with Connect.
+// The caller is responsible for calling Close on the returned pool.
+func NewConnectionPool(log log.Logger, socketURL string,
+	max int) (*ConnectionPool, error) {
+	if max <= 0 {
+		return nil, fmt.Errorf("invalid size %d of connection pool: must be "+
+			"greater than zero", max)
+	}
+
+	return &ConnectionPool{
+		log:   log,
+		slots: make(chan struct{}, max),
+		connect: func() (*libvirt.Connect, error) {
+			return Connect(log, socketURL)
+		},
+		disconnect: func(conn *libvirt.Connect) error {
+			_, err := conn.Close()
+			return err
+		},
+	}, nil
+}
+
+// Get borrows a connection from the pool. An idle connection is reused,
+// otherwise a new one is opened. If the maximum number of connections is
+// borrowed already, Get blocks until a connection is handed back.
+func (p *ConnectionPool) Get() (*libvirt.Connect, error) {
+	p.slots <- struct{}{}
+
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		<-p.slots
+		return nil, ErrPoolClosed
+	}
+	if len(p.idle) > 0 {
+		conn := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mutex.Unlock()
+		return conn, nil
+	}
+	p.mutex.Unlock()
+
+	// opening a connection may take a while, so do not block the pool
+	conn, err := p.connect()
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Put hands the given connection back to the pool for reuse. If the pool was
+// closed in the meantime, the connection is closed instead.
+func (p *ConnectionPool) Put(conn *libvirt.Connect) {
+	p.mutex.Lock()
+	closed := p.closed
+	if !closed {
+		p.idle = append(p.idle, conn)
+	}
+	p.mutex.Unlock()
+
+	if closed {
+		p.close(conn)
+	}
+	<-p.slots
+}
+
+// Discard closes the given broken connection instead of handing it back to
+// the pool. A new connection is opened for the next Get.
+func (p *ConnectionPool) Discard(conn *libvirt.Connect) {
+	p.close(conn)
+	<-p.slots
+}
+
+// Close closes the idle connections of the pool. Connections that are still
+// borrowed are closed as soon as they are handed back. Get fails with
+// ErrPoolClosed afterwards.
+func (p *ConnectionPool) Close() {
+	p.mutex.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mutex.Unlock()
+
+	for _, conn := range idle {
+		p.close(conn)
+	}
+}
+
+// close closes the given connection and logs a warning if this fails.
+func (p *ConnectionPool) close(conn *libvirt.Connect) {
+	err := p.disconnect(conn)
+	if err != nil {
+		p.log.Warnf("unable to close libvirt connection: %s", err)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libvirt/libvirt-go"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// newTestConnectionPool returns a pool of at most max connections that are
+// not connected to libvirt. The returned counters track how many connections
+// were opened and closed.
+func newTestConnectionPool(t *testing.T, max int) (*ConnectionPool, *int,
+	*int) {
+	pool, err := NewConnectionPool(zap.NewNop().Sugar(), "test:///default",
+		max)
+	require.NoError(t, err)
+
+	var mutex sync.Mutex
+	opened, closed := 0, 0
+	pool.connect = func() (*libvirt.Connect, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		opened++
+		return &libvirt.Connect{}, nil
+	}
+	pool.disconnect = func(conn *libvirt.Connect) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		closed++
+		return nil
+	}
+	return pool, &opened, &closed
+}
+
+func TestConnectionPool(t *testing.T) {
+	_, err := NewConnectionPool(nil, "test:///default", 0)
+	require.Error(t, err)
+
+	pool, opened, closed := newTestConnectionPool(t, 2)
+
+	first, err := pool.Get()
+	require.NoError(t, err)
+	second, err := pool.Get()
+	require.NoError(t, err)
+	require.Equal(t, 2, *opened)
+
+	// a third connection is only handed out once one is returned
+	third := make(chan *libvirt.Connect)
+	go func() {
+		conn, err := pool.Get()
+		require.NoError(t, err)
+		third <- conn
+	}()
+
+	select {
+	case <-third:
+		t.Fatal("pool handed out more connections than allowed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	pool.Put(first)
+	require.True(t, first == <-third, "returned connection was not reused")
+	require.Equal(t, 2, *opened)
+
+	// a discarded connection is replaced by a new one
+	pool.Discard(second)
+	require.Equal(t, 1, *closed)
+	fourth, err := pool.Get()
+	require.NoError(t, err)
+	require.Equal(t, 3, *opened)
+
+	// idle connections are closed right away, borrowed ones once returned
+	pool.Put(fourth)
+	pool.Close()
+	require.Equal(t, 2, *closed)
+
+	pool.Put(first)
+	require.Equal(t, 3, *closed)
+
+	_, err = pool.Get()
+	require.Equal(t, ErrPoolClosed, err)
+}
+
+func TestConnectionPoolConnectError(t *testing.T) {
+	pool, _, _ := newTestConnectionPool(t, 1)
+	pool.connect = func() (*libvirt.Connect, error) {
+		return nil, errors.New("connection refused")
+	}
+
+	// a failed connection attempt must not occupy the only slot
+	for i := 0; i < 2; i++ {
+		_, err := pool.Get()
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Trigger denotes what caused the creation of a snapshot.
+type Trigger string
+
+const (
+	// TriggerManual denotes a snapshot created on request of an operator.
+	TriggerManual Trigger = "manual"
+
+	// TriggerScheduled denotes a snapshot created by a scheduler, e.g. cron.
+	TriggerScheduled Trigger = "scheduled"
+)
+
+// ParseTrigger converts the given string into a Trigger and returns an error
+// if the string does not denote a known trigger.
+func ParseTrigger(trigger string) (Trigger, error) {
+	switch Trigger(trigger) {
+	case TriggerManual, TriggerScheduled:
+		return Trigger(trigger), nil
+	default:
+		return "", fmt.Errorf("invalid trigger '%s': must be one of 'manual' or "+
+			"'scheduled'", trigger)
+	}
+}
+
+// Description is the structured description of a snapshot. It is stored as
+// JSON object in the description of the snapshot, so that it can be parsed by
+// automated tools while still being readable for humans.
+type Description struct {
+	// Summary is the human-readable description of the snapshot.
+	Summary string `json:"summary"`
+
+	// Reason describes why the snapshot was created, e.g. "before upgrade".
+	Reason string `json:"reason,omitempty"`
+
+	// Trigger denotes what caused the creation of the snapshot.
+	Trigger Trigger `json:"trigger,omitempty"`
+
+	// Operator is the user who created the snapshot.
+	Operator string `json:"operator,omitempty"`
+
+	// Structured determines whether the description was stored as JSON object.
+	// Plain text descriptions are parsed into the summary only.
+	Structured bool `json:"-"`
+}
+
+// Encode returns the JSON representation of the description that is stored in
+// the description of a snapshot.
+func (d Description) Encode() (string, error) {
+	doc, err := json.Marshal(d)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal snapshot description: %s", err)
+	}
+	return string(doc), nil
+}
+
+// String returns a human-readable representation of the description, e.g.
+// "nightly backup (reason: before upgrade, trigger: scheduled, operator: root)".
+func (d Description) String() string {
+	fields := make([]string, 0, 3)
+	if d.Reason != "" {
+		fields = append(fields, "reason: "+d.Reason)
+	}
+	if d.Trigger != "" {
+		fields = append(fields, "trigger: "+string(d.Trigger))
+	}
+	if d.Operator != "" {
+		fields = append(fields, "operator: "+d.Operator)
+	}
+
+	if len(fields) == 0 {
+		return d.Summary
+	}
+	if d.Summary == "" {
+		return strings.Join(fields, ", ")
+	}
+	return fmt.Sprintf("%s (%s)", d.Summary, strings.Join(fields, ", "))
+}
+
+// ParseDescription parses the description of a snapshot. A description that
+// is not a JSON object, e.g. of snapshots created by older versions of virsnap
+// or by other tools, is returned as plain text summary.
+func ParseDescription(description string) Description {
+	trimmed := strings.TrimSpace(description)
+	if strings.HasPrefix(trimmed, "{") {
+		var d Description
+		if json.Unmarshal([]byte(trimmed), &d) == nil {
+			d.Structured = true
+			return d
+		}
+	}
+	return Description{Summary: description}
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescription(t *testing.T) {
+	d := Description{
+		Summary:  "snapshot created by virnsnap",
+		Reason:   "before upgrade",
+		Trigger:  TriggerScheduled,
+		Operator: "root",
+	}
+
+	encoded, err := d.Encode()
+	require.NoError(t, err)
+	require.JSONEq(t, `{"summary": "snapshot created by virnsnap", `+
+		`"reason": "before upgrade", "trigger": "scheduled", `+
+		`"operator": "root"}`, encoded)
+
+	parsed := ParseDescription(encoded)
+	require.True(t, parsed.Structured)
+	d.Structured = true
+	require.Equal(t, d, parsed)
+
+	require.Equal(t, "snapshot created by virnsnap (reason: before upgrade, "+
+		"trigger: scheduled, operator: root)", parsed.String())
+}
+
+func TestParseDescriptionPlainText(t *testing.T) {
+	for _, description := range []string{
+		"snapshot created by virnsnap",
+		"",
+		"{not json",
+	} {
+		parsed := ParseDescription(description)
+		require.False(t, parsed.Structured)
+		require.Equal(t, description, parsed.Summary)
+		require.Equal(t, description, parsed.String())
+	}
+}
+
+func TestParseTrigger(t *testing.T) {
+	trigger, err := ParseTrigger("scheduled")
+	require.NoError(t, err)
+	require.Equal(t, TriggerScheduled, trigger)
+
+	_, err = ParseTrigger("cron")
+	require.Error(t, err)
+}
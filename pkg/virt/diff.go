@@ -0,0 +1,193 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// VolatileDescriptorFields are the fields of a domain descriptor that change
+// whenever a VM is started, e.g. the ID of a running VM or the device aliases
+// assigned by qemu. DiffDescriptors ignores them by default.
+var VolatileDescriptorFields = []string{
+	"ID",
+	"Alias",
+	"SecLabel",
+	"Devices.Interfaces.Target",
+	"Devices.Consoles.Source",
+	"Devices.Serials.Source",
+}
+
+// Difference is a field whose value differs between two domain descriptors.
+type Difference struct {
+	// Path is the path of the field in the descriptor, e.g.
+	// "Devices.Disks[0].Source.File.File".
+	Path string
+
+	// Left and Right are the values of the field in the compared descriptors
+	// or "<none>" if the field is not set.
+	Left  string
+	Right string
+}
+
+// String returns a human-readable representation of the difference.
+func (d Difference) String() string {
+	return fmt.Sprintf("%s: '%s' != '%s'", d.Path, d.Left, d.Right)
+}
+
+// ReadDescriptor reads and unmarshals the domain descriptor stored in the file
+// with the given path, e.g. the descriptor.xml of an export.
+func ReadDescriptor(path string) (libvirtxml.Domain, error) {
+	descriptor := libvirtxml.Domain{}
+
+	doc, err := ioutil.ReadFile(path)
+	if err != nil {
+		return descriptor, fmt.Errorf("could not read descriptor: %v", err)
+	}
+
+	err = descriptor.Unmarshal(string(doc))
+	if err != nil {
+		err = fmt.Errorf("unable to unmarshal descriptor '%s': %s", path, err)
+		return descriptor, err
+	}
+	return descriptor, nil
+}
+
+// DiffDescriptors compares the given domain descriptors field by field and
+// returns the fields that differ. Fields matching one of the given ignore
+// patterns or one of the VolatileDescriptorFields are skipped. A pattern
+// either is a single field name, matching this field anywhere in the
+// descriptor (e.g. "Alias"), or a path of field names without indices,
+// matching the field and all of its sub fields (e.g. "Devices.Disks.Source").
+func DiffDescriptors(left libvirtxml.Domain, right libvirtxml.Domain,
+	ignore []string) []Difference {
+	patterns := append(append([]string{}, VolatileDescriptorFields...),
+		ignore...)
+
+	differences := make([]Difference, 0)
+	diffValues(reflect.ValueOf(left), reflect.ValueOf(right), "", "", patterns,
+		&differences)
+	return differences
+}
+
+// diffValues recursively compares the given values and appends the
+// differences. path is the path of the values including indices, pattern the
+// path without indices used for matching the ignore patterns.
+func diffValues(left reflect.Value, right reflect.Value, path string,
+	pattern string, ignore []string, differences *[]Difference) {
+	if ignored(pattern, ignore) {
+		return
+	}
+
+	switch left.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if left.IsNil() || right.IsNil() {
+			if left.IsNil() != right.IsNil() {
+				*differences = append(*differences, Difference{
+					Path:  path,
+					Left:  formatValue(left),
+					Right: formatValue(right),
+				})
+			}
+			return
+		}
+		diffValues(left.Elem(), right.Elem(), path, pattern, ignore, differences)
+
+	case reflect.Struct:
+		for i := 0; i < left.NumField(); i++ {
+			field := left.Type().Field(i)
+			if field.PkgPath != "" || field.Name == "XMLName" {
+				// unexported fields and the XML element names are not compared
+				continue
+			}
+			diffValues(left.Field(i), right.Field(i), join(path, field.Name),
+				join(pattern, field.Name), ignore, differences)
+		}
+
+	case reflect.Slice, reflect.Array:
+		n := left.Len()
+		if right.Len() > n {
+			n = right.Len()
+		}
+		for i := 0; i < n; i++ {
+			elemPath := fmt.Sprintf("%s[%d]", path, i)
+			if i >= left.Len() || i >= right.Len() {
+				difference := Difference{Path: elemPath, Left: "<none>",
+					Right: "<none>"}
+				if i < left.Len() {
+					difference.Left = formatValue(left.Index(i))
+				} else {
+					difference.Right = formatValue(right.Index(i))
+				}
+				*differences = append(*differences, difference)
+				continue
+			}
+			diffValues(left.Index(i), right.Index(i), elemPath, pattern, ignore,
+				differences)
+		}
+
+	default:
+		if !reflect.DeepEqual(left.Interface(), right.Interface()) {
+			*differences = append(*differences, Difference{
+				Path:  path,
+				Left:  formatValue(left),
+				Right: formatValue(right),
+			})
+		}
+	}
+}
+
+// ignored determines whether the field with the given path without indices
+// matches one of the ignore patterns.
+func ignored(pattern string, ignore []string) bool {
+	if pattern == "" {
+		return false
+	}
+
+	fields := strings.Split(pattern, ".")
+	for _, p := range ignore {
+		if !strings.Contains(p, ".") {
+			if fields[len(fields)-1] == p {
+				return true
+			}
+		} else if pattern == p || strings.HasPrefix(pattern, p+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// formatValue returns a short representation of the given value for a
+// Difference.
+func formatValue(value reflect.Value) string {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return "<none>"
+		}
+		value = value.Elem()
+	}
+
+	switch value.Kind() {
+	case reflect.Struct, reflect.Slice, reflect.Array, reflect.Map:
+		return fmt.Sprintf("%+v", value.Interface())
+	default:
+		return fmt.Sprintf("%v", value.Interface())
+	}
+}
+
+// join appends the given field name to the given path.
+func join(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDomain returns a domain descriptor with a single disk backed by the
+// given file.
+func newTestDomain(file string) libvirtxml.Domain {
+	return libvirtxml.Domain{
+		Name: "testvm",
+		Devices: &libvirtxml.DomainDeviceList{
+			Disks: []libvirtxml.DomainDisk{
+				{
+					Device: "disk",
+					Source: &libvirtxml.DomainDiskSource{
+						File: &libvirtxml.DomainDiskSourceFile{
+							File: file,
+						},
+					},
+					Alias: &libvirtxml.DomainAlias{
+						Name: "virtio-disk0",
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestDiffDescriptors(t *testing.T) {
+	exported := newTestDomain("./testvm.qcow2")
+	current := newTestDomain("/var/lib/libvirt/images/testvm.qcow2")
+
+	// volatile fields are ignored
+	id := 3
+	current.ID = &id
+	current.Devices.Disks[0].Alias.Name = "ide0-0-0"
+
+	differences := DiffDescriptors(exported, current, nil)
+	require.Equal(t, []Difference{
+		{
+			Path:  "Devices.Disks[0].Source.File.File",
+			Left:  "./testvm.qcow2",
+			Right: "/var/lib/libvirt/images/testvm.qcow2",
+		},
+	}, differences)
+
+	require.Empty(t, DiffDescriptors(exported, current,
+		[]string{"Devices.Disks.Source"}))
+
+	// missing devices
+	current.Devices.Disks = append(current.Devices.Disks,
+		newTestDomain("/var/lib/libvirt/images/data.qcow2").Devices.Disks...)
+	differences = DiffDescriptors(exported, current,
+		[]string{"Devices.Disks.Source"})
+	require.Len(t, differences, 1)
+	require.Equal(t, "Devices.Disks[1]", differences[0].Path)
+	require.Equal(t, "<none>", differences[0].Left)
+
+	require.Empty(t, DiffDescriptors(exported, exported, nil))
+}
+
+func TestIgnored(t *testing.T) {
+	ignore := []string{"Alias", "Devices.Disks.Source"}
+
+	require.True(t, ignored("Devices.Disks.Alias", ignore))
+	require.True(t, ignored("Devices.Disks.Source", ignore))
+	require.True(t, ignored("Devices.Disks.Source.File.File", ignore))
+	require.False(t, ignored("Devices.Disks.SourceX", ignore))
+	require.False(t, ignored("Devices.Disks", ignore))
+	require.False(t, ignored("", ignore))
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"fmt"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// xmlFlags maps the human readable names of the libvirt XML flags to their
+// values.
+var xmlFlags = map[string]libvirt.DomainXMLFlags{
+	"SECURE":     libvirt.DOMAIN_XML_SECURE,
+	"INACTIVE":   libvirt.DOMAIN_XML_INACTIVE,
+	"UPDATE_CPU": libvirt.DOMAIN_XML_UPDATE_CPU,
+	"MIGRATABLE": libvirt.DOMAIN_XML_MIGRATABLE,
+}
+
+// ParseXMLFlags converts the given human readable XML flags (e.g. "secure",
+// "update-cpu" or "DOMAIN_XML_INACTIVE", case-insensitive) into the combined
+// libvirt.DomainXMLFlags and returns an error if a string does not denote a
+// known flag.
+func ParseXMLFlags(names []string) (libvirt.DomainXMLFlags, error) {
+	var flags libvirt.DomainXMLFlags
+	for _, name := range names {
+		key := strings.ToUpper(strings.Replace(name, "-", "_", -1))
+		key = strings.TrimPrefix(key, "DOMAIN_XML_")
+
+		flag, ok := xmlFlags[key]
+		if !ok {
+			return 0, fmt.Errorf("invalid XML flag '%s': must be one of "+
+				"'secure', 'inactive', 'update-cpu' or 'migratable'", name)
+		}
+		flags |= flag
+	}
+	return flags, nil
+}
+
+// ParseSnapshotXMLFlags converts the given human readable XML flags like
+// ParseXMLFlags into the combined libvirt.DomainSnapshotXMLFlags. Since libvirt
+// only supports the SECURE flag for snapshots, an error is returned for any
+// other flag.
+func ParseSnapshotXMLFlags(names []string) (libvirt.DomainSnapshotXMLFlags,
+	error) {
+	var flags libvirt.DomainSnapshotXMLFlags
+	for _, name := range names {
+		key := strings.ToUpper(strings.Replace(name, "-", "_", -1))
+		key = strings.TrimPrefix(key, "DOMAIN_XML_")
+
+		_, ok := xmlFlags[key]
+		if !ok {
+			return 0, fmt.Errorf("invalid XML flag '%s': must be one of "+
+				"'secure', 'inactive', 'update-cpu' or 'migratable'", name)
+		}
+		if key != "SECURE" {
+			return 0, fmt.Errorf("XML flag '%s' is not supported for "+
+				"snapshots, only 'secure' is", name)
+		}
+		flags |= libvirt.DOMAIN_SNAPSHOT_XML_SECURE
+	}
+	return flags, nil
+}
+
+// XML returns the XML descriptor of the VM as reported by libvirt with the
+// given flags. In contrast to the Descriptor of the VM, the XML is not
+// round-tripped through libvirtxml, so that unknown elements are retained.
+func (vm *VM) XML(flags libvirt.DomainXMLFlags) (string, error) {
+	xml, err := vm.Instance.GetXMLDesc(flags)
+	if err != nil {
+		err = fmt.Errorf("unable to retrieve XML descriptor of VM '%s': %s",
+			vm.Descriptor.Name, err)
+		return "", err
+	}
+	return xml, nil
+}
+
+// SnapshotXML returns the XML descriptor of the snapshot of the VM with
+// exactly the given name as reported by libvirt with the given flags (see
+// ParseSnapshotXMLFlags).
+func (vm *VM) SnapshotXML(name string,
+	flags libvirt.DomainSnapshotXMLFlags) (string, error) {
+	snapshot, err := vm.Instance.SnapshotLookupByName(name, 0)
+	if err != nil {
+		err = fmt.Errorf("unable to find snapshot '%s' of VM '%s': %s", name,
+			vm.Descriptor.Name, err)
+		return "", err
+	}
+	defer snapshot.Free()
+
+	xml, err := snapshot.GetXMLDesc(flags)
+	if err != nil {
+		err = fmt.Errorf("unable to retrieve XML descriptor of snapshot '%s' "+
+			"of VM '%s': %s", name, vm.Descriptor.Name, err)
+		return "", err
+	}
+	return xml, nil
+}
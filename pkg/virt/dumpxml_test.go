@@ -0,0 +1,50 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"testing"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseXMLFlags(t *testing.T) {
+	flags, err := ParseXMLFlags(nil)
+	require.NoError(t, err)
+	require.Equal(t, libvirt.DomainXMLFlags(0), flags)
+
+	flags, err = ParseXMLFlags([]string{"secure", "Update-CPU",
+		"DOMAIN_XML_INACTIVE"})
+	require.NoError(t, err)
+	require.Equal(t, libvirt.DOMAIN_XML_SECURE|libvirt.DOMAIN_XML_UPDATE_CPU|
+		libvirt.DOMAIN_XML_INACTIVE, flags)
+
+	for _, name := range []string{"", "insecure", "xml_secure"} {
+		_, err := ParseXMLFlags([]string{name})
+		require.Error(t, err, name)
+	}
+}
+
+func TestParseSnapshotXMLFlags(t *testing.T) {
+	flags, err := ParseSnapshotXMLFlags(nil)
+	require.NoError(t, err)
+	require.Equal(t, libvirt.DomainSnapshotXMLFlags(0), flags)
+
+	flags, err = ParseSnapshotXMLFlags([]string{"secure", "DOMAIN_XML_SECURE"})
+	require.NoError(t, err)
+	require.Equal(t, libvirt.DOMAIN_SNAPSHOT_XML_SECURE, flags)
+
+	for _, name := range []string{"inactive", "update-cpu", "migratable"} {
+		_, err := ParseSnapshotXMLFlags([]string{"secure", name})
+		require.Error(t, err, name)
+		require.Contains(t, err.Error(), "not supported for snapshots")
+	}
+
+	_, err = ParseSnapshotXMLFlags([]string{"insecure"})
+	require.Error(t, err)
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"github.com/joroec/virsnap/pkg/instrument/log"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+// VerboseErrors determines whether the details of errors returned by libvirt
+// are logged. The error messages returned by this package only contain the
+// message of a libvirt error, but not its code and domain.
+var VerboseErrors bool
+
+// logLibvirtError logs the code, domain and message of the given error at
+// debug level if VerboseErrors is set and the error is a libvirt.Error.
+func logLibvirtError(logger log.Logger, err error) {
+	if !VerboseErrors || logger == nil {
+		return
+	}
+
+	lverr, ok := err.(libvirt.Error)
+	if !ok {
+		return
+	}
+
+	logger.Debugf("libvirt error: code=%d domain=%d level=%d message=%q",
+		lverr.Code, lverr.Domain, lverr.Level, lverr.Message)
+}
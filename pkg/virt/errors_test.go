@@ -0,0 +1,48 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+package virt
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/libvirt/libvirt-go"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogLibvirtError(t *testing.T) {
+	lverr := libvirt.Error{
+		Code:    libvirt.ERR_OPERATION_INVALID,
+		Domain:  libvirt.FROM_DOMAIN,
+		Message: "domain is not running",
+	}
+
+	defer func(verbose bool) { VerboseErrors = verbose }(VerboseErrors)
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(core).Sugar()
+
+	// nothing is logged unless enabled
+	VerboseErrors = false
+	logLibvirtError(logger, lverr)
+	require.Equal(t, 0, logs.Len())
+
+	VerboseErrors = true
+	logLibvirtError(logger, lverr)
+	entries := logs.TakeAll()
+	require.Len(t, entries, 1)
+	require.Equal(t, zapcore.DebugLevel, entries[0].Level)
+	require.Contains(t, entries[0].Message, "domain is not running")
+	require.Contains(t, entries[0].Message,
+		fmt.Sprintf("code=%d", libvirt.ERR_OPERATION_INVALID))
+
+	// errors not returned by libvirt are ignored
+	logLibvirtError(logger, errors.New("some error"))
+	require.Equal(t, 0, logs.Len())
+}
@@ -8,83 +8,787 @@ package virt
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"strings"
+	"time"
 
 	"github.com/joroec/virsnap/pkg/fs"
 	"github.com/kennygrant/sanitize"
 
 	"github.com/joroec/virsnap/pkg/instrument/log"
+	"github.com/joroec/virsnap/pkg/instrument/trace"
 
+	"github.com/libvirt/libvirt-go"
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
 )
 
-// Export is a function that exports a given VM.
-func (vm *VM) Export(outputDirectory string, perm os.FileMode, logger log.Logger) error {
+// DescriptorFilename is the name of the descriptor file stored alongside the
+// disk images of an exported VM.
+const DescriptorFilename = "descriptor.xml"
+
+// PathMode determines how the disk source paths are rewritten in the
+// descriptor stored alongside the exported disk images.
+type PathMode string
+
+const (
+	// PathModeRelative rewrites the disk source paths to "./<filename>", i.e.
+	// relative to the export directory of the VM. This keeps the export
+	// portable, an import needs to resolve the paths against the directory the
+	// disks are placed in.
+	PathModeRelative PathMode = "relative"
+
+	// PathModeAbsolute rewrites the disk source paths to the absolute paths of
+	// the exported disk images. An import can define the VM in place, using the
+	// disk images of the export directory directly.
+	PathModeAbsolute PathMode = "absolute"
+
+	// PathModeOriginal keeps the disk source paths untouched. An import defines
+	// the VM with the original disk locations, so the exported images need to
+	// be copied back to these locations first.
+	PathModeOriginal PathMode = "original"
+)
+
+// ParsePathMode converts the given string into a PathMode and returns an error
+// if the string does not denote a known mode.
+func ParsePathMode(mode string) (PathMode, error) {
+	switch PathMode(mode) {
+	case PathModeRelative, PathModeAbsolute, PathModeOriginal:
+		return PathMode(mode), nil
+	default:
+		return "", fmt.Errorf("invalid path mode '%s': must be one of "+
+			"'relative', 'absolute' or 'original'", mode)
+	}
+}
+
+// ExportOptions bundles the optional settings of an export.
+type ExportOptions struct {
+	// Strict determines whether an export that would not contain any disk
+	// image should be treated as an error instead of being skipped with a
+	// warning.
+	Strict bool
+
+	// PathMode determines how the disk source paths are rewritten in the
+	// exported descriptor. Defaults to PathModeRelative if empty.
+	PathMode PathMode
+
+	// Flatten determines whether each disk is exported as a standalone image
+	// using "qemu-img convert" instead of copying the image file. The backing
+	// chain and the internal snapshots of the disk are not part of the export
+	// then, only the current state of the disk.
+	Flatten bool
+
+	// Pool is the libvirt storage pool the volume disks of the VM are resolved
+	// in (see LookupStoragePool). Volume disks are only supported if a pool is
+	// given, file disks are exported by their file path in any case. May be
+	// nil.
+	Pool *libvirt.StoragePool
+
+	// OnlyChangedDisks determines whether disks whose image did not change in
+	// size and modification time since the previous export to the same local
+	// directory are carried over instead of being copied again. Has no effect
+	// for other destinations and flattened exports.
+	OnlyChangedDisks bool
+
+	// Timer is used to measure the duration of the disk syncs. May be nil.
+	Timer *trace.Timer
+}
+
+// Export is a function that exports a given VM. The disk images are stored
+// in the destination below a key prefix named after the VM, alongside the
+// descriptor and a manifest describing the outcome for each disk. If any disk
+// could not be copied, an error is returned in addition to the manifest. A VM
+// without any disk device is skipped with a warning, leaving the destination
+// untouched and the manifest without disks (see ExportOptions.Strict).
+func (vm *VM) Export(dest fs.Destination, logger log.Logger,
+	opts ExportOptions) (Manifest, error) {
+	manifest := Manifest{
+		VM:    vm.Descriptor.Name,
+		Time:  time.Now(),
+		Disks: make([]DiskResult, 0),
+	}
+
 	// get the XML descriptor
 	xml, err := vm.Instance.GetXMLDesc(0)
 	if err != nil {
 		err = fmt.Errorf("unable to get XML descriptor of VM: %s", err)
-		return err
+		return manifest, err
 	}
 
 	descriptor := libvirtxml.Domain{}
 	err = descriptor.Unmarshal(xml)
 	if err != nil {
 		err = fmt.Errorf("unable to unmarshal XML descriptor of VM: %s", err)
-		return err
+		return manifest, err
+	}
+
+	// a VM without any disk device (e.g. only network or cdrom devices) would
+	// result in an export containing nothing but the descriptor, so nothing
+	// is written to the destination at all
+	disks := diskDevices(descriptor)
+	if len(disks) == 0 {
+		if opts.Strict {
+			err = fmt.Errorf("VM '%s' has no disk devices, export would not "+
+				"contain any disk image", vm.Descriptor.Name)
+			return manifest, err
+		}
+		logger.Warnf("VM '%s' has no disk devices, skipping the export",
+			vm.Descriptor.Name)
+		return manifest, nil
 	}
 
-	// create the output directory for the VM if not already existing
+	// all files of the VM are stored below a key prefix named after the VM
 	sanVMName := sanitize.BaseName(vm.Descriptor.Name)
 
-	vmOutputDir := path.Join(outputDirectory, sanVMName)
-	err = os.MkdirAll(vmOutputDir, perm)
+	// the descriptor and the manifest are staged in a temporary directory
+	// before they are stored in the destination
+	staging, err := ioutil.TempDir("", "virsnap-export")
 	if err != nil {
-		return err
+		err = fmt.Errorf("could not create staging directory: %v", err)
+		return manifest, err
 	}
+	defer os.RemoveAll(staging)
 
-	// loop over HDDs and store them using differential file sync
-	for _, disk := range descriptor.Devices.Disks {
-		// only observe disks, not cdroms
-		if disk.Device != "disk" {
-			continue
+	// formats holds the format of each flattened image by target device
+	formats := make(map[string]string)
+
+	// the manifest of a previous export tells which disks can be carried over.
+	// The size of a flattened image differs from its source, so it can never
+	// be compared.
+	var previous *Manifest
+	if opts.OnlyChangedDisks && !opts.Flatten {
+		previous = vm.previousManifest(dest, logger)
+	}
+
+	// loop over HDDs and store them in the destination
+	for _, disk := range disks {
+		result := DiskResult{
+			Target: diskTarget(disk),
 		}
 
-		filepath := disk.Source.File.File
-		if filepath == "" {
-			logger.Errorf("could not get filepath of disk '%s'", disk.Target)
+		filepath, err := diskSourcePath(disk, opts.Pool)
+		if err != nil {
+			logger.Errorf("could not get filepath of disk '%s': %v",
+				diskTarget(disk), err)
+			result.Status = DiskFailed
+			result.Error = err.Error()
+			manifest.Disks = append(manifest.Disks, result)
 			continue
 		}
 
 		filename := path.Base(filepath)
+		result.Source = filepath
+		result.File = filename
+
+		// the descriptor may lie about the format of the image or omit it, which
+		// matters as soon as the image is converted
+		var sourceFormat string
+		if opts.Flatten {
+			sourceFormat = probeFormat(disk, filepath, logger)
+			formats[result.Target] = flattenFormat(sourceFormat)
+		}
+
+		// remember the state of the source, so that a later export can detect
+		// whether the disk changed in the meantime
+		info, err := os.Stat(filepath)
+		if err == nil {
+			result.Size = info.Size()
+			result.ModTime = info.ModTime()
+		}
+
+		// the exported image of a volume disk is referenced as a file, unless
+		// the original source is kept
+		if disk.Source.Volume != nil && opts.PathMode != PathModeOriginal {
+			disk.Source.Volume = nil
+			disk.Source.File = &libvirtxml.DomainDiskSourceFile{}
+		}
+
+		// transform descriptor, a volume disk has no file source to rewrite if
+		// the original source is kept
+		if opts.PathMode != PathModeOriginal {
+			disk.Source.File.File = exportedPath(opts.PathMode, dest, sanVMName,
+				filepath)
+		}
+
+		// an unchanged disk does not need to be copied again
+		if previous != nil && carriedOver(previous, result,
+			dest.Location(path.Join(sanVMName, filename))) {
+			logger.Infof("disk '%s' did not change since the previous export, "+
+				"carrying it over", filepath)
+			result.Status = DiskCarriedOver
+			result.Checksum = previousChecksum(previous, result.Target)
+			if result.Checksum == "" {
+				result.Checksum = checksum(
+					dest.Location(path.Join(sanVMName, filename)), logger)
+			}
+			manifest.Disks = append(manifest.Disks, result)
+			continue
+		}
 
-		// transform descriptor
-		disk.Source.File.File = "./" + filename
+		// a VM restarted in the meantime, e.g. due to its lifecycle policy, would
+		// write to the disk while it is copied
+		err = vm.ensureShutoff()
+		if err != nil {
+			logger.Errorf("could not sync the disk '%s': %v", filepath, err)
+			result.Status = DiskFailed
+			result.Error = err.Error()
+			manifest.Disks = append(manifest.Disks, result)
+			continue
+		}
 
 		// sync file
-		err = fs.Sync(filepath, path.Join(vmOutputDir, filename), logger)
+		span := opts.Timer.Start("sync " + filename)
+		if opts.Flatten {
+			result.Checksum, err = flattenDisk(filepath, sourceFormat,
+				formats[result.Target], dest, path.Join(sanVMName, filename),
+				staging, logger)
+		} else {
+			err = dest.Put(filepath, path.Join(sanVMName, filename))
+		}
+		span.End()
+		if err == nil && !opts.Flatten {
+			// the source is hashed instead of the copy, so that a copy
+			// corrupted on its way to the destination is detected as well
+			result.Checksum = checksum(filepath, logger)
+		}
+		if err == nil {
+			// the copy is only consistent if the VM stayed off the whole time
+			err = vm.ensureShutoff()
+		}
 		if err != nil {
 			logger.Errorf("could sync the disk '%s': %v", filepath, err)
+			result.Status = DiskFailed
+			result.Error = err.Error()
+			result.Checksum = ""
+		} else {
+			result.Status = DiskCopied
 		}
+		manifest.Disks = append(manifest.Disks, result)
+	}
+
+	// the UEFI variables of the VM are stored in a separate file. Without
+	// it, the exported VM loses its boot entries and may not boot anymore.
+	manifest.NVRAM = vm.exportNVRAM(&descriptor, dest, sanVMName, opts.PathMode,
+		logger)
+
+	// the flattened images do not have a backing store anymore
+	if opts.Flatten {
+		flattenDescriptor(&descriptor, formats)
 	}
 
 	// store new descriptor alongside the disk files
 	xmldoc, err := descriptor.Marshal()
 	if err != nil {
 		err = fmt.Errorf("could marshal the new descriptor '%v': %v", descriptor, err)
+		return manifest, err
+	}
+
+	err = ioutil.WriteFile(path.Join(staging, DescriptorFilename), []byte(xmldoc),
+		0600)
+	if err != nil {
+		err = fmt.Errorf("could not write new descriptor file: %v", err)
+		return manifest, err
+	}
+
+	err = dest.Put(path.Join(staging, DescriptorFilename),
+		path.Join(sanVMName, DescriptorFilename))
+	if err != nil {
+		err = fmt.Errorf("could not store new descriptor file: %v", err)
+		return manifest, err
+	}
+
+	// the checksums allow to detect a corruption of the export later on
+	err = fs.WriteChecksums(staging, manifest.Checksums())
+	if err != nil {
+		return manifest, err
+	}
+
+	err = dest.Put(path.Join(staging, fs.ChecksumsFilename),
+		path.Join(sanVMName, fs.ChecksumsFilename))
+	if err != nil {
+		err = fmt.Errorf("could not store the checksums: %v", err)
+		return manifest, err
+	}
+
+	err = manifest.Write(staging)
+	if err != nil {
+		return manifest, err
+	}
+
+	err = dest.Put(path.Join(staging, ManifestFilename),
+		path.Join(sanVMName, ManifestFilename))
+	if err != nil {
+		err = fmt.Errorf("could not store the manifest: %v", err)
+		return manifest, err
+	}
+
+	if manifest.NVRAM != nil && manifest.NVRAM.Status == DiskFailed {
+		err = fmt.Errorf("unable to export the NVRAM of VM '%s': %s",
+			vm.Descriptor.Name, manifest.NVRAM.Error)
+		return manifest, err
+	}
+
+	// a partial export must not be reported as success
+	failed := manifest.FailedDisks()
+	if len(failed) > 0 {
+		targets := make([]string, 0, len(failed))
+		for _, disk := range failed {
+			targets = append(targets, disk.Target)
+		}
+		err = fmt.Errorf("unable to export %d of %d disks of VM '%s': %s",
+			len(failed), len(manifest.Disks), vm.Descriptor.Name,
+			strings.Join(targets, ", "))
+		return manifest, err
+	}
+
+	// the time of the export is only informational, so failing to store it
+	// does not fail the export
+	err = vm.RecordLastExport(manifest.Time)
+	if err != nil {
+		logger.Warn(err)
+	}
+
+	return manifest, nil
+}
+
+// exportedPath returns the path of the exported copy of the file with the
+// given source path as referenced by the exported descriptor, according to
+// the given path mode.
+func exportedPath(mode PathMode, dest fs.Destination, sanVMName string,
+	source string) string {
+	filename := path.Base(source)
+	switch mode {
+	case PathModeAbsolute:
+		return dest.Location(path.Join(sanVMName, filename))
+	case PathModeOriginal:
+		// keep the source path untouched
+		return source
+	default:
+		return "./" + filename
+	}
+}
+
+// nvramPath returns the path of the UEFI variable store of the VM described
+// by the given descriptor or an empty string if the VM does not have one.
+func nvramPath(descriptor libvirtxml.Domain) string {
+	if descriptor.OS == nil || descriptor.OS.NVRam == nil {
+		return ""
+	}
+	return descriptor.OS.NVRam.NVRam
+}
+
+// exportNVRAM stores the UEFI variable store of the VM in the destination
+// alongside the disks and rewrites its path in the given descriptor according
+// to the given path mode. nil is returned if the VM does not have a variable
+// store. The firmware loader and the template of the variable store are
+// read-only files of the firmware package of the host, so their paths are
+// kept and need to exist on the host the VM is imported on.
+func (vm *VM) exportNVRAM(descriptor *libvirtxml.Domain, dest fs.Destination,
+	sanVMName string, mode PathMode, logger log.Logger) *DiskResult {
+	source := nvramPath(*descriptor)
+	if source == "" {
+		return nil
+	}
+
+	filename := path.Base(source)
+	result := &DiskResult{
+		Target: "nvram",
+		Source: source,
+		File:   filename,
+	}
+
+	info, err := os.Stat(source)
+	if err == nil {
+		result.Size = info.Size()
+		result.ModTime = info.ModTime()
+	}
+
+	descriptor.OS.NVRam.NVRam = exportedPath(mode, dest, sanVMName, source)
+
+	// the guest firmware writes to the variable store while the VM is running
+	err = vm.ensureShutoff()
+	if err == nil {
+		err = dest.Put(source, path.Join(sanVMName, filename))
+	}
+	if err != nil {
+		logger.Errorf("could not sync the NVRAM '%s': %v", source, err)
+		result.Status = DiskFailed
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Status = DiskCopied
+	result.Checksum = checksum(source, logger)
+	return result
+}
+
+// checksum returns the SHA-256 of the file with the given path. Failing to
+// compute it does not fail the export, the file is only missing from the
+// checksum file then. An empty string is returned in this case.
+func checksum(file string, logger log.Logger) string {
+	sum, err := fs.Checksum(file)
+	if err != nil {
+		logger.Warnf("unable to compute checksum: %v", err)
+		return ""
+	}
+	return sum
+}
+
+// flattenDisk converts the disk image with the given path and format into a
+// standalone image of the given format and stores it in the destination under
+// the given key. A local destination is written directly, for other
+// destinations the image is converted into the staging directory first. The
+// checksum of the converted image is returned (see checksum).
+func flattenDisk(source string, sourceFormat string, format string,
+	dest fs.Destination, remoteKey string, staging string,
+	logger log.Logger) (string, error) {
+	if local, ok := dest.(*fs.FilesystemDestination); ok {
+		target := local.Location(remoteKey)
+		err := os.MkdirAll(path.Dir(target), local.Perm)
+		if err != nil {
+			return "", err
+		}
+		err = ConvertDisk(source, sourceFormat, target, format, logger)
+		if err != nil {
+			return "", err
+		}
+		return checksum(target, logger), nil
+	}
+
+	staged := path.Join(staging, path.Base(remoteKey))
+	defer os.Remove(staged)
+
+	err := ConvertDisk(source, sourceFormat, staged, format, logger)
+	if err != nil {
+		return "", err
+	}
+	sum := checksum(staged, logger)
+	return sum, dest.Put(staged, remoteKey)
+}
+
+// probeFormat returns the format of the disk image with the given path as
+// detected by qemu-img. A format differing from the driver type in the
+// descriptor is reported as a warning. If the image cannot be inspected, the
+// driver type of the descriptor is returned.
+func probeFormat(disk libvirtxml.DomainDisk, source string,
+	logger log.Logger) string {
+	declared := ""
+	if disk.Driver != nil {
+		declared = disk.Driver.Type
+	}
+
+	info, err := DiskInfo(source)
+	if err == nil && info.Format == "" {
+		err = fmt.Errorf("qemu-img did not report a format")
+	}
+	if err != nil {
+		logger.Warnf("could not probe format of disk '%s', assuming '%s' as "+
+			"stated by the descriptor: %v", source, declared, err)
+		return declared
+	}
+
+	if declared == "" {
+		logger.Debugf("descriptor does not state the format of disk '%s', "+
+			"probed '%s'", source, info.Format)
+	} else if declared != info.Format {
+		logger.Warnf("descriptor states format '%s' for disk '%s', but the "+
+			"image is '%s', using the probed format", declared, source,
+			info.Format)
+	}
+	return info.Format
+}
+
+// flattenFormat returns the image format of a flattened export of a disk
+// image in the given format. Raw images stay raw, all other images are
+// converted to qcow2.
+func flattenFormat(format string) string {
+	if format == "raw" {
+		return "raw"
+	}
+	return "qcow2"
+}
+
+// flattenDescriptor rewrites the file-backed disks of the given descriptor to
+// reference a flattened image without any backing store. The format of the
+// images is taken from the given map by target device, disks missing in the
+// map get the format returned by flattenFormat for their driver type.
+func flattenDescriptor(descriptor *libvirtxml.Domain,
+	formats map[string]string) {
+	if descriptor.Devices == nil {
+		return
+	}
+
+	for i := range descriptor.Devices.Disks {
+		disk := &descriptor.Devices.Disks[i]
+		if disk.Device != "disk" || disk.Source == nil || disk.Source.File == nil {
+			continue
+		}
+
+		format, ok := formats[diskTarget(*disk)]
+		if !ok {
+			declared := ""
+			if disk.Driver != nil {
+				declared = disk.Driver.Type
+			}
+			format = flattenFormat(declared)
+		}
+
+		disk.BackingStore = nil
+		if disk.Driver == nil {
+			disk.Driver = &libvirtxml.DomainDiskDriver{Name: "qemu"}
+		}
+		disk.Driver.Type = format
+	}
+}
+
+// ensureShutoff returns an error if the VM is not shut off (anymore).
+func (vm *VM) ensureShutoff() error {
+	state, _, err := vm.Instance.GetState()
+	if err != nil {
+		return fmt.Errorf("unable to retrieve state of VM '%s': %s",
+			vm.Descriptor.Name, err)
+	}
+
+	if state != libvirt.DOMAIN_SHUTOFF {
+		err = fmt.Errorf("VM '%s' is not shut off anymore but '%s', the disk "+
+			"may have been modified while copying", vm.Descriptor.Name,
+			GetStateString(state))
+		if vm.RestartsOnPoweroff() {
+			err = fmt.Errorf("%s (the VM is configured to restart on poweroff)",
+				err)
+		}
 		return err
 	}
+	return nil
+}
+
+// ExportUpToDate checks whether a previous export of the VM to the given
+// output directory is still up to date, i.e. its manifest reports all disks of
+// the VM as copied and neither the size nor the modification time of any disk
+// image changed since. This is a cheap check that allows to skip the shutdown
+// of a VM whose disks were not modified. If there is no previous export, false
+// is returned without an error.
+func (vm *VM) ExportUpToDate(outputDirectory string) (bool, error) {
+	vmOutputDir := vm.exportDirectory(outputDirectory)
+
+	_, err := os.Stat(path.Join(vmOutputDir, ManifestFilename))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
 
-	// create descriptor file if not existent, overwrite of existent
-	file, err := os.Create(path.Join(vmOutputDir, "descriptor.xml"))
+	manifest, err := ReadManifest(vmOutputDir)
 	if err != nil {
-		err = fmt.Errorf("could not open new descriptor file: %v", err)
+		return false, err
+	}
+
+	disks := diskDevices(vm.Descriptor)
+	if len(disks) != len(manifest.Disks) || len(manifest.FailedDisks()) > 0 {
+		return false, nil
+	}
+
+	results := make(map[string]DiskResult, len(manifest.Disks))
+	for _, result := range manifest.Disks {
+		results[result.Source] = result
+	}
+
+	for _, disk := range disks {
+		if disk.Source == nil || disk.Source.File == nil {
+			return false, nil
+		}
+
+		result, ok := results[disk.Source.File.File]
+		if !ok {
+			return false, nil
+		}
+
+		source, err := os.Stat(result.Source)
+		if err != nil {
+			return false, fmt.Errorf("could not stat disk '%s': %v",
+				result.Source, err)
+		}
+		if source.Size() != result.Size || !source.ModTime().Equal(result.ModTime) {
+			return false, nil
+		}
+
+		// the exported copy may have been removed or truncated
+		exported, err := os.Stat(path.Join(vmOutputDir, result.File))
+		if err != nil || exported.Size() != result.Size {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// previousManifest returns the manifest of a previous export of the VM to the
+// given destination or nil if there is none. Only local destinations are
+// inspected.
+func (vm *VM) previousManifest(dest fs.Destination,
+	logger log.Logger) *Manifest {
+	local, ok := dest.(*fs.FilesystemDestination)
+	if !ok {
+		logger.Warnf("previous exports can only be inspected in a local "+
+			"directory, copying all disks of VM '%s'", vm.Descriptor.Name)
+		return nil
+	}
+
+	vmOutputDir := vm.exportDirectory(local.Directory)
+	_, err := os.Stat(path.Join(vmOutputDir, ManifestFilename))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	manifest, err := ReadManifest(vmOutputDir)
+	if err != nil {
+		logger.Warnf("unable to read previous export of VM '%s', copying all "+
+			"disks: %v", vm.Descriptor.Name, err)
+		return nil
+	}
+	return &manifest
+}
+
+// carriedOver determines whether the disk of the given result can be carried
+// over from the export described by the previous manifest, i.e. the disk was
+// exported to the same file before, neither the size nor the modification time
+// of its image changed since and the exported copy at the given path still has
+// the size of the image.
+func carriedOver(previous *Manifest, result DiskResult, exported string) bool {
+	for _, disk := range previous.Disks {
+		if disk.Target != result.Target || disk.Source != result.Source {
+			continue
+		}
+
+		if disk.Status != DiskCopied && disk.Status != DiskCarriedOver {
+			return false
+		}
+		if disk.File != result.File || disk.Size != result.Size ||
+			!disk.ModTime.Equal(result.ModTime) {
+			return false
+		}
+
+		// the exported copy may have been removed or truncated
+		info, err := os.Stat(exported)
+		return err == nil && info.Size() == result.Size
+	}
+	return false
+}
+
+// previousChecksum returns the checksum of the disk with the given target
+// device in the previous manifest. Empty if the previous export did not
+// record one.
+func previousChecksum(previous *Manifest, target string) string {
+	for _, disk := range previous.Disks {
+		if disk.Target == target {
+			return disk.Checksum
+		}
+	}
+	return ""
+}
+
+// HasExport determines whether the given output directory contains an export
+// of the VM, i.e. the export directory of the VM is not empty. Exports made
+// before the manifest was introduced only contain the descriptor and the disk
+// images, so the manifest alone does not tell. If the directory cannot be
+// read, an export is assumed, so that it is never removed by accident.
+func (vm *VM) HasExport(outputDirectory string) bool {
+	entries, err := ioutil.ReadDir(vm.exportDirectory(outputDirectory))
+	if os.IsNotExist(err) {
+		return false
+	}
+	return err != nil || len(entries) > 0
+}
+
+// RemoveFailedExport removes the export directory of the VM in the given
+// output directory after a failed export. If partial is false, the directory
+// is only removed if it is empty. Otherwise, any partially exported content is
+// removed as well. The caller needs to make sure that the directory did not
+// contain a previous export before (see HasExport), since it would be removed
+// as well.
+func (vm *VM) RemoveFailedExport(outputDirectory string, partial bool) error {
+	vmOutputDir := vm.exportDirectory(outputDirectory)
+
+	_, err := os.Stat(vmOutputDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if partial {
+		err = os.RemoveAll(vmOutputDir)
+		if err != nil {
+			err = fmt.Errorf("could not remove export directory '%s': %v",
+				vmOutputDir, err)
+		}
 		return err
 	}
-	defer file.Close()
 
-	file.WriteString(xmldoc)
+	entries, err := ioutil.ReadDir(vmOutputDir)
+	if err != nil {
+		return fmt.Errorf("could not read export directory '%s': %v",
+			vmOutputDir, err)
+	}
+	if len(entries) > 0 {
+		return nil
+	}
 
-	return nil
+	err = os.Remove(vmOutputDir)
+	if err != nil {
+		err = fmt.Errorf("could not remove export directory '%s': %v",
+			vmOutputDir, err)
+	}
+	return err
+}
+
+// exportDirectory returns the export directory of the VM in the given output
+// directory.
+func (vm *VM) exportDirectory(outputDirectory string) string {
+	return path.Join(outputDirectory, sanitize.BaseName(vm.Descriptor.Name))
+}
+
+// ExportSize returns the number of bytes an export of the VM would copy, i.e.
+// the sum of the allocated sizes of all file-backed disks of the VM. Disks
+// that are not backed by a file are ignored, like they are by Export.
+func (vm *VM) ExportSize() (uint64, error) {
+	var total uint64
+	for _, disk := range diskDevices(vm.Descriptor) {
+		if disk.Source == nil || disk.Source.File == nil ||
+			disk.Source.File.File == "" {
+			continue
+		}
+
+		allocated, err := DiskAllocation(disk.Source.File.File)
+		if err != nil {
+			return 0, err
+		}
+		total += allocated
+	}
+	return total, nil
+}
+
+// diskDevices returns the disk devices of the given domain descriptor. Other
+// block devices like cdroms or floppies are omitted. Since the source of a
+// disk is a pointer, changes to the source of a returned disk are reflected in
+// the descriptor.
+func diskDevices(descriptor libvirtxml.Domain) []libvirtxml.DomainDisk {
+	if descriptor.Devices == nil {
+		return nil
+	}
+
+	disks := make([]libvirtxml.DomainDisk, 0, len(descriptor.Devices.Disks))
+	for _, disk := range descriptor.Devices.Disks {
+		// only observe disks, not cdroms
+		if disk.Device == "disk" {
+			disks = append(disks, disk)
+		}
+	}
+	return disks
+}
+
+// diskTarget returns the target device name of the given disk (e.g. "vda") or
+// an empty string, if the descriptor does not specify one.
+func diskTarget(disk libvirtxml.DomainDisk) string {
+	if disk.Target == nil {
+		return ""
+	}
+	return disk.Target.Dev
 }
@@ -0,0 +1,281 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/joroec/virsnap/pkg/fs"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportUpToDate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virsnap-export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the disk image of the VM and its exported copy
+	source := path.Join(dir, "testvm.qcow2")
+	require.NoError(t, ioutil.WriteFile(source, []byte("disk"), 0600))
+
+	exportDir := path.Join(dir, "export")
+	vmExportDir := path.Join(exportDir, "testvm")
+	require.NoError(t, os.MkdirAll(vmExportDir, 0700))
+	require.NoError(t, ioutil.WriteFile(path.Join(vmExportDir, "testvm.qcow2"),
+		[]byte("disk"), 0600))
+
+	vm := VM{
+		Descriptor: libvirtxml.Domain{
+			Name: "testvm",
+			Devices: &libvirtxml.DomainDeviceList{
+				Disks: []libvirtxml.DomainDisk{
+					{
+						Device: "disk",
+						Source: &libvirtxml.DomainDiskSource{
+							File: &libvirtxml.DomainDiskSourceFile{
+								File: source,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// no previous export
+	upToDate, err := vm.ExportUpToDate(exportDir)
+	require.NoError(t, err)
+	require.False(t, upToDate)
+
+	info, err := os.Stat(source)
+	require.NoError(t, err)
+
+	manifest := Manifest{
+		VM:   "testvm",
+		Time: time.Now(),
+		Disks: []DiskResult{
+			{
+				Source:  source,
+				File:    "testvm.qcow2",
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+				Status:  DiskCopied,
+			},
+		},
+	}
+	require.NoError(t, manifest.Write(vmExportDir))
+
+	upToDate, err = vm.ExportUpToDate(exportDir)
+	require.NoError(t, err)
+	require.True(t, upToDate)
+
+	// the disk was modified after the export
+	later := info.ModTime().Add(time.Minute)
+	require.NoError(t, os.Chtimes(source, later, later))
+
+	upToDate, err = vm.ExportUpToDate(exportDir)
+	require.NoError(t, err)
+	require.False(t, upToDate)
+}
+
+func TestRemoveFailedExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virsnap-export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	vm := VM{
+		Descriptor: libvirtxml.Domain{
+			Name: "testvm",
+		},
+	}
+	vmExportDir := path.Join(dir, "testvm")
+
+	// nothing to remove
+	require.False(t, vm.HasExport(dir))
+	require.NoError(t, vm.RemoveFailedExport(dir, false))
+
+	// an empty directory is always removed
+	require.NoError(t, os.MkdirAll(vmExportDir, 0700))
+	require.NoError(t, vm.RemoveFailedExport(dir, false))
+	_, err = os.Stat(vmExportDir)
+	require.True(t, os.IsNotExist(err))
+
+	// partial content is only removed on request
+	require.NoError(t, os.MkdirAll(vmExportDir, 0700))
+	require.NoError(t, ioutil.WriteFile(path.Join(vmExportDir, "testvm.qcow2"),
+		[]byte("disk"), 0600))
+	require.NoError(t, vm.RemoveFailedExport(dir, false))
+	_, err = os.Stat(vmExportDir)
+	require.NoError(t, err)
+
+	require.NoError(t, vm.RemoveFailedExport(dir, true))
+	_, err = os.Stat(vmExportDir)
+	require.True(t, os.IsNotExist(err))
+
+	// an empty directory is no previous export
+	require.NoError(t, os.MkdirAll(vmExportDir, 0700))
+	require.False(t, vm.HasExport(dir))
+
+	// an export made before the manifest was introduced
+	require.NoError(t, ioutil.WriteFile(path.Join(vmExportDir,
+		DescriptorFilename), []byte("<domain/>"), 0600))
+	require.True(t, vm.HasExport(dir))
+
+	// a manifest denotes a previous export
+	require.NoError(t, os.Remove(path.Join(vmExportDir, DescriptorFilename)))
+	manifest := Manifest{VM: "testvm"}
+	require.NoError(t, manifest.Write(vmExportDir))
+	require.True(t, vm.HasExport(dir))
+}
+
+func TestFlattenDescriptor(t *testing.T) {
+	descriptor := libvirtxml.Domain{}
+	err := descriptor.Unmarshal(`<domain type="kvm">
+  <name>testvm</name>
+  <devices>
+    <disk type="file" device="disk">
+      <driver name="qemu" type="qcow2"/>
+      <source file="./testvm-overlay.qcow2"/>
+      <backingStore type="file">
+        <format type="qcow2"/>
+        <source file="/var/lib/libvirt/images/testvm-base.qcow2"/>
+      </backingStore>
+      <target dev="vda" bus="virtio"/>
+    </disk>
+    <disk type="file" device="disk">
+      <driver name="qemu" type="raw"/>
+      <source file="./testvm-data.img"/>
+      <target dev="vdb" bus="virtio"/>
+    </disk>
+    <disk type="file" device="cdrom">
+      <driver name="qemu" type="raw"/>
+      <source file="/var/lib/libvirt/images/install.iso"/>
+      <target dev="sda" bus="sata"/>
+    </disk>
+  </devices>
+</domain>`)
+	require.NoError(t, err)
+	require.NotNil(t, descriptor.Devices.Disks[0].BackingStore)
+
+	// the data disk claims to be raw, but was probed as qcow2
+	flattenDescriptor(&descriptor, map[string]string{"vdb": "qcow2"})
+
+	disks := descriptor.Devices.Disks
+	require.Nil(t, disks[0].BackingStore)
+	require.Equal(t, "qcow2", disks[0].Driver.Type)
+	require.Equal(t, "./testvm-overlay.qcow2", disks[0].Source.File.File)
+	require.Nil(t, disks[1].BackingStore)
+	require.Equal(t, "qcow2", disks[1].Driver.Type)
+	require.Equal(t, "raw", disks[2].Driver.Type)
+
+	xml, err := descriptor.Marshal()
+	require.NoError(t, err)
+	require.NotContains(t, xml, "backingStore")
+}
+
+func TestFlattenFormat(t *testing.T) {
+	require.Equal(t, "raw", flattenFormat("raw"))
+	require.Equal(t, "qcow2", flattenFormat("qcow2"))
+	require.Equal(t, "qcow2", flattenFormat("vmdk"))
+	require.Equal(t, "qcow2", flattenFormat(""))
+}
+
+func TestCarriedOver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virsnap-export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	exported := path.Join(dir, "testvm-data.img")
+	require.NoError(t, ioutil.WriteFile(exported, []byte("data"), 0600))
+
+	modTime := time.Unix(1564427514, 0).UTC()
+	result := DiskResult{
+		Target:  "vdb",
+		Source:  "/var/lib/libvirt/images/testvm-data.img",
+		File:    "testvm-data.img",
+		Size:    4,
+		ModTime: modTime,
+	}
+
+	previous := Manifest{
+		VM: "testvm",
+		Disks: []DiskResult{
+			{
+				Target:  "vda",
+				Source:  "/var/lib/libvirt/images/testvm.qcow2",
+				File:    "testvm.qcow2",
+				Size:    4,
+				ModTime: modTime,
+				Status:  DiskCopied,
+			},
+			{
+				Target:  "vdb",
+				Source:  "/var/lib/libvirt/images/testvm-data.img",
+				File:    "testvm-data.img",
+				Size:    4,
+				ModTime: modTime,
+				Status:  DiskCarriedOver,
+			},
+		},
+	}
+	require.True(t, carriedOver(&previous, result, exported))
+
+	// the disk was modified after the previous export
+	changed := result
+	changed.ModTime = modTime.Add(time.Minute)
+	require.False(t, carriedOver(&previous, changed, exported))
+
+	// the disk was not exported successfully before
+	previous.Disks[1].Status = DiskFailed
+	require.False(t, carriedOver(&previous, result, exported))
+	previous.Disks[1].Status = DiskCopied
+
+	// the exported copy was truncated or removed
+	require.NoError(t, ioutil.WriteFile(exported, []byte("da"), 0600))
+	require.False(t, carriedOver(&previous, result, exported))
+	require.NoError(t, os.Remove(exported))
+	require.False(t, carriedOver(&previous, result, exported))
+
+	// a disk unknown to the previous export
+	unknown := result
+	unknown.Target = "vdc"
+	require.False(t, carriedOver(&previous, unknown, exported))
+}
+
+func TestNVRAMPath(t *testing.T) {
+	require.Empty(t, nvramPath(libvirtxml.Domain{}))
+
+	descriptor := libvirtxml.Domain{}
+	err := descriptor.Unmarshal(`<domain type="kvm">
+  <name>uefivm</name>
+  <os>
+    <type arch="x86_64" machine="q35">hvm</type>
+    <loader readonly="yes" type="pflash">/usr/share/OVMF/OVMF_CODE.fd</loader>
+    <nvram template="/usr/share/OVMF/OVMF_VARS.fd">/var/lib/libvirt/qemu/nvram/uefivm_VARS.fd</nvram>
+  </os>
+</domain>`)
+	require.NoError(t, err)
+	require.Equal(t, "/var/lib/libvirt/qemu/nvram/uefivm_VARS.fd",
+		nvramPath(descriptor))
+}
+
+func TestExportedPath(t *testing.T) {
+	dest := &fs.FilesystemDestination{Directory: "/backup"}
+	source := "/var/lib/libvirt/qemu/nvram/uefivm_VARS.fd"
+
+	require.Equal(t, "./uefivm_VARS.fd",
+		exportedPath(PathModeRelative, dest, "uefivm", source))
+	require.Equal(t, "/backup/uefivm/uefivm_VARS.fd",
+		exportedPath(PathModeAbsolute, dest, "uefivm", source))
+	require.Equal(t, source,
+		exportedPath(PathModeOriginal, dest, "uefivm", source))
+}
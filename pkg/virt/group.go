@@ -0,0 +1,123 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GroupKey returns the name of the group the given VM belongs to.
+type GroupKey func(vm *VM) string
+
+// VMGroup is a named group of VMs.
+type VMGroup struct {
+	Name string
+	VMs  []VM
+}
+
+// ParseGroupBy returns the GroupKey denoted by the given specification:
+// "prefix:<n>" groups VMs by the first n characters of their name,
+// "prefix:<delimiter>" groups VMs by their name up to the first occurrence of
+// the delimiter, e.g. "prefix:-" puts "web-1" and "web-2" into group "web".
+// "tag:<key>" groups VMs by the value of the element <key> in the <metadata>
+// of their descriptor.
+func ParseGroupBy(spec string) (GroupKey, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid grouping '%s': must be one of "+
+			"'prefix:<n>', 'prefix:<delimiter>' or 'tag:<key>'", spec)
+	}
+	kind, arg := parts[0], parts[1]
+
+	switch kind {
+	case "prefix":
+		n, err := strconv.Atoi(arg)
+		if err == nil {
+			if n <= 0 {
+				return nil, fmt.Errorf("invalid grouping '%s': prefix length "+
+					"must be greater than zero", spec)
+			}
+			return func(vm *VM) string {
+				name := []rune(vm.Descriptor.Name)
+				if len(name) > n {
+					name = name[:n]
+				}
+				return string(name)
+			}, nil
+		}
+
+		return func(vm *VM) string {
+			return strings.SplitN(vm.Descriptor.Name, arg, 2)[0]
+		}, nil
+
+	case "tag":
+		return func(vm *VM) string {
+			return vm.MetadataValue(arg)
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("invalid grouping '%s': must be one of "+
+			"'prefix:<n>', 'prefix:<delimiter>' or 'tag:<key>'", spec)
+	}
+}
+
+// GroupVMs groups the given VMs by the given key. The groups are sorted by
+// name, the order of the VMs within a group is preserved.
+func GroupVMs(vms []VM, key GroupKey) []VMGroup {
+	indices := make(map[string]int)
+	groups := make([]VMGroup, 0)
+
+	for i := range vms {
+		name := key(&vms[i])
+
+		index, ok := indices[name]
+		if !ok {
+			index = len(groups)
+			indices[name] = index
+			groups = append(groups, VMGroup{Name: name})
+		}
+		groups[index].VMs = append(groups[index].VMs, vms[i])
+	}
+
+	sort.SliceStable(groups, func(i int, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
+// MetadataValue returns the text of the first element with the given name in
+// the <metadata> of the descriptor of the VM, ignoring XML namespaces. An
+// empty string is returned if there is no such element.
+func (vm *VM) MetadataValue(key string) string {
+	if vm.Descriptor.Metadata == nil {
+		return ""
+	}
+
+	decoder := xml.NewDecoder(strings.NewReader(vm.Descriptor.Metadata.XML))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != key {
+			continue
+		}
+
+		var value string
+		err = decoder.DecodeElement(&value, &start)
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(value)
+	}
+}
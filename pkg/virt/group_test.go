@@ -0,0 +1,88 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestVMs returns VMs with the given names.
+func newTestVMs(names ...string) []VM {
+	vms := make([]VM, 0, len(names))
+	for _, name := range names {
+		vms = append(vms, VM{
+			Descriptor: libvirtxml.Domain{
+				Name: name,
+			},
+		})
+	}
+	return vms
+}
+
+// groupNames returns the names of the given groups mapped to the names of
+// their VMs.
+func groupNames(groups []VMGroup) map[string][]string {
+	names := make(map[string][]string, len(groups))
+	for _, group := range groups {
+		for _, vm := range group.VMs {
+			names[group.Name] = append(names[group.Name], vm.Descriptor.Name)
+		}
+	}
+	return names
+}
+
+func TestGroupVMsByPrefix(t *testing.T) {
+	vms := newTestVMs("web-1", "db-1", "web-2", "mail")
+
+	key, err := ParseGroupBy("prefix:-")
+	require.NoError(t, err)
+	groups := GroupVMs(vms, key)
+	require.Equal(t, "db", groups[0].Name)
+	require.Equal(t, map[string][]string{
+		"db":   {"db-1"},
+		"mail": {"mail"},
+		"web":  {"web-1", "web-2"},
+	}, groupNames(groups))
+
+	key, err = ParseGroupBy("prefix:2")
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{
+		"db": {"db-1"},
+		"ma": {"mail"},
+		"we": {"web-1", "web-2"},
+	}, groupNames(GroupVMs(vms, key)))
+}
+
+func TestGroupVMsByTag(t *testing.T) {
+	vms := newTestVMs("web-1", "db-1", "other")
+	vms[0].Descriptor.Metadata = &libvirtxml.DomainMetadata{
+		XML: `<app:info xmlns:app="http://example.org/app"><app:team>blue` +
+			`</app:team></app:info>`,
+	}
+	vms[1].Descriptor.Metadata = &libvirtxml.DomainMetadata{
+		XML: `<team>red</team>`,
+	}
+
+	key, err := ParseGroupBy("tag:team")
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{
+		"":     {"other"},
+		"blue": {"web-1"},
+		"red":  {"db-1"},
+	}, groupNames(GroupVMs(vms, key)))
+}
+
+func TestParseGroupBy(t *testing.T) {
+	for _, spec := range []string{"", "prefix", "prefix:", "prefix:0",
+		"name:foo"} {
+		_, err := ParseGroupBy(spec)
+		require.Error(t, err, spec)
+	}
+}
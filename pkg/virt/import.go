@@ -0,0 +1,286 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/joroec/virsnap/pkg/fs"
+	"github.com/joroec/virsnap/pkg/instrument/log"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// ErrVMExists is returned by ImportVM if a VM with the name of the imported VM
+// exists already and is not to be replaced.
+var ErrVMExists = errors.New("a VM with this name already exists")
+
+// ImportOptions bundles the optional settings of an import.
+type ImportOptions struct {
+	// DiskDir is the directory the relative disk paths of the exported
+	// descriptor (see PathModeRelative) are resolved against. Defaults to the
+	// export directory if empty.
+	DiskDir string
+
+	// Verify determines whether the files in the export directory are checked
+	// against the checksums recorded by the export before the VM is defined
+	// (see fs.VerifyChecksums).
+	Verify bool
+
+	// Replace determines whether an existing VM with the same name is replaced
+	// by the imported one. The existing VM needs to be shut off.
+	Replace bool
+
+	// Strict determines whether incompatibilities of the VM with the host (see
+	// HostIncompatibilities) are treated as an error instead of a warning.
+	Strict bool
+}
+
+// ReadExportDescriptor reads the descriptor of the VM exported to the given
+// directory, i.e. the directory named after the VM below the output directory
+// of the export.
+func ReadExportDescriptor(exportDir string) (libvirtxml.Domain, error) {
+	descriptor := libvirtxml.Domain{}
+
+	xml, err := ioutil.ReadFile(filepath.Join(exportDir, DescriptorFilename))
+	if err != nil {
+		err = fmt.Errorf("unable to read exported descriptor: %s", err)
+		return descriptor, err
+	}
+
+	err = descriptor.Unmarshal(string(xml))
+	if err != nil {
+		err = fmt.Errorf("unable to unmarshal exported descriptor: %s", err)
+		return descriptor, err
+	}
+	return descriptor, nil
+}
+
+// resolveImportPaths rewrites the relative paths of the disk images and the
+// UEFI variable store in the given descriptor to absolute paths below the
+// given directory. Absolute paths are kept. It returns the paths of all files
+// referenced by the descriptor, which need to exist before the VM is defined.
+func resolveImportPaths(descriptor *libvirtxml.Domain, dir string) []string {
+	files := make([]string, 0)
+
+	resolve := func(file string) string {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		files = append(files, file)
+		return file
+	}
+
+	for _, disk := range diskDevices(*descriptor) {
+		// volume disks are resolved by libvirt in their storage pool
+		if disk.Source == nil || disk.Source.File == nil ||
+			disk.Source.File.File == "" {
+			continue
+		}
+		disk.Source.File.File = resolve(disk.Source.File.File)
+	}
+
+	if nvramPath(*descriptor) != "" {
+		descriptor.OS.NVRam.NVRam = resolve(descriptor.OS.NVRam.NVRam)
+	}
+
+	return files
+}
+
+// checkImportFiles returns an error naming the first of the given files that
+// does not exist.
+func checkImportFiles(files []string) error {
+	for _, file := range files {
+		_, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("unable to access file '%s' referenced by the "+
+				"exported descriptor: %s", file, err)
+		}
+	}
+	return nil
+}
+
+// ImportVM defines the VM exported to the given directory with the given
+// connection. The relative paths of the exported descriptor are resolved
+// against opts.DiskDir and every referenced file needs to exist. With
+// opts.Verify, the files are checked against their checksums. The VM is
+// checked for incompatibilities with the host, which are only logged unless
+// opts.Strict is set. An existing VM with the same name is only replaced with
+// opts.Replace, otherwise ErrVMExists is returned. The name of the imported VM
+// is returned, also together with an error once the descriptor was read.
+func ImportVM(log log.Logger, conn *libvirt.Connect, exportDir string,
+	opts ImportOptions) (string, error) {
+	descriptor, err := ReadExportDescriptor(exportDir)
+	if err != nil {
+		return "", err
+	}
+
+	dir := opts.DiskDir
+	if dir == "" {
+		dir = exportDir
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		err = fmt.Errorf("unable to resolve disk directory: %s", err)
+		return descriptor.Name, err
+	}
+
+	err = checkImportFiles(resolveImportPaths(&descriptor, dir))
+	if err != nil {
+		return descriptor.Name, err
+	}
+
+	if opts.Verify {
+		log.Infof("verifying checksums of the export of VM '%s'",
+			descriptor.Name)
+		err = fs.VerifyChecksums(exportDir)
+		if err != nil {
+			return descriptor.Name, err
+		}
+	}
+
+	// a VM exported on another host may not boot on this one
+	problems, err := HostIncompatibilities(log, conn, descriptor)
+	if err != nil {
+		return descriptor.Name, err
+	}
+	if len(problems) > 0 && opts.Strict {
+		return descriptor.Name, fmt.Errorf("VM '%s' is not compatible with "+
+			"the host: %s", descriptor.Name, strings.Join(problems, ", "))
+	}
+	for _, problem := range problems {
+		log.Warnf("VM '%s' may not boot on this host: %s", descriptor.Name,
+			problem)
+	}
+
+	existing, err := lookupReplaceable(log, conn, descriptor.Name,
+		opts.Replace)
+	if err != nil {
+		return descriptor.Name, err
+	}
+	if existing != nil {
+		defer existing.Free()
+	}
+
+	xml, err := descriptor.Marshal()
+	if err != nil {
+		err = fmt.Errorf("unable to marshal descriptor of VM '%s': %s",
+			descriptor.Name, err)
+		return descriptor.Name, err
+	}
+
+	var domain *libvirt.Domain
+	if existing == nil || sameUUID(existing, descriptor.UUID) {
+		// libvirt redefines an existing VM with the same UUID in place, so
+		// the existing definition is only replaced if the new one is valid
+		domain, err = conn.DomainDefineXML(xml)
+	} else {
+		domain, err = redefine(log, conn, existing, descriptor.Name, xml)
+	}
+	if err != nil {
+		logLibvirtError(log, err)
+		err = fmt.Errorf("unable to define VM '%s': %s", descriptor.Name, err)
+		return descriptor.Name, err
+	}
+
+	err = domain.Free()
+	if err != nil {
+		log.Warnf("unable to free VM '%s': %s", descriptor.Name, err)
+	}
+	return descriptor.Name, nil
+}
+
+// lookupReplaceable looks up the VM with the given name. nil is returned if
+// there is none. If the VM exists and replace is not set, ErrVMExists is
+// returned, otherwise the VM needs to be shut off to be replaced. The caller
+// is responsible for calling Free on the returned VM.
+func lookupReplaceable(log log.Logger, conn *libvirt.Connect, name string,
+	replace bool) (*libvirt.Domain, error) {
+	existing, err := conn.LookupDomainByName(name)
+	if err != nil {
+		lverr, ok := err.(libvirt.Error)
+		if ok && lverr.Code == libvirt.ERR_NO_DOMAIN {
+			return nil, nil
+		}
+		logLibvirtError(log, err)
+		return nil, fmt.Errorf("unable to look up VM '%s': %s", name, err)
+	}
+
+	if !replace {
+		existing.Free()
+		return nil, ErrVMExists
+	}
+
+	state, _, err := existing.GetState()
+	if err != nil {
+		existing.Free()
+		logLibvirtError(log, err)
+		return nil, fmt.Errorf("unable to retrieve state of VM '%s': %s", name,
+			err)
+	}
+	if state != libvirt.DOMAIN_SHUTOFF {
+		existing.Free()
+		return nil, fmt.Errorf("VM '%s' cannot be replaced in state '%s', shut "+
+			"it down first", name, GetStateString(state))
+	}
+
+	log.Infof("replacing existing VM '%s'", name)
+	return existing, nil
+}
+
+// sameUUID determines whether the given VM has the given UUID. A descriptor
+// without a UUID never matches, since libvirt generates a new one.
+func sameUUID(domain *libvirt.Domain, uuid string) bool {
+	if uuid == "" {
+		return false
+	}
+	existing, err := domain.GetUUIDString()
+	return err == nil && strings.EqualFold(existing, uuid)
+}
+
+// redefine replaces the given existing VM with a VM of a different UUID
+// defined by the given XML, which requires undefining the existing VM first.
+// Its snapshot metadata is removed, its disk images and UEFI variable store
+// are kept. If the new VM cannot be defined, the existing VM is defined again
+// from its previous XML descriptor.
+func redefine(log log.Logger, conn *libvirt.Connect, existing *libvirt.Domain,
+	name string, xml string) (*libvirt.Domain, error) {
+	previous, err := existing.GetXMLDesc(libvirt.DOMAIN_XML_SECURE |
+		libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get XML descriptor of existing VM: %s",
+			err)
+	}
+
+	err = existing.UndefineFlags(libvirt.DOMAIN_UNDEFINE_SNAPSHOTS_METADATA |
+		libvirt.DOMAIN_UNDEFINE_MANAGED_SAVE | libvirt.DOMAIN_UNDEFINE_KEEP_NVRAM)
+	if err != nil {
+		return nil, fmt.Errorf("unable to undefine existing VM: %s", err)
+	}
+
+	domain, err := conn.DomainDefineXML(xml)
+	if err == nil {
+		return domain, nil
+	}
+
+	restored, rerr := conn.DomainDefineXML(previous)
+	if rerr != nil {
+		logLibvirtError(log, rerr)
+		log.Errorf("unable to restore the previous definition of VM '%s': %s",
+			name, rerr)
+		return nil, err
+	}
+	log.Warnf("restored the previous definition of VM '%s'", name)
+	restored.Free()
+	return nil, err
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const importDescriptor = `<domain type="kvm">
+  <name>uefivm</name>
+  <os>
+    <type arch="x86_64" machine="q35">hvm</type>
+    <loader readonly="yes" type="pflash">/usr/share/OVMF/OVMF_CODE.fd</loader>
+    <nvram>./uefivm_VARS.fd</nvram>
+  </os>
+  <devices>
+    <disk type="file" device="disk">
+      <source file="./uefivm.qcow2"/>
+      <target dev="vda" bus="virtio"/>
+    </disk>
+    <disk type="file" device="disk">
+      <source file="/data/shared.qcow2"/>
+      <target dev="vdb" bus="virtio"/>
+    </disk>
+    <disk type="volume" device="disk">
+      <source pool="default" volume="data.qcow2"/>
+      <target dev="vdc" bus="virtio"/>
+    </disk>
+  </devices>
+</domain>`
+
+func TestReadExportDescriptor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virsnap-import")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = ReadExportDescriptor(dir)
+	require.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, DescriptorFilename),
+		[]byte(importDescriptor), 0600))
+	descriptor, err := ReadExportDescriptor(dir)
+	require.NoError(t, err)
+	require.Equal(t, "uefivm", descriptor.Name)
+}
+
+func TestResolveImportPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virsnap-import")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, DescriptorFilename),
+		[]byte(importDescriptor), 0600))
+	descriptor, err := ReadExportDescriptor(dir)
+	require.NoError(t, err)
+
+	files := resolveImportPaths(&descriptor, "/backup/uefivm")
+	require.Equal(t, []string{
+		"/backup/uefivm/uefivm.qcow2",
+		"/data/shared.qcow2",
+		"/backup/uefivm/uefivm_VARS.fd",
+	}, files)
+
+	disks := diskDevices(descriptor)
+	require.Equal(t, "/backup/uefivm/uefivm.qcow2", disks[0].Source.File.File)
+	require.Equal(t, "/data/shared.qcow2", disks[1].Source.File.File)
+	require.Equal(t, "/backup/uefivm/uefivm_VARS.fd", nvramPath(descriptor))
+}
+
+func TestCheckImportFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virsnap-import")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	disk := path.Join(dir, "uefivm.qcow2")
+	require.NoError(t, ioutil.WriteFile(disk, []byte("disk"), 0600))
+	require.NoError(t, checkImportFiles([]string{disk}))
+
+	missing := path.Join(dir, "uefivm_VARS.fd")
+	err = checkImportFiles([]string{disk, missing})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), missing)
+}
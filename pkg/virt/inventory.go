@@ -0,0 +1,191 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"fmt"
+	"time"
+)
+
+// Inventory is a serializable snapshot of the VMs and their snapshots found on
+// a libvirt instance, e.g. for auditing or for backing up the metadata.
+type Inventory struct {
+	// URI is the libvirt socket URL the inventory was taken from.
+	URI string `json:"uri" yaml:"uri"`
+
+	// Time is the time the inventory was taken.
+	Time time.Time `json:"time" yaml:"time"`
+
+	// VMs are the inventoried VMs, sorted by name.
+	VMs []VMInventory `json:"vms" yaml:"vms"`
+
+	// Truncated is set if the inventory was interrupted, so that VMs are
+	// missing.
+	Truncated bool `json:"truncated,omitempty" yaml:"truncated,omitempty"`
+}
+
+// VMInventory describes a VM and its snapshots.
+type VMInventory struct {
+	// Name is the name of the VM.
+	Name string `json:"name" yaml:"name"`
+
+	// UUID is the UUID of the VM.
+	UUID string `json:"uuid,omitempty" yaml:"uuid,omitempty"`
+
+	// State is the state of the VM, e.g. "running", at the time of the
+	// inventory.
+	State string `json:"state" yaml:"state"`
+
+	// Memory is the maximum memory of the VM in bytes.
+	Memory uint64 `json:"memory,omitempty" yaml:"memory,omitempty"`
+
+	// VCPUs is the number of virtual CPUs of the VM.
+	VCPUs int `json:"vcpus,omitempty" yaml:"vcpus,omitempty"`
+
+	// Disks are the disk devices of the VM.
+	Disks []DiskInventory `json:"disks" yaml:"disks"`
+
+	// Snapshots are the snapshots of the VM, sorted by creation time.
+	Snapshots []SnapshotInventory `json:"snapshots" yaml:"snapshots"`
+
+	// XML is the XML descriptor of the VM. Only set for a full inventory.
+	XML string `json:"xml,omitempty" yaml:"xml,omitempty"`
+
+	// Error describes why the inventory of the VM is incomplete.
+	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// DiskInventory describes a disk device of a VM.
+type DiskInventory struct {
+	// Target is the target device of the disk in the VM, e.g. "vda".
+	Target string `json:"target" yaml:"target"`
+
+	// Source is the path of the disk image or block device on the host.
+	Source string `json:"source,omitempty" yaml:"source,omitempty"`
+
+	// Format is the driver type of the disk as stated by the descriptor.
+	Format string `json:"format,omitempty" yaml:"format,omitempty"`
+}
+
+// SnapshotInventory describes a snapshot of a VM.
+type SnapshotInventory struct {
+	// Name is the name of the snapshot.
+	Name string `json:"name" yaml:"name"`
+
+	// Parent is the name of the parent snapshot, if any.
+	Parent string `json:"parent,omitempty" yaml:"parent,omitempty"`
+
+	// CreationTime is the creation time of the snapshot as seconds since the
+	// unix epoch, as stored by libvirt.
+	CreationTime string `json:"creation_time" yaml:"creation_time"`
+
+	// State is the state of the VM at the time of the snapshot.
+	State string `json:"state,omitempty" yaml:"state,omitempty"`
+
+	// Description is the description of the snapshot.
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+
+	// XML is the XML descriptor of the snapshot. Only set for a full
+	// inventory.
+	XML string `json:"xml,omitempty" yaml:"xml,omitempty"`
+}
+
+// NewVMInventory describes the VM in the given state with the given
+// snapshots. If full is set, the XML descriptors of the VM and the snapshots
+// are included as well.
+func NewVMInventory(vm *VM, state string, snapshots []Snapshot,
+	full bool) (VMInventory, error) {
+	inventory := VMInventory{
+		Name:      vm.Descriptor.Name,
+		UUID:      vm.Descriptor.UUID,
+		State:     state,
+		Memory:    memoryBytes(vm.Descriptor.Memory),
+		Disks:     make([]DiskInventory, 0),
+		Snapshots: make([]SnapshotInventory, 0, len(snapshots)),
+	}
+	if vm.Descriptor.VCPU != nil {
+		inventory.VCPUs = vm.Descriptor.VCPU.Value
+	}
+
+	for _, disk := range diskDevices(vm.Descriptor) {
+		entry := DiskInventory{
+			Target: diskTarget(disk),
+		}
+		if disk.Driver != nil {
+			entry.Format = disk.Driver.Type
+		}
+		if disk.Source != nil {
+			switch {
+			case disk.Source.File != nil:
+				entry.Source = disk.Source.File.File
+			case disk.Source.Block != nil:
+				entry.Source = disk.Source.Block.Dev
+			case disk.Source.Volume != nil:
+				entry.Source = disk.Source.Volume.Pool + "/" +
+					disk.Source.Volume.Volume
+			}
+		}
+		inventory.Disks = append(inventory.Disks, entry)
+	}
+
+	if full {
+		xml, err := vm.Descriptor.Marshal()
+		if err != nil {
+			err = fmt.Errorf("unable to marshal XML descriptor of VM '%s': %s",
+				vm.Descriptor.Name, err)
+			return inventory, err
+		}
+		inventory.XML = xml
+	}
+
+	for _, snapshot := range snapshots {
+		entry := SnapshotInventory{
+			Name:         snapshot.Descriptor.Name,
+			CreationTime: snapshot.Descriptor.CreationTime,
+			State:        snapshot.Descriptor.State,
+			Description:  snapshot.Descriptor.Description,
+		}
+		if snapshot.Descriptor.Parent != nil {
+			entry.Parent = snapshot.Descriptor.Parent.Name
+		}
+
+		if full {
+			xml, err := snapshot.Descriptor.Marshal()
+			if err != nil {
+				err = fmt.Errorf("unable to marshal XML descriptor of snapshot "+
+					"'%s' of VM '%s': %s", snapshot.Descriptor.Name,
+					vm.Descriptor.Name, err)
+				return inventory, err
+			}
+			entry.XML = xml
+		}
+
+		inventory.Snapshots = append(inventory.Snapshots, entry)
+	}
+
+	return inventory, nil
+}
+
+// Inventory describes the VM with its current state and all of its snapshots.
+// If full is set, the XML descriptors of the VM and the snapshots are included
+// as well.
+func (vm *VM) Inventory(full bool) (VMInventory, error) {
+	state, err := vm.GetCurrentStateString()
+	if err != nil {
+		return VMInventory{Name: vm.Descriptor.Name}, err
+	}
+
+	snapshots, err := vm.ListMatchingSnapshots([]string{".*"})
+	if err != nil {
+		err = fmt.Errorf("unable to retrieve snapshots of VM '%s': %s",
+			vm.Descriptor.Name, err)
+		return VMInventory{Name: vm.Descriptor.Name, State: state}, err
+	}
+	defer FreeSnapshots(vm.Logger, snapshots)
+
+	return NewVMInventory(vm, state, snapshots, full)
+}
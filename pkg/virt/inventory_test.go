@@ -0,0 +1,81 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewVMInventory(t *testing.T) {
+	vm := VM{}
+	err := vm.Descriptor.Unmarshal(`<domain type="kvm">
+  <name>testvm</name>
+  <uuid>8f0a7a4c-2f5e-4a55-9d3c-0b6f6f4c2a11</uuid>
+  <memory unit="MiB">2048</memory>
+  <vcpu>2</vcpu>
+  <devices>
+    <disk type="file" device="disk">
+      <driver name="qemu" type="qcow2"/>
+      <source file="/var/lib/libvirt/images/testvm.qcow2"/>
+      <target dev="vda" bus="virtio"/>
+    </disk>
+    <disk type="volume" device="disk">
+      <driver name="qemu" type="raw"/>
+      <source pool="default" volume="testvm-data"/>
+      <target dev="vdb" bus="virtio"/>
+    </disk>
+    <disk type="file" device="cdrom">
+      <source file="/var/lib/libvirt/images/install.iso"/>
+      <target dev="sda" bus="sata"/>
+    </disk>
+  </devices>
+</domain>`)
+	require.NoError(t, err)
+
+	snapshots := []Snapshot{
+		{Descriptor: libvirtxml.DomainSnapshot{
+			Name:         "virsnap_1",
+			CreationTime: "1563086270",
+			State:        "running",
+			Description:  "snapshot created by virnsnap",
+		}},
+		{Descriptor: libvirtxml.DomainSnapshot{
+			Name:         "virsnap_2",
+			CreationTime: "1563086280",
+			State:        "shutoff",
+			Parent:       &libvirtxml.DomainSnapshotParent{Name: "virsnap_1"},
+		}},
+	}
+
+	inventory, err := NewVMInventory(&vm, "running", snapshots, false)
+	require.NoError(t, err)
+	require.Equal(t, "testvm", inventory.Name)
+	require.Equal(t, "8f0a7a4c-2f5e-4a55-9d3c-0b6f6f4c2a11", inventory.UUID)
+	require.Equal(t, "running", inventory.State)
+	require.Equal(t, uint64(2048<<20), inventory.Memory)
+	require.Equal(t, 2, inventory.VCPUs)
+	require.Equal(t, []DiskInventory{
+		{Target: "vda", Source: "/var/lib/libvirt/images/testvm.qcow2",
+			Format: "qcow2"},
+		{Target: "vdb", Source: "default/testvm-data", Format: "raw"},
+	}, inventory.Disks)
+	require.Equal(t, []SnapshotInventory{
+		{Name: "virsnap_1", CreationTime: "1563086270", State: "running",
+			Description: "snapshot created by virnsnap"},
+		{Name: "virsnap_2", Parent: "virsnap_1", CreationTime: "1563086280",
+			State: "shutoff"},
+	}, inventory.Snapshots)
+	require.Empty(t, inventory.XML)
+
+	inventory, err = NewVMInventory(&vm, "running", snapshots, true)
+	require.NoError(t, err)
+	require.Contains(t, inventory.XML, "<name>testvm</name>")
+	require.Contains(t, inventory.Snapshots[1].XML, "<name>virsnap_1</name>")
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+// HasActiveJob determines whether libvirt is currently running a job on the
+// VM, e.g. a migration, a save or dump of its memory, or a block job like a
+// block copy or commit on one of its disks. Snapshotting or shutting down a VM
+// with an active job fails or interferes with the job.
+func (vm *VM) HasActiveJob() (bool, error) {
+	domain := vm.control()
+
+	info, err := domain.GetJobInfo()
+	if err != nil {
+		logLibvirtError(vm.Logger, err)
+		return false, fmt.Errorf("unable to retrieve job of VM '%s': %s",
+			vm.Descriptor.Name, err)
+	}
+	if info.Type == libvirt.DOMAIN_JOB_BOUNDED ||
+		info.Type == libvirt.DOMAIN_JOB_UNBOUNDED {
+		vm.Logger.Debugf("VM '%s' has an active job running for %d ms",
+			vm.Descriptor.Name, info.TimeElapsed)
+		return true, nil
+	}
+
+	if vm.Descriptor.Devices == nil {
+		return false, nil
+	}
+	for _, disk := range vm.Descriptor.Devices.Disks {
+		target := diskTarget(disk)
+		if target == "" {
+			continue
+		}
+
+		blockInfo, err := domain.GetBlockJobInfo(target, 0)
+		if err != nil {
+			logLibvirtError(vm.Logger, err)
+			return false, fmt.Errorf("unable to retrieve block job of disk '%s' "+
+				"of VM '%s': %s", target, vm.Descriptor.Name, err)
+		}
+		if blockInfo.Type != libvirt.DOMAIN_BLOCK_JOB_TYPE_UNKNOWN {
+			vm.Logger.Debugf("disk '%s' of VM '%s' has an active block job",
+				target, vm.Descriptor.Name)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// WaitForJob waits until the VM has no active job anymore, as determined by
+// HasActiveJob. An error is returned if the job is still running after the
+// given timeout.
+func (vm *VM) WaitForJob(timeout time.Duration) error {
+	start := time.Now()
+	for {
+		active, err := vm.HasActiveJob()
+		if err != nil {
+			return err
+		}
+		if !active {
+			return nil
+		}
+
+		if time.Since(start) > timeout {
+			return fmt.Errorf("timeout while waiting for the active job of VM "+
+				"'%s' to finish", vm.Descriptor.Name)
+		}
+
+		vm.Logger.Debugf("waiting for the active job of VM '%s' to finish",
+			vm.Descriptor.Name)
+		time.Sleep(statePollInterval)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeJobDomain is a fakeDomain whose job is taken from a sequence of job
+// types, one per call of GetJobInfo. The last job type is repeated.
+type fakeJobDomain struct {
+	*fakeDomain
+	jobs      []libvirt.DomainJobType
+	blockJobs map[string]libvirt.DomainBlockJobType
+	calls     int
+}
+
+func (d *fakeJobDomain) GetJobInfo() (*libvirt.DomainJobInfo, error) {
+	index := d.calls
+	if index >= len(d.jobs) {
+		index = len(d.jobs) - 1
+	}
+	d.calls++
+	return &libvirt.DomainJobInfo{Type: d.jobs[index]}, nil
+}
+
+func (d *fakeJobDomain) GetBlockJobInfo(disk string,
+	flags libvirt.DomainBlockJobInfoFlags) (*libvirt.DomainBlockJobInfo, error) {
+	return &libvirt.DomainBlockJobInfo{Type: d.blockJobs[disk]}, nil
+}
+
+// newFakeJobVM returns a running VM with the disks vda and vdb whose jobs are
+// taken from the given sequence.
+func newFakeJobVM(jobs ...libvirt.DomainJobType) (*VM, *fakeJobDomain) {
+	vm, domain := newFakeVM(libvirt.DOMAIN_RUNNING)
+	jobDomain := &fakeJobDomain{fakeDomain: domain, jobs: jobs}
+	vm.controller = jobDomain
+	vm.Descriptor.Devices = &libvirtxml.DomainDeviceList{
+		Disks: []libvirtxml.DomainDisk{
+			{Target: &libvirtxml.DomainDiskTarget{Dev: "vda"}},
+			{Target: &libvirtxml.DomainDiskTarget{Dev: "vdb"}},
+		},
+	}
+	return vm, jobDomain
+}
+
+func TestHasActiveJob(t *testing.T) {
+	vm, domain := newFakeJobVM(libvirt.DOMAIN_JOB_NONE)
+	active, err := vm.HasActiveJob()
+	require.NoError(t, err)
+	require.False(t, active)
+
+	// a finished job is not active anymore
+	domain.jobs = []libvirt.DomainJobType{libvirt.DOMAIN_JOB_COMPLETED}
+	active, err = vm.HasActiveJob()
+	require.NoError(t, err)
+	require.False(t, active)
+
+	// e.g. a migration
+	domain.jobs = []libvirt.DomainJobType{libvirt.DOMAIN_JOB_UNBOUNDED}
+	active, err = vm.HasActiveJob()
+	require.NoError(t, err)
+	require.True(t, active)
+
+	// a block job on any disk
+	domain.jobs = []libvirt.DomainJobType{libvirt.DOMAIN_JOB_NONE}
+	domain.blockJobs = map[string]libvirt.DomainBlockJobType{
+		"vdb": libvirt.DOMAIN_BLOCK_JOB_TYPE_COPY,
+	}
+	active, err = vm.HasActiveJob()
+	require.NoError(t, err)
+	require.True(t, active)
+}
+
+func TestWaitForJob(t *testing.T) {
+	defer func(interval time.Duration) {
+		statePollInterval = interval
+	}(statePollInterval)
+	statePollInterval = time.Millisecond
+
+	vm, domain := newFakeJobVM(libvirt.DOMAIN_JOB_BOUNDED,
+		libvirt.DOMAIN_JOB_BOUNDED, libvirt.DOMAIN_JOB_COMPLETED)
+	require.NoError(t, vm.WaitForJob(time.Minute))
+	require.Equal(t, 3, domain.calls)
+
+	vm, _ = newFakeJobVM(libvirt.DOMAIN_JOB_UNBOUNDED)
+	err := vm.WaitForJob(10 * time.Millisecond)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "timeout")
+}
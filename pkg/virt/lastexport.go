@@ -0,0 +1,70 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+const (
+	// MetadataURI is the XML namespace of the element virsnap stores in the
+	// <metadata> of a VM.
+	MetadataURI = "https://github.com/joroec/virsnap"
+
+	// metadataPrefix is the namespace prefix of the element virsnap stores in
+	// the <metadata> of a VM.
+	metadataPrefix = "virsnap"
+
+	// lastExportKey is the name of the element holding the time of the last
+	// successful export.
+	lastExportKey = "lastExport"
+)
+
+// RecordLastExport stores the given time as time of the last successful
+// export in the <metadata> of the VM. The metadata is written to the
+// persistent configuration and, if the VM is running, to the live
+// configuration as well.
+func (vm *VM) RecordLastExport(t time.Time) error {
+	element := fmt.Sprintf("<%s><%s>%s</%s></%s>", metadataPrefix,
+		lastExportKey, t.UTC().Format(time.RFC3339), lastExportKey,
+		metadataPrefix)
+
+	flags := libvirt.DOMAIN_AFFECT_CONFIG
+	active, err := vm.Instance.IsActive()
+	if err == nil && active {
+		flags |= libvirt.DOMAIN_AFFECT_LIVE
+	}
+
+	err = vm.Instance.SetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, element,
+		metadataPrefix, MetadataURI, flags)
+	if err != nil {
+		logLibvirtError(vm.Logger, err)
+		err = fmt.Errorf("unable to store time of last export of VM '%s': %s",
+			vm.Descriptor.Name, err)
+		return err
+	}
+	return nil
+}
+
+// LastExport returns the time of the last successful export stored in the
+// <metadata> of the descriptor of the VM. The boolean is false if the VM was
+// never exported or the stored time cannot be parsed.
+func (vm *VM) LastExport() (time.Time, bool) {
+	value := vm.MetadataValue(lastExportKey)
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"testing"
+	"time"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLastExport(t *testing.T) {
+	vm := VM{}
+	_, ok := vm.LastExport()
+	require.False(t, ok)
+
+	// the metadata as stored by libvirt after RecordLastExport
+	vm.Descriptor.Metadata = &libvirtxml.DomainMetadata{
+		XML: `<virsnap:virsnap xmlns:virsnap="https://github.com/joroec/virsnap">` +
+			`<virsnap:lastExport>2019-07-14T06:37:50Z</virsnap:lastExport>` +
+			`</virsnap:virsnap>`,
+	}
+	lastExport, ok := vm.LastExport()
+	require.True(t, ok)
+	require.True(t, time.Unix(1563086270, 0).Equal(lastExport))
+
+	vm.Descriptor.Metadata.XML = `<virsnap:virsnap ` +
+		`xmlns:virsnap="https://github.com/joroec/virsnap">` +
+		`<virsnap:lastExport>yesterday</virsnap:lastExport></virsnap:virsnap>`
+	_, ok = vm.LastExport()
+	require.False(t, ok)
+}
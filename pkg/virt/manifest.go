@@ -0,0 +1,141 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"time"
+)
+
+// ManifestFilename is the name of the manifest file stored alongside the disk
+// images and the descriptor of an exported VM.
+const ManifestFilename = "manifest.json"
+
+// DiskStatus is the outcome of exporting a single disk.
+type DiskStatus string
+
+const (
+	// DiskCopied denotes a disk that was successfully copied.
+	DiskCopied DiskStatus = "copied"
+
+	// DiskFailed denotes a disk that could not be copied.
+	DiskFailed DiskStatus = "failed"
+
+	// DiskCarriedOver denotes a disk that did not change since the previous
+	// export to the same directory and was therefore not copied again.
+	DiskCarriedOver DiskStatus = "carried_over"
+)
+
+// DiskResult describes the export of a single disk.
+type DiskResult struct {
+	// Target is the target device of the disk in the VM, e.g. "vda".
+	Target string `json:"target"`
+
+	// Source is the path of the disk image on the host.
+	Source string `json:"source,omitempty"`
+
+	// File is the filename of the disk image in the export directory.
+	File string `json:"file,omitempty"`
+
+	// Size is the size in bytes of the disk image on the host at the time of
+	// the export.
+	Size int64 `json:"size,omitempty"`
+
+	// ModTime is the modification time of the disk image on the host at the
+	// time of the export.
+	ModTime time.Time `json:"mod_time,omitempty"`
+
+	// Checksum is the hex-encoded SHA-256 of the exported image, which is also
+	// listed in the checksum file of the export directory (see
+	// fs.VerifyChecksums). Empty if the disk was not exported or the checksum
+	// could not be computed.
+	Checksum string `json:"sha256,omitempty"`
+
+	// Status is the outcome of the export of the disk.
+	Status DiskStatus `json:"status"`
+
+	// Error describes why the export of the disk failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Manifest describes the content of the export directory of a VM.
+type Manifest struct {
+	// VM is the name of the exported VM.
+	VM string `json:"vm"`
+
+	// Time is the time the export was started.
+	Time time.Time `json:"time"`
+
+	// Disks are the results of the exported disks.
+	Disks []DiskResult `json:"disks"`
+
+	// NVRAM is the result of the exported UEFI variable store with target
+	// "nvram". nil if the VM does not have one.
+	NVRAM *DiskResult `json:"nvram,omitempty"`
+}
+
+// FailedDisks returns the disks of the manifest that could not be exported.
+func (m *Manifest) FailedDisks() []DiskResult {
+	failed := make([]DiskResult, 0)
+	for _, disk := range m.Disks {
+		if disk.Status == DiskFailed {
+			failed = append(failed, disk)
+		}
+	}
+	return failed
+}
+
+// Checksums returns the checksums of the exported disk images and the UEFI
+// variable store by their filename in the export directory.
+func (m *Manifest) Checksums() map[string]string {
+	checksums := make(map[string]string)
+	results := m.Disks
+	if m.NVRAM != nil {
+		results = append(results[:len(results):len(results)], *m.NVRAM)
+	}
+	for _, result := range results {
+		if result.Status == DiskFailed || result.Checksum == "" {
+			continue
+		}
+		checksums[result.File] = result.Checksum
+	}
+	return checksums
+}
+
+// Write stores the manifest in the given export directory of a VM.
+func (m *Manifest) Write(dir string) error {
+	doc, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal the manifest: %v", err)
+	}
+
+	err = ioutil.WriteFile(path.Join(dir, ManifestFilename), doc, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write the manifest: %v", err)
+	}
+	return nil
+}
+
+// ReadManifest reads the manifest stored in the given export directory of a
+// VM.
+func ReadManifest(dir string) (Manifest, error) {
+	var manifest Manifest
+
+	doc, err := ioutil.ReadFile(path.Join(dir, ManifestFilename))
+	if err != nil {
+		return manifest, fmt.Errorf("could not read the manifest: %v", err)
+	}
+
+	err = json.Unmarshal(doc, &manifest)
+	if err != nil {
+		return manifest, fmt.Errorf("could not unmarshal the manifest: %v", err)
+	}
+	return manifest, nil
+}
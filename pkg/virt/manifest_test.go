@@ -0,0 +1,96 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virsnap-manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	manifest := Manifest{
+		VM:   "testvm",
+		Time: time.Unix(1564427514, 0).UTC(),
+		Disks: []DiskResult{
+			{
+				Target: "vda",
+				Source: "/var/lib/libvirt/images/testvm.qcow2",
+				File:   "testvm.qcow2",
+				Status: DiskCopied,
+			},
+			{
+				Target: "vdb",
+				Status: DiskFailed,
+				Error:  "disk is not backed by a file",
+			},
+		},
+	}
+
+	failed := manifest.FailedDisks()
+	require.Len(t, failed, 1)
+	require.Equal(t, "vdb", failed[0].Target)
+
+	require.NoError(t, manifest.Write(dir))
+
+	read, err := ReadManifest(dir)
+	require.NoError(t, err)
+	require.Equal(t, manifest, read)
+
+	_, err = ReadManifest(dir + "/nonexistent")
+	require.Error(t, err)
+}
+
+func TestManifestChecksums(t *testing.T) {
+	manifest := Manifest{
+		VM: "testvm",
+		Disks: []DiskResult{
+			{
+				Target:   "vda",
+				File:     "testvm.qcow2",
+				Checksum: "1044dec7",
+				Status:   DiskCopied,
+			},
+			{
+				Target:   "vdb",
+				File:     "data.qcow2",
+				Checksum: "9f2c1a0b",
+				Status:   DiskCarriedOver,
+			},
+			{
+				Target: "vdc",
+				File:   "scratch.qcow2",
+				Status: DiskCopied,
+			},
+			{
+				Target: "vdd",
+				Status: DiskFailed,
+				Error:  "disk is not backed by a file",
+			},
+		},
+		NVRAM: &DiskResult{
+			Target:   "nvram",
+			File:     "testvm_VARS.fd",
+			Checksum: "5d41402a",
+			Status:   DiskCopied,
+		},
+	}
+
+	require.Equal(t, map[string]string{
+		"testvm.qcow2":   "1044dec7",
+		"data.qcow2":     "9f2c1a0b",
+		"testvm_VARS.fd": "5d41402a",
+	}, manifest.Checksums())
+	require.Len(t, manifest.Disks, 4)
+}
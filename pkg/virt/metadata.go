@@ -0,0 +1,179 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/joroec/virsnap/pkg/instrument/log"
+)
+
+// DefaultSnapshotMetadataDir is the directory in which libvirt stores the
+// snapshot metadata of QEMU domains of the system instance. The metadata of
+// each domain is stored in a sub directory named after the domain.
+const DefaultSnapshotMetadataDir = "/var/lib/libvirt/qemu/snapshot"
+
+// OrphanedMetadata describes the snapshot metadata of a domain that is not
+// defined anymore.
+type OrphanedMetadata struct {
+	// Domain is the name of the domain the metadata belongs to.
+	Domain string
+
+	// Dir is the directory holding the metadata.
+	Dir string
+
+	// Files are the snapshot metadata files in Dir.
+	Files []string
+}
+
+// ListOrphanedSnapshotMetadata returns the snapshot metadata in metadataDir
+// that is not associated with any domain currently defined on the libvirt
+// instance with the given socket URL. Since libvirt offers no API for
+// accessing the snapshots of undefined domains, the metadata directory needs
+// to be read directly. It only belongs to the local system instance, so an
+// error is returned for any other connection, e.g. a remote or a session
+// instance, whose domains would all be missing in the local directory.
+func ListOrphanedSnapshotMetadata(log log.Logger, socketURL string,
+	metadataDir string) ([]OrphanedMetadata, error) {
+	conn, err := Connect(log, socketURL)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// the socket URL may be empty or overridden by the environment, so the
+	// URI of the established connection is checked
+	uri, err := conn.GetURI()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get URI of the connection: %s", err)
+	}
+	if !isLocalSystemURI(uri) {
+		return nil, fmt.Errorf("snapshot metadata can only be inspected for "+
+			"the local system instance qemu:///system, not for '%s'", uri)
+	}
+
+	// all domains are listed, including running and transient ones, so that
+	// their metadata is never reported as orphaned
+	instances, err := conn.ListAllDomains(0)
+	if err != nil {
+		err = fmt.Errorf("unable to retrieve list of VMs from QEMU: %s",
+			err)
+		return nil, err
+	}
+
+	defined := make(map[string]bool, len(instances))
+	for i := range instances {
+		name, err := instances[i].GetName()
+		if err != nil {
+			// without the name, metadata of this domain could falsely be reported
+			// as orphaned, so better abort
+			for j := i; j < len(instances); j++ {
+				freeInstance(log, &instances[j], instanceName(&instances[j]))
+			}
+			return nil, fmt.Errorf("unable to get name of VM: %s", err)
+		}
+		defined[name] = true
+		freeInstance(log, &instances[i], name)
+	}
+
+	orphans, err := orphanedMetadata(metadataDir, defined)
+	if err != nil {
+		return nil, err
+	}
+
+	// a domain may have been defined or started since the domains were listed
+	unused := make([]OrphanedMetadata, 0, len(orphans))
+	for _, orphan := range orphans {
+		domain, err := conn.LookupDomainByName(orphan.Domain)
+		if err == nil {
+			log.Debugf("skipping snapshot metadata of VM '%s': VM is defined",
+				orphan.Domain)
+			freeInstance(log, domain, orphan.Domain)
+			continue
+		}
+		unused = append(unused, orphan)
+	}
+
+	return unused, nil
+}
+
+// isLocalSystemURI determines whether the given libvirt URI denotes the QEMU
+// system instance on the local host.
+func isLocalSystemURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "qemu" || u.Scheme == "qemu+unix") && u.Host == "" &&
+		u.Path == "/system"
+}
+
+// orphanedMetadata returns the snapshot metadata in metadataDir whose domain
+// is not contained in the given defined domains.
+func orphanedMetadata(metadataDir string,
+	defined map[string]bool) ([]OrphanedMetadata, error) {
+	entries, err := ioutil.ReadDir(metadataDir)
+	if err != nil {
+		err = fmt.Errorf("unable to read snapshot metadata directory '%s': %s",
+			metadataDir, err)
+		return nil, err
+	}
+
+	orphans := make([]OrphanedMetadata, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() || defined[entry.Name()] {
+			continue
+		}
+
+		dir := filepath.Join(metadataDir, entry.Name())
+		files, err := filepath.Glob(filepath.Join(dir, "*.xml"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+
+		orphans = append(orphans, OrphanedMetadata{
+			Domain: entry.Name(),
+			Dir:    dir,
+			Files:  files,
+		})
+	}
+
+	return orphans, nil
+}
+
+// Remove removes the snapshot metadata files and, if it is empty afterwards,
+// the metadata directory. Only the metadata is removed, disk images are never
+// touched.
+func (m *OrphanedMetadata) Remove() error {
+	for _, file := range m.Files {
+		if !strings.HasSuffix(file, ".xml") {
+			continue
+		}
+
+		err := os.Remove(file)
+		if err != nil {
+			return fmt.Errorf("unable to remove snapshot metadata '%s': %s", file,
+				err)
+		}
+	}
+
+	// fails if the directory is not empty, which is intended
+	err := os.Remove(m.Dir)
+	if err != nil {
+		return fmt.Errorf("unable to remove snapshot metadata directory '%s': %s",
+			m.Dir, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsLocalSystemURI(t *testing.T) {
+	for _, uri := range []string{"qemu:///system", "qemu+unix:///system",
+		"qemu:///system?socket=/run/libvirt/libvirt-sock"} {
+		require.True(t, isLocalSystemURI(uri), uri)
+	}
+
+	for _, uri := range []string{"", "qemu:///session", "qemu+ssh://host/system",
+		"qemu+tcp://host/system", "xen:///system", "test:///default"} {
+		require.False(t, isLocalSystemURI(uri), uri)
+	}
+}
+
+func TestOrphanedMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virsnap-metadata")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{"testvm/virsnap_1.xml", "undefined/b.xml",
+		"undefined/a.xml", "running/virsnap_2.xml"} {
+		path := filepath.Join(dir, file)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, ioutil.WriteFile(path, []byte("<domainsnapshot/>"),
+			0600))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "stray.xml"), nil,
+		0600))
+
+	orphans, err := orphanedMetadata(dir, map[string]bool{
+		"testvm":  true,
+		"running": true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []OrphanedMetadata{{
+		Domain: "undefined",
+		Dir:    filepath.Join(dir, "undefined"),
+		Files: []string{filepath.Join(dir, "undefined", "a.xml"),
+			filepath.Join(dir, "undefined", "b.xml")},
+	}}, orphans)
+
+	require.NoError(t, orphans[0].Remove())
+	_, err = os.Stat(filepath.Join(dir, "undefined"))
+	require.True(t, os.IsNotExist(err))
+
+	orphans, err = orphanedMetadata(dir, map[string]bool{"testvm": true})
+	require.NoError(t, err)
+	require.Len(t, orphans, 1)
+	require.Equal(t, "running", orphans[0].Domain)
+
+	_, err = orphanedMetadata(filepath.Join(dir, "missing"), nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/joroec/virsnap/pkg/instrument/log"
+)
+
+// VMOrder determines the order in which VMs are processed.
+type VMOrder string
+
+const (
+	// OrderByName processes the VMs ordered by their name.
+	OrderByName VMOrder = "name"
+
+	// OrderByOldestBackup processes the VMs whose last export is the oldest
+	// first. VMs that were never exported come first.
+	OrderByOldestBackup VMOrder = "oldest-backup"
+
+	// OrderByOldestSnapshot processes the VMs whose latest snapshot is the
+	// oldest first. VMs without any snapshot come first.
+	OrderByOldestSnapshot VMOrder = "oldest-snapshot"
+)
+
+// ParseVMOrder converts the given string into a VMOrder and returns an error
+// if the string does not denote a known order.
+func ParseVMOrder(order string) (VMOrder, error) {
+	switch VMOrder(order) {
+	case OrderByName, OrderByOldestBackup, OrderByOldestSnapshot:
+		return VMOrder(order), nil
+	}
+	return "", fmt.Errorf("invalid order '%s': must be one of 'name', "+
+		"'oldest-backup' or 'oldest-snapshot'", order)
+}
+
+// OrderVMs sorts the given VMs in place according to the given order. VMs
+// with equal times keep their order, i.e. they stay ordered by name if the VMs
+// were returned by ListMatchingVMs.
+func OrderVMs(log log.Logger, vms []VM, order VMOrder) {
+	switch order {
+	case OrderByOldestBackup:
+		sortVMsByTime(vms, func(vm *VM) time.Time {
+			t, _ := vm.LastExport()
+			return t
+		})
+	case OrderByOldestSnapshot:
+		sortVMsByTime(vms, func(vm *VM) time.Time {
+			t, err := vm.LatestSnapshotTime()
+			if err != nil {
+				log.Warn(err)
+			}
+			return t
+		})
+	default:
+		sorter := VMSorter{
+			VMs: &vms,
+		}
+		sort.Stable(&sorter)
+	}
+}
+
+// sortVMsByTime sorts the given VMs in place by the time returned by the given
+// function in increasing order. The zero time sorts first.
+func sortVMsByTime(vms []VM, timeOf func(vm *VM) time.Time) {
+	times := make(map[string]time.Time, len(vms))
+	for i := range vms {
+		times[vms[i].Descriptor.Name] = timeOf(&vms[i])
+	}
+
+	sort.SliceStable(vms, func(i int, j int) bool {
+		return times[vms[i].Descriptor.Name].Before(times[vms[j].Descriptor.Name])
+	})
+}
+
+// LatestSnapshotTime returns the creation time of the most recent snapshot of
+// the VM or the zero time if the VM does not have any snapshot.
+func (vm *VM) LatestSnapshotTime() (time.Time, error) {
+	snapshots, err := vm.ListMatchingSnapshots([]string{".*"})
+	if err != nil {
+		err = fmt.Errorf("unable to retrieve snapshots of VM '%s': %s",
+			vm.Descriptor.Name, err)
+		return time.Time{}, err
+	}
+	defer FreeSnapshots(vm.Logger, snapshots)
+
+	var latest time.Time
+	for _, snapshot := range snapshots {
+		if snapshot.Unparseable {
+			continue
+		}
+		created, err := SnapshotTime(snapshot)
+		if err != nil {
+			vm.Logger.Warn(err)
+			continue
+		}
+		if created.After(latest) {
+			latest = created
+		}
+	}
+	return latest, nil
+}
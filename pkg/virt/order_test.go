@@ -0,0 +1,56 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/require"
+)
+
+// vmNames returns the names of the given VMs.
+func vmNames(vms []VM) []string {
+	names := make([]string, 0, len(vms))
+	for _, vm := range vms {
+		names = append(names, vm.Descriptor.Name)
+	}
+	return names
+}
+
+func TestOrderVMs(t *testing.T) {
+	vms := newTestVMs("alpha", "beta", "gamma", "delta")
+	for i, lastExport := range []string{"2019-07-14T06:37:50Z", "",
+		"2019-07-01T00:00:00Z", ""} {
+		if lastExport == "" {
+			continue
+		}
+		vms[i].Descriptor.Metadata = &libvirtxml.DomainMetadata{
+			XML: `<virsnap:virsnap xmlns:virsnap="https://github.com/joroec/virsnap">` +
+				`<virsnap:lastExport>` + lastExport + `</virsnap:lastExport>` +
+				`</virsnap:virsnap>`,
+		}
+	}
+
+	// VMs that were never exported come first and keep their order
+	OrderVMs(nil, vms, OrderByOldestBackup)
+	require.Equal(t, []string{"beta", "delta", "gamma", "alpha"}, vmNames(vms))
+
+	OrderVMs(nil, vms, OrderByName)
+	require.Equal(t, []string{"alpha", "beta", "delta", "gamma"}, vmNames(vms))
+}
+
+func TestParseVMOrder(t *testing.T) {
+	order, err := ParseVMOrder("oldest-snapshot")
+	require.NoError(t, err)
+	require.Equal(t, OrderByOldestSnapshot, order)
+
+	for _, order := range []string{"", "Name", "oldest"} {
+		_, err := ParseVMOrder(order)
+		require.Error(t, err, order)
+	}
+}
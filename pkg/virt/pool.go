@@ -0,0 +1,85 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"fmt"
+
+	"github.com/joroec/virsnap/pkg/instrument/log"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// LookupStoragePool looks up the libvirt storage pool with the given name. The
+// pool keeps its own reference to the connection, so the connection opened by
+// this function is closed again. The caller is responsible for calling Free on
+// the returned pool.
+func LookupStoragePool(log log.Logger, socketURL string,
+	name string) (*libvirt.StoragePool, error) {
+	conn, err := Connect(log, socketURL)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	pool, err := conn.LookupStoragePoolByName(name)
+	if err != nil {
+		logLibvirtError(log, err)
+		err = fmt.Errorf("unable to find storage pool '%s': %s", name, err)
+		return nil, err
+	}
+	return pool, nil
+}
+
+// diskSourcePath returns the path of the image of the given disk on the host.
+// The path of a file disk is taken from the descriptor. A volume disk is
+// resolved with the volume API of the given storage pool, which needs to be
+// the pool the disk refers to. If pool is nil, only file disks are supported.
+func diskSourcePath(disk libvirtxml.DomainDisk,
+	pool *libvirt.StoragePool) (string, error) {
+	if disk.Source == nil {
+		return "", fmt.Errorf("disk has no source")
+	}
+
+	if disk.Source.File != nil && disk.Source.File.File != "" {
+		return disk.Source.File.File, nil
+	}
+
+	volume := disk.Source.Volume
+	if volume == nil || volume.Volume == "" {
+		return "", fmt.Errorf("disk is neither backed by a file nor by a volume")
+	}
+
+	if pool == nil {
+		return "", fmt.Errorf("disk is backed by volume '%s' of storage pool "+
+			"'%s', specify the pool to export it", volume.Volume, volume.Pool)
+	}
+
+	poolName, err := pool.GetName()
+	if err != nil {
+		return "", fmt.Errorf("unable to get name of storage pool: %s", err)
+	}
+	if volume.Pool != poolName {
+		return "", fmt.Errorf("disk is backed by volume '%s' of storage pool "+
+			"'%s', not of pool '%s'", volume.Volume, volume.Pool, poolName)
+	}
+
+	vol, err := pool.LookupStorageVolByName(volume.Volume)
+	if err != nil {
+		return "", fmt.Errorf("unable to find volume '%s' in storage pool "+
+			"'%s': %s", volume.Volume, poolName, err)
+	}
+	defer vol.Free()
+
+	volPath, err := vol.GetPath()
+	if err != nil {
+		return "", fmt.Errorf("unable to get path of volume '%s' in storage "+
+			"pool '%s': %s", volume.Volume, poolName, err)
+	}
+	return volPath, nil
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskSourcePath(t *testing.T) {
+	file := libvirtxml.DomainDisk{
+		Source: &libvirtxml.DomainDiskSource{
+			File: &libvirtxml.DomainDiskSourceFile{
+				File: "/var/lib/libvirt/images/testvm.qcow2",
+			},
+		},
+	}
+	path, err := diskSourcePath(file, nil)
+	require.NoError(t, err)
+	require.Equal(t, "/var/lib/libvirt/images/testvm.qcow2", path)
+
+	// volumes can only be resolved with a storage pool
+	volume := libvirtxml.DomainDisk{
+		Source: &libvirtxml.DomainDiskSource{
+			Volume: &libvirtxml.DomainDiskSourceVolume{
+				Pool:   "default",
+				Volume: "testvm.qcow2",
+			},
+		},
+	}
+	_, err = diskSourcePath(volume, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "storage pool 'default'")
+
+	_, err = diskSourcePath(libvirtxml.DomainDisk{}, nil)
+	require.Error(t, err)
+
+	_, err = diskSourcePath(libvirtxml.DomainDisk{
+		Source: &libvirtxml.DomainDiskSource{},
+	}, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,346 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joroec/virsnap/pkg/instrument/log"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// qemuImgSnapshotLine matches a snapshot row of the tabular output of
+// "qemu-img snapshot -l", e.g.
+//
+//	1         before-upgrade    1.2 GiB 2019-07-11 08:37:50   00:05:12.345
+//
+// Older versions of qemu-img print the VM size without a space ("1.2G").
+var qemuImgSnapshotLine = regexp.MustCompile(`^(\S+)\s+(.+?)\s+` +
+	`(\S+(?: [KMGTPE]?i?B)?)\s+(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2})\s+`)
+
+// qemuImgDateFormat is the format of the DATE column of "qemu-img snapshot -l".
+const qemuImgDateFormat = "2006-01-02 15:04:05"
+
+// ListUnmanagedSnapshots runs "qemu-img snapshot -l" on the qcow2 disks of the
+// VM and returns the internal snapshots libvirt has no metadata for, e.g.
+// because they were taken with the raw qemu tools. Snapshots whose name is
+// contained in the given slice of libvirt snapshots are omitted. The returned
+// snapshots are marked as unmanaged and do not have a libvirt instance. They
+// are sorted by creation time.
+func (vm *VM) ListUnmanagedSnapshots(known []Snapshot) ([]Snapshot, error) {
+	qemuImgPath, err := exec.LookPath("qemu-img")
+	if err != nil {
+		err = fmt.Errorf("could not find qemu-img: %v", err)
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(known))
+	for _, snapshot := range known {
+		seen[snapshot.Descriptor.Name] = true
+	}
+
+	unmanaged := make([]Snapshot, 0)
+	for _, disk := range diskDevices(vm.Descriptor) {
+		if disk.Driver == nil || disk.Driver.Type != "qcow2" {
+			continue
+		}
+		if disk.Source == nil || disk.Source.File == nil ||
+			disk.Source.File.File == "" {
+			continue
+		}
+		path := disk.Source.File.File
+
+		// the image of a running VM is locked by qemu, so force a shared lock
+		// for the read-only listing
+		vm.Logger.Debugf("executing command 'qemu-img snapshot -l -U %s'", path)
+		output, err := exec.Command(qemuImgPath, "snapshot", "-l", "-U",
+			path).Output()
+		if err != nil {
+			err = fmt.Errorf("unable to list snapshots of disk '%s' of VM '%s' "+
+				"with qemu-img: %s", path, vm.Descriptor.Name, err)
+			return nil, err
+		}
+
+		snapshots, err := ParseQemuImgSnapshots(string(output))
+		if err != nil {
+			err = fmt.Errorf("unable to parse snapshots of disk '%s' of VM '%s': "+
+				"%s", path, vm.Descriptor.Name, err)
+			return nil, err
+		}
+
+		// an internal snapshot spanning multiple disks is listed for each disk
+		for _, snapshot := range snapshots {
+			if seen[snapshot.Descriptor.Name] {
+				continue
+			}
+			seen[snapshot.Descriptor.Name] = true
+			unmanaged = append(unmanaged, snapshot)
+		}
+	}
+
+	sorter := SnapshotSorter{
+		Snapshots: &unmanaged,
+	}
+	sort.Sort(&sorter)
+
+	return unmanaged, nil
+}
+
+// ParseQemuImgSnapshots parses the tabular output of "qemu-img snapshot -l"
+// into unmanaged snapshots. qemu-img prints the dates in the local time zone.
+func ParseQemuImgSnapshots(output string) ([]Snapshot, error) {
+	snapshots := make([]Snapshot, 0)
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		// skip the "Snapshot list:" caption and the header row
+		if line == "" || strings.HasPrefix(line, "Snapshot list:") ||
+			strings.HasPrefix(line, "ID") {
+			continue
+		}
+
+		match := qemuImgSnapshotLine.FindStringSubmatch(line)
+		if match == nil {
+			return nil, fmt.Errorf("unexpected line in qemu-img output: '%s'",
+				line)
+		}
+
+		created, err := time.ParseInLocation(qemuImgDateFormat, match[4],
+			time.Local)
+		if err != nil {
+			err = fmt.Errorf("unable to parse creation time of snapshot '%s': %s",
+				match[2], err)
+			return nil, err
+		}
+
+		snapshots = append(snapshots, Snapshot{
+			Descriptor: libvirtxml.DomainSnapshot{
+				Name:         match[2],
+				CreationTime: strconv.FormatInt(created.Unix(), 10),
+			},
+			Unmanaged: true,
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read qemu-img output: %s", err)
+	}
+
+	return snapshots, nil
+}
+
+// ImageInfo is the subset of the JSON output of "qemu-img info" describing a
+// disk image that is needed by virsnap.
+type ImageInfo struct {
+	// Filename is the path of the image.
+	Filename string `json:"filename"`
+
+	// Format is the format of the image, e.g. "qcow2" or "raw".
+	Format string `json:"format"`
+
+	// VirtualSize is the size of the disk in bytes as seen by the guest.
+	VirtualSize uint64 `json:"virtual-size"`
+
+	// ActualSize is the number of bytes allocated by the image on the host.
+	ActualSize uint64 `json:"actual-size"`
+
+	// BackingFilename is the backing file as stored in the image, i.e. possibly
+	// relative to the image. Empty if the image has no backing file.
+	BackingFilename string `json:"backing-filename,omitempty"`
+
+	// FullBackingFilename is the resolved path of the backing file.
+	FullBackingFilename string `json:"full-backing-filename,omitempty"`
+
+	// Snapshots are the internal snapshots stored in the image.
+	Snapshots []ImageSnapshot `json:"snapshots,omitempty"`
+}
+
+// ImageSnapshot is an internal snapshot of a qcow2 image as listed by
+// "qemu-img info".
+type ImageSnapshot struct {
+	// Name is the name of the snapshot, which matches the name of the libvirt
+	// snapshot for snapshots created by libvirt.
+	Name string `json:"name"`
+
+	// VMStateSize is the number of bytes of the VM state (memory and device
+	// state) saved with the snapshot. Zero for snapshots of shut off VMs.
+	VMStateSize uint64 `json:"vm-state-size"`
+}
+
+// DiskInfo runs "qemu-img info" on the disk image with the given path and
+// returns what qemu-img actually found, e.g. the format of the image, which
+// does not necessarily match the driver type in the descriptor of the VM.
+func DiskInfo(path string) (ImageInfo, error) {
+	qemuImgPath, err := exec.LookPath("qemu-img")
+	if err != nil {
+		err = fmt.Errorf("could not find qemu-img: %v", err)
+		return ImageInfo{}, err
+	}
+
+	// the image of a running VM is locked by qemu, so force a shared lock for
+	// the read-only inspection
+	output, err := exec.Command(qemuImgPath, "info", "--output=json", "-U",
+		path).Output()
+	if err != nil {
+		err = fmt.Errorf("unable to inspect disk '%s' with qemu-img: %s", path,
+			err)
+		return ImageInfo{}, err
+	}
+
+	return parseQemuImgInfo(output)
+}
+
+// DiskAllocation runs "qemu-img info" on the disk image with the given path and
+// returns the number of bytes actually allocated by the image on the host.
+func DiskAllocation(path string) (uint64, error) {
+	info, err := DiskInfo(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.ActualSize, nil
+}
+
+// parseQemuImgInfo parses the JSON output of "qemu-img info --output=json".
+func parseQemuImgInfo(output []byte) (ImageInfo, error) {
+	var info ImageInfo
+	err := json.Unmarshal(output, &info)
+	if err != nil {
+		return ImageInfo{}, fmt.Errorf("unable to parse qemu-img output: %s", err)
+	}
+	return info, nil
+}
+
+// ConvertDisk runs "qemu-img convert" to copy the disk image with the given
+// path into a standalone image of the given format (e.g. "qcow2" or "raw").
+// The backing chain of the source is collapsed into the target, internal
+// snapshots are not copied. An existing target is overwritten. The format of
+// the source is probed by qemu-img if sourceFormat is empty.
+func ConvertDisk(source string, sourceFormat string, target string,
+	format string, logger log.Logger) error {
+	qemuImgPath, err := exec.LookPath("qemu-img")
+	if err != nil {
+		err = fmt.Errorf("could not find qemu-img: %v", err)
+		return err
+	}
+
+	args := []string{"convert", "-p"}
+	if sourceFormat != "" {
+		args = append(args, "-f", sourceFormat)
+	}
+	args = append(args, "-O", format, source, target)
+
+	// call qemu-img and show its progress
+	logger.Debugf("executing command 'qemu-img %s'", strings.Join(args, " "))
+	cmd := exec.Command(qemuImgPath, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if err != nil {
+		err = fmt.Errorf("unable to convert disk '%s' with qemu-img: %s", source,
+			err)
+	}
+	return err
+}
+
+// BackingChain runs "qemu-img info --backing-chain" on the disk image with the
+// given path and returns the images of its backing chain, starting with the
+// given image itself. An image without backing file (e.g. a raw image) results
+// in a chain of a single image.
+func BackingChain(path string) ([]ImageInfo, error) {
+	qemuImgPath, err := exec.LookPath("qemu-img")
+	if err != nil {
+		err = fmt.Errorf("could not find qemu-img: %v", err)
+		return nil, err
+	}
+
+	// the image of a running VM is locked by qemu, so force a shared lock for
+	// the read-only inspection
+	output, err := exec.Command(qemuImgPath, "info", "--backing-chain",
+		"--output=json", "-U", path).Output()
+	if err != nil {
+		err = fmt.Errorf("unable to inspect backing chain of disk '%s' with "+
+			"qemu-img: %s", path, err)
+		return nil, err
+	}
+
+	return parseBackingChain(output)
+}
+
+// parseBackingChain parses the JSON output of
+// "qemu-img info --backing-chain --output=json", which is an array of image
+// infos.
+func parseBackingChain(output []byte) ([]ImageInfo, error) {
+	chain := make([]ImageInfo, 0)
+	err := json.Unmarshal(output, &chain)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse qemu-img output: %s", err)
+	}
+	return chain, nil
+}
+
+// DiskChain is the backing chain of a disk of a VM.
+type DiskChain struct {
+	// Target is the target device of the disk in the VM, e.g. "vda".
+	Target string
+
+	// Source is the path of the disk image or block device on the host. Empty
+	// if the disk is neither backed by a file nor by a block device.
+	Source string
+
+	// Images are the images of the backing chain, starting with the active
+	// image. Empty if the chain could not be inspected.
+	Images []ImageInfo
+
+	// Error describes why the chain could not be inspected.
+	Error error
+}
+
+// BackingChains inspects the backing chains of all disks of the VM. Disks that
+// are neither backed by a file nor by a block device (e.g. network disks) and
+// disks whose chain cannot be inspected are reported with an error instead of
+// images.
+func (vm *VM) BackingChains() []DiskChain {
+	disks := diskDevices(vm.Descriptor)
+	chains := make([]DiskChain, 0, len(disks))
+	for _, disk := range disks {
+		chain := DiskChain{
+			Target: diskTarget(disk),
+		}
+
+		switch {
+		case disk.Source != nil && disk.Source.File != nil &&
+			disk.Source.File.File != "":
+			chain.Source = disk.Source.File.File
+		case disk.Source != nil && disk.Source.Block != nil &&
+			disk.Source.Block.Dev != "":
+			chain.Source = disk.Source.Block.Dev
+		default:
+			chain.Error = fmt.Errorf("disk is neither backed by a file nor by a " +
+				"block device")
+			chains = append(chains, chain)
+			continue
+		}
+
+		vm.Logger.Debugf("inspecting backing chain of disk '%s'", chain.Source)
+		chain.Images, chain.Error = BackingChain(chain.Source)
+		chains = append(chains, chain)
+	}
+	return chains
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQemuImgSnapshots(t *testing.T) {
+	output := "Snapshot list:\n" +
+		"ID        TAG               VM SIZE                DATE     VM CLOCK     ICOUNT\n" +
+		"1         before-upgrade    1.2 GiB 2019-07-11 08:37:50 00:05:12.345         --\n" +
+		"2         clean install         0 B 2019-07-12 10:00:00 00:00:00.000         --\n"
+
+	snapshots, err := ParseQemuImgSnapshots(output)
+	require.NoError(t, err)
+	require.Equal(t, []string{"before-upgrade", "clean install"},
+		snapshotNames(snapshots))
+
+	created := time.Date(2019, 7, 11, 8, 37, 50, 0, time.Local)
+	require.Equal(t, strconv.FormatInt(created.Unix(), 10),
+		snapshots[0].Descriptor.CreationTime)
+	require.True(t, snapshots[0].Unmanaged)
+}
+
+func TestParseQemuImgSnapshotsLegacy(t *testing.T) {
+	output := "Snapshot list:\n" +
+		"ID        TAG                 VM SIZE                DATE       VM CLOCK\n" +
+		"1         manual                 1.2G 2019-07-11 08:37:50   00:05:12.345\n"
+
+	snapshots, err := ParseQemuImgSnapshots(output)
+	require.NoError(t, err)
+	require.Equal(t, []string{"manual"}, snapshotNames(snapshots))
+}
+
+func TestParseQemuImgSnapshotsEmpty(t *testing.T) {
+	snapshots, err := ParseQemuImgSnapshots("")
+	require.NoError(t, err)
+	require.Empty(t, snapshots)
+
+	_, err = ParseQemuImgSnapshots("garbage\n")
+	require.Error(t, err)
+}
+
+func TestParseQemuImgInfo(t *testing.T) {
+	output := []byte(`{
+    "virtual-size": 21474836480,
+    "filename": "/var/lib/libvirt/images/testvm.qcow2",
+    "cluster-size": 65536,
+    "format": "qcow2",
+    "actual-size": 5368709120,
+    "dirty-flag": false
+}`)
+
+	info, err := parseQemuImgInfo(output)
+	require.NoError(t, err)
+	require.Equal(t, "qcow2", info.Format)
+	require.Equal(t, uint64(21474836480), info.VirtualSize)
+	require.Equal(t, uint64(5368709120), info.ActualSize)
+	require.Empty(t, info.BackingFilename)
+
+	_, err = parseQemuImgInfo([]byte("qemu-img: Could not open"))
+	require.Error(t, err)
+}
+
+func TestParseBackingChain(t *testing.T) {
+	output := []byte(`[
+    {
+        "virtual-size": 21474836480,
+        "filename": "/var/lib/libvirt/images/testvm-overlay.qcow2",
+        "cluster-size": 65536,
+        "format": "qcow2",
+        "actual-size": 200704,
+        "backing-filename": "testvm-base.qcow2",
+        "full-backing-filename": "/var/lib/libvirt/images/testvm-base.qcow2",
+        "backing-filename-format": "qcow2",
+        "dirty-flag": false
+    },
+    {
+        "virtual-size": 21474836480,
+        "filename": "/var/lib/libvirt/images/testvm-base.qcow2",
+        "cluster-size": 65536,
+        "format": "qcow2",
+        "actual-size": 5368709120,
+        "dirty-flag": false
+    }
+]`)
+
+	chain, err := parseBackingChain(output)
+	require.NoError(t, err)
+	require.Len(t, chain, 2)
+	require.Equal(t, ImageInfo{
+		Filename:            "/var/lib/libvirt/images/testvm-overlay.qcow2",
+		Format:              "qcow2",
+		VirtualSize:         21474836480,
+		ActualSize:          200704,
+		BackingFilename:     "testvm-base.qcow2",
+		FullBackingFilename: "/var/lib/libvirt/images/testvm-base.qcow2",
+	}, chain[0])
+	require.Equal(t, "/var/lib/libvirt/images/testvm-base.qcow2",
+		chain[1].Filename)
+	require.Empty(t, chain[1].BackingFilename)
+
+	_, err = parseBackingChain([]byte("qemu-img: Could not open"))
+	require.Error(t, err)
+}
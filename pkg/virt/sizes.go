@@ -0,0 +1,110 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"sort"
+)
+
+// SnapshotSize is the estimated size of a snapshot of a VM.
+type SnapshotSize struct {
+	// VM is the name of the VM the snapshot belongs to.
+	VM string
+
+	// Snapshot is the name of the snapshot.
+	Snapshot string
+
+	// Bytes is the size of the VM state saved with the snapshot in the qcow2
+	// images of the VM, summed over all disks, as reported by qemu-img. The
+	// disk clusters that are only kept by the snapshot are not included, since
+	// qcow2 does not account them per snapshot. Only valid if Known is true.
+	Bytes uint64
+
+	// Known determines whether the size could be estimated. The size is
+	// unknown if the snapshot is not stored in any qcow2 image of the VM (e.g.
+	// an external snapshot) or if an image could not be inspected.
+	Known bool
+}
+
+// SnapshotSizes estimates the sizes of the given snapshots of the VM from the
+// internal snapshots of its qcow2 disks, which are inspected with
+// "qemu-img info". If a disk cannot be inspected, a warning is logged and the
+// sizes of all snapshots are unknown, since they would be underestimated.
+func (vm *VM) SnapshotSizes(snapshots []Snapshot) []SnapshotSize {
+	names := make([]string, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		names = append(names, snapshot.Descriptor.Name)
+	}
+
+	infos := make([]ImageInfo, 0)
+	complete := true
+	for _, disk := range diskDevices(vm.Descriptor) {
+		if disk.Driver == nil || disk.Driver.Type != "qcow2" {
+			continue
+		}
+		if disk.Source == nil || disk.Source.File == nil ||
+			disk.Source.File.File == "" {
+			continue
+		}
+		path := disk.Source.File.File
+
+		vm.Logger.Debugf("inspecting snapshots of disk '%s'", path)
+		info, err := DiskInfo(path)
+		if err != nil {
+			vm.Logger.Warnf("unable to estimate snapshot sizes of VM '%s': %s",
+				vm.Descriptor.Name, err)
+			complete = false
+			continue
+		}
+		infos = append(infos, info)
+	}
+
+	sizes := estimateSnapshotSizes(vm.Descriptor.Name, names, infos)
+	if !complete {
+		for index := range sizes {
+			sizes[index].Known = false
+			sizes[index].Bytes = 0
+		}
+	}
+	return sizes
+}
+
+// estimateSnapshotSizes sums up the VM state sizes of the internal snapshots
+// with the given names over the given images. The size of a snapshot that is
+// not stored in any of the images is unknown.
+func estimateSnapshotSizes(vmName string, names []string,
+	infos []ImageInfo) []SnapshotSize {
+	sizes := make([]SnapshotSize, 0, len(names))
+	for _, name := range names {
+		size := SnapshotSize{
+			VM:       vmName,
+			Snapshot: name,
+		}
+		for _, info := range infos {
+			for _, snapshot := range info.Snapshots {
+				if snapshot.Name != name {
+					continue
+				}
+				size.Bytes += snapshot.VMStateSize
+				size.Known = true
+			}
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes
+}
+
+// SortSnapshotSizes sorts the given sizes in place, largest first. Unknown
+// sizes are sorted last. The order of equal sizes is kept.
+func SortSnapshotSizes(sizes []SnapshotSize) {
+	sort.SliceStable(sizes, func(i int, j int) bool {
+		if sizes[i].Known != sizes[j].Known {
+			return sizes[i].Known
+		}
+		return sizes[i].Bytes > sizes[j].Bytes
+	})
+}
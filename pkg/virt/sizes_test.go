@@ -0,0 +1,81 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateSnapshotSizes(t *testing.T) {
+	output := []byte(`{
+    "virtual-size": 21474836480,
+    "filename": "/var/lib/libvirt/images/testvm.qcow2",
+    "format": "qcow2",
+    "actual-size": 5368709120,
+    "snapshots": [
+        {
+            "id": "1",
+            "name": "virsnap_angry_hypatia",
+            "vm-state-size": 1073741824,
+            "date-sec": 1562827070,
+            "date-nsec": 0,
+            "vm-clock-sec": 312,
+            "vm-clock-nsec": 345000000
+        },
+        {
+            "id": "2",
+            "name": "virsnap_hardcore_galileo",
+            "vm-state-size": 0,
+            "date-sec": 1562913470,
+            "date-nsec": 0,
+            "vm-clock-sec": 0,
+            "vm-clock-nsec": 0
+        }
+    ]
+}`)
+	info, err := parseQemuImgInfo(output)
+	require.NoError(t, err)
+	require.Len(t, info.Snapshots, 2)
+
+	// the VM state of a snapshot is stored in one image, the other images
+	// only hold its disk state
+	data := ImageInfo{
+		Snapshots: []ImageSnapshot{{Name: "virsnap_angry_hypatia"}},
+	}
+
+	sizes := estimateSnapshotSizes("testvm", []string{"virsnap_angry_hypatia",
+		"virsnap_hardcore_galileo", "external"}, []ImageInfo{info, data})
+	require.Equal(t, []SnapshotSize{
+		{
+			VM:       "testvm",
+			Snapshot: "virsnap_angry_hypatia",
+			Bytes:    1073741824,
+			Known:    true,
+		},
+		{VM: "testvm", Snapshot: "virsnap_hardcore_galileo", Known: true},
+		{VM: "testvm", Snapshot: "external"},
+	}, sizes)
+}
+
+func TestSortSnapshotSizes(t *testing.T) {
+	sizes := []SnapshotSize{
+		{Snapshot: "unknown"},
+		{Snapshot: "small", Bytes: 1, Known: true},
+		{Snapshot: "empty", Known: true},
+		{Snapshot: "large", Bytes: 1 << 30, Known: true},
+	}
+
+	SortSnapshotSizes(sizes)
+
+	names := make([]string, 0, len(sizes))
+	for _, size := range sizes {
+		names = append(names, size.Snapshot)
+	}
+	require.Equal(t, []string{"large", "small", "empty", "unknown"}, names)
+}
@@ -7,10 +7,17 @@
 package virt
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/joroec/virsnap/pkg/fs"
 	"github.com/joroec/virsnap/pkg/instrument/log"
 
 	"github.com/docker/docker/pkg/namesgenerator"
@@ -25,11 +32,25 @@ import (
 type Snapshot struct {
 	Instance   libvirt.DomainSnapshot
 	Descriptor libvirtxml.DomainSnapshot
+
+	// Unmanaged marks an internal qcow2 snapshot libvirt has no metadata for.
+	// Such a snapshot has no libvirt instance and only the name and creation
+	// time of the descriptor are set. See ListUnmanagedSnapshots.
+	Unmanaged bool
+
+	// Unparseable marks a snapshot whose XML descriptor could not be retrieved
+	// or unmarshalled. Only the name of the descriptor is set. Since the
+	// creation time is unknown, such a snapshot sorts as the oldest one and is
+	// removed first by clean. See ListMatchingSnapshots.
+	Unparseable bool
 }
 
 // Free is a convenience method for calling Free on the corresponding libvirt
-// Snapshot instance.
+// Snapshot instance. Unmanaged snapshots have no instance to free.
 func (s *Snapshot) Free() error {
+	if s.Unmanaged {
+		return nil
+	}
 	return s.Instance.Free()
 }
 
@@ -41,7 +62,8 @@ func (s *Snapshot) Free() error {
 // machines whose name matches at least one of the regular expressions are
 // returned. The caller is responsible for calling FreeSnapshots on the
 // returned slice to free any buffer in libvirt. The returned snapshots
-// are sorted by creation time.
+// are sorted by creation time. Snapshots whose descriptor cannot be parsed
+// are returned with Unparseable set instead of being skipped.
 func (vm *VM) ListMatchingSnapshots(regexes []string) ([]Snapshot, error) {
 	// argument validity checking
 	exprs := make([]*regexp.Regexp, 0, len(regexes))
@@ -62,6 +84,7 @@ func (vm *VM) ListMatchingSnapshots(regexes []string) ([]Snapshot, error) {
 	// retrieve all snapshots from libvirt
 	instances, err := vm.Instance.ListAllSnapshots(0)
 	if err != nil {
+		logLibvirtError(vm.Logger, err)
 		err = fmt.Errorf("unable to retrieve snapshots for VM %s: %s",
 			vm.Descriptor.Name, err)
 		return nil, err
@@ -74,18 +97,13 @@ func (vm *VM) ListMatchingSnapshots(regexes []string) ([]Snapshot, error) {
 	for _, instance := range instances {
 
 		// retrieve and unmarshal the descriptor of snapshot
-		xml, err := instance.GetXMLDesc(0)
+		descriptor, unparseable, err := describeSnapshot(vm.Logger, &instance)
 		if err != nil {
-			err = fmt.Errorf("unable to get XML descriptor of snapshot: %s", err)
 			vm.Logger.Warnf("Skipping snapshot: %s", err)
-			continue
-		}
-
-		descriptor := libvirtxml.DomainSnapshot{}
-		err = descriptor.Unmarshal(xml)
-		if err != nil {
-			err = fmt.Errorf("unable to unmarshal the XML descriptor of snapshot: %s", err)
-			vm.Logger.Warn("Skipping snapshot: %s", err)
+			freeErr := instance.Free()
+			if freeErr != nil {
+				vm.Logger.Warnf("unable to free snapshot: %s", freeErr)
+			}
 			continue
 		}
 
@@ -102,8 +120,9 @@ func (vm *VM) ListMatchingSnapshots(regexes []string) ([]Snapshot, error) {
 			// the caller is responsible for calling domain.Free() on the returned
 			// domains
 			matchedSnapshot := Snapshot{
-				Instance:   instance,
-				Descriptor: descriptor,
+				Instance:    instance,
+				Descriptor:  descriptor,
+				Unparseable: unparseable,
 			}
 			matchedSnapshots = append(matchedSnapshots, matchedSnapshot)
 		} else {
@@ -127,12 +146,188 @@ func (vm *VM) ListMatchingSnapshots(regexes []string) ([]Snapshot, error) {
 	return matchedSnapshots, nil
 }
 
+// snapshotDescriber is the part of a libvirt.DomainSnapshot needed to
+// describe the snapshot.
+type snapshotDescriber interface {
+	GetName() (string, error)
+	GetXMLDesc(flags libvirt.DomainSnapshotXMLFlags) (string, error)
+}
+
+// describeSnapshot retrieves and unmarshals the XML descriptor of the given
+// snapshot. If the descriptor cannot be retrieved or unmarshalled, a warning
+// is logged and a descriptor only containing the name of the snapshot is
+// returned with unparseable set, so that the snapshot stays visible and can
+// still be removed. An error is returned if not even the name of the snapshot
+// can be retrieved.
+func describeSnapshot(log log.Logger,
+	instance snapshotDescriber) (libvirtxml.DomainSnapshot, bool, error) {
+	descriptor := libvirtxml.DomainSnapshot{}
+
+	xml, err := instance.GetXMLDesc(0)
+	if err == nil {
+		err = descriptor.Unmarshal(xml)
+		if err == nil {
+			return descriptor, false, nil
+		}
+		err = fmt.Errorf("unable to unmarshal the XML descriptor: %s", err)
+	} else {
+		err = fmt.Errorf("unable to get the XML descriptor: %s", err)
+	}
+
+	name, nameErr := instance.GetName()
+	if nameErr != nil {
+		err = fmt.Errorf("unable to get the name of snapshot: %s (%s)", nameErr,
+			err)
+		return libvirtxml.DomainSnapshot{}, false, err
+	}
+
+	log.Warnf("snapshot '%s' is unparseable: %s", name, err)
+	return libvirtxml.DomainSnapshot{Name: name}, true, nil
+}
+
+// FilterSnapshotsByPrefix returns the snapshots of the given slice whose
+// name starts with the given prefix. The order of the snapshots is preserved.
+func FilterSnapshotsByPrefix(snapshots []Snapshot, prefix string) []Snapshot {
+	filtered := make([]Snapshot, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		if strings.HasPrefix(snapshot.Descriptor.Name, prefix) {
+			filtered = append(filtered, snapshot)
+		}
+	}
+	return filtered
+}
+
+// ExpiredSnapshots takes a slice of snapshots sorted by creation time and
+// returns the snapshots exceeding the keep newest snapshots, i.e. the oldest
+// len(snapshots)-keep snapshots.
+func ExpiredSnapshots(snapshots []Snapshot, keep int) []Snapshot {
+	if len(snapshots) <= keep {
+		return nil
+	}
+	return snapshots[:len(snapshots)-keep]
+}
+
+// ExpiredDailySnapshots takes a slice of snapshots sorted by creation time and
+// returns the snapshots exceeding the retention policy "keep the newest
+// snapshot of each of the last days calendar days that have snapshots". The
+// calendar day of a snapshot is determined in the given location, so that
+// days with a daylight saving time transition are handled like any other day.
+// Snapshots with an unparsable creation time are never returned, since their
+// age is unknown.
+func ExpiredDailySnapshots(snapshots []Snapshot, days int,
+	loc *time.Location) []Snapshot {
+	keep := make(map[int]bool, days)
+	kept := 0
+	var lastDay string
+
+	// iterate from newest to oldest, the first snapshot of each day is kept
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		created, err := SnapshotTime(snapshots[i])
+		if err != nil {
+			keep[i] = true
+			continue
+		}
+
+		day := created.In(loc).Format("2006-01-02")
+		if day != lastDay && kept < days {
+			keep[i] = true
+			kept++
+		}
+		lastDay = day
+	}
+
+	expired := make([]Snapshot, 0, len(snapshots))
+	for i, snapshot := range snapshots {
+		if !keep[i] {
+			expired = append(expired, snapshot)
+		}
+	}
+	return expired
+}
+
+// SnapshotsOlderThan returns the snapshots of the given slice that were
+// created before the given cutoff, preserving their order. Snapshots with an
+// unparsable creation time are never returned, since their age is unknown.
+func SnapshotsOlderThan(snapshots []Snapshot, cutoff time.Time) []Snapshot {
+	older := make([]Snapshot, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		created, err := SnapshotTime(snapshot)
+		if err != nil {
+			continue
+		}
+		if created.Before(cutoff) {
+			older = append(older, snapshot)
+		}
+	}
+	return older
+}
+
+// SnapshotsBetween takes a slice of snapshots sorted by creation time and
+// returns the snapshots positioned after the snapshot named after and before
+// the snapshot named before. An empty name does not restrict the selection on
+// this side. The reference snapshots themselves are never selected. An error
+// is returned if a reference snapshot is not contained in the slice.
+func SnapshotsBetween(snapshots []Snapshot, after string,
+	before string) ([]Snapshot, error) {
+	start := 0
+	end := len(snapshots)
+
+	if after != "" {
+		index := snapshotIndex(snapshots, after)
+		if index < 0 {
+			return nil, fmt.Errorf("reference snapshot '%s' does not exist", after)
+		}
+		start = index + 1
+	}
+
+	if before != "" {
+		index := snapshotIndex(snapshots, before)
+		if index < 0 {
+			return nil, fmt.Errorf("reference snapshot '%s' does not exist", before)
+		}
+		end = index
+	}
+
+	if start >= end {
+		return nil, nil
+	}
+	return snapshots[start:end], nil
+}
+
+// snapshotIndex returns the index of the snapshot with the given name in the
+// given slice or -1 if the slice does not contain such a snapshot.
+func snapshotIndex(snapshots []Snapshot, name string) int {
+	for i, snapshot := range snapshots {
+		if snapshot.Descriptor.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// IntersectSnapshots returns the snapshots of the first slice whose name is
+// contained in the second slice, preserving the order of the first slice.
+func IntersectSnapshots(snapshots []Snapshot, others []Snapshot) []Snapshot {
+	names := make(map[string]bool, len(others))
+	for _, snapshot := range others {
+		names[snapshot.Descriptor.Name] = true
+	}
+
+	intersection := make([]Snapshot, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		if names[snapshot.Descriptor.Name] {
+			intersection = append(intersection, snapshot)
+		}
+	}
+	return intersection
+}
+
 // FreeSnapshots is a function that takes a slice of snapshots and frees any
 // associated libvirt.DomainSnapshot. Usually, this is called after
 // ListMatchingSnapshots with a "defer" statement.
 func FreeSnapshots(log log.Logger, snapshots []Snapshot) {
 	for _, snapshot := range snapshots {
-		err := snapshot.Instance.Free()
+		err := snapshot.Free()
 		if err != nil {
 			log.Warnf("unable to free snapshot %s: %s",
 				snapshot.Descriptor.Name,
@@ -142,32 +337,565 @@ func FreeSnapshots(log log.Logger, snapshots []Snapshot) {
 	}
 }
 
+// deleteRetryDelay is the time to wait before retrying to remove a snapshot of
+// a VM that is busy.
+const deleteRetryDelay = 5 * time.Second
+
+// DeleteSnapshot removes the given snapshot of the VM. If libvirt refuses the
+// removal because another operation is using the VM, the removal is retried up
+// to the given number of times, since this is usually transient.
+func (vm *VM) DeleteSnapshot(snapshot *Snapshot, retries int) error {
+	if snapshot.Unmanaged {
+		return fmt.Errorf("unable to remove snapshot '%s' of VM '%s': snapshot "+
+			"is not managed by libvirt", snapshot.Descriptor.Name,
+			vm.Descriptor.Name)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := snapshot.Instance.Delete(0)
+		if err == nil {
+			return nil
+		}
+
+		if !isBusyError(err) || attempt >= retries {
+			err = fmt.Errorf("unable to remove snapshot '%s' of VM '%s': %s",
+				snapshot.Descriptor.Name, vm.Descriptor.Name, err)
+			return err
+		}
+
+		vm.Logger.Debugf("VM '%s' is busy, retrying to remove snapshot '%s' in "+
+			"%s: %s", vm.Descriptor.Name, snapshot.Descriptor.Name,
+			deleteRetryDelay, err)
+		time.Sleep(deleteRetryDelay)
+	}
+}
+
+// LatestSnapshot returns the most recently created snapshot of the VM, as
+// sorted by SnapshotSorter. Snapshots whose descriptor cannot be parsed are not
+// considered, since their creation time is unknown. The other snapshots are
+// freed. The caller is responsible for calling Free on the returned snapshot.
+func (vm *VM) LatestSnapshot() (Snapshot, error) {
+	snapshots, err := vm.ListMatchingSnapshots([]string{".*"})
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	latest, others, ok := latestSnapshot(snapshots)
+	FreeSnapshots(vm.Logger, others)
+	if !ok {
+		return Snapshot{}, fmt.Errorf("VM '%s' has no snapshots",
+			vm.Descriptor.Name)
+	}
+	return latest, nil
+}
+
+// latestSnapshot sorts the given snapshots by creation time and splits off the
+// latest snapshot that is not unparseable. The remaining snapshots are
+// returned as well, so that they can be freed. The boolean is false if there is
+// no such snapshot.
+func latestSnapshot(snapshots []Snapshot) (Snapshot, []Snapshot, bool) {
+	sorter := SnapshotSorter{
+		Snapshots: &snapshots,
+	}
+	sort.Sort(&sorter)
+
+	for index := len(snapshots) - 1; index >= 0; index-- {
+		if snapshots[index].Unparseable {
+			continue
+		}
+
+		others := make([]Snapshot, 0, len(snapshots)-1)
+		others = append(others, snapshots[:index]...)
+		others = append(others, snapshots[index+1:]...)
+		return snapshots[index], others, true
+	}
+	return Snapshot{}, snapshots, false
+}
+
+// RevertToSnapshot reverts the VM to the given snapshot. The VM is left in the
+// state recorded in the snapshot, e.g. running for a snapshot of a running VM.
+// The current state of the disks and, if running, the memory of the VM is
+// lost.
+func (vm *VM) RevertToSnapshot(snapshot *Snapshot) error {
+	err := snapshot.Instance.RevertToSnapshot(0)
+	if err != nil {
+		logLibvirtError(vm.Logger, err)
+		return fmt.Errorf("unable to revert VM '%s' to snapshot '%s': %s",
+			vm.Descriptor.Name, snapshot.Descriptor.Name, err)
+	}
+	return nil
+}
+
+// SnapshotTime returns the creation time of the given snapshot. libvirt stores
+// the creation time as seconds since the unix epoch.
+func SnapshotTime(s Snapshot) (time.Time, error) {
+	seconds, err := strconv.ParseInt(s.Descriptor.CreationTime, 10, 64)
+	if err != nil {
+		err = fmt.Errorf("unable to parse creation time of snapshot '%s': %s",
+			s.Descriptor.Name, err)
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// UpdateSnapshotDescription changes the description of the given snapshot of
+// the VM by redefining the snapshot's metadata (see RedefineSnapshot). All
+// other fields of the snapshot (e.g. parent, disks and creation time) are
+// preserved.
+func (vm *VM) UpdateSnapshotDescription(snapshot *Snapshot,
+	description string) error {
+	return vm.RedefineSnapshot(snapshot,
+		func(descriptor *libvirtxml.DomainSnapshot) {
+			descriptor.Description = description
+		})
+}
+
+// RedefineSnapshot changes the metadata of the given snapshot of the VM by
+// applying update to its descriptor and redefining the snapshot. The disks and
+// the memory state of the snapshot are never touched. If update changes the
+// name, the snapshot is renamed: the new definition is created first and the
+// old metadata is only removed once the new definition was verified. If any
+// step fails, the original metadata is restored, so that the VM never ends up
+// without metadata for the snapshot. Snapshots with children cannot be
+// renamed, since the children would still reference the old name.
+func (vm *VM) RedefineSnapshot(snapshot *Snapshot,
+	update func(descriptor *libvirtxml.DomainSnapshot)) error {
+	// the secure XML is required for redefining the snapshot
+	original, err := snapshot.Instance.GetXMLDesc(
+		libvirt.DOMAIN_SNAPSHOT_XML_SECURE)
+	if err != nil {
+		err = fmt.Errorf("unable to get XML descriptor of snapshot '%s': %s",
+			snapshot.Descriptor.Name, err)
+		return err
+	}
+
+	descriptor := libvirtxml.DomainSnapshot{}
+	err = descriptor.Unmarshal(original)
+	if err != nil {
+		err = fmt.Errorf("unable to unmarshal the XML descriptor of snapshot "+
+			"'%s': %s", snapshot.Descriptor.Name, err)
+		return err
+	}
+	oldName := descriptor.Name
+	update(&descriptor)
+	renamed := descriptor.Name != oldName
+
+	if renamed {
+		children, err := snapshot.Instance.NumChildren(0)
+		if err != nil {
+			err = fmt.Errorf("unable to count children of snapshot '%s': %s",
+				oldName, err)
+			return err
+		}
+		if children > 0 {
+			return fmt.Errorf("unable to rename snapshot '%s' of VM '%s': the "+
+				"snapshot has %d children", oldName, vm.Descriptor.Name, children)
+		}
+	}
+
+	doc, err := descriptor.Marshal()
+	if err != nil {
+		err = fmt.Errorf("unable to marshal snapshot XML for VM '%s': %s",
+			vm.Descriptor.Name, err)
+		return err
+	}
+
+	// redefining a snapshot without the current flag would lose the mark of
+	// the current snapshot
+	flags := libvirt.DOMAIN_SNAPSHOT_CREATE_REDEFINE
+	current, err := snapshot.Instance.IsCurrent(0)
+	if err != nil {
+		err = fmt.Errorf("unable to check whether snapshot '%s' is the current "+
+			"snapshot: %s", oldName, err)
+		return err
+	}
+	if current {
+		flags |= libvirt.DOMAIN_SNAPSHOT_CREATE_CURRENT
+	}
+
+	// step 1: create the new definition, which replaces the old one in place
+	// unless the snapshot is renamed
+	redefined, err := vm.Instance.CreateSnapshotXML(doc, flags)
+	if err != nil {
+		logLibvirtError(vm.Logger, err)
+		err = fmt.Errorf("unable to redefine snapshot '%s' of VM '%s': %s",
+			oldName, vm.Descriptor.Name, err)
+		return err
+	}
+
+	// step 2: verify that libvirt stored what was requested
+	err = verifySnapshotDefinition(redefined, descriptor)
+	if err != nil {
+		err = fmt.Errorf("unable to verify the redefined snapshot '%s' of VM "+
+			"'%s': %s", descriptor.Name, vm.Descriptor.Name, err)
+		vm.rollbackRedefine(redefined, renamed, original, flags)
+		redefined.Free()
+		return err
+	}
+
+	// step 3: remove the old metadata of a renamed snapshot
+	if renamed {
+		err = snapshot.Instance.Delete(
+			libvirt.DOMAIN_SNAPSHOT_DELETE_METADATA_ONLY)
+		if err != nil {
+			logLibvirtError(vm.Logger, err)
+			err = fmt.Errorf("unable to remove old metadata of snapshot '%s' of "+
+				"VM '%s': %s", oldName, vm.Descriptor.Name, err)
+			vm.rollbackRedefine(redefined, renamed, original, flags)
+			redefined.Free()
+			return err
+		}
+
+		// the old instance refers to the removed metadata
+		snapshot.Instance.Free()
+		snapshot.Instance = *redefined
+	} else {
+		redefined.Free()
+	}
+
+	snapshot.Descriptor = descriptor
+	return nil
+}
+
+// verifySnapshotDefinition checks whether the metadata of the given snapshot
+// matches the expected descriptor in the fields a redefinition may change.
+func verifySnapshotDefinition(snapshot *libvirt.DomainSnapshot,
+	expected libvirtxml.DomainSnapshot) error {
+	xml, err := snapshot.GetXMLDesc(0)
+	if err != nil {
+		return fmt.Errorf("unable to get XML descriptor: %s", err)
+	}
+
+	actual := libvirtxml.DomainSnapshot{}
+	err = actual.Unmarshal(xml)
+	if err != nil {
+		return fmt.Errorf("unable to unmarshal XML descriptor: %s", err)
+	}
+
+	return compareSnapshotDefinitions(actual, expected)
+}
+
+// compareSnapshotDefinitions returns an error describing the first field a
+// redefinition may change that differs between the given descriptors.
+func compareSnapshotDefinitions(actual libvirtxml.DomainSnapshot,
+	expected libvirtxml.DomainSnapshot) error {
+	parentName := func(descriptor libvirtxml.DomainSnapshot) string {
+		if descriptor.Parent == nil {
+			return ""
+		}
+		return descriptor.Parent.Name
+	}
+
+	switch {
+	case actual.Name != expected.Name:
+		return fmt.Errorf("name is '%s' instead of '%s'", actual.Name,
+			expected.Name)
+	case actual.Description != expected.Description:
+		return fmt.Errorf("description is '%s' instead of '%s'",
+			actual.Description, expected.Description)
+	case actual.CreationTime != expected.CreationTime:
+		return fmt.Errorf("creation time is '%s' instead of '%s'",
+			actual.CreationTime, expected.CreationTime)
+	case parentName(actual) != parentName(expected):
+		return fmt.Errorf("parent is '%s' instead of '%s'", parentName(actual),
+			parentName(expected))
+	}
+	return nil
+}
+
+// rollbackRedefine restores the original metadata of a snapshot after a failed
+// redefinition. The new definition of a renamed snapshot is removed, the
+// definition of a snapshot redefined in place is overwritten with the original
+// XML. Failures are only logged, since the caller already reports an error.
+func (vm *VM) rollbackRedefine(redefined *libvirt.DomainSnapshot,
+	renamed bool, original string, flags libvirt.DomainSnapshotCreateFlags) {
+	if renamed {
+		err := redefined.Delete(libvirt.DOMAIN_SNAPSHOT_DELETE_METADATA_ONLY)
+		if err != nil {
+			logLibvirtError(vm.Logger, err)
+			vm.Logger.Errorf("unable to roll back the rename of a snapshot of VM "+
+				"'%s', the snapshot is defined twice: %s", vm.Descriptor.Name, err)
+		}
+		return
+	}
+
+	restored, err := vm.Instance.CreateSnapshotXML(original, flags)
+	if err != nil {
+		logLibvirtError(vm.Logger, err)
+		vm.Logger.Errorf("unable to restore the original metadata of a "+
+			"snapshot of VM '%s': %s", vm.Descriptor.Name, err)
+		return
+	}
+	restored.Free()
+}
+
+// NameGenerator is a function returning a candidate for the name of a new
+// snapshot. The parameter attempt specifies how many candidates were already
+// rejected because a snapshot with this name exists.
+type NameGenerator func(attempt int) string
+
+// RandomNames returns a NameGenerator generating random, docker-style names
+// like "angry_hypatia".
+func RandomNames() NameGenerator {
+	return func(attempt int) string {
+		return namesgenerator.GetRandomName(0)
+	}
+}
+
+// TimestampNames returns a NameGenerator generating names from the current
+// time in RFC3339 format (UTC), e.g. "2019-07-11T08:37:50Z". Since timestamps
+// have a granularity of seconds, a counter is appended to the name if a
+// snapshot with the same timestamp already exists.
+func TimestampNames() NameGenerator {
+	return func(attempt int) string {
+		name := time.Now().UTC().Format(time.RFC3339)
+		if attempt > 0 {
+			name = fmt.Sprintf("%s-%d", name, attempt)
+		}
+		return name
+	}
+}
+
+// SequenceNames returns a NameGenerator generating sequential names of the
+// form "<base>-0001". The first candidate continues the sequence of the given
+// existing snapshots, i.e. its number is one higher than the highest number of
+// the snapshots named "<prefix><base>-<number>". Gaps in the sequence are not
+// filled. Each rejected candidate increments the number, so that a snapshot
+// created concurrently with the same number is skipped.
+func SequenceNames(prefix string, base string,
+	existing []Snapshot) NameGenerator {
+	next := nextSequenceNumber(prefix+base, existing)
+	return func(attempt int) string {
+		return fmt.Sprintf("%s-%04d", base, next+attempt)
+	}
+}
+
+// nextSequenceNumber returns the number following the highest sequence number
+// of the given snapshots named "<name>-<number>". 1 is returned if there is no
+// such snapshot.
+func nextSequenceNumber(name string, snapshots []Snapshot) int {
+	regex := regexp.MustCompile("^" + regexp.QuoteMeta(name) + "-([0-9]+)$")
+
+	highest := 0
+	for _, snapshot := range snapshots {
+		match := regex.FindStringSubmatch(snapshot.Descriptor.Name)
+		if match == nil {
+			continue
+		}
+
+		number, err := strconv.Atoi(match[1])
+		if err != nil {
+			// out of range, cannot be continued anyway
+			continue
+		}
+		if number > highest {
+			highest = number
+		}
+	}
+
+	return highest + 1
+}
+
+// SnapshotOptions bundles the optional settings for creating a snapshot.
+type SnapshotOptions struct {
+	// SkipSpaceCheck disables the check for enough free space on the
+	// filesystems holding the disks of the VM or, for a disk-only snapshot,
+	// the ExternalDir.
+	SkipSpaceCheck bool
+
+	// Structured holds the fields of a structured description (see
+	// Description). If set, the description of the snapshot is stored as JSON
+	// object with the given description as summary. May be nil.
+	Structured *Description
+
+	// Timeout limits the time libvirt may take to create the snapshot. If the
+	// timeout expires, the snapshot job is aborted and ErrSnapshotTimeout is
+	// returned. Zero disables the timeout.
+	Timeout time.Duration
+
+	// DiskOnly creates an external snapshot of the disks only instead of an
+	// internal snapshot: libvirt freezes the current images as the snapshot
+	// and continues writing to new overlay files, so that the frozen images
+	// can be backed up while the VM is running. The memory is not saved.
+	DiskOnly bool
+
+	// ExternalDir is the existing directory the overlay files of a disk-only
+	// snapshot are created in, named "<vm>_<disk>_<snapshot>.qcow2". If
+	// empty, libvirt creates them next to the current images.
+	ExternalDir string
+
+	// ReuseExisting lets a disk-only snapshot use overlay files that already
+	// exist instead of refusing to create the snapshot. The existing files
+	// must be qcow2 images backed by the current images of the VM, libvirt
+	// does not create them anew.
+	ReuseExisting bool
+
+	// Quiesce asks the QEMU guest agent to freeze the filesystems of the guest
+	// while a disk-only snapshot is created, so that the snapshot is
+	// consistent. Only supported for disk-only snapshots of running VMs.
+	Quiesce bool
+
+	// WaitForAgent is how long to wait for the guest agent to answer before
+	// creating a quiesced snapshot (see VM.WaitForAgent). Zero does not wait.
+	WaitForAgent time.Duration
+}
+
+// ErrSnapshotInProgress is returned by CreateSnapshot if libvirt refuses to
+// create the snapshot because another operation (e.g. another snapshot or a
+// block job) is currently using the VM.
+var ErrSnapshotInProgress = errors.New("another operation is in progress " +
+	"on the VM")
+
+// ErrSnapshotExists is returned by CreateNamedSnapshot if the VM already has
+// a snapshot with the given name.
+var ErrSnapshotExists = errors.New("a snapshot with this name already exists")
+
+// ErrSnapshotTimeout is returned by CreateSnapshot if libvirt did not finish
+// the creation of the snapshot within the timeout of the SnapshotOptions.
+var ErrSnapshotTimeout = errors.New("timeout while creating the snapshot")
+
+// snapshotAbortGrace is the time to wait for libvirt to return from the
+// snapshot creation after the job was aborted due to the timeout.
+const snapshotAbortGrace = 30 * time.Second
+
+// isBusyError determines whether the given error returned by libvirt denotes
+// that the VM is currently used by another operation.
+func isBusyError(err error) bool {
+	lverr, ok := err.(libvirt.Error)
+	if !ok {
+		return false
+	}
+
+	switch lverr.Code {
+	case libvirt.ERR_OPERATION_TIMEOUT, libvirt.ERR_BLOCK_COPY_ACTIVE:
+		// e.g. "cannot acquire state change lock" or an active block copy
+		return true
+	case libvirt.ERR_OPERATION_INVALID:
+		return strings.Contains(lverr.Message, "in progress") ||
+			strings.Contains(lverr.Message, "block job")
+	default:
+		return false
+	}
+}
+
+// snapshotSpaceMargin is the number of bytes that need to be available on each
+// filesystem a snapshot is written to in addition to the memory state of the
+// VM before the snapshot is created.
+const snapshotSpaceMargin = 1 << 30 // 1 GiB
+
 // CreateSnapshot creates a snapshot for the given domain while checking
 // whether the name is already used. The given prefix is prepended to the
-// snapshots name. The caller is responsible for calling Free on snapshot.
-func (vm *VM) CreateSnapshot(prefix string, description string) (Snapshot,
-	error) {
-	var descriptor libvirtxml.DomainSnapshot
+// names returned by generate. The caller is responsible for calling Free on
+// snapshot.
+func (vm *VM) CreateSnapshot(prefix string, description string,
+	generate NameGenerator, opts SnapshotOptions) (Snapshot, error) {
+	return vm.createSnapshot(description, opts, func() (string, error) {
+		return uniqueSnapshotName(prefix, generate, vm.snapshotExists)
+	})
+}
+
+// CreateNamedSnapshot creates a snapshot with exactly the given name for the
+// given domain. Unlike CreateSnapshot, no other name is tried if the name is
+// already used, but ErrSnapshotExists is returned. The caller is responsible
+// for calling Free on snapshot.
+func (vm *VM) CreateNamedSnapshot(name string, description string,
+	opts SnapshotOptions) (Snapshot, error) {
+	return vm.createSnapshot(description, opts, func() (string, error) {
+		return freeSnapshotName(name, vm.snapshotExists)
+	})
+}
+
+// createSnapshot creates a snapshot with the given description and the name
+// returned by name, which is only determined right before the creation.
+func (vm *VM) createSnapshot(description string, opts SnapshotOptions,
+	name func() (string, error)) (Snapshot, error) {
+	// libvirt only quiesces the filesystems for external snapshots
+	if opts.Quiesce && !opts.DiskOnly {
+		return Snapshot{}, fmt.Errorf("unable to create snapshot for VM '%s': "+
+			"only disk-only snapshots can be quiesced", vm.Descriptor.Name)
+	}
 
-	for true {
-		descriptor = libvirtxml.DomainSnapshot{
-			Name:        prefix + namesgenerator.GetRandomName(0),
-			Description: description,
+	// a missing directory would only be reported by libvirt after the VM was
+	// frozen
+	if opts.DiskOnly && opts.ExternalDir != "" {
+		err := fs.EnsureDirectory(opts.ExternalDir)
+		if err != nil {
+			return Snapshot{}, err
 		}
+	}
 
-		// check if name is already given
-		regex := []string{"^" + descriptor.Name + "$"}
-		snapshots, err := vm.ListMatchingSnapshots(regex)
+	// internal snapshots grow the image files. Running out of space in the
+	// middle of a snapshot may corrupt the images, so better refuse early.
+	if !opts.SkipSpaceCheck {
+		state, _, err := vm.Instance.GetState()
 		if err != nil {
-			err = fmt.Errorf("unable to retrieve existing snapshot for VM '%s': %s",
+			err = fmt.Errorf("unable to retrieve state of VM '%s': %s",
 				vm.Descriptor.Name,
 				err,
 			)
 			return Snapshot{}, err
 		}
 
-		if len(snapshots) == 0 {
-			break
+		err = vm.CheckSnapshotSpace(state, opts)
+		if err != nil {
+			return Snapshot{}, err
+		}
+	}
+
+	if opts.Structured != nil {
+		structured := *opts.Structured
+		structured.Summary = description
+
+		encoded, err := structured.Encode()
+		if err != nil {
+			return Snapshot{}, err
+		}
+		description = encoded
+	}
+
+	// the guest agent of a freshly booted VM is not ready yet, libvirt would
+	// fail the quiesced snapshot right away
+	if opts.Quiesce && opts.WaitForAgent > 0 {
+		err := vm.WaitForAgent(opts.WaitForAgent)
+		if err != nil {
+			return Snapshot{}, err
+		}
+	}
+
+	snapshotName, err := name()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	descriptor := libvirtxml.DomainSnapshot{
+		Name:        snapshotName,
+		Description: description,
+	}
+
+	// list all disks in a single descriptor, so that libvirt snapshots them in
+	// one atomic operation with consistent settings
+	descriptor.Disks = snapshotDisks(vm.Descriptor)
+
+	var flags libvirt.DomainSnapshotCreateFlags
+	if opts.DiskOnly {
+		descriptor.Memory = &libvirtxml.DomainSnapshotMemory{Snapshot: "no"}
+		descriptor.Disks = externalSnapshotDisks(descriptor.Disks,
+			vm.Descriptor.Name, snapshotName, opts.ExternalDir)
+		flags |= libvirt.DOMAIN_SNAPSHOT_CREATE_DISK_ONLY
+		if opts.Quiesce {
+			flags |= libvirt.DOMAIN_SNAPSHOT_CREATE_QUIESCE
+		}
+
+		// libvirt either fails cryptically on an existing overlay file or,
+		// when asked to reuse it, writes on top of whatever it contains
+		if opts.ReuseExisting {
+			flags |= libvirt.DOMAIN_SNAPSHOT_CREATE_REUSE_EXT
+		} else {
+			paths := overlayPaths(vm.Descriptor, descriptor.Disks, snapshotName)
+			err = checkOverlayPaths(paths)
+			if err != nil {
+				return Snapshot{}, fmt.Errorf("unable to create snapshot for VM "+
+					"'%s': %s", vm.Descriptor.Name, err)
+			}
 		}
 	}
 
@@ -181,8 +909,18 @@ func (vm *VM) CreateSnapshot(prefix string, description string) (Snapshot,
 		return Snapshot{}, err
 	}
 
-	snapshot, err := vm.Instance.CreateSnapshotXML(xml, 0)
+	snapshot, err := vm.createSnapshotXML(xml, flags, opts.Timeout)
+	if err == ErrSnapshotTimeout {
+		return Snapshot{}, err
+	}
 	if err != nil {
+		logLibvirtError(vm.Logger, err)
+		if isBusyError(err) {
+			vm.Logger.Debugf("unable to create snapshot for VM '%s': %s",
+				vm.Descriptor.Name, err)
+			return Snapshot{}, ErrSnapshotInProgress
+		}
+
 		err = fmt.Errorf("unable to create snapshot for VM '%s': %s",
 			vm.Descriptor.Name,
 			err,
@@ -196,6 +934,334 @@ func (vm *VM) CreateSnapshot(prefix string, description string) (Snapshot,
 	}, nil
 }
 
+// uniqueSnapshotName returns the first name generated by generate that is not
+// used by an existing snapshot yet, as determined by exists. The given prefix
+// is prepended to the generated names.
+func uniqueSnapshotName(prefix string, generate NameGenerator,
+	exists func(name string) (bool, error)) (string, error) {
+	for attempt := 0; ; attempt++ {
+		name := prefix + generate(attempt)
+
+		used, err := exists(name)
+		if err != nil {
+			return "", err
+		}
+		if !used {
+			return name, nil
+		}
+	}
+}
+
+// freeSnapshotName returns the given name if it is not used by an existing
+// snapshot yet, as determined by exists, and ErrSnapshotExists otherwise.
+func freeSnapshotName(name string,
+	exists func(name string) (bool, error)) (string, error) {
+	used, err := exists(name)
+	if err != nil {
+		return "", err
+	}
+	if used {
+		return "", ErrSnapshotExists
+	}
+	return name, nil
+}
+
+// snapshotExists determines whether the VM has a snapshot with the given name.
+func (vm *VM) snapshotExists(name string) (bool, error) {
+	regex := []string{"^" + regexp.QuoteMeta(name) + "$"}
+	snapshots, err := vm.ListMatchingSnapshots(regex)
+	if err != nil {
+		err = fmt.Errorf("unable to retrieve existing snapshot for VM '%s': %s",
+			vm.Descriptor.Name,
+			err,
+		)
+		return false, err
+	}
+	FreeSnapshots(vm.Logger, snapshots)
+
+	return len(snapshots) > 0, nil
+}
+
+// createSnapshotXML creates the snapshot described by the given XML with the
+// given flags. If the given timeout is greater than zero and expires, the
+// snapshot job of the VM is aborted and ErrSnapshotTimeout is returned. A
+// snapshot that libvirt creates nevertheless after the timeout is freed, but
+// not deleted.
+func (vm *VM) createSnapshotXML(xml string,
+	flags libvirt.DomainSnapshotCreateFlags, timeout time.Duration) (
+	*libvirt.DomainSnapshot, error) {
+	if timeout <= 0 {
+		return vm.Instance.CreateSnapshotXML(xml, flags)
+	}
+
+	type result struct {
+		snapshot *libvirt.DomainSnapshot
+		err      error
+	}
+
+	// the libvirt call cannot be interrupted, so it runs in its own goroutine.
+	// Once the result is not awaited anymore, the goroutine frees a snapshot
+	// created late and exits instead of blocking on the channel.
+	results := make(chan result)
+	abandoned := make(chan struct{})
+	defer close(abandoned)
+
+	go func() {
+		snapshot, err := vm.Instance.CreateSnapshotXML(xml, flags)
+		select {
+		case results <- result{snapshot, err}:
+		case <-abandoned:
+			if snapshot != nil {
+				vm.Logger.Warnf("snapshot for VM '%s' was created after the "+
+					"timeout", vm.Descriptor.Name)
+				snapshot.Free()
+			}
+		}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-results:
+		return r.snapshot, r.err
+	case <-timer.C:
+	}
+
+	vm.Logger.Warnf("creating the snapshot for VM '%s' took longer than %s, "+
+		"aborting the snapshot job", vm.Descriptor.Name, timeout)
+	err := vm.Instance.AbortJob()
+	if err != nil {
+		logLibvirtError(vm.Logger, err)
+		vm.Logger.Warnf("unable to abort snapshot job of VM '%s': %s",
+			vm.Descriptor.Name, err)
+	}
+
+	// give libvirt the chance to clean up the aborted job before returning, so
+	// that the caller does not restore the state of the VM in the meantime
+	grace := time.NewTimer(snapshotAbortGrace)
+	defer grace.Stop()
+
+	select {
+	case r := <-results:
+		if r.err == nil {
+			// the job finished before it could be aborted
+			return r.snapshot, nil
+		}
+		vm.Logger.Debugf("snapshot creation for VM '%s' returned after abort: "+
+			"%s", vm.Descriptor.Name, r.err)
+	case <-grace.C:
+		vm.Logger.Warnf("snapshot creation for VM '%s' did not return after "+
+			"aborting the job", vm.Descriptor.Name)
+	}
+	return nil, ErrSnapshotTimeout
+}
+
+// snapshotDisks returns the disk elements of a snapshot descriptor for the
+// given VM. Every writable disk is included in the internal snapshot, whereas
+// CD-ROMs, floppies, read-only disks and disks that opted out of snapshots
+// (snapshot="no") are excluded explicitly.
+func snapshotDisks(domain libvirtxml.Domain) *libvirtxml.DomainSnapshotDisks {
+	if domain.Devices == nil {
+		return nil
+	}
+
+	disks := make([]libvirtxml.DomainSnapshotDisk, 0,
+		len(domain.Devices.Disks))
+	for _, disk := range domain.Devices.Disks {
+		if disk.Target == nil || disk.Target.Dev == "" {
+			continue
+		}
+
+		mode := "internal"
+		if disk.Device == "cdrom" || disk.Device == "floppy" ||
+			disk.ReadOnly != nil || disk.Snapshot == "no" {
+			mode = "no"
+		}
+
+		disks = append(disks, libvirtxml.DomainSnapshotDisk{
+			Name:     disk.Target.Dev,
+			Snapshot: mode,
+		})
+	}
+
+	if len(disks) == 0 {
+		return nil
+	}
+	return &libvirtxml.DomainSnapshotDisks{Disks: disks}
+}
+
+// externalSnapshotDisks turns the disk elements of an internal snapshot
+// descriptor (see snapshotDisks) into the ones of a disk-only snapshot. The
+// disks included in the snapshot get an external qcow2 overlay, which is
+// created in dir if it is not empty.
+func externalSnapshotDisks(disks *libvirtxml.DomainSnapshotDisks,
+	vmName string, snapshotName string,
+	dir string) *libvirtxml.DomainSnapshotDisks {
+	if disks == nil {
+		return nil
+	}
+
+	external := make([]libvirtxml.DomainSnapshotDisk, 0, len(disks.Disks))
+	for _, disk := range disks.Disks {
+		if disk.Snapshot == "internal" {
+			disk.Snapshot = "external"
+			disk.Driver = &libvirtxml.DomainSnapshotDiskDriver{Type: "qcow2"}
+			if dir != "" {
+				file := fmt.Sprintf("%s_%s_%s.qcow2", vmName, disk.Name,
+					snapshotName)
+				disk.Source = &libvirtxml.DomainDiskSource{
+					File: &libvirtxml.DomainDiskSourceFile{
+						File: filepath.Join(dir, file),
+					},
+				}
+			}
+		}
+		external = append(external, disk)
+	}
+	return &libvirtxml.DomainSnapshotDisks{Disks: external}
+}
+
+// overlayPaths returns the paths of the overlay files libvirt creates for the
+// given disk elements of a disk-only snapshot (see externalSnapshotDisks) of
+// the VM with the given descriptor. Overlays without an explicit source are
+// named like libvirt does: the extension of the current image is replaced by
+// the name of the snapshot, e.g. "testvm.virsnap_live" for "testvm.qcow2".
+// Disks that are not backed by a file are skipped.
+func overlayPaths(domain libvirtxml.Domain,
+	disks *libvirtxml.DomainSnapshotDisks, snapshotName string) []string {
+	if disks == nil {
+		return nil
+	}
+
+	images := make(map[string]string)
+	for _, disk := range diskDevices(domain) {
+		if disk.Source == nil || disk.Source.File == nil ||
+			disk.Source.File.File == "" {
+			continue
+		}
+		images[diskTarget(disk)] = disk.Source.File.File
+	}
+
+	paths := make([]string, 0, len(disks.Disks))
+	for _, disk := range disks.Disks {
+		if disk.Snapshot != "external" {
+			continue
+		}
+
+		if disk.Source != nil && disk.Source.File != nil &&
+			disk.Source.File.File != "" {
+			paths = append(paths, disk.Source.File.File)
+			continue
+		}
+
+		image, ok := images[disk.Name]
+		if !ok {
+			continue
+		}
+		image = strings.TrimSuffix(image, filepath.Ext(image))
+		paths = append(paths, image+"."+snapshotName)
+	}
+	return paths
+}
+
+// checkOverlayPaths returns an error naming the first of the given overlay
+// paths that already exists.
+func checkOverlayPaths(paths []string) error {
+	for _, path := range paths {
+		_, err := os.Lstat(path)
+		if err == nil {
+			return fmt.Errorf("overlay file '%s' already exists", path)
+		}
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("unable to check overlay file '%s': %s", path, err)
+		}
+	}
+	return nil
+}
+
+// CheckSnapshotSpace checks whether the filesystems the snapshot with the
+// given options is written to have enough space available, if the snapshot is
+// taken while the VM is in the given state. This is a conservative estimate:
+// Since the memory state of an active VM is stored in the image of an internal
+// snapshot, the memory size of the VM plus a safety margin is required. The
+// overlays of a disk-only snapshot start empty and only need the margin. The
+// check is part of creating a snapshot unless opts.SkipSpaceCheck is set, but
+// can be done before shutting down or pausing the VM for the snapshot.
+func (vm *VM) CheckSnapshotSpace(state libvirt.DomainState,
+	opts SnapshotOptions) error {
+	required := uint64(snapshotSpaceMargin)
+	if !opts.DiskOnly && state != libvirt.DOMAIN_SHUTOFF &&
+		state != libvirt.DOMAIN_CRASHED {
+		required += memoryBytes(vm.Descriptor.Memory)
+	}
+
+	for _, path := range snapshotSpacePaths(vm.Descriptor, opts) {
+		available, err := fs.AvailableBytes(path)
+		if err != nil {
+			return err
+		}
+
+		if available < required {
+			return fmt.Errorf("not enough free space for a snapshot of VM '%s' "+
+				"on the filesystem of '%s': %d bytes available, at least %d "+
+				"bytes required", vm.Descriptor.Name, path, available, required)
+		}
+	}
+
+	return nil
+}
+
+// snapshotSpacePaths returns the paths whose filesystems a snapshot with the
+// given options is written to: the directory of the overlays of a disk-only
+// snapshot if given, otherwise the file-backed disks of the VM, which are
+// grown by an internal snapshot or get their overlays next to them.
+func snapshotSpacePaths(descriptor libvirtxml.Domain,
+	opts SnapshotOptions) []string {
+	if opts.DiskOnly && opts.ExternalDir != "" {
+		return []string{opts.ExternalDir}
+	}
+
+	paths := make([]string, 0)
+	for _, disk := range diskDevices(descriptor) {
+		if disk.Source == nil || disk.Source.File == nil ||
+			disk.Source.File.File == "" {
+			continue
+		}
+		paths = append(paths, disk.Source.File.File)
+	}
+	return paths
+}
+
+// memoryBytes converts the given memory size of a domain descriptor to bytes.
+func memoryBytes(memory *libvirtxml.DomainMemory) uint64 {
+	if memory == nil {
+		return 0
+	}
+
+	value := uint64(memory.Value)
+	switch memory.Unit {
+	case "b", "bytes":
+		return value
+	case "KB":
+		return value * 1000
+	case "MB":
+		return value * 1000 * 1000
+	case "GB":
+		return value * 1000 * 1000 * 1000
+	case "TB":
+		return value * 1000 * 1000 * 1000 * 1000
+	case "M", "MiB":
+		return value << 20
+	case "G", "GiB":
+		return value << 30
+	case "T", "TiB":
+		return value << 40
+	default: // libvirt defaults to KiB
+		return value << 10
+	}
+}
+
 // -----------------------------------------------------------------------------
 
 // SnapshotSorter is a sorter for sorting snapshots by creation date.
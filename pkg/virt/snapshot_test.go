@@ -0,0 +1,670 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// newTestSnapshots returns snapshots with the given names. The creation times
+// increase in the order of the names.
+func newTestSnapshots(names ...string) []Snapshot {
+	snapshots := make([]Snapshot, 0, len(names))
+	for i, name := range names {
+		snapshots = append(snapshots, Snapshot{
+			Descriptor: libvirtxml.DomainSnapshot{
+				Name:         name,
+				CreationTime: strconv.Itoa(1562827070 + i),
+			},
+		})
+	}
+	return snapshots
+}
+
+// snapshotNames returns the names of the given snapshots.
+func snapshotNames(snapshots []Snapshot) []string {
+	names := make([]string, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		names = append(names, snapshot.Descriptor.Name)
+	}
+	return names
+}
+
+// fakeSnapshot is a snapshotDescriber returning the given name and XML.
+type fakeSnapshot struct {
+	name    string
+	nameErr error
+	xml     string
+	xmlErr  error
+}
+
+func (s *fakeSnapshot) GetName() (string, error) {
+	return s.name, s.nameErr
+}
+
+func (s *fakeSnapshot) GetXMLDesc(
+	flags libvirt.DomainSnapshotXMLFlags) (string, error) {
+	return s.xml, s.xmlErr
+}
+
+func TestDescribeSnapshot(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+
+	descriptor, unparseable, err := describeSnapshot(logger, &fakeSnapshot{
+		name: "virsnap_a",
+		xml: "<domainsnapshot><name>virsnap_a</name>" +
+			"<creationTime>1562827070</creationTime></domainsnapshot>",
+	})
+	require.NoError(t, err)
+	require.False(t, unparseable)
+	require.Equal(t, "1562827070", descriptor.CreationTime)
+
+	// a malformed descriptor must not hide the snapshot
+	descriptor, unparseable, err = describeSnapshot(logger, &fakeSnapshot{
+		name: "virsnap_b",
+		xml:  "<domainsnapshot><name>virsnap_b</name><creationTime>",
+	})
+	require.NoError(t, err)
+	require.True(t, unparseable)
+	require.Equal(t, libvirtxml.DomainSnapshot{Name: "virsnap_b"}, descriptor)
+
+	_, unparseable, err = describeSnapshot(logger, &fakeSnapshot{
+		name:   "virsnap_c",
+		xmlErr: errors.New("internal error"),
+	})
+	require.NoError(t, err)
+	require.True(t, unparseable)
+
+	_, _, err = describeSnapshot(logger, &fakeSnapshot{
+		nameErr: errors.New("invalid snapshot pointer"),
+		xmlErr:  errors.New("invalid snapshot pointer"),
+	})
+	require.Error(t, err)
+
+	// unparseable snapshots sort as the oldest ones
+	snapshots := newTestSnapshots("virsnap_a", "virsnap_c")
+	snapshots = append(snapshots, Snapshot{Descriptor: descriptor,
+		Unparseable: true})
+	sorter := SnapshotSorter{
+		Snapshots: &snapshots,
+	}
+	sort.Sort(&sorter)
+	require.Equal(t, []string{"virsnap_b", "virsnap_a", "virsnap_c"},
+		snapshotNames(snapshots))
+	require.Equal(t, []string{"virsnap_b"},
+		snapshotNames(ExpiredSnapshots(snapshots, 2)))
+}
+
+func TestFilterSnapshotsByPrefix(t *testing.T) {
+	snapshots := newTestSnapshots("virsnap_a", "manual", "virsnap_b",
+		"before-upgrade", "virsnap_c")
+
+	managed := FilterSnapshotsByPrefix(snapshots, "virsnap_")
+	require.Equal(t, []string{"virsnap_a", "virsnap_b", "virsnap_c"},
+		snapshotNames(managed))
+
+	require.Empty(t, FilterSnapshotsByPrefix(snapshots, "other_"))
+}
+
+func TestExpiredSnapshots(t *testing.T) {
+	snapshots := newTestSnapshots("virsnap_a", "manual", "virsnap_b",
+		"before-upgrade", "virsnap_c")
+
+	t.Run("TestManagedOnly", func(t *testing.T) {
+		managed := FilterSnapshotsByPrefix(snapshots, "virsnap_")
+
+		require.Equal(t, []string{"virsnap_a"},
+			snapshotNames(ExpiredSnapshots(managed, 2)))
+		require.Equal(t, []string{"virsnap_a", "virsnap_b", "virsnap_c"},
+			snapshotNames(ExpiredSnapshots(managed, 0)))
+		require.Empty(t, ExpiredSnapshots(managed, 3))
+		require.Empty(t, ExpiredSnapshots(managed, 10))
+	})
+
+	t.Run("TestCountAll", func(t *testing.T) {
+		require.Equal(t, []string{"virsnap_a", "manual", "virsnap_b"},
+			snapshotNames(ExpiredSnapshots(snapshots, 2)))
+		require.Empty(t, ExpiredSnapshots(snapshots, 5))
+	})
+}
+
+// newTimedSnapshots returns snapshots with the given names created at the
+// given times.
+func newTimedSnapshots(names []string, times []time.Time) []Snapshot {
+	snapshots := make([]Snapshot, 0, len(names))
+	for i, name := range names {
+		snapshots = append(snapshots, Snapshot{
+			Descriptor: libvirtxml.DomainSnapshot{
+				Name:         name,
+				CreationTime: strconv.FormatInt(times[i].Unix(), 10),
+			},
+		})
+	}
+	return snapshots
+}
+
+func TestExpiredDailySnapshots(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	at := func(day int, hour int, min int) time.Time {
+		return time.Date(2019, 7, day, hour, min, 0, 0, loc)
+	}
+
+	snapshots := newTimedSnapshots(
+		[]string{"a", "b", "c", "d", "e", "f"},
+		[]time.Time{at(9, 12, 0), at(10, 8, 0), at(10, 23, 30), at(11, 0, 30),
+			at(11, 1, 0), at(12, 6, 0)},
+	)
+
+	t.Run("TestDayBoundary", func(t *testing.T) {
+		// c and d are on the same day in UTC, but not in the location
+		require.Equal(t, []string{"a", "b", "d"},
+			snapshotNames(ExpiredDailySnapshots(snapshots, 3, loc)))
+		require.Equal(t, []string{"b", "d"},
+			snapshotNames(ExpiredDailySnapshots(snapshots, 10, loc)))
+		require.Equal(t, []string{"a", "b", "c", "d", "e"},
+			snapshotNames(ExpiredDailySnapshots(snapshots, 1, loc)))
+
+		// in UTC, c (21:30) and d (22:30) are both on July 10
+		require.Equal(t, []string{"b", "c", "d"},
+			snapshotNames(ExpiredDailySnapshots(snapshots, 10, time.UTC)))
+	})
+
+	t.Run("TestDaylightSavingTime", func(t *testing.T) {
+		berlin, err := time.LoadLocation("Europe/Berlin")
+		if err != nil {
+			t.Skipf("time zone database not available: %s", err)
+		}
+
+		// March 31, 2019 only has 23 hours in Berlin
+		dst := newTimedSnapshots(
+			[]string{"a", "b", "c"},
+			[]time.Time{
+				time.Date(2019, 3, 31, 0, 30, 0, 0, berlin),
+				time.Date(2019, 3, 31, 23, 30, 0, 0, berlin),
+				time.Date(2019, 4, 1, 0, 30, 0, 0, berlin),
+			},
+		)
+		require.Equal(t, []string{"a"},
+			snapshotNames(ExpiredDailySnapshots(dst, 2, berlin)))
+	})
+
+	t.Run("TestUnparsableTime", func(t *testing.T) {
+		broken := append([]Snapshot{}, snapshots...)
+		broken[1].Descriptor.CreationTime = "yesterday"
+		require.Equal(t, []string{"d"},
+			snapshotNames(ExpiredDailySnapshots(broken, 10, loc)))
+		require.Equal(t, []string{"a", "c", "d", "e"},
+			snapshotNames(ExpiredDailySnapshots(broken, 1, loc)))
+	})
+}
+
+func TestSnapshotsOlderThan(t *testing.T) {
+	now := time.Date(2019, 7, 12, 12, 0, 0, 0, time.UTC)
+	snapshots := newTimedSnapshots(
+		[]string{"a", "b", "c"},
+		[]time.Time{now.Add(-31 * 24 * time.Hour), now.Add(-29 * 24 * time.Hour),
+			now.Add(-time.Hour)},
+	)
+	snapshots = append(snapshots, Snapshot{Unparseable: true})
+
+	require.Equal(t, []string{"a"},
+		snapshotNames(SnapshotsOlderThan(snapshots, now.Add(-720*time.Hour))))
+	require.Equal(t, []string{"a", "b", "c"},
+		snapshotNames(SnapshotsOlderThan(snapshots, now)))
+	require.Empty(t, SnapshotsOlderThan(snapshots, now.Add(-365*24*time.Hour)))
+}
+
+func TestSnapshotsBetween(t *testing.T) {
+	snapshots := newTestSnapshots("virsnap_a", "virsnap_b", "bad", "virsnap_c",
+		"virsnap_d")
+
+	selected, err := SnapshotsBetween(snapshots, "bad", "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"virsnap_c", "virsnap_d"}, snapshotNames(selected))
+
+	selected, err = SnapshotsBetween(snapshots, "", "bad")
+	require.NoError(t, err)
+	require.Equal(t, []string{"virsnap_a", "virsnap_b"}, snapshotNames(selected))
+
+	selected, err = SnapshotsBetween(snapshots, "virsnap_a", "virsnap_c")
+	require.NoError(t, err)
+	require.Equal(t, []string{"virsnap_b", "bad"}, snapshotNames(selected))
+
+	selected, err = SnapshotsBetween(snapshots, "", "")
+	require.NoError(t, err)
+	require.Equal(t, snapshotNames(snapshots), snapshotNames(selected))
+
+	// empty and inverted windows select nothing
+	selected, err = SnapshotsBetween(snapshots, "virsnap_d", "")
+	require.NoError(t, err)
+	require.Empty(t, selected)
+
+	selected, err = SnapshotsBetween(snapshots, "virsnap_c", "virsnap_a")
+	require.NoError(t, err)
+	require.Empty(t, selected)
+
+	_, err = SnapshotsBetween(snapshots, "missing", "")
+	require.Error(t, err)
+	_, err = SnapshotsBetween(snapshots, "", "missing")
+	require.Error(t, err)
+}
+
+func TestIntersectSnapshots(t *testing.T) {
+	snapshots := newTestSnapshots("virsnap_a", "virsnap_b", "bad", "virsnap_c")
+
+	// the newest snapshot is kept by -k 1, the window starts after virsnap_a
+	expired := ExpiredSnapshots(FilterSnapshotsByPrefix(snapshots, "virsnap_"),
+		1)
+	window, err := SnapshotsBetween(snapshots, "virsnap_a", "")
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"virsnap_b"},
+		snapshotNames(IntersectSnapshots(expired, window)))
+	require.Empty(t, IntersectSnapshots(expired, nil))
+}
+
+func TestMemoryBytes(t *testing.T) {
+	require.Equal(t, uint64(0), memoryBytes(nil))
+	require.Equal(t, uint64(2<<30), memoryBytes(&libvirtxml.DomainMemory{
+		Value: 2097152,
+	}))
+	require.Equal(t, uint64(2<<30), memoryBytes(&libvirtxml.DomainMemory{
+		Value: 2097152,
+		Unit:  "KiB",
+	}))
+	require.Equal(t, uint64(512<<20), memoryBytes(&libvirtxml.DomainMemory{
+		Value: 512,
+		Unit:  "MiB",
+	}))
+	require.Equal(t, uint64(4000000000), memoryBytes(&libvirtxml.DomainMemory{
+		Value: 4,
+		Unit:  "GB",
+	}))
+}
+
+func TestSnapshotTime(t *testing.T) {
+	snapshots := newTestSnapshots("virsnap_a")
+
+	created, err := SnapshotTime(snapshots[0])
+	require.NoError(t, err)
+	require.Equal(t, int64(1562827070), created.Unix())
+
+	snapshots[0].Descriptor.CreationTime = "yesterday"
+	_, err = SnapshotTime(snapshots[0])
+	require.Error(t, err)
+}
+
+func TestSnapshotDisks(t *testing.T) {
+	domain := libvirtxml.Domain{}
+	err := domain.Unmarshal(`<domain type="kvm">
+  <name>testvm</name>
+  <devices>
+    <disk type="file" device="disk">
+      <source file="/var/lib/libvirt/images/testvm.qcow2"/>
+      <target dev="vda" bus="virtio"/>
+    </disk>
+    <disk type="file" device="disk">
+      <source file="/var/lib/libvirt/images/testvm-data.qcow2"/>
+      <target dev="vdb" bus="virtio"/>
+    </disk>
+    <disk type="file" device="disk" snapshot="no">
+      <source file="/var/lib/libvirt/images/testvm-scratch.qcow2"/>
+      <target dev="vdc" bus="virtio"/>
+    </disk>
+    <disk type="file" device="cdrom">
+      <source file="/var/lib/libvirt/images/install.iso"/>
+      <target dev="sda" bus="sata"/>
+      <readonly/>
+    </disk>
+  </devices>
+</domain>`)
+	require.NoError(t, err)
+
+	descriptor := libvirtxml.DomainSnapshot{
+		Name:  "virsnap_test",
+		Disks: snapshotDisks(domain),
+	}
+	require.NotNil(t, descriptor.Disks)
+	require.Equal(t, []libvirtxml.DomainSnapshotDisk{
+		{Name: "vda", Snapshot: "internal"},
+		{Name: "vdb", Snapshot: "internal"},
+		{Name: "vdc", Snapshot: "no"},
+		{Name: "sda", Snapshot: "no"},
+	}, descriptor.Disks.Disks)
+
+	// all disks end up in the single descriptor passed to libvirt
+	xml, err := descriptor.Marshal()
+	require.NoError(t, err)
+	require.Contains(t, xml, `<disk name="vda" snapshot="internal"`)
+	require.Contains(t, xml, `<disk name="vdb" snapshot="internal"`)
+	require.Contains(t, xml, `<disk name="vdc" snapshot="no"`)
+	require.Contains(t, xml, `<disk name="sda" snapshot="no"`)
+
+	require.Nil(t, snapshotDisks(libvirtxml.Domain{}))
+}
+
+func TestExternalSnapshotDisks(t *testing.T) {
+	disks := &libvirtxml.DomainSnapshotDisks{
+		Disks: []libvirtxml.DomainSnapshotDisk{
+			{Name: "vda", Snapshot: "internal"},
+			{Name: "sda", Snapshot: "no"},
+		},
+	}
+	qcow2 := &libvirtxml.DomainSnapshotDiskDriver{Type: "qcow2"}
+
+	external := externalSnapshotDisks(disks, "testvm", "virsnap_live",
+		"/var/backups")
+	require.Equal(t, []libvirtxml.DomainSnapshotDisk{
+		{
+			Name:     "vda",
+			Snapshot: "external",
+			Driver:   qcow2,
+			Source: &libvirtxml.DomainDiskSource{
+				File: &libvirtxml.DomainDiskSourceFile{
+					File: "/var/backups/testvm_vda_virsnap_live.qcow2",
+				},
+			},
+		},
+		{Name: "sda", Snapshot: "no"},
+	}, external.Disks)
+
+	// the internal descriptor is not changed
+	require.Equal(t, "internal", disks.Disks[0].Snapshot)
+
+	// without a directory, libvirt chooses the location of the overlays
+	external = externalSnapshotDisks(disks, "testvm", "virsnap_live", "")
+	require.Equal(t, libvirtxml.DomainSnapshotDisk{Name: "vda",
+		Snapshot: "external", Driver: qcow2}, external.Disks[0])
+
+	require.Nil(t, externalSnapshotDisks(nil, "testvm", "virsnap_live", ""))
+}
+
+func TestOverlayPaths(t *testing.T) {
+	domain := libvirtxml.Domain{}
+	err := domain.Unmarshal(`<domain type="kvm">
+  <name>testvm</name>
+  <devices>
+    <disk type="file" device="disk">
+      <source file="/var/lib/libvirt/images/testvm.qcow2"/>
+      <target dev="vda" bus="virtio"/>
+    </disk>
+    <disk type="file" device="disk">
+      <source file="/var/lib/libvirt/images/testvm-data"/>
+      <target dev="vdb" bus="virtio"/>
+    </disk>
+    <disk type="network" device="disk">
+      <source protocol="rbd" name="pool/testvm-rbd"/>
+      <target dev="vdc" bus="virtio"/>
+    </disk>
+    <disk type="file" device="cdrom">
+      <source file="/var/lib/libvirt/images/install.iso"/>
+      <target dev="sda" bus="sata"/>
+      <readonly/>
+    </disk>
+  </devices>
+</domain>`)
+	require.NoError(t, err)
+	disks := snapshotDisks(domain)
+
+	// libvirt names the overlays after the current images
+	external := externalSnapshotDisks(disks, "testvm", "virsnap_live", "")
+	require.Equal(t, []string{
+		"/var/lib/libvirt/images/testvm.virsnap_live",
+		"/var/lib/libvirt/images/testvm-data.virsnap_live",
+	}, overlayPaths(domain, external, "virsnap_live"))
+
+	external = externalSnapshotDisks(disks, "testvm", "virsnap_live",
+		"/var/backups")
+	require.Equal(t, []string{
+		"/var/backups/testvm_vda_virsnap_live.qcow2",
+		"/var/backups/testvm_vdb_virsnap_live.qcow2",
+		"/var/backups/testvm_vdc_virsnap_live.qcow2",
+	}, overlayPaths(domain, external, "virsnap_live"))
+
+	// internal snapshots have no overlays
+	require.Empty(t, overlayPaths(domain, disks, "virsnap_live"))
+	require.Empty(t, overlayPaths(domain, nil, "virsnap_live"))
+}
+
+func TestCheckOverlayPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virsnap-overlays")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	free := filepath.Join(dir, "testvm_vda_virsnap_live.qcow2")
+	colliding := filepath.Join(dir, "testvm_vdb_virsnap_live.qcow2")
+	require.NoError(t, ioutil.WriteFile(colliding, []byte("data"), 0600))
+
+	require.NoError(t, checkOverlayPaths(nil))
+	require.NoError(t, checkOverlayPaths([]string{free}))
+
+	err = checkOverlayPaths([]string{free, colliding})
+	require.EqualError(t, err, "overlay file '"+colliding+"' already exists")
+
+	// libvirt would write through a dangling symlink
+	link := filepath.Join(dir, "testvm_vdc_virsnap_live.qcow2")
+	require.NoError(t, os.Symlink(filepath.Join(dir, "missing"), link))
+	err = checkOverlayPaths([]string{link})
+	require.EqualError(t, err, "overlay file '"+link+"' already exists")
+}
+
+func TestCreateSnapshotQuiesce(t *testing.T) {
+	vm := VM{
+		Descriptor: libvirtxml.Domain{Name: "testvm"},
+		Logger:     zap.NewNop().Sugar(),
+	}
+
+	_, err := vm.CreateNamedSnapshot("virsnap_live", "", SnapshotOptions{
+		Quiesce: true,
+	})
+	require.EqualError(t, err, "unable to create snapshot for VM 'testvm': "+
+		"only disk-only snapshots can be quiesced")
+}
+
+func TestSnapshotSpacePaths(t *testing.T) {
+	domain := libvirtxml.Domain{}
+	err := domain.Unmarshal(`<domain type="kvm">
+  <name>testvm</name>
+  <devices>
+    <disk type="file" device="disk">
+      <source file="/var/lib/libvirt/images/testvm.qcow2"/>
+      <target dev="vda" bus="virtio"/>
+    </disk>
+    <disk type="network" device="disk">
+      <source protocol="rbd" name="pool/testvm-data"/>
+      <target dev="vdb" bus="virtio"/>
+    </disk>
+    <disk type="file" device="cdrom">
+      <source file="/var/lib/libvirt/images/install.iso"/>
+      <target dev="sda" bus="sata"/>
+      <readonly/>
+    </disk>
+  </devices>
+</domain>`)
+	require.NoError(t, err)
+
+	disks := []string{"/var/lib/libvirt/images/testvm.qcow2"}
+	require.Equal(t, disks, snapshotSpacePaths(domain, SnapshotOptions{}))
+
+	// the overlays are created next to the images without a directory
+	require.Equal(t, disks, snapshotSpacePaths(domain, SnapshotOptions{
+		DiskOnly: true,
+	}))
+	require.Equal(t, []string{"/var/backups"},
+		snapshotSpacePaths(domain, SnapshotOptions{
+			DiskOnly:    true,
+			ExternalDir: "/var/backups",
+		}))
+
+	// the directory is only used for disk-only snapshots
+	require.Equal(t, disks, snapshotSpacePaths(domain, SnapshotOptions{
+		ExternalDir: "/var/backups",
+	}))
+
+	require.Empty(t, snapshotSpacePaths(libvirtxml.Domain{}, SnapshotOptions{}))
+}
+
+func TestIsBusyError(t *testing.T) {
+	require.True(t, isBusyError(libvirt.Error{
+		Code:    libvirt.ERR_OPERATION_TIMEOUT,
+		Message: "Timed out during operation: cannot acquire state change lock",
+	}))
+	require.True(t, isBusyError(libvirt.Error{
+		Code:    libvirt.ERR_OPERATION_INVALID,
+		Message: "Requested operation is not valid: domain has active block job",
+	}))
+	require.True(t, isBusyError(libvirt.Error{
+		Code:    libvirt.ERR_BLOCK_COPY_ACTIVE,
+		Message: "block copy still active",
+	}))
+
+	require.False(t, isBusyError(libvirt.Error{
+		Code:    libvirt.ERR_OPERATION_INVALID,
+		Message: "Requested operation is not valid: domain is not running",
+	}))
+	require.False(t, isBusyError(libvirt.Error{
+		Code:    libvirt.ERR_NO_DOMAIN,
+		Message: "Domain not found",
+	}))
+	require.False(t, isBusyError(errors.New("in progress")))
+}
+
+func TestNextSequenceNumber(t *testing.T) {
+	require.Equal(t, 1, nextSequenceNumber("virsnap_testvm", nil))
+
+	snapshots := newTestSnapshots("virsnap_testvm-0001", "manual",
+		"virsnap_testvm-0007", "virsnap_testvm-0003", "virsnap_testvm-abc",
+		"virsnap_othervm-0042", "virsnap_testvm-0002-copy")
+	require.Equal(t, 8, nextSequenceNumber("virsnap_testvm", snapshots))
+
+	// names containing regular expression meta characters
+	snapshots = newTestSnapshots("virsnap_test.vm-0004", "virsnap_testxvm-0009")
+	require.Equal(t, 5, nextSequenceNumber("virsnap_test.vm", snapshots))
+}
+
+func TestSequenceNames(t *testing.T) {
+	snapshots := newTestSnapshots("virsnap_testvm-0001", "virsnap_testvm-0002")
+
+	generate := SequenceNames("virsnap_", "testvm", snapshots)
+	require.Equal(t, "testvm-0003", generate(0))
+	require.Equal(t, "testvm-0004", generate(1))
+
+	generate = SequenceNames("virsnap_", "testvm", nil)
+	require.Equal(t, "testvm-0001", generate(0))
+
+	generate = SequenceNames("virsnap_", "testvm",
+		newTestSnapshots("virsnap_testvm-9999"))
+	require.Equal(t, "testvm-10000", generate(0))
+}
+
+func TestLatestSnapshot(t *testing.T) {
+	snapshots := newTestSnapshots("first", "second", "third")
+	snapshots[0], snapshots[2] = snapshots[2], snapshots[0]
+
+	latest, others, ok := latestSnapshot(snapshots)
+	require.True(t, ok)
+	require.Equal(t, "third", latest.Descriptor.Name)
+	require.Equal(t, []string{"first", "second"}, snapshotNames(others))
+
+	// the creation time of an unparseable snapshot is unknown
+	snapshots = newTestSnapshots("first", "second")
+	snapshots[1].Unparseable = true
+	latest, others, ok = latestSnapshot(snapshots)
+	require.True(t, ok)
+	require.Equal(t, "first", latest.Descriptor.Name)
+	require.Equal(t, []string{"second"}, snapshotNames(others))
+
+	_, others, ok = latestSnapshot(nil)
+	require.False(t, ok)
+	require.Empty(t, others)
+}
+
+func TestUniqueSnapshotName(t *testing.T) {
+	// a deterministic generator instead of the random docker names
+	candidates := []string{"angry_hypatia", "hardcore_galileo", "gracious_turing"}
+	generate := func(attempt int) string {
+		return candidates[attempt]
+	}
+
+	existing := map[string]bool{
+		"virsnap_angry_hypatia":    true,
+		"virsnap_hardcore_galileo": true,
+	}
+	checked := make([]string, 0)
+	exists := func(name string) (bool, error) {
+		checked = append(checked, name)
+		return existing[name], nil
+	}
+
+	name, err := uniqueSnapshotName("virsnap_", generate, exists)
+	require.NoError(t, err)
+	require.Equal(t, "virsnap_gracious_turing", name)
+	require.Equal(t, []string{"virsnap_angry_hypatia",
+		"virsnap_hardcore_galileo", "virsnap_gracious_turing"}, checked)
+
+	// the lookup of the existing snapshots fails
+	_, err = uniqueSnapshotName("virsnap_", generate, func(name string) (bool,
+		error) {
+		return false, errors.New("connection lost")
+	})
+	require.Error(t, err)
+}
+
+func TestFreeSnapshotName(t *testing.T) {
+	existing := map[string]bool{"nightly-2019-07-11": true}
+	exists := func(name string) (bool, error) {
+		return existing[name], nil
+	}
+
+	name, err := freeSnapshotName("nightly-2019-07-12", exists)
+	require.NoError(t, err)
+	require.Equal(t, "nightly-2019-07-12", name)
+
+	// a used name is not replaced by another one
+	_, err = freeSnapshotName("nightly-2019-07-11", exists)
+	require.Equal(t, ErrSnapshotExists, err)
+}
+
+func TestCompareSnapshotDefinitions(t *testing.T) {
+	expected := libvirtxml.DomainSnapshot{
+		Name:         "virsnap_renamed",
+		Description:  "before upgrade",
+		CreationTime: "1563086270",
+		Parent:       &libvirtxml.DomainSnapshotParent{Name: "virsnap_base"},
+	}
+	require.NoError(t, compareSnapshotDefinitions(expected, expected))
+
+	actual := expected
+	actual.Name = "virsnap_old"
+	require.Error(t, compareSnapshotDefinitions(actual, expected))
+
+	actual = expected
+	actual.Description = ""
+	require.Error(t, compareSnapshotDefinitions(actual, expected))
+
+	actual = expected
+	actual.CreationTime = "1563086271"
+	require.Error(t, compareSnapshotDefinitions(actual, expected))
+
+	actual = expected
+	actual.Parent = nil
+	err := compareSnapshotDefinitions(actual, expected)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "virsnap_base")
+}
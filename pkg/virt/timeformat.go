@@ -0,0 +1,91 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// TimeFormat determines how timestamps, e.g. the creation time of snapshots,
+// are displayed. Besides the predefined formats, any Go time layout (see the
+// documentation of package time) is a valid TimeFormat.
+type TimeFormat string
+
+const (
+	// TimeFormatRFC3339 displays timestamps in RFC3339 format, e.g.
+	// "2019-07-11T08:37:50+02:00".
+	TimeFormatRFC3339 TimeFormat = "rfc3339"
+
+	// TimeFormatUnix displays timestamps as seconds since the unix epoch, e.g.
+	// "1562827070".
+	TimeFormatUnix TimeFormat = "unix"
+
+	// TimeFormatRelative displays timestamps relative to the current time,
+	// e.g. "3 days ago".
+	TimeFormatRelative TimeFormat = "relative"
+
+	// TimeFormatDefault is the layout used if no time format is specified,
+	// e.g. "Thu Jul 11 08:37:50 CEST 2019".
+	TimeFormatDefault TimeFormat = "Mon Jan 2 15:04:05 MST 2006"
+)
+
+// ParseTimeFormat converts the given string into a TimeFormat. Strings not
+// denoting a predefined format are treated as custom Go time layout. An error
+// is returned if the string is empty.
+func ParseTimeFormat(format string) (TimeFormat, error) {
+	if format == "" {
+		return "", fmt.Errorf("invalid time format '': must be one of " +
+			"'rfc3339', 'unix', 'relative' or a Go time layout")
+	}
+	return TimeFormat(format), nil
+}
+
+// Format returns the given time displayed in the time format. The parameter
+// now is the reference time for TimeFormatRelative.
+func (f TimeFormat) Format(t time.Time, now time.Time) string {
+	switch f {
+	case TimeFormatRFC3339:
+		return t.Format(time.RFC3339)
+	case TimeFormatUnix:
+		return strconv.FormatInt(t.Unix(), 10)
+	case TimeFormatRelative:
+		return relativeTime(t, now)
+	default:
+		return t.Format(string(f))
+	}
+}
+
+// relativeTime returns a human-readable description of the duration between
+// t and now using the largest fitting unit, e.g. "5 minutes ago".
+func relativeTime(t time.Time, now time.Time) string {
+	d := now.Sub(t)
+	suffix := "ago"
+	if d < 0 {
+		d = -d
+		suffix = "from now"
+	}
+
+	var value int64
+	var unit string
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		value, unit = int64(d/time.Minute), "minute"
+	case d < 24*time.Hour:
+		value, unit = int64(d/time.Hour), "hour"
+	default:
+		value, unit = int64(d/(24*time.Hour)), "day"
+	}
+
+	if value != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s %s", value, unit, suffix)
+}
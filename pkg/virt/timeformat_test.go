@@ -0,0 +1,50 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeFormat(t *testing.T) {
+	created := time.Unix(1562827070, 0).UTC()
+	now := created.Add(3*24*time.Hour + 5*time.Hour)
+
+	require.Equal(t, "2019-07-11T06:37:50Z",
+		TimeFormatRFC3339.Format(created, now))
+	require.Equal(t, "1562827070", TimeFormatUnix.Format(created, now))
+	require.Equal(t, "3 days ago", TimeFormatRelative.Format(created, now))
+	require.Equal(t, "Thu Jul 11 06:37:50 UTC 2019",
+		TimeFormatDefault.Format(created, now))
+	require.Equal(t, "11.07.2019", TimeFormat("02.01.2006").Format(created, now))
+}
+
+func TestRelativeTime(t *testing.T) {
+	now := time.Unix(1562827070, 0)
+
+	require.Equal(t, "just now", relativeTime(now.Add(-30*time.Second), now))
+	require.Equal(t, "1 minute ago", relativeTime(now.Add(-time.Minute), now))
+	require.Equal(t, "5 hours ago", relativeTime(now.Add(-5*time.Hour), now))
+	require.Equal(t, "1 day ago", relativeTime(now.Add(-36*time.Hour), now))
+	require.Equal(t, "2 hours from now", relativeTime(now.Add(2*time.Hour), now))
+}
+
+func TestParseTimeFormat(t *testing.T) {
+	format, err := ParseTimeFormat("relative")
+	require.NoError(t, err)
+	require.Equal(t, TimeFormatRelative, format)
+
+	format, err = ParseTimeFormat("2006-01-02")
+	require.NoError(t, err)
+	require.Equal(t, TimeFormat("2006-01-02"), format)
+
+	_, err = ParseTimeFormat("")
+	require.Error(t, err)
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"fmt"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+// LibraryVersion returns the version of the libvirt library virsnap is linked
+// against, e.g. "5.5.0". No connection is needed for this.
+func LibraryVersion() (string, error) {
+	version, err := libvirt.GetVersion()
+	if err != nil {
+		err = fmt.Errorf("unable to retrieve libvirt library version: %s", err)
+		return "", err
+	}
+	return FormatVersion(version), nil
+}
+
+// DaemonVersions opens a read-only connection to the libvirt socket with the
+// given URL and returns the version of the libvirt daemon and of the
+// hypervisor (e.g. qemu) behind it.
+func DaemonVersions(socketURL string) (daemon string, hypervisor string,
+	err error) {
+	conn, err := libvirt.NewConnectReadOnly(socketURL)
+	if err != nil {
+		err = fmt.Errorf("unable to connect to QEMU socket: %s", err)
+		return "", "", err
+	}
+	defer conn.Close()
+
+	libVersion, err := conn.GetLibVersion()
+	if err != nil {
+		err = fmt.Errorf("unable to retrieve libvirt daemon version: %s", err)
+		return "", "", err
+	}
+
+	hvVersion, err := conn.GetVersion()
+	if err != nil {
+		err = fmt.Errorf("unable to retrieve hypervisor version: %s", err)
+		return "", "", err
+	}
+
+	return FormatVersion(libVersion), FormatVersion(uint32(hvVersion)), nil
+}
+
+// FormatVersion converts a version number as encoded by libvirt
+// (major * 1,000,000 + minor * 1,000 + release) into the usual dotted form.
+func FormatVersion(version uint32) string {
+	return fmt.Sprintf("%d.%d.%d", version/1000000, version/1000%1000,
+		version%1000)
+}
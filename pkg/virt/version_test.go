@@ -0,0 +1,19 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatVersion(t *testing.T) {
+	require.Equal(t, "5.5.0", FormatVersion(5005000))
+	require.Equal(t, "4.0.12", FormatVersion(4000012))
+	require.Equal(t, "0.0.0", FormatVersion(0))
+}
@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/joroec/virsnap/pkg/instrument/log"
+	"github.com/joroec/virsnap/pkg/instrument/trace"
 
 	"github.com/libvirt/libvirt-go"
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
@@ -27,6 +28,10 @@ type VM struct {
 	Instance   libvirt.Domain
 	Descriptor libvirtxml.Domain
 	Logger     log.Logger
+
+	// controller replaces Instance for state transitions if set. Only used in
+	// tests.
+	controller domainControl
 }
 
 // Free ist just a convenience function to free the associated libvirt.Domain
@@ -35,14 +40,89 @@ func (vm *VM) Free() error {
 	return vm.Instance.Free()
 }
 
+// maxTransitionDepth is the maximum number of transitions a single call of
+// Transition may be nested in, e.g. because a blocked VM becomes blocked again
+// right after it was unblocked.
+const maxTransitionDepth = 8
+
+// statePollInterval is the interval in which the state of a VM is polled while
+// waiting for a state change. While waiting for a transition, it is the
+// maximum interval of the backoff starting at minStatePollInterval.
+var statePollInterval = 5 * time.Second
+
+// minStatePollInterval is the interval after which the state of a VM is
+// polled first while waiting for a transition.
+const minStatePollInterval = 500 * time.Millisecond
+
+// pollBackoff determines the intervals between the polls of the state of a VM
+// while waiting for a transition: The interval starts at minStatePollInterval
+// and doubles after every poll up to statePollInterval, so that a fast VM is
+// not kept waiting and a slow VM does not cause needless libvirt calls.
+type pollBackoff struct {
+	// next is the next interval. Zero before the first poll.
+	next time.Duration
+}
+
+// interval returns the interval to wait before the next poll.
+func (b *pollBackoff) interval() time.Duration {
+	interval := b.next
+	if interval == 0 {
+		interval = minStatePollInterval
+	}
+	if interval > statePollInterval {
+		interval = statePollInterval
+	}
+	b.next = 2 * interval
+	return interval
+}
+
+// wait sleeps for the interval before the next poll.
+func (b *pollBackoff) wait() {
+	time.Sleep(b.interval())
+}
+
+// domainControl is the subset of the methods of libvirt.Domain that is used by
+// Transition and HasActiveJob, so that the domain can be replaced in tests.
+type domainControl interface {
+	GetState() (libvirt.DomainState, int, error)
+	Suspend() error
+	Resume() error
+	PMSuspendForDuration(target libvirt.NodeSuspendTarget, duration uint64,
+		flags uint32) error
+	PMWakeup(flags uint32) error
+	Shutdown() error
+	Destroy() error
+	Create() error
+	GetJobInfo() (*libvirt.DomainJobInfo, error)
+	GetBlockJobInfo(disk string,
+		flags libvirt.DomainBlockJobInfoFlags) (*libvirt.DomainBlockJobInfo, error)
+}
+
+// control returns the domain the state transitions of the VM are applied to.
+func (vm *VM) control() domainControl {
+	if vm.controller != nil {
+		return vm.controller
+	}
+	return &vm.Instance
+}
+
 // Transition implements state transitions of the given VM. This method can
 // be seen as implementation of an finite state machine (FSM). "to" specifies
 // the target state of the VM. "forceShutdown" determines whether the VM should
 // be forced to shutoff (plug the cable) after several tries of graceful
 // shutdown before returning an error. "timeout" specifies the timeout in
-// minutes a VM is allowed to take before forcing shutdown.
+// minutes a VM is allowed to take before forcing shutdown. A VM that changes
+// its state again and again (e.g. between blocked and running) results in an
+// error after maxTransitionDepth nested transitions.
 func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 	timeout int) (libvirt.DomainState, error) {
+	return vm.transition(to, forceShutdown, timeout, 0)
+}
+
+// transition implements Transition. "depth" is the number of transitions the
+// current transition is nested in.
+func (vm *VM) transition(to libvirt.DomainState, forceShutdown bool,
+	timeout int, depth int) (libvirt.DomainState, error) {
 
 	// check argument validity
 	if to != libvirt.DOMAIN_RUNNING && to != libvirt.DOMAIN_SHUTOFF &&
@@ -53,9 +133,19 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 		return libvirt.DOMAIN_NOSTATE, err
 	}
 
+	if depth > maxTransitionDepth {
+		err := fmt.Errorf("could not reach target state '%s' of VM '%s' after "+
+			"%d transitions, the state of the VM keeps changing",
+			GetStateString(to), vm.Descriptor.Name, maxTransitionDepth)
+		return libvirt.DOMAIN_NOSTATE, err
+	}
+
+	domain := vm.control()
+
 	// get current state of virtual machine
-	state, _, err := vm.Instance.GetState()
+	state, _, err := domain.GetState()
 	if err != nil {
+		logLibvirtError(vm.Logger, err)
 		err = fmt.Errorf("unable to retrieve state of VM '%s': %s ",
 			vm.Descriptor.Name,
 			err,
@@ -76,8 +166,9 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 
 		case libvirt.DOMAIN_PAUSED:
 			vm.Logger.Debugf("Suspending domain '%s'.", vm.Descriptor.Name)
-			err = vm.Instance.Suspend()
+			err = domain.Suspend()
 			if err != nil {
+				logLibvirtError(vm.Logger, err)
 				err = fmt.Errorf("unable to suspend VM '%s': %s",
 					vm.Descriptor.Name,
 					err,
@@ -88,9 +179,10 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 
 		case libvirt.DOMAIN_PMSUSPENDED:
 			vm.Logger.Debugf("PMSuspending domain '%s'.", vm.Descriptor.Name)
-			err = vm.Instance.PMSuspendForDuration(libvirt.NODE_SUSPEND_TARGET_MEM,
+			err = domain.PMSuspendForDuration(libvirt.NODE_SUSPEND_TARGET_MEM,
 				0, 0)
 			if err != nil {
+				logLibvirtError(vm.Logger, err)
 				err = fmt.Errorf("unable to pmsuspend VM '%s': %s",
 					vm.Descriptor.Name,
 					err,
@@ -113,8 +205,9 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 
 				vm.Logger.Debugf("Sending shutdown request to VM '%s'.",
 					vm.Descriptor.Name)
-				err = vm.Instance.Shutdown() // returns instantly
+				err = domain.Shutdown() // returns instantly
 				if err != nil {
+					logLibvirtError(vm.Logger, err)
 					// we need to cast to specific libvirt error, since the VM might
 					// be in a shutoff state since last check. If this is the case, we
 					// do not want to return an error!
@@ -137,11 +230,16 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 
 				vm.Logger.Debugf("Waiting for VM '%s' to shutdown.",
 					vm.Descriptor.Name)
+
+				// each round starts polling quickly again, since the VM may react
+				// to the new shutdown request right away
+				backoff := pollBackoff{}
 				for true {
-					time.Sleep(5 * time.Second)
+					backoff.wait()
 
-					newState, _, err = vm.Instance.GetState()
+					newState, _, err = domain.GetState()
 					if err != nil {
+						logLibvirtError(vm.Logger, err)
 						err = fmt.Errorf("unable to re-retrieve state of VM "+
 							"'%s': %s", vm.Descriptor.Name, err)
 						vm.Logger.Warnf("%s, Retrying...", err)
@@ -171,8 +269,9 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 					"shutdown gracefully.",
 					vm.Descriptor.Name,
 				)
-				err = vm.Instance.Destroy()
+				err = domain.Destroy()
 				if err != nil {
+					logLibvirtError(vm.Logger, err)
 					err = fmt.Errorf("unable to destroy VM '%s': %s",
 						vm.Descriptor.Name,
 						err,
@@ -213,8 +312,9 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 			return state, nil
 		} else if to == libvirt.DOMAIN_RUNNING {
 
-			err := vm.Instance.Create()
+			err := domain.Create()
 			if err != nil {
+				logLibvirtError(vm.Logger, err)
 				vm.Logger.Errorf("unable to boot VM '%s': %s",
 					vm.Descriptor.Name,
 					err,
@@ -225,7 +325,8 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 
 		} else {
 			// First Transition: Wait for the VM to be running
-			prev, err := vm.Transition(libvirt.DOMAIN_RUNNING, forceShutdown, timeout)
+			prev, err := vm.transition(libvirt.DOMAIN_RUNNING, forceShutdown,
+				timeout, depth+1)
 			if err != nil {
 				return state, err
 			}
@@ -239,7 +340,7 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 			}
 
 			// Second Transition: Transition to the acutal target state
-			prev, err = vm.Transition(to, forceShutdown, timeout)
+			prev, err = vm.transition(to, forceShutdown, timeout, depth+1)
 			if err != nil {
 				return state, err
 			}
@@ -265,11 +366,13 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 			vm.Logger.Debugf("Waiting for VM '%s' to shutdown.",
 				vm.Descriptor.Name)
 			before := time.Now()
+			backoff := pollBackoff{}
 			for true {
-				time.Sleep(5 * time.Second)
+				backoff.wait()
 
-				newState, _, err := vm.Instance.GetState()
+				newState, _, err := domain.GetState()
 				if err != nil {
+					logLibvirtError(vm.Logger, err)
 					err = fmt.Errorf("unable to re-retrieve state of VM "+
 						"'%s': %s", vm.Descriptor.Name, err)
 					vm.Logger.Warnf("%s, Retrying...", err)
@@ -299,7 +402,8 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 		}
 
 		// In any other case: First Transition: Wait for the VM to be shutoff
-		prev, err := vm.Transition(libvirt.DOMAIN_SHUTOFF, forceShutdown, timeout)
+		prev, err := vm.transition(libvirt.DOMAIN_SHUTOFF, forceShutdown,
+			timeout, depth+1)
 		if err != nil {
 			// return shutoff, since the VM reaches this state without any further
 			// intervention.
@@ -315,7 +419,7 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 		}
 
 		// Second Transition: Transition to the acutal target state
-		prev, err = vm.Transition(to, forceShutdown, timeout)
+		prev, err = vm.transition(to, forceShutdown, timeout, depth+1)
 		if err != nil {
 			// return shutoff, since the VM reaches this state without any further
 			// intervention.
@@ -345,8 +449,9 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 		} else if to == libvirt.DOMAIN_RUNNING {
 
 			vm.Logger.Debugf("Resuming domain '%s'.", vm.Descriptor.Name)
-			err = vm.Instance.Resume()
+			err = domain.Resume()
 			if err != nil {
+				logLibvirtError(vm.Logger, err)
 				err = fmt.Errorf("unable to resume VM '%s': %s",
 					vm.Descriptor.Name,
 					err,
@@ -357,7 +462,8 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 
 		} else {
 			// First Transition: Wait for the VM to be resumed
-			prev, err := vm.Transition(libvirt.DOMAIN_RUNNING, forceShutdown, timeout)
+			prev, err := vm.transition(libvirt.DOMAIN_RUNNING, forceShutdown,
+				timeout, depth+1)
 			if err != nil {
 				return state, err
 			}
@@ -371,7 +477,7 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 			}
 
 			// Second Transition: Transition to the acutal target state
-			prev, err = vm.Transition(to, forceShutdown, timeout)
+			prev, err = vm.transition(to, forceShutdown, timeout, depth+1)
 			if err != nil {
 				return state, err
 			}
@@ -398,8 +504,9 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 		} else if to == libvirt.DOMAIN_RUNNING {
 
 			vm.Logger.Debugf("Wake up domain '%s'.", vm.Descriptor.Name)
-			err = vm.Instance.PMWakeup(0)
+			err = domain.PMWakeup(0)
 			if err != nil {
+				logLibvirtError(vm.Logger, err)
 				err = fmt.Errorf("unable to wake up VM '%s': %s",
 					vm.Descriptor.Name,
 					err,
@@ -410,7 +517,8 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 
 		} else {
 			// First Transition: Wait for the VM to be woken up
-			prev, err := vm.Transition(libvirt.DOMAIN_RUNNING, forceShutdown, timeout)
+			prev, err := vm.transition(libvirt.DOMAIN_RUNNING, forceShutdown,
+				timeout, depth+1)
 			if err != nil {
 				return state, err
 			}
@@ -424,7 +532,7 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 			}
 
 			// Second Transition: Transition to the acutal target state
-			prev, err = vm.Transition(to, forceShutdown, timeout)
+			prev, err = vm.transition(to, forceShutdown, timeout, depth+1)
 			if err != nil {
 				return state, err
 			}
@@ -449,11 +557,13 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 		vm.Logger.Debugf("Waiting vor the VM '%s' to not be blocked anymore.",
 			vm.Descriptor.Name)
 		before := time.Now()
+		backoff := pollBackoff{}
 		for true {
-			time.Sleep(5 * time.Second)
+			backoff.wait()
 
-			newState, _, err := vm.Instance.GetState()
+			newState, _, err := domain.GetState()
 			if err != nil {
+				logLibvirtError(vm.Logger, err)
 				err = fmt.Errorf("unable to re-retrieve state of VM "+
 					"'%s': %s", vm.Descriptor.Name, err)
 				vm.Logger.Warnf("%s, Retrying...", err)
@@ -461,7 +571,7 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 
 			if newState != libvirt.DOMAIN_BLOCKED {
 				// Execute Transition to the acutal target state
-				prev, err := vm.Transition(to, forceShutdown, timeout)
+				prev, err := vm.transition(to, forceShutdown, timeout, depth+1)
 				if err != nil {
 					return state, err
 				}
@@ -506,8 +616,119 @@ func (vm *VM) Transition(to libvirt.DomainState, forceShutdown bool,
 
 }
 
+// PlanTransition simulates Transition without any side effects. It returns the
+// states a VM in state "from" passes through when transitioning to state "to",
+// starting with "from", and the state Transition would return as previous
+// state. A blocked VM is assumed to be running once it is unblocked.
+func PlanTransition(from libvirt.DomainState, to libvirt.DomainState) (
+	[]libvirt.DomainState, libvirt.DomainState, error) {
+	// check argument validity
+	if to != libvirt.DOMAIN_RUNNING && to != libvirt.DOMAIN_SHUTOFF &&
+		to != libvirt.DOMAIN_PMSUSPENDED && to != libvirt.DOMAIN_PAUSED {
+		err := fmt.Errorf("unable to plan transition to state '%s': target "+
+			"state not allowed", GetStateString(to))
+		return nil, libvirt.DOMAIN_NOSTATE, err
+	}
+
+	// follow-up transitions are planned like Transition executes them
+	via := func(intermediate libvirt.DomainState,
+		previous libvirt.DomainState) ([]libvirt.DomainState,
+		libvirt.DomainState, error) {
+		rest, _, err := PlanTransition(intermediate, to)
+		if err != nil {
+			return nil, libvirt.DOMAIN_NOSTATE, err
+		}
+		return append([]libvirt.DomainState{from}, rest...), previous, nil
+	}
+
+	switch from {
+	case libvirt.DOMAIN_RUNNING:
+		if to == libvirt.DOMAIN_RUNNING {
+			return []libvirt.DomainState{from}, from, nil
+		}
+		return []libvirt.DomainState{from, to}, from, nil
+
+	case libvirt.DOMAIN_CRASHED, libvirt.DOMAIN_SHUTOFF:
+		if to == libvirt.DOMAIN_SHUTOFF {
+			return []libvirt.DomainState{from}, from, nil
+		} else if to == libvirt.DOMAIN_RUNNING {
+			return []libvirt.DomainState{from, to}, from, nil
+		}
+		return via(libvirt.DOMAIN_RUNNING, from)
+
+	case libvirt.DOMAIN_SHUTDOWN:
+		// the VM reaches the shutoff state without any further intervention
+		if to == libvirt.DOMAIN_SHUTOFF {
+			return []libvirt.DomainState{from, to}, libvirt.DOMAIN_SHUTOFF, nil
+		}
+		return via(libvirt.DOMAIN_SHUTOFF, libvirt.DOMAIN_SHUTOFF)
+
+	case libvirt.DOMAIN_PAUSED, libvirt.DOMAIN_PMSUSPENDED:
+		if to == from {
+			return []libvirt.DomainState{from}, from, nil
+		} else if to == libvirt.DOMAIN_RUNNING {
+			return []libvirt.DomainState{from, to}, from, nil
+		}
+		return via(libvirt.DOMAIN_RUNNING, from)
+
+	case libvirt.DOMAIN_BLOCKED:
+		return via(libvirt.DOMAIN_RUNNING, libvirt.DOMAIN_RUNNING)
+
+	default:
+		err := fmt.Errorf("unable to plan transition from illegal state '%s'",
+			GetStateString(from))
+		return nil, libvirt.DOMAIN_NOSTATE, err
+	}
+}
+
+// FormatTransitions returns the given states as human readable chain, e.g.
+// "running -> shutoff -> running".
+func FormatTransitions(states []libvirt.DomainState) string {
+	names := make([]string, 0, len(states))
+	for _, state := range states {
+		names = append(names, strings.ToLower(strings.TrimPrefix(
+			GetStateString(state), "DOMAIN_")))
+	}
+	return strings.Join(names, " -> ")
+}
+
 // -----------------------------------------------------------------------------
 
+// matchesAny determines whether the given name matches at least one of the
+// given regular expressions.
+func matchesAny(exprs []*regexp.Regexp, name string) bool {
+	for _, regex := range exprs {
+		if regex.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// instanceName returns the name of the given instance for log messages if
+// its descriptor cannot be used, falling back to its UUID.
+func instanceName(instance *libvirt.Domain) string {
+	name, err := instance.GetName()
+	if err == nil {
+		return name
+	}
+
+	uuid, err := instance.GetUUIDString()
+	if err == nil {
+		return uuid
+	}
+	return "unknown"
+}
+
+// freeInstance frees the given instance of the VM with the given name that is
+// not handed out to the caller and logs a warning if this fails.
+func freeInstance(log log.Logger, instance *libvirt.Domain, name string) {
+	err := instance.Free()
+	if err != nil {
+		log.Warnf("unable to free VM '%s': %s", name, err)
+	}
+}
+
 // ListMatchingVMs is a method that allows to retrieve information about
 // virtual machines that can be accessed via libvirt. The first parameter
 // specifies the logger to be used to output warnings. The second parameter
@@ -533,10 +754,13 @@ func ListMatchingVMs(log log.Logger, regexes []string, socketURL string) ([]VM,
 		return nil, fmt.Errorf("bo regular expression was specified")
 	}
 
+	timer := trace.New(log, "libvirt")
+
 	// trying to connect to QEMU socket...
-	conn, err := libvirt.NewConnect(socketURL)
+	span := timer.Start("connect")
+	conn, err := Connect(log, socketURL)
+	span.End()
 	if err != nil {
-		err = fmt.Errorf("unable to connect to QEMU socket: %s", err)
 		return nil, err
 	}
 	defer conn.Close()
@@ -545,8 +769,11 @@ func ListMatchingVMs(log log.Logger, regexes []string, socketURL string) ([]VM,
 	// the parameter for ListAllDomains is a bitmask that is used for filtering
 	// the results. Since we do not want to restrict the usage to any strict type,
 	// we use 0 which returns all of the found virtual machines.
+	span = timer.Start("list domains")
 	instances, err := conn.ListAllDomains(0)
+	span.End()
 	if err != nil {
+		logLibvirtError(log, err)
 		err = fmt.Errorf("unable to retrieve list of VMs from QEMU: %s",
 			err)
 		return nil, err
@@ -561,7 +788,9 @@ func ListMatchingVMs(log log.Logger, regexes []string, socketURL string) ([]VM,
 		xml, err := instance.GetXMLDesc(0)
 		if err != nil {
 			err = fmt.Errorf("unable to get XML descriptor of VM: %s", err)
-			log.Warnf("Skipping VM: %s", err)
+			name := instanceName(&instance)
+			log.Warnf("Skipping VM '%s': %s", name, err)
+			freeInstance(log, &instance, name)
 			continue
 		}
 
@@ -569,20 +798,15 @@ func ListMatchingVMs(log log.Logger, regexes []string, socketURL string) ([]VM,
 		err = descriptor.Unmarshal(xml)
 		if err != nil {
 			err = fmt.Errorf("unable to unmarshal XML descriptor of VM: %s", err)
-			log.Warnf("Skipping VM: %s", err)
+			name := instanceName(&instance)
+			log.Warnf("Skipping VM '%s': %s", name, err)
+			freeInstance(log, &instance, name)
 			continue
 		}
 
-		// checking for a matching regular expression
-		found := false
-		for _, regex := range exprs {
-			if regex.Find([]byte(descriptor.Name)) != nil {
-				found = true
-				break
-			}
-		}
-
-		if found {
+		// all regular expressions are checked before the instance is either
+		// returned or freed, so that it is freed at most once
+		if matchesAny(exprs, descriptor.Name) {
 			// the caller is responsible for calling domain.Free() on the returned
 			// domains
 			matchedVM := VM{
@@ -593,11 +817,7 @@ func ListMatchingVMs(log log.Logger, regexes []string, socketURL string) ([]VM,
 			matchedVMs = append(matchedVMs, matchedVM)
 		} else {
 			// we do not need the instance here anymore
-			err = instance.Free()
-			if err != nil {
-				err = fmt.Errorf("unable to free VM '%s': %s", descriptor.Name, err)
-				log.Warn(err)
-			}
+			freeInstance(log, &instance, descriptor.Name)
 		}
 	}
 
@@ -610,6 +830,27 @@ func ListMatchingVMs(log log.Logger, regexes []string, socketURL string) ([]VM,
 	return matchedVMs, nil
 }
 
+// Reconnect returns a copy of the VM whose domain is looked up by name on the
+// given connection, so that the operations on the copy use the given
+// connection instead of the one the VM was listed with, e.g. one connection
+// per worker of a parallel run. The caller is responsible for calling Free on
+// the returned VM.
+func (vm *VM) Reconnect(conn *libvirt.Connect) (VM, error) {
+	instance, err := conn.LookupDomainByName(vm.Descriptor.Name)
+	if err != nil {
+		logLibvirtError(vm.Logger, err)
+		err = fmt.Errorf("unable to look up VM '%s': %s", vm.Descriptor.Name,
+			err)
+		return VM{}, err
+	}
+
+	return VM{
+		Instance:   *instance,
+		Descriptor: vm.Descriptor,
+		Logger:     vm.Logger,
+	}, nil
+}
+
 // -----------------------------------------------------------------------------
 
 // VMSorter is a sorter for sorting snapshots by name lexically.
@@ -644,11 +885,24 @@ func FreeVMs(log log.Logger, vms []VM) {
 	}
 }
 
+// RestartsOnPoweroff determines whether the lifecycle policy of the VM restarts
+// the VM as soon as it is powered off (<on_poweroff>restart</on_poweroff>).
+// Shutting down such a VM does not keep it off.
+func (vm *VM) RestartsOnPoweroff() bool {
+	switch vm.Descriptor.OnPoweroff {
+	case "restart", "rename-restart":
+		return true
+	default:
+		return false
+	}
+}
+
 // GetCurrentStateString is a helper method that retrieves the current
 // state of the VM and returns this state as human readable representation.
 func (vm *VM) GetCurrentStateString() (string, error) {
 	state, _, err := vm.Instance.GetState()
 	if err != nil {
+		logLibvirtError(vm.Logger, err)
 		err = fmt.Errorf("unable to retrieve state of VM '%s': %s",
 			vm.Descriptor.Name,
 			err,
@@ -680,3 +934,31 @@ func GetStateString(state libvirt.DomainState) string {
 		return "DOMAIN_NOSTATE"
 	}
 }
+
+// ParseState converts the given human readable state (e.g. "shutoff" or
+// "DOMAIN_SHUTOFF", case-insensitive) into a libvirt.DomainState and returns
+// an error if the string does not denote a known state.
+func ParseState(state string) (libvirt.DomainState, error) {
+	name := strings.ToUpper(state)
+	if !strings.HasPrefix(name, "DOMAIN_") {
+		name = "DOMAIN_" + name
+	}
+
+	for _, candidate := range []libvirt.DomainState{
+		libvirt.DOMAIN_RUNNING,
+		libvirt.DOMAIN_BLOCKED,
+		libvirt.DOMAIN_PAUSED,
+		libvirt.DOMAIN_SHUTDOWN,
+		libvirt.DOMAIN_CRASHED,
+		libvirt.DOMAIN_PMSUSPENDED,
+		libvirt.DOMAIN_SHUTOFF,
+	} {
+		if GetStateString(candidate) == name {
+			return candidate, nil
+		}
+	}
+
+	return libvirt.DOMAIN_NOSTATE, fmt.Errorf("invalid VM state '%s': must be "+
+		"one of 'running', 'blocked', 'paused', 'shutdown', 'crashed', "+
+		"'pmsuspended' or 'shutoff'", state)
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2019 The virnsnap authors. See file "AUTHORS".
+// Licensed under the MIT License. You have obtained a copy of the License at
+// the "LICENSE" file in this repository.
+
+// Package virt implements high-level functions for handling virtual machines
+// (VMS) that use the more low-level libvirt functions internally.
+package virt
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseState(t *testing.T) {
+	state, err := ParseState("shutoff")
+	require.NoError(t, err)
+	require.Equal(t, libvirt.DOMAIN_SHUTOFF, state)
+
+	state, err = ParseState("DOMAIN_RUNNING")
+	require.NoError(t, err)
+	require.Equal(t, libvirt.DOMAIN_RUNNING, state)
+
+	state, err = ParseState("PMSuspended")
+	require.NoError(t, err)
+	require.Equal(t, libvirt.DOMAIN_PMSUSPENDED, state)
+
+	_, err = ParseState("nostate")
+	require.Error(t, err)
+
+	_, err = ParseState("sleeping")
+	require.Error(t, err)
+}
+
+func TestMatchesAny(t *testing.T) {
+	exprs := []*regexp.Regexp{
+		regexp.MustCompile("^web"),
+		regexp.MustCompile("db$"),
+	}
+
+	// a name matching only a later expression is still matched
+	require.True(t, matchesAny(exprs, "web1"))
+	require.True(t, matchesAny(exprs, "testdb"))
+	require.False(t, matchesAny(exprs, "mail"))
+	require.False(t, matchesAny(nil, "web1"))
+}
+
+func TestPollBackoff(t *testing.T) {
+	defer func(interval time.Duration) {
+		statePollInterval = interval
+	}(statePollInterval)
+	statePollInterval = 5 * time.Second
+
+	backoff := pollBackoff{}
+	intervals := make([]time.Duration, 0)
+	for i := 0; i < 6; i++ {
+		intervals = append(intervals, backoff.interval())
+	}
+	require.Equal(t, []time.Duration{500 * time.Millisecond, time.Second,
+		2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second},
+		intervals)
+
+	// the maximum interval also caps the first one
+	statePollInterval = time.Millisecond
+	backoff = pollBackoff{}
+	require.Equal(t, time.Millisecond, backoff.interval())
+}
+
+func TestPlanTransition(t *testing.T) {
+	cases := []struct {
+		from     libvirt.DomainState
+		to       libvirt.DomainState
+		path     string
+		previous libvirt.DomainState
+	}{
+		{libvirt.DOMAIN_RUNNING, libvirt.DOMAIN_SHUTOFF, "running -> shutoff",
+			libvirt.DOMAIN_RUNNING},
+		{libvirt.DOMAIN_SHUTOFF, libvirt.DOMAIN_SHUTOFF, "shutoff",
+			libvirt.DOMAIN_SHUTOFF},
+		{libvirt.DOMAIN_SHUTOFF, libvirt.DOMAIN_PAUSED,
+			"shutoff -> running -> paused", libvirt.DOMAIN_SHUTOFF},
+		{libvirt.DOMAIN_SHUTDOWN, libvirt.DOMAIN_RUNNING,
+			"shutdown -> shutoff -> running", libvirt.DOMAIN_SHUTOFF},
+		{libvirt.DOMAIN_PMSUSPENDED, libvirt.DOMAIN_SHUTOFF,
+			"pmsuspended -> running -> shutoff", libvirt.DOMAIN_PMSUSPENDED},
+		{libvirt.DOMAIN_BLOCKED, libvirt.DOMAIN_SHUTOFF,
+			"blocked -> running -> shutoff", libvirt.DOMAIN_RUNNING},
+		{libvirt.DOMAIN_CRASHED, libvirt.DOMAIN_SHUTOFF, "crashed",
+			libvirt.DOMAIN_CRASHED},
+	}
+
+	for _, c := range cases {
+		path, previous, err := PlanTransition(c.from, c.to)
+		require.NoError(t, err)
+		require.Equal(t, c.path, FormatTransitions(path))
+		require.Equal(t, c.previous, previous)
+	}
+
+	_, _, err := PlanTransition(libvirt.DOMAIN_SHUTOFF, libvirt.DOMAIN_CRASHED)
+	require.Error(t, err)
+
+	_, _, err = PlanTransition(libvirt.DOMAIN_NOSTATE, libvirt.DOMAIN_RUNNING)
+	require.Error(t, err)
+}
+
+func TestRestartsOnPoweroff(t *testing.T) {
+	vm := VM{}
+	require.False(t, vm.RestartsOnPoweroff())
+
+	vm.Descriptor.OnPoweroff = "destroy"
+	require.False(t, vm.RestartsOnPoweroff())
+
+	vm.Descriptor.OnPoweroff = "restart"
+	require.True(t, vm.RestartsOnPoweroff())
+}
+
+// fakeDomain is a domain whose state is taken from a cyclic sequence of
+// states, one per call of GetState. Any other operation succeeds without
+// changing the state.
+type fakeDomain struct {
+	states []libvirt.DomainState
+	calls  int
+}
+
+func (d *fakeDomain) GetState() (libvirt.DomainState, int, error) {
+	state := d.states[d.calls%len(d.states)]
+	d.calls++
+	return state, 0, nil
+}
+
+func (d *fakeDomain) Suspend() error { return nil }
+func (d *fakeDomain) Resume() error  { return nil }
+func (d *fakeDomain) PMSuspendForDuration(target libvirt.NodeSuspendTarget,
+	duration uint64, flags uint32) error {
+	return nil
+}
+func (d *fakeDomain) PMWakeup(flags uint32) error { return nil }
+func (d *fakeDomain) Shutdown() error             { return nil }
+func (d *fakeDomain) Destroy() error              { return nil }
+func (d *fakeDomain) Create() error               { return nil }
+func (d *fakeDomain) GetJobInfo() (*libvirt.DomainJobInfo, error) {
+	return &libvirt.DomainJobInfo{Type: libvirt.DOMAIN_JOB_NONE}, nil
+}
+func (d *fakeDomain) GetBlockJobInfo(disk string,
+	flags libvirt.DomainBlockJobInfoFlags) (*libvirt.DomainBlockJobInfo, error) {
+	return &libvirt.DomainBlockJobInfo{}, nil
+}
+
+// newFakeVM returns a VM backed by a fakeDomain cycling through the given
+// states.
+func newFakeVM(states ...libvirt.DomainState) (*VM, *fakeDomain) {
+	domain := &fakeDomain{states: states}
+	return &VM{
+		Descriptor: libvirtxml.Domain{Name: "testvm"},
+		Logger:     zap.NewNop().Sugar(),
+		controller: domain,
+	}, domain
+}
+
+func TestTransitionOscillating(t *testing.T) {
+	defer func(interval time.Duration) {
+		statePollInterval = interval
+	}(statePollInterval)
+	statePollInterval = time.Millisecond
+
+	// a blocked VM that is unblocked only briefly would recurse forever
+	vm, domain := newFakeVM(libvirt.DOMAIN_BLOCKED, libvirt.DOMAIN_RUNNING)
+	_, err := vm.Transition(libvirt.DOMAIN_RUNNING, false, 1)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "after 8 transitions")
+	require.Equal(t, 2*(maxTransitionDepth+1), domain.calls)
+
+	// a VM that stays unblocked reaches the target state
+	vm, _ = newFakeVM(libvirt.DOMAIN_BLOCKED, libvirt.DOMAIN_RUNNING,
+		libvirt.DOMAIN_RUNNING)
+	_, err = vm.Transition(libvirt.DOMAIN_RUNNING, false, 1)
+	require.NoError(t, err)
+}